@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+// Agent-based economic simulator for the DB3 protocol. Drives the contract
+// model over many blocks with populations of honest, lazy, sybil and flaky
+// hosts and reports host profitability, slashing, royalties and attack
+// success rates for a given set of protocol parameters.
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "sort"
+    "text/tabwriter"
+
+    "blockwatch.cc/db3-near/pkg/db3"
+    "blockwatch.cc/db3-near/pkg/near"
+    "github.com/echa/log"
+)
+
+var (
+    cfg     Config
+    fee     [2]uint64
+    deposit uint64
+    cost    uint64
+    flags   = flag.NewFlagSet("econ", flag.ContinueOnError)
+)
+
+func init() {
+    cfg.Params = db3.DefaultParams()
+    flags.Usage = func() {}
+    flags.Int64Var(&cfg.Blocks, "blocks", 10000, "number of blocks to simulate")
+    flags.Int64Var(&cfg.Seed, "seed", 1, "random seed")
+    flags.IntVar(&cfg.Hosts[Honest], "honest", 10, "number of honest hosts")
+    flags.IntVar(&cfg.Hosts[Lazy], "lazy", 2, "number of lazy hosts copying results")
+    flags.IntVar(&cfg.Hosts[Sybil], "sybil", 3, "number of colluding sybil hosts")
+    flags.IntVar(&cfg.Hosts[Flaky], "flaky", 2, "number of flaky hosts")
+    flags.IntVar(&cfg.Users, "users", 20, "number of users")
+    flags.Float64Var(&cfg.QueryRate, "rate", 0.05, "query probability per user and block")
+    flags.Uint64Var(&fee[0], "fee-min", 1000, "minimum user fee budget per query")
+    flags.Uint64Var(&fee[1], "fee-max", 10000, "maximum user fee budget per query")
+    flags.IntVar(&cfg.Params.CommitteeSize, "committee", db3.COMMITTEE_SIZE, "number of hosts assigned to each query")
+    flags.IntVar(&cfg.Quorum, "quorum", 1, "votes required to answer a query")
+    flags.Int64Var(&cfg.TTL, "ttl", 120, "query TTL in blocks")
+    flags.Uint64Var(&cost, "cost", 500, "host cost to execute a query")
+    flags.IntVar(&cfg.Royalty, "royalty", 1000, "developer royalty in bips")
+    flags.Uint64Var(&deposit, "deposit", db3.SECURITY_DEPOSIT, "host security deposit")
+    flags.IntVar(&cfg.Params.SlashedDepositBips, "slash", db3.SLASHED_DEPOSIT_BIPS, "slashed deposit share in bips")
+    flags.IntVar(&cfg.Params.SlashMajorityBips, "slash-majority", db3.SLASH_MAJORITY_BIPS, "slash share paid to majority hosts in bips")
+    flags.IntVar(&cfg.Params.SlashFinalizerBips, "slash-finalizer", db3.SLASH_FINALIZER_BIPS, "slash share paid to the finalizer in bips")
+    flags.Float64Var(&cfg.FlakyOffline, "offline", 0.3, "probability a flaky host misses a query")
+    flags.Float64Var(&cfg.FlakyError, "error", 0.1, "probability a flaky host returns a wrong result")
+    flags.Int64Var(&cfg.ClaimInterval, "claim", 100, "blocks between host fee claims")
+    flags.Int64Var(&cfg.Params.EpochBlocks, "epoch", db3.EPOCH_BLOCKS, "blocks per payout epoch, 0 pays fees per query")
+    flags.Int64Var(&cfg.Params.VestingBlocks, "vesting", db3.VESTING_BLOCKS, "blocks over which epoch royalties vest")
+}
+
+func main() {
+    if err := run(); err != nil {
+        log.Fatalf("Error: %v\n", err)
+    }
+}
+
+func run() error {
+    err := flags.Parse(os.Args[1:])
+    if err != nil {
+        if err == flag.ErrHelp {
+            fmt.Printf("Usage: %s [flags]\n", os.Args[0])
+            fmt.Println("\nFlags")
+            flags.PrintDefaults()
+            return nil
+        }
+        return err
+    }
+
+    cfg.FeeMin, cfg.FeeMax = near.Money(fee[0]), near.Money(fee[1])
+    cfg.Cost = near.Money(cost)
+    cfg.Params.SecurityDeposit = near.Money(deposit)
+
+    switch {
+    case cfg.Blocks <= 0:
+        return fmt.Errorf("Number of blocks must be positive")
+    case cfg.Params.CommitteeSize <= 0 || cfg.Params.CommitteeSize > db3.MAX_QUORUM:
+        return fmt.Errorf("Committee size out of range")
+    case cfg.Quorum <= 0 || cfg.Quorum > db3.MAX_QUORUM:
+        return fmt.Errorf("Quorum out of range")
+    case cfg.TTL <= 0:
+        return fmt.Errorf("TTL must be positive")
+    case cfg.ClaimInterval <= 0:
+        return fmt.Errorf("Claim interval must be positive")
+    case cfg.FeeMin > cfg.FeeMax:
+        return fmt.Errorf("Minimum fee exceeds maximum fee")
+    case cfg.Params.SecurityDeposit == 0:
+        return fmt.Errorf("Zero security deposit")
+    case cfg.Params.SlashedDepositBips <= 0 || cfg.Params.SlashedDepositBips > 10000:
+        return fmt.Errorf("Slash rate out of range")
+    case cfg.Params.SlashMajorityBips < 0 || cfg.Params.SlashFinalizerBips < 0 ||
+        cfg.Params.SlashMajorityBips+cfg.Params.SlashFinalizerBips > 10000:
+        return fmt.Errorf("Slash distribution out of range")
+    case cfg.Params.EpochBlocks < 0 || cfg.Params.VestingBlocks < 0:
+        return fmt.Errorf("Negative epoch or vesting period")
+    }
+    for _, n := range cfg.Hosts {
+        if n < 0 {
+            return fmt.Errorf("Negative host count")
+        }
+    }
+
+    sim := NewSim(cfg)
+    sim.Run()
+    if err := sim.db.CheckInvariants(); err != nil {
+        return fmt.Errorf("contract books are inconsistent: %v", err)
+    }
+    report(sim)
+    return nil
+}
+
+func report(s *Sim) {
+    var escrowed near.Money
+    outcomes := make([]int, len(outcomeNames))
+    var attacked, forged int
+    for _, q := range s.queries {
+        escrowed += q.Fee
+        o := q.Outcome()
+        outcomes[o]++
+        if q.Sybils > 0 {
+            attacked++
+            if o == Forged {
+                forged++
+            }
+        }
+    }
+
+    fmt.Printf("Simulated %d blocks, %d queries, deposit %d, slash %d bips, committee %d, quorum %d\n\n",
+        s.cfg.Blocks, len(s.queries), s.cfg.Params.SecurityDeposit,
+        s.cfg.Params.SlashedDepositBips, s.cfg.Params.CommitteeSize, s.cfg.Quorum)
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+    fmt.Fprintf(w, "Fees escrowed\t%d\t\n", escrowed)
+    fmt.Fprintf(w, "Refunded below quorum\t%d\t\n", s.Refunds)
+    fmt.Fprintf(w, "Developer royalties\t%d\t\n", s.Royalties)
+    fmt.Fprintf(w, "Slash rewards\t%d\t\n", s.Rewards)
+    fmt.Fprintf(w, "Slashed pool\t%d\t\n", s.db.Slashed)
+    fmt.Fprintf(w, "  from unpaid fees and dust\t%d\t\n", s.Dust)
+    w.Flush()
+    fmt.Println()
+
+    // host profitability per strategy
+    w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+    fmt.Fprintln(w, "Strategy\tHosts\tResults\tFees\tRewards\tCost\tSlashed\tProfit\tProfit/Host\tROI\t")
+    for strategy, n := range s.cfg.Hosts {
+        if n == 0 {
+            continue
+        }
+        var results int
+        var fees, rewards, cost, slashed, capital near.Money
+        for _, h := range s.hosts {
+            if int(h.Strategy) != strategy {
+                continue
+            }
+            results += h.Queries
+            fees += h.Fees
+            rewards += h.Rewards
+            cost += h.Cost
+            slashed += h.Slashed
+            capital += h.Capital
+        }
+        profit := int64(fees) + int64(rewards) - int64(cost) - int64(slashed)
+        fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%.1f%%\t\n",
+            Strategy(strategy), n, results, fees, rewards, cost, slashed, profit,
+            profit/int64(n), 100*float64(profit)/float64(capital))
+    }
+    w.Flush()
+    fmt.Println()
+
+    // query outcomes and attack success
+    w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+    fmt.Fprintln(w, "Outcome\tQueries\tShare\t")
+    for o, n := range outcomes {
+        fmt.Fprintf(w, "%s\t%d\t%.2f%%\t\n", Outcome(o), n, percent(n, len(s.queries)))
+    }
+    w.Flush()
+    fmt.Println()
+    fmt.Printf("Attack success %d of %d queries reaching a sybil host (%.2f%%)\n",
+        forged, attacked, percent(forged, attacked))
+
+    if len(s.Failed) > 0 {
+        fmt.Println("\nRejected calls")
+        keys := make([]string, 0, len(s.Failed))
+        for k := range s.Failed {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+            fmt.Printf("  %6d %s\n", s.Failed[k], k)
+        }
+    }
+}
+
+func percent(n, total int) float64 {
+    if total == 0 {
+        return 0
+    }
+    return 100 * float64(n) / float64(total)
+}
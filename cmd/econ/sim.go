@@ -0,0 +1,370 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package main
+
+import (
+    "fmt"
+    "math/rand"
+    "sort"
+
+    "blockwatch.cc/db3-near/pkg/db3"
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Host behaviour
+type Strategy int
+
+const (
+    Honest Strategy = iota // executes every query and settles the correct result
+    Lazy                   // copies results other hosts already settled on-chain
+    Sybil                  // colluding identities settling the same forged result
+    Flaky                  // honest but sometimes offline or wrong
+)
+
+var strategyNames = []string{"honest", "lazy", "sybil", "flaky"}
+
+func (s Strategy) String() string {
+    return strategyNames[s]
+}
+
+// Query outcome after finalization
+type Outcome int
+
+const (
+    Unresolved Outcome = iota // no quorum or no supermajority, fees are refunded or go to slashed
+    Correct                   // the correct result won
+    Forged                    // the sybil result won
+    Wrong                     // another wrong result won
+)
+
+var outcomeNames = []string{"unresolved", "correct", "forged", "wrong"}
+
+func (o Outcome) String() string {
+    return outcomeNames[o]
+}
+
+type Config struct {
+    Blocks        int64
+    Seed          int64
+    Hosts         [4]int // host count per strategy
+    Users         int
+    QueryRate     float64 // query probability per user and block
+    FeeMin        near.Money
+    FeeMax        near.Money
+    Quorum        int   // votes required to answer a query
+    TTL           int64 // query TTL in blocks
+    Cost          near.Money
+    Royalty       int
+    Params        db3.Params
+    FlakyOffline  float64
+    FlakyError    float64
+    ClaimInterval int64
+}
+
+type Host struct {
+    Id       near.AccountID
+    Strategy Strategy
+    Queries  int        // settled results
+    Fees     near.Money // earned fees
+    Rewards  near.Money // earned slash rewards
+    Cost     near.Money // spent on query execution
+    Slashed  near.Money // lost deposit
+    Capital  near.Money // locked deposit including top-ups
+}
+
+type User struct {
+    Id      near.AccountID
+    Fee     near.Money // fee budget per query
+    Queries int
+    Spent   near.Money
+}
+
+type Query struct {
+    Id     db3.QueryCID
+    Result db3.ResultCID // correct result
+    TTL    int64
+    Fee    near.Money
+    Sybils int // sybil hosts the query was sent to
+    Votes  map[near.AccountID]db3.ResultCID
+    Winner db3.ResultCID
+}
+
+func (q *Query) Outcome() Outcome {
+    switch {
+    case q.Winner == "":
+        return Unresolved
+    case q.Winner == q.Result:
+        return Correct
+    case q.Winner == forged(q.Id):
+        return Forged
+    default:
+        return Wrong
+    }
+}
+
+type Sim struct {
+    cfg      Config
+    rng      *rand.Rand
+    db       *db3.DB3
+    dbid     db3.DBId
+    dev      near.AccountID
+    height   int64
+    hosts    []*Host
+    users    []*User
+    byId     map[near.AccountID]*Host
+    queries  []*Query
+    byQid    map[db3.QueryCID]*Query
+    schedule map[int64][]func()
+
+    Royalties near.Money // developer royalties
+    Rewards   near.Money // slash rewards paid to hosts and finalizers
+    Refunds   near.Money // fees refunded for queries below quorum
+    Dust      near.Money // unpaid fees and rounding dust
+    Failed    map[string]int
+}
+
+const (
+    STORAGE_BALANCE = 1000000 // large enough to never run out during a run
+)
+
+func NewSim(cfg Config) *Sim {
+    s := &Sim{
+        cfg:      cfg,
+        rng:      rand.New(rand.NewSource(cfg.Seed)),
+        dev:      "dev.near",
+        byId:     make(map[near.AccountID]*Host),
+        byQid:    make(map[db3.QueryCID]*Query),
+        schedule: make(map[int64][]func()),
+        Failed:   make(map[string]int),
+    }
+
+    s.db = db3.NewDB3()
+    cfg.Params.Validate()
+    s.db.Params = cfg.Params
+    s.call(s.dev, db3.STORAGE_COST, "Deploy", func() {
+        s.dbid = s.db.Deploy(db3.Manifest{
+            Name:        "sim",
+            CID:         "sim-cid",
+            RoyaltyBips: cfg.Royalty,
+            MinQuorum:   cfg.Quorum,
+        })
+    })
+
+    for strategy, n := range cfg.Hosts {
+        for i := 0; i < n; i++ {
+            h := &Host{
+                Id:       near.AccountID(fmt.Sprintf("%s-%02d.near", Strategy(strategy), i)),
+                Strategy: Strategy(strategy),
+            }
+            s.call(h.Id, STORAGE_BALANCE, "StorageDeposit", func() { s.db.StorageDeposit("") })
+            s.deposit(h)
+            s.call(h.Id, 0, "Register", func() { s.db.Register(s.dbid, db3.ApiEndpoint("http://"+h.Id)) })
+            s.hosts = append(s.hosts, h)
+            s.byId[h.Id] = h
+        }
+    }
+
+    for i := 0; i < cfg.Users; i++ {
+        u := &User{
+            Id:  near.AccountID(fmt.Sprintf("user-%02d.near", i)),
+            Fee: cfg.FeeMin + near.Money(s.rng.Int63n(int64(cfg.FeeMax-cfg.FeeMin)+1)),
+        }
+        s.call(u.Id, STORAGE_BALANCE, "StorageDeposit", func() { s.db.StorageDeposit("") })
+        s.users = append(s.users, u)
+    }
+    s.collect()
+    return s
+}
+
+// Run simulates all blocks, then waits for the last queries to expire and
+// finalizes them
+func (s *Sim) Run() {
+    end := s.cfg.Blocks + s.cfg.TTL + 1
+    for s.height = 1; s.height <= end; s.height++ {
+        if s.height <= s.cfg.Blocks {
+            for _, u := range s.users {
+                if s.rng.Float64() < s.cfg.QueryRate {
+                    s.send(u)
+                }
+            }
+        }
+        for _, fn := range s.schedule[s.height] {
+            fn()
+        }
+        delete(s.schedule, s.height)
+        if s.height%s.cfg.ClaimInterval == 0 || s.height == end {
+            s.claim()
+        }
+        s.collect()
+    }
+}
+
+// send escrows a query fee and forwards the query to its assigned committee
+func (s *Sim) send(u *User) {
+    n := len(s.queries)
+    q := &Query{
+        Id:     db3.QueryCID(fmt.Sprintf("q-%d", n)),
+        Result: db3.ResultCID(fmt.Sprintf("r-%d", n)),
+        TTL:    s.height + s.cfg.TTL,
+        Fee:    u.Fee,
+        Votes:  make(map[near.AccountID]db3.ResultCID),
+    }
+    if !s.call(u.Id, u.Fee, "EscrowFee", func() { s.db.EscrowFee(s.dbid, q.Id, q.TTL, 0) }) {
+        return
+    }
+    u.Queries++
+    u.Spent += u.Fee
+    s.queries = append(s.queries, q)
+    s.byQid[q.Id] = q
+
+    // hosts settle within the first quarter of the TTL
+    window := s.cfg.TTL/4 + 1
+    for _, id := range s.db.Committee(s.dbid, q.Id) {
+        h := s.byId[id]
+        at := s.height + 1 + s.rng.Int63n(window)
+        switch h.Strategy {
+        case Honest:
+            h.Cost += s.cfg.Cost
+            s.at(at, func() { s.settle(h, q, q.Result) })
+        case Flaky:
+            if s.rng.Float64() < s.cfg.FlakyOffline {
+                continue
+            }
+            h.Cost += s.cfg.Cost
+            rid := q.Result
+            if s.rng.Float64() < s.cfg.FlakyError {
+                rid = db3.ResultCID(fmt.Sprintf("e-%d-%s", n, h.Id))
+            }
+            s.at(at, func() { s.settle(h, q, rid) })
+        case Sybil:
+            q.Sybils++
+            s.at(at, func() { s.settle(h, q, forged(q.Id)) })
+        case Lazy:
+            s.at(at+1, func() { s.copy(h, q) })
+        }
+    }
+}
+
+// copy settles the most popular result other hosts published on-chain or
+// retries in the next block
+func (s *Sim) copy(h *Host, q *Query) {
+    if s.height >= q.TTL {
+        return
+    }
+    counts := make(map[db3.ResultCID]int)
+    for _, rid := range s.db.PendingResults[s.dbid][q.Id] {
+        counts[rid]++
+    }
+    if len(counts) == 0 {
+        s.at(s.height+1, func() { s.copy(h, q) })
+        return
+    }
+    rids := make([]db3.ResultCID, 0, len(counts))
+    for rid := range counts {
+        rids = append(rids, rid)
+    }
+    sort.Slice(rids, func(i, j int) bool {
+        if counts[rids[i]] != counts[rids[j]] {
+            return counts[rids[i]] > counts[rids[j]]
+        }
+        return rids[i] < rids[j]
+    })
+    s.settle(h, q, rids[0])
+}
+
+// settle tops up a slashed deposit and publishes a host's result
+func (s *Sim) settle(h *Host, q *Query, rid db3.ResultCID) {
+    s.deposit(h)
+    if s.call(h.Id, 0, "Settle", func() { s.db.Settle(s.dbid, q.Id, rid) }) {
+        h.Queries++
+        q.Votes[h.Id] = rid
+    }
+}
+
+// deposit locks or tops up a host's security deposit
+func (s *Sim) deposit(h *Host) {
+    have := s.db.Deposits[s.dbid][h.Id]
+    if have >= s.db.Params.SecurityDeposit {
+        return
+    }
+    amount := s.db.Params.SecurityDeposit - have
+    if s.call(h.Id, amount, "Deposit", func() { s.db.Deposit(s.dbid) }) {
+        h.Capital += amount
+    }
+}
+
+// claim finalizes expired queries and pays out hosts and the developer
+func (s *Sim) claim() {
+    for _, h := range s.hosts {
+        s.call(h.Id, 0, "ClaimFees", func() { s.db.ClaimFees() })
+    }
+    s.call(s.dev, 0, "ClaimRoyalties", func() { s.db.ClaimRoyalties() })
+}
+
+// collect accounts payouts from contract events and drops the event log
+func (s *Sim) collect() {
+    for _, e := range s.db.EventLog {
+        switch e.Event {
+        case "fee_paid":
+            ev := e.Data.(db3.PayoutEvent)
+            if h, ok := s.byId[ev.Account]; ok {
+                h.Fees += ev.Amount
+            }
+            if q, ok := s.byQid[ev.Qid]; ok {
+                q.Winner = q.Votes[ev.Account]
+            }
+        case "result_counted":
+            // epoch mode pays fees later, the counted result wins
+            ev := e.Data.(db3.PayoutEvent)
+            if q, ok := s.byQid[ev.Qid]; ok {
+                q.Winner = q.Votes[ev.Account]
+            }
+        case "slash_reward":
+            ev := e.Data.(db3.PayoutEvent)
+            s.Rewards += ev.Amount
+            if h, ok := s.byId[ev.Account]; ok {
+                h.Rewards += ev.Amount
+            }
+        case "fee_refunded":
+            s.Refunds += e.Data.(db3.PayoutEvent).Amount
+        case "royalty_paid", "royalty_granted":
+            s.Royalties += e.Data.(db3.PayoutEvent).Amount
+        case "dust_collected":
+            s.Dust += e.Data.(db3.PayoutEvent).Amount
+        case "host_slashed":
+            ev := e.Data.(db3.SlashEvent)
+            if h, ok := s.byId[ev.Account]; ok {
+                h.Slashed += ev.Amount
+            }
+        }
+    }
+    s.db.EventLog = s.db.EventLog[:0]
+}
+
+// at schedules an action for a future block
+func (s *Sim) at(height int64, fn func()) {
+    s.schedule[height] = append(s.schedule[height], fn)
+}
+
+// call runs a contract method in a transaction context and counts rejected
+// calls per method
+func (s *Sim) call(caller near.AccountID, amount near.Money, method string, fn func()) (ok bool) {
+    db3.SetCallContext(near.CallContext{
+        Caller: caller,
+        Amount: amount,
+        Height: s.height,
+    })
+    defer func() {
+        if e := recover(); e != nil {
+            s.Failed[fmt.Sprintf("%s: %v", method, e)]++
+            ok = false
+        }
+    }()
+    fn()
+    return true
+}
+
+func forged(qid db3.QueryCID) db3.ResultCID {
+    return db3.ResultCID("s-" + qid)
+}
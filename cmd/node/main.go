@@ -4,6 +4,8 @@
 package main
 
 import (
+    "crypto/ed25519"
+    "crypto/sha256"
     "encoding/base64"
     "encoding/json"
     "flag"
@@ -13,11 +15,19 @@ import (
     "net/http"
     "os"
     "path/filepath"
+    "strconv"
+    "strings"
+    "sync/atomic"
     "time"
 
+    "blockwatch.cc/db3-near/pkg/db3"
+    db3near "blockwatch.cc/db3-near/pkg/near"
     "blockwatch.cc/near-api-go"
+    "blockwatch.cc/near-api-go/utils"
+    "github.com/btcsuite/btcutil/base58"
     "github.com/echa/log"
     cid "github.com/ipfs/go-cid"
+    "github.com/near/borsh-go"
 )
 
 var (
@@ -25,12 +35,21 @@ var (
     networkId       string
     accountId       string
     databaseId      string
+    joinIds         string // further databases hosted for cross-database queries
     rpcEndpoint     string
     port            string
     conn            *near.Connection
     flags           = flag.NewFlagSet("node", flag.ContinueOnError)
     home            string
     account         *near.Account
+    codeVersion     int
+    serving         int32 // 1 while the database accepts queries
+)
+
+const (
+    watchInterval     = time.Minute
+    claimInterval     = 10 * time.Second // hosts must answer claims within the governed response window
+    committeeAttempts = 5                // polls for the committee drawn by the fee tx
 )
 
 func init() {
@@ -38,6 +57,7 @@ func init() {
     flags.StringVar(&contractAddress, "contract", os.Getenv("DB3_CONTRACT_ID"), "DB3 contract")
     flags.StringVar(&accountId, "account", os.Getenv("DB3_NODE_ACCOUNT_ID"), "DB3 node account")
     flags.StringVar(&databaseId, "db", "0", "DB3 database id to host")
+    flags.StringVar(&joinIds, "join", "", "comma separated ids of further databases to host for cross-database queries")
     flags.StringVar(&rpcEndpoint, "rpc", "https://rpc.testnet.near.org", "NEAR RPC endpoint")
     flags.StringVar(&networkId, "net", "testnet", "NEAR network id")
     flags.StringVar(&port, "port", "8000", "HTTP server port")
@@ -95,29 +115,88 @@ func run() error {
     // use default http server
     log.Infof("Listening on :%s", port)
     http.HandleFunc("/", queryHandler)
+    http.HandleFunc("/assignments", assignmentsHandler)
     return http.ListenAndServe(":"+port, nil)
 }
 
 type Manifest struct {
-    Author      string `json:"author_id"`
-    Name        string `json:"name"`
+    Author      string   `json:"author_id"`
+    Name        string   `json:"name"`
+    License     string   `json:"license"`
+    Cid         string   `json:"code_cid"`
+    RoyaltyBips int      `json:"royalty_bips,string"`
+    Tags        []string `json:"tags"`
+    MinQuorum   optInt   `json:"min_quorum"`
+    MaxQuorum   optInt   `json:"max_quorum"`
+
+    ForkRoyaltyBips          optInt `json:"fork_royalty_bips"`
+    NonCommercialRoyaltyBips optInt `json:"non_commercial_royalty_bips"`
+    Attribution              string `json:"attribution"`
+    UsageCap                 optInt `json:"usage_cap"`
+
+    AuthorKey string `json:"author_key"`
+    Signature string `json:"signature"`
+}
+
+// optInt decodes optional integers the contract stores as strings, empty
+// strings mean zero
+type optInt int
+
+func (i *optInt) UnmarshalJSON(buf []byte) error {
+    s := strings.Trim(string(buf), `"`)
+    if s == "" || s == "null" {
+        *i = 0
+        return nil
+    }
+    v, err := strconv.Atoi(s)
+    if err != nil {
+        return err
+    }
+    *i = optInt(v)
+    return nil
+}
+
+type DatabaseStatus struct {
+    Status       string `json:"status"`
+    SunsetHeight int64  `json:"sunset_height,string"`
+}
+
+type ManifestVersion struct {
+    Version          int      `json:"version"`
+    Manifest         Manifest `json:"manifest"`
+    ActivationHeight int64    `json:"activation_height,string"`
+}
+
+type LicenseTerms struct {
     License     string `json:"license"`
-    Cid         string `json:"code_cid"`
-    RoyaltyBips int    `json:"royalty_bips,string"`
+    Commercial  bool   `json:"commercial"`
+    Attribution string `json:"attribution"`
+    UsageCap    int    `json:"usage_cap,string"`
 }
 
 type SignedQuery struct {
-    Db    string `json:"db"`
-    Query string `json:"query"`
-    Cid   string `json:"cid"`
-    FeeTx []byte `json:"fee_tx"`
+    Db            string   `json:"db"`
+    Joins         []string `json:"joins,omitempty"` // further databases joined by the query
+    Query         string   `json:"query"`
+    Cid           string   `json:"cid"`
+    FeeTx         []byte   `json:"fee_tx"`
+    NonCommercial bool     `json:"non_commercial,omitempty"` // must match the use declared by the fee tx
+}
+
+type CensorshipClaim struct {
+    Qid      string `json:"qid"`
+    Host     string `json:"host"`
+    Claimant string `json:"claimant"`
+    Query    string `json:"query"`
+    Deadline int64  `json:"deadline,string"`
 }
 
 type SignedResult struct {
-    QueryCID  string      `json:"query_cid"`
-    ResultCID string      `json:"result_cid"`
-    Result    interface{} `json:"result"`
-    Sig       string      `json:"sig"`
+    QueryCID    string      `json:"query_cid"`
+    ResultCID   string      `json:"result_cid"`
+    Result      interface{} `json:"result"`
+    Attribution []string    `json:"attribution,omitempty"` // credit lines required by database licenses
+    Sig         string      `json:"sig"`
 }
 
 func queryHandler(w http.ResponseWriter, r *http.Request) {
@@ -127,6 +206,12 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // stop serving paused and retired databases
+    if atomic.LoadInt32(&serving) == 0 {
+        http.Error(w, "database is not accepting queries", http.StatusServiceUnavailable)
+        return
+    }
+
     // parse query
     var query SignedQuery
     dec := json.NewDecoder(r.Body)
@@ -145,7 +230,58 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // TODO: check embedded transaction is valid and signed
+    // the contract only accepts censorship claims for queries that hash to their qid
+    if db3.QueryCIDOf(query.Query) != db3.QueryCID(query.Cid) {
+        http.Error(w, "query does not match cid", http.StatusBadRequest)
+        return
+    }
+
+    // the fee tx must be signed by a key of the account we check access for
+    signer, err := feeSigner(query.FeeTx)
+    if err != nil {
+        log.Error(err)
+        http.Error(w, fmt.Sprintf("invalid fee tx: %v", err), http.StatusBadRequest)
+        return
+    }
+
+    // cross-database queries need all joined databases on this node
+    for _, id := range query.Joins {
+        if !isHosted(id) {
+            http.Error(w, fmt.Sprintf("database %s is not hosted", id), http.StatusBadRequest)
+            return
+        }
+    }
+
+    // private databases only serve allowlisted users
+    for _, id := range append([]string{query.Db}, query.Joins...) {
+        var allowed bool
+        err = callContract("has_access", map[string]string{"dbid": id, "account_id": signer}, &allowed)
+        if err != nil {
+            log.Error(err)
+            http.Error(w, fmt.Sprintf("access check: %v", err), http.StatusBadGateway)
+            return
+        }
+        if !allowed {
+            http.Error(w, fmt.Sprintf("database %s is private", id), http.StatusForbidden)
+            return
+        }
+    }
+
+    // licenses must permit the declared use and the payer must stay below
+    // the usage cap of the query database, or the fee escrow fails
+    credits, status, err := checkLicense(query, signer)
+    if err != nil {
+        log.Error(err)
+        http.Error(w, err.Error(), status)
+        return
+    }
+
+    // answer only after the fee is escrowed on-chain
+    if err := escrowFee(query.FeeTx); err != nil {
+        log.Error(err)
+        http.Error(w, fmt.Sprintf("fee escrow failed: %v", err), http.StatusPaymentRequired)
+        return
+    }
 
     // execute DB query
     result, err := executeQuery(query)
@@ -171,10 +307,11 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
 
     // create result CID and return it to the user
     response := SignedResult{
-        QueryCID:  query.Cid,
-        ResultCID: c.String(),
-        Result:    result,
-        Sig:       "TODO",
+        QueryCID:    query.Cid,
+        ResultCID:   c.String(),
+        Result:      result,
+        Attribution: credits,
+        Sig:         "TODO",
     }
     buf, err = json.Marshal(response)
     if err != nil {
@@ -188,19 +325,12 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
     w.WriteHeader(http.StatusOK)
     w.Write(buf)
 
-    // sign settle call and broadcast embedded fee tx async
+    // sign and broadcast settle call async
     go func() {
-        // fee tx
-        for retries := 3; retries > 0; retries-- {
-            log.Infof("Broadcasting user tx")
-            res, err := conn.SendTransactionAsync(query.FeeTx)
-            if err == nil {
-                log.Infof("Result: %s", res)
-                break
-            } else {
-                log.Error(err)
-                <-time.After(time.Second)
-            }
+        // only committee members may settle, skip queries assigned to other hosts
+        if !isAssigned(query.Db, query.Cid) {
+            log.Infof("Not assigned to query %s, skipping settlement", query.Cid)
+            return
         }
 
         // sign and broadcast settle
@@ -233,6 +363,142 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
     }()
 }
 
+// assignmentsHandler lists pending queries this node is assigned to answer
+func assignmentsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+        return
+    }
+    var qids []string
+    err := callContract("assignments", map[string]string{"dbid": databaseId, "host": accountId}, &qids)
+    if err != nil {
+        log.Error(err)
+        http.Error(w, fmt.Sprintf("assignments: %v", err), http.StatusBadGateway)
+        return
+    }
+    buf, _ := json.Marshal(qids)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    w.Write(buf)
+}
+
+// isHosted reports whether this node hosts a database
+func isHosted(dbid string) bool {
+    if dbid == databaseId {
+        return true
+    }
+    for _, id := range strings.Split(joinIds, ",") {
+        if strings.TrimSpace(id) == dbid {
+            return true
+        }
+    }
+    return false
+}
+
+// checkLicense checks the license terms of all databases of a query and
+// returns the credit lines results must carry, errors come with an HTTP status
+func checkLicense(query SignedQuery, signer string) ([]string, int, error) {
+    var credits []string
+    for _, id := range append([]string{query.Db}, query.Joins...) {
+        var terms LicenseTerms
+        if err := callContract("license_terms", map[string]string{"dbid": id}, &terms); err != nil {
+            return nil, http.StatusBadGateway, fmt.Errorf("license check: %v", err)
+        }
+        if !query.NonCommercial && !terms.Commercial {
+            return nil, http.StatusForbidden, fmt.Errorf("database %s is licensed for non-commercial use only (%s)", id, terms.License)
+        }
+        if id == query.Db && terms.UsageCap > 0 {
+            var usage int
+            err := callContract("usage", map[string]string{"dbid": id, "account_id": signer}, &usage)
+            if err != nil {
+                return nil, http.StatusBadGateway, fmt.Errorf("usage check: %v", err)
+            }
+            if usage >= terms.UsageCap {
+                return nil, http.StatusTooManyRequests, fmt.Errorf("usage cap of database %s reached", id)
+            }
+        }
+        if terms.Attribution != "" {
+            credits = append(credits, terms.Attribution)
+        }
+    }
+    return credits, http.StatusOK, nil
+}
+
+// feeSigner decodes the account that signed the embedded fee transaction,
+// checks the signature and that the signing key is an access key of the account
+func feeSigner(buf []byte) (string, error) {
+    var tx near.SignedTransaction
+    if err := borsh.Deserialize(&tx, buf); err != nil {
+        return "", err
+    }
+    if tx.Transaction.PublicKey.KeyType != utils.ED25519 || tx.Signature.KeyType != utils.ED25519 {
+        return "", fmt.Errorf("unsupported key type")
+    }
+    msg, err := borsh.Serialize(tx.Transaction)
+    if err != nil {
+        return "", err
+    }
+    hash := sha256.Sum256(msg)
+    pk := tx.Transaction.PublicKey.Data[:]
+    if !ed25519.Verify(ed25519.PublicKey(pk), hash[:], tx.Signature.Data[:]) {
+        return "", fmt.Errorf("invalid signature")
+    }
+    if _, err := conn.ViewAccessKey(tx.Transaction.SignerID, "ed25519:"+base58.Encode(pk)); err != nil {
+        return "", fmt.Errorf("key is not an access key of %s: %v", tx.Transaction.SignerID, err)
+    }
+    return tx.Transaction.SignerID, nil
+}
+
+// escrowFee broadcasts the embedded fee transaction and waits for its outcome
+func escrowFee(buf []byte) error {
+    var (
+        res map[string]interface{}
+        err error
+    )
+    for retries := 3; retries > 0; retries-- {
+        log.Infof("Broadcasting user tx")
+        res, err = conn.SendTransaction(buf)
+        if err == nil {
+            break
+        }
+        log.Error(err)
+        <-time.After(time.Second)
+    }
+    if err != nil {
+        return err
+    }
+    r, err := handleResult(res)
+    if err != nil {
+        return err
+    }
+    log.Infof("Result: %s", string(r))
+    return nil
+}
+
+// isAssigned checks whether this node belongs to the committee of a query.
+// The committee is drawn when the fee tx executes, queries without committee
+// are open to all hosts and results settled before the draw are ignored.
+func isAssigned(dbid, qid string) bool {
+    var members []string
+    for i := 0; i < committeeAttempts; i++ {
+        if err := callContract("committee", map[string]string{"dbid": dbid, "qid": qid}, &members); err != nil {
+            log.Error(err)
+        } else if len(members) > 0 {
+            break
+        }
+        <-time.After(time.Second)
+    }
+    if len(members) == 0 {
+        return true
+    }
+    for _, v := range members {
+        if v == accountId {
+            return true
+        }
+    }
+    return false
+}
+
 func handleResult(res map[string]interface{}) ([]byte, error) {
     // buf, _ := json.MarshalIndent(res, "", "  ")
     // log.Infof("Res %s", string(buf))
@@ -246,7 +512,7 @@ func handleResult(res map[string]interface{}) ([]byte, error) {
 }
 
 func executeQuery(query SignedQuery) (interface{}, error) {
-    log.Infof("Processing query db=%s cid=%s q=%q", query.Db, query.Cid, query.Query)
+    log.Infof("Processing query db=%s joins=%v cid=%s q=%q", query.Db, query.Joins, query.Cid, query.Query)
 
     // TODO: execute query against a real database
 
@@ -254,29 +520,205 @@ func executeQuery(query SignedQuery) (interface{}, error) {
 }
 
 func initDatabase() error {
-    // load the database manifest
+    // load the database code version history
     log.Infof("Loading database %s id %s", contractAddress, databaseId)
-    res, err := account.FunctionCall(
-        contractAddress,
-        "manifest",
-        []byte(`{"dbid":"`+databaseId+`"}`),
-        100_000_000_000_000,
-        *big.NewInt(0),
-    )
+    var versions []ManifestVersion
+    if err := callContract("versions", map[string]string{"dbid": databaseId}, &versions); err != nil {
+        return err
+    }
+    if len(versions) == 0 {
+        return fmt.Errorf("database %s has no code versions", databaseId)
+    }
+    height, err := blockHeight()
+    if err != nil {
+        return err
+    }
+
+    // init the code version that is active now
+    v := activeVersion(versions, height)
+    log.Infof("> %#v", v)
+    if err := loadCode(v.Manifest); err != nil {
+        return err
+    }
+    codeVersion = v.Version
+    if err := checkStatus(); err != nil {
+        return err
+    }
+
+    // migrate when the developer publishes a new code version and
+    // follow lifecycle changes
+    go watchDatabase()
+    go watchClaims()
+    return nil
+}
+
+// checkStatus enables or disables query admission based on the
+// database lifecycle status
+func checkStatus() error {
+    var status DatabaseStatus
+    if err := callContract("status", map[string]string{"dbid": databaseId}, &status); err != nil {
+        return err
+    }
+    if status.Status == "active" || status.Status == "deprecated" {
+        if atomic.SwapInt32(&serving, 1) == 0 {
+            log.Infof("Database is %s, serving queries", status.Status)
+        }
+    } else {
+        if atomic.SwapInt32(&serving, 0) == 1 {
+            log.Infof("Database is %s, no longer serving queries", status.Status)
+        }
+    }
+    return nil
+}
+
+// watchDatabase polls the database status and version history and
+// switches to a new code version once its activation height is reached
+func watchDatabase() {
+    prepared := codeVersion
+    for {
+        <-time.After(watchInterval)
+        if err := checkStatus(); err != nil {
+            log.Error(err)
+        }
+        var versions []ManifestVersion
+        if err := callContract("versions", map[string]string{"dbid": databaseId}, &versions); err != nil {
+            log.Error(err)
+            continue
+        }
+        if len(versions) == 0 {
+            log.Errorf("database %s has no code versions", databaseId)
+            continue
+        }
+        height, err := blockHeight()
+        if err != nil {
+            log.Error(err)
+            continue
+        }
+
+        // prepare pending upgrades ahead of activation
+        latest := versions[len(versions)-1]
+        if latest.Version > prepared && latest.ActivationHeight > height {
+            log.Infof("Preparing migration to version %d (cid=%s) activating at block %d",
+                latest.Version, latest.Manifest.Cid, latest.ActivationHeight)
+            if err := loadCode(latest.Manifest); err != nil {
+                log.Error(err)
+                continue
+            }
+            prepared = latest.Version
+        }
+
+        // switch to the active version
+        if v := activeVersion(versions, height); v.Version != codeVersion {
+            log.Infof("Activating code version %d (cid=%s) at block %d", v.Version, v.Manifest.Cid, height)
+            if err := loadCode(v.Manifest); err != nil {
+                log.Error(err)
+                continue
+            }
+            codeVersion = v.Version
+        }
+    }
+}
+
+// watchClaims polls censorship claims against this node and answers them
+// on-chain before their deadline
+func watchClaims() {
+    for {
+        <-time.After(claimInterval)
+        var claims []CensorshipClaim
+        if err := callContract("open_claims", map[string]string{"dbid": databaseId, "host": accountId}, &claims); err != nil {
+            log.Error(err)
+            continue
+        }
+        for _, claim := range claims {
+            if err := answerClaim(claim); err != nil {
+                log.Errorf("Answering claim for query %s: %v", claim.Qid, err)
+            }
+        }
+    }
+}
+
+// answerClaim re-executes the claimed query and posts the result on-chain
+func answerClaim(claim CensorshipClaim) error {
+    log.Infof("Answering claim of %s for query %s due at block %d", claim.Claimant, claim.Qid, claim.Deadline)
+    c, err := cid.Decode(claim.Qid)
+    if err != nil {
+        return fmt.Errorf("invalid cid: %v", err)
+    }
+    result, err := executeQuery(SignedQuery{Db: databaseId, Query: claim.Query, Cid: claim.Qid})
     if err != nil {
         return err
     }
-    buf, err := base64.StdEncoding.DecodeString(res["status"].(map[string]interface{})["SuccessValue"].(string))
+    buf, err := json.Marshal(result)
     if err != nil {
         return err
     }
-    var m Manifest
-    if err := json.Unmarshal(buf, &m); err != nil {
+    c, err = c.Prefix().Sum(buf)
+    if err != nil {
         return err
     }
-    log.Infof("> %#v", m)
+    return callContract("answer_claim", map[string]string{
+        "dbid":   databaseId,
+        "qid":    claim.Qid,
+        "rid":    c.String(),
+        "result": string(buf),
+    }, nil)
+}
+
+func activeVersion(versions []ManifestVersion, height int64) ManifestVersion {
+    for i := len(versions) - 1; i > 0; i-- {
+        if versions[i].ActivationHeight <= height {
+            return versions[i]
+        }
+    }
+    return versions[0]
+}
+
+// verifyAuthor refuses code bundles that are unsigned or not signed by a
+// key the manifest author registered with the contract
+func verifyAuthor(m Manifest) error {
+    if m.AuthorKey == "" || m.Signature == "" {
+        return fmt.Errorf("code bundle %s is not signed by its author", m.Cid)
+    }
+    var keys []string
+    if err := callContract("author_keys", map[string]string{"author_id": m.Author}, &keys); err != nil {
+        return fmt.Errorf("author check: %v", err)
+    }
+    registered := false
+    for _, k := range keys {
+        registered = registered || k == m.AuthorKey
+    }
+    if !registered {
+        return fmt.Errorf("key %s is not registered by author %s", m.AuthorKey, m.Author)
+    }
+    ok := db3.VerifyManifest(db3.Manifest{
+        Author:      db3near.AccountID(m.Author),
+        Name:        m.Name,
+        License:     m.License,
+        CID:         db3.CodeCID(m.Cid),
+        RoyaltyBips: m.RoyaltyBips,
+        Tags:        m.Tags,
+        MinQuorum:   int(m.MinQuorum),
+        MaxQuorum:   int(m.MaxQuorum),
+
+        ForkRoyaltyBips:          int(m.ForkRoyaltyBips),
+        NonCommercialRoyaltyBips: int(m.NonCommercialRoyaltyBips),
+        Attribution:              m.Attribution,
+        UsageCap:                 int(m.UsageCap),
+
+        AuthorKey: db3near.Pubkey(m.AuthorKey),
+        Signature: db3near.Signature(m.Signature),
+    })
+    if !ok {
+        return fmt.Errorf("author signature does not match code bundle %s", m.Cid)
+    }
+    return nil
+}
 
-    log.Infof("Initializing database from cid=%s", m.Cid)
+func loadCode(m Manifest) error {
+    if err := verifyAuthor(m); err != nil {
+        return err
+    }
+    log.Infof("Initializing database from cid=%s by %s", m.Cid, m.Author)
     resp, err := http.Get("https://ipfs.io/ipfs/" + m.Cid)
     if err != nil {
         return err
@@ -292,3 +734,35 @@ func initDatabase() error {
 
     return nil
 }
+
+func blockHeight() (int64, error) {
+    stat, err := conn.GetNodeStatus()
+    if err != nil {
+        return 0, err
+    }
+    return stat["sync_info"].(map[string]interface{})["latest_block_height"].(json.Number).Int64()
+}
+
+// callContract calls a contract method and decodes its JSON result, a nil
+// result discards the return value
+func callContract(method string, args interface{}, result interface{}) error {
+    buf, err := json.Marshal(args)
+    if err != nil {
+        return err
+    }
+    res, err := account.FunctionCall(
+        contractAddress,
+        method,
+        buf,
+        100_000_000_000_000,
+        *big.NewInt(0),
+    )
+    if err != nil {
+        return err
+    }
+    buf, err = handleResult(res)
+    if err != nil || result == nil {
+        return err
+    }
+    return json.Unmarshal(buf, result)
+}
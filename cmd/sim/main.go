@@ -13,7 +13,9 @@ import (
     "os"
     "path/filepath"
     "strconv"
+    "time"
 
+    db3near "blockwatch.cc/db3-near/pkg/near"
     "blockwatch.cc/near-api-go"
     "github.com/echa/log"
     cid "github.com/ipfs/go-cid"
@@ -31,6 +33,9 @@ var (
     databaseId      string
     queryString     string
     ttl             int64
+    within          time.Duration
+    quorum          int
+    nonCommercial   bool
     feeString       string
     flags           = flag.NewFlagSet("sim", flag.ContinueOnError)
     home            string
@@ -47,6 +52,9 @@ func init() {
     flags.StringVar(&queryString, "query", "", "query string")
     flags.StringVar(&feeString, "fee", "1000000000000000000000000", "query fee in yoctoNear (1 Near = 10^24)")
     flags.Int64Var(&ttl, "ttl", 120, "TX TTL in blocks")
+    flags.DurationVar(&within, "within", 0, "TX TTL as duration, converted by the contract (overrides -ttl)")
+    flags.IntVar(&quorum, "quorum", 0, "hosts required to answer the query (0 = database minimum)")
+    flags.BoolVar(&nonCommercial, "non-commercial", false, "pay the non-commercial royalty of the database license")
 
     var err error
     home, err = os.UserHomeDir()
@@ -68,15 +76,17 @@ type Query struct {
 
 type SignedQuery struct {
     Query
-    Cid   string `json:"cid"`
-    FeeTx []byte `json:"fee_tx"`
+    Cid           string `json:"cid"`
+    FeeTx         []byte `json:"fee_tx"`
+    NonCommercial bool   `json:"non_commercial,omitempty"`
 }
 
 type SignedResult struct {
-    QueryCID  string      `json:"query_cid"`
-    ResultCID string      `json:"result_cid"`
-    Result    interface{} `json:"result"`
-    Sig       string      `json:"sig"`
+    QueryCID    string      `json:"query_cid"`
+    ResultCID   string      `json:"result_cid"`
+    Result      interface{} `json:"result"`
+    Attribution []string    `json:"attribution,omitempty"`
+    Sig         string      `json:"sig"`
 }
 
 func run() error {
@@ -145,15 +155,30 @@ func run() error {
     if err != nil {
         return err
     }
-    height, _ := stat["sync_info"].(map[string]interface{})["latest_block_height"].(json.Number).Int64()
+    info := stat["sync_info"].(map[string]interface{})
+    height, _ := info["latest_block_height"].(json.Number).Int64()
     log.Infof("NEAR %s is on block %d", networkId, height)
 
-    // create near transaction
-    args, _ := json.Marshal(map[string]string{
-        "dbid": databaseId,
-        "qid":  c.String(),
-        "ttl":  strconv.FormatInt(ttl+height, 10),
-    })
+    // create near transaction, durations are converted to a height by the
+    // contract using its block time estimate
+    escrow := map[string]interface{}{
+        "dbid":   databaseId,
+        "qid":    c.String(),
+        "quorum": quorum,
+    }
+    if nonCommercial {
+        escrow["non_commercial"] = true
+    }
+    if within > 0 {
+        escrow["within_ms"] = strconv.FormatInt(within.Milliseconds(), 10)
+        if ts, err := time.Parse(time.RFC3339Nano, fmt.Sprint(info["latest_block_time"])); err == nil {
+            expires := db3near.EstimateHeight(height, ts, ts.Add(within), db3near.BLOCK_TIME)
+            log.Infof("Query expires around block %d", expires)
+        }
+    } else {
+        escrow["ttl"] = strconv.FormatInt(ttl+height, 10)
+    }
+    args, _ := json.Marshal(escrow)
 
     _, signedTx, err := account.SignTransaction(contractAddress, []near.Action{{
         Enum: 2,
@@ -176,9 +201,10 @@ func run() error {
 
     // prepare and send database query
     squery := SignedQuery{
-        Query: q,
-        Cid:   c.String(),
-        FeeTx: buf,
+        Query:         q,
+        Cid:           c.String(),
+        FeeTx:         buf,
+        NonCommercial: nonCommercial,
     }
     qbuf, _ := json.Marshal(squery)
     log.Infof("Signed query %s", string(qbuf))
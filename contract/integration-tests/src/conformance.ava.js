@@ -0,0 +1,189 @@
+// Runs the conformance scenarios recorded from the Go model against the
+// contract in a sandbox. Fixtures are generated by
+//
+//   go test ./pkg/conformance -update
+//
+// Scenario heights and height arguments are relative to the sandbox height
+// after setup, scenario account names map to sub-accounts of the root account.
+// Accounts with a scenario key are created with the key derived from its seed.
+import { Worker, KeyPair } from 'near-workspaces'
+import test from 'ava'
+import crypto from 'crypto'
+import fs from 'fs'
+import path from 'path'
+import { fileURLToPath } from 'url'
+
+const FIXTURE_DIR = path.join(path.dirname(fileURLToPath(import.meta.url)), '..', 'fixtures')
+const WASM = path.join(path.dirname(fileURLToPath(import.meta.url)), '..', '..', 'build', 'db3_near.wasm')
+const GAS = '300000000000000'
+const HEIGHT_ARGS = ['ttl', 'sunset_height']
+
+// contract fields checked by scenarios and their storage layout
+const LOOKUP_MAPS = {
+  db_deposits: 'map-dbid-deposit',
+  db_pending_fees: 'map-dbid-pending-fees',
+  db_quorums: 'map-dbid-quorum',
+  db_settled_fees: 'map-dbid-settled-fees',
+  db_settled_royalties: 'map-dbid-settled-royalties',
+  storage_balances: 'map-account-storage',
+}
+const UNORDERED_MAPS = {
+  db_api_registry: 'map-dbid-api',
+  db_ttls: 'map-dbid-ttl',
+  db_pending_votes: 'map-dbid-pending-results',
+  db_payments: 'map-dbid-payments',
+  db_committees: 'map-dbid-committee',
+  db_receipts: 'map-dbid-receipts',
+  db_claims: 'map-dbid-claims',
+}
+const AMOUNTS = ['db_deposits', 'db_pending_fees', 'db_payments', 'db_settled_fees', 'db_settled_royalties', 'storage_balances']
+
+const BASE58 = '123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz'
+
+function base58(buf) {
+  let n = BigInt('0x' + buf.toString('hex'))
+  let s = ''
+  while (n > 0n) {
+    s = BASE58[Number(n % 58n)] + s
+    n /= 58n
+  }
+  for (let i = 0; i < buf.length && buf[i] === 0; i++) {
+    s = '1' + s
+  }
+  return s
+}
+
+// derives the ed25519 key pair of a hex seed, NEAR secret keys are the seed
+// followed by the public key
+function keyPair(seed) {
+  const priv = Buffer.from(seed, 'hex')
+  const pkcs8 = Buffer.concat([Buffer.from('302e020100300506032b657004220420', 'hex'), priv])
+  const key = crypto.createPrivateKey({ key: pkcs8, format: 'der', type: 'pkcs8' })
+  const pub = crypto.createPublicKey(key).export({ format: 'der', type: 'spki' }).subarray(12)
+  return KeyPair.fromString('ed25519:' + base58(Buffer.concat([priv, pub])))
+}
+
+async function height(worker) {
+  const block = await worker.provider.block({ finality: 'final' })
+  return block.header.height
+}
+
+// decodes contract state into the neutral form written by the Go model
+function snapshot(items, suffix, base) {
+  const state = { next_id: 0, db_slashed: '0' }
+  for (const name of [...Object.keys(LOOKUP_MAPS), ...Object.keys(UNORDERED_MAPS)]) {
+    state[name] = {}
+  }
+  const prefixes = [
+    ...Object.entries(LOOKUP_MAPS).map(([name, prefix]) => [name, prefix, false]),
+    ...Object.entries(UNORDERED_MAPS).map(([name, prefix]) => [name, prefix + 'm', true]),
+  ].sort((a, b) => b[1].length - a[1].length)
+
+  for (const { key, value } of items) {
+    const k = key.toString()
+    if (k === 'STATE') {
+      const obj = JSON.parse(value.toString())
+      state.next_id = obj.next_id
+      state.db_slashed = obj.db_slashed
+      continue
+    }
+    const match = prefixes.find(([, prefix]) => k.startsWith(prefix))
+    if (!match) {
+      continue
+    }
+    const [name, prefix, unordered] = match
+    let v = JSON.parse(value.toString())
+    if (unordered) {
+      v = JSON.parse(v[0])
+    }
+    if (name === 'db_receipts') {
+      v = v.rid
+    } else if (name === 'storage_balances') {
+      // storage balances compare by available amount
+      v = v.available
+    } else if (name === 'db_claims') {
+      // deadlines depend on the sandbox height, claims compare by claimant
+      v = v.claimant.split(suffix).join('')
+    } else if (Array.isArray(v)) {
+      // account lists compare as sorted comma-separated names
+      v = v.map(acc => acc.split(suffix).join('')).sort().join(',')
+    }
+    v = String(v)
+    if (AMOUNTS.includes(name) && v === '0') {
+      continue
+    }
+    if (name === 'db_ttls') {
+      v = String(BigInt(v) - BigInt(base))
+    }
+    state[name][k.slice(prefix.length).split(suffix).join('')] = v
+  }
+  return state
+}
+
+for (const file of fs.readdirSync(FIXTURE_DIR).filter(f => f.endsWith('.json')).sort()) {
+  const scenario = JSON.parse(fs.readFileSync(path.join(FIXTURE_DIR, file)))
+
+  test.serial(scenario.name, async t => {
+    const worker = await Worker.init()
+    try {
+      const root = worker.rootAccount
+      const suffix = '.' + root.accountId
+      const accounts = {}
+      for (const name of [scenario.owner, ...scenario.steps.map(s => s.caller)]) {
+        if (!accounts[name]) {
+          const keys = scenario.keys || {}
+          accounts[name] = await root.createSubAccount(name, {
+            initialBalance: '100000000000000000000000000',
+            keyPair: keys[name] ? keyPair(keys[name]) : undefined,
+          })
+        }
+      }
+      const contract = await root.createSubAccount('db3')
+      await contract.deploy(WASM)
+      await contract.call(contract, 'init', { owner: accounts[scenario.owner].accountId })
+      const base = await height(worker)
+
+      for (const [i, step] of scenario.steps.entries()) {
+        const target = base + step.height
+        const now = await height(worker)
+        if (now < target) {
+          await worker.provider.fastForward(target - now)
+        }
+        const args = { ...(step.args || {}) }
+        for (const name of HEIGHT_ARGS) {
+          if (name in args) {
+            args[name] = typeof args[name] === 'string' ? String(base + Number(args[name])) : base + args[name]
+          }
+        }
+        for (const name of ['target', 'owner', 'host']) {
+          if (accounts[args[name]]) {
+            args[name] = accounts[args[name]].accountId
+          }
+        }
+        const label = `step ${i} ${step.method}`
+        try {
+          const result = await accounts[step.caller].call(contract, step.method, args, {
+            attachedDeposit: step.amount || '0',
+            gas: GAS,
+          })
+          t.falsy(step.error, `${label}: expected error ${step.error}`)
+          if (step.result !== undefined) {
+            t.deepEqual(result, step.result, `${label}: result`)
+          }
+        } catch (e) {
+          t.truthy(step.error, `${label}: unexpected error ${e.message}`)
+          t.true(String(e.message).includes(step.error), `${label}: got ${e.message}, want ${step.error}`)
+        }
+      }
+
+      const state = snapshot(await contract.viewStateRaw(), suffix, base)
+      for (const [name, want] of Object.entries(scenario.state)) {
+        if (want !== null) {
+          t.deepEqual(state[name], want, name)
+        }
+      }
+    } finally {
+      await worker.tearDown()
+    }
+  })
+}
@@ -1,62 +1,449 @@
 import { NearBindgen, near, call, view, initialize, LookupMap, UnorderedMap } from 'near-sdk-js';
-import { assert, makekey, splitkey, scanmap } from './utils'
-import { Manifest, STORAGE_COST, SECURITY_DEPOSIT, SLASHED_DEPOSIT_BIPS, MAX_BLOCKS_TO_SETTLE } from './model'
+import { assert, makekey, splitkey, scanmap, intersect, bykey, emit, selectCommittee, tohex, fromhex, signerKey, manifestPayload, queryCid } from './utils'
+import { verify } from './ed25519'
+import { Manifest, ManifestVersion, DatabaseInfo, ForkLink, DatabaseStatus, STATUS_ACTIVE, STATUS_PAUSED, STATUS_DEPRECATED, STATUS_RETIRED, RoyaltyShare, MAX_ROYALTY_SPLITS, MAX_QUORUM, COMMITTEE_SIZE, CLAIM_RESPONSE_BLOCKS, FT_TRANSFER_GAS, FT_CALLBACK_GAS, STORAGE_COST, STORAGE_ENTRY_COST, StorageBalance, SECURITY_DEPOSIT, SLASHED_DEPOSIT_BIPS, SLASH_MAJORITY_BIPS, SLASH_FINALIZER_BIPS, MAX_BLOCKS_TO_SETTLE, MAX_PAGE_LIMIT, UPGRADE_DELAY_BLOCKS, MAX_FORK_DEPTH, AccessPolicy, AccessGrant, ACCESS_GRANT_BLOCKS, GATE_VIEW_GAS, GATE_CALLBACK_GAS, GATE_FUNGIBLE_TOKEN, GATE_NON_FUNGIBLE_TOKEN, JoinShare, MAX_JOIN_DATABASES, BlockClock, BLOCK_TIME_NS, CLOCK_WINDOW_BLOCKS, STATE_VERSION, ElectionOutcome, Payout, MAX_OUTCOMES, OUTCOME_UNPAID, OUTCOME_REFUNDED, OUTCOME_UNANIMOUS, OUTCOME_SUPERMAJORITY, OUTCOME_NO_MAJORITY, LicenseTerms, SPDX_LICENSES, LICENSE_NONE, LICENSE_NOASSERTION, LICENSE_REF_PREFIX, MAX_ATTRIBUTION_LEN, MAX_AUTHOR_KEYS, USE_COMMERCIAL, USE_NON_COMMERCIAL } from './model'
 import { Election } from './vote'
 
 
 @NearBindgen({})
 class Db3Contract {
+  version: number = 1;
   owner: string = "db3.blockwatch.testnet";
   next_id: number = 0;
   db_owners: UnorderedMap = new UnorderedMap('map-dbid-owner');
   db_manifests: UnorderedMap = new UnorderedMap('map-dbid-manifest');
+  db_versions: LookupMap = new LookupMap('map-dbid-versions');
+  db_query_versions: LookupMap = new LookupMap('map-dbid-query-versions');
+  db_pending_owners: LookupMap = new LookupMap('map-dbid-pending-owner');
+  db_royalty_splits: LookupMap = new LookupMap('map-dbid-royalty-split');
+  db_parents: LookupMap = new LookupMap('map-dbid-parent');
+  db_status: LookupMap = new LookupMap('map-dbid-status');
+  db_storage_deposits: LookupMap = new LookupMap('map-dbid-storage-deposit');
+  db_storage_payers: LookupMap = new LookupMap('map-dbid-storage-payer');
+  db_storage_charges: UnorderedMap = new UnorderedMap('map-dbid-storage-charges');
   db_api_registry: UnorderedMap = new UnorderedMap('map-dbid-api');
+  db_access: LookupMap = new LookupMap('map-dbid-access');
+  db_allowlists: UnorderedMap = new UnorderedMap('map-dbid-allowlist');
   db_deposits: LookupMap = new LookupMap('map-dbid-deposit');
   db_ttls: UnorderedMap = new UnorderedMap('map-dbid-ttl');
   db_pending_votes: UnorderedMap = new UnorderedMap('map-dbid-pending-results');
   db_pending_fees: LookupMap = new LookupMap('map-dbid-pending-fees');
   db_settled_fees: LookupMap = new LookupMap('map-dbid-settled-fees');
   db_settled_royalties: LookupMap = new LookupMap('map-dbid-settled-royalties');
+  db_quorums: LookupMap = new LookupMap('map-dbid-quorum');
+  db_payments: UnorderedMap = new UnorderedMap('map-dbid-payments');
+  db_committees: UnorderedMap = new UnorderedMap('map-dbid-committee');
+  db_receipts: UnorderedMap = new UnorderedMap('map-dbid-receipts');
+  db_claims: UnorderedMap = new UnorderedMap('map-dbid-claims');
+  db_fee_tokens: LookupMap = new LookupMap('map-dbid-fee-token');
+  db_joins: LookupMap = new LookupMap('map-dbid-joins');
+  db_outcomes: LookupMap = new LookupMap('map-dbid-outcomes');
+  db_query_uses: LookupMap = new LookupMap('map-dbid-query-use');
+  db_usage: LookupMap = new LookupMap('map-dbid-usage');
+  signing_keys: LookupMap = new LookupMap('map-account-signing-keys');
+  storage_balances: LookupMap = new LookupMap('map-account-storage');
+  token_settled_fees: LookupMap = new LookupMap('map-token-settled-fees');
+  token_settled_royalties: LookupMap = new LookupMap('map-token-settled-royalties');
+  token_slashed: LookupMap = new LookupMap('map-token-slashed');
   db_slashed: string = "0";
+  idx_author: LookupMap = new LookupMap('idx-author-dbids');
+  idx_license: LookupMap = new LookupMap('idx-license-dbids');
+  idx_tag: LookupMap = new LookupMap('idx-tag-dbids');
+  idx_fork: LookupMap = new LookupMap('idx-fork-dbids');
+  clock: BlockClock = null;
 
   @initialize({})
   init({ owner }:{owner: string}) {
+    this.version = STATE_VERSION
     this.owner = owner
   }
 
+  // Upgrades state written by an earlier contract version, the contract
+  // account calls it in the same transaction that deploys the new code.
+  // Migrations must carry over all deposits, fees and balances.
+  @call({privateFunction: true})
+  migrate(): void {
+    assert(this.version <= STATE_VERSION, "State is newer than the contract")
+    while (this.version < STATE_VERSION) {
+      this.internalMigrate({ from: this.version })
+      this.version++
+    }
+  }
+
+  // Views the schema version of the contract state
+  @view({})
+  state_version(): number {
+    return this.version
+  }
+
 
   // Registers a new DB3 database and prepares storage
   @call({payableFunction: true})
   deploy({ manifest }: { manifest: Manifest }): string {
     let amount: bigint = near.attachedDeposit() as bigint;
-    let royalty_bips = BigInt(manifest.royalty_bips || '0')
     assert(amount >= STORAGE_COST, `Attach at least ${STORAGE_COST} yoctoNEAR for storage`);
-    assert(royalty_bips >= 0n && royalty_bips <= 10000n, "Royalty basis points out of range [0, 10000]")
-    assert(manifest.code_cid.length > 0, "Empty code CID")
+    this.internalValidateManifest({ manifest })
     let caller = near.signerAccountId()
 
     if (manifest.author_id.length === 0) {
       manifest.author_id = caller
     }
+    this.internalCheckAuthor({ manifest })
 
     let dbid:string = this.next_id.toString()
     this.db_owners.set(dbid, caller)
     this.db_manifests.set(dbid, manifest)
+    this.db_versions.set(dbid, [new ManifestVersion({
+      version: 0,
+      manifest,
+      activation_height: near.blockIndex().toString(),
+    })])
+    this.db_storage_deposits.set(dbid, amount.toString())
+    this.db_storage_payers.set(dbid, caller)
+
+    // update discovery indexes
+    this.internalIndexDatabase({ dbid, manifest })
+    emit("db_deployed", { dbid, owner: caller, author_id: manifest.author_id, code_cid: manifest.code_cid })
 
     this.next_id++
     return dbid;
   }
 
+  // Registers a fork of a database. The fork is deployed like a new database
+  // and records its parent, royalties of the fork pass the fork royalty
+  // declared by the parent's active manifest up the fork chain.
+  @call({payableFunction: true})
+  fork({ parent, manifest }: { parent: string, manifest: Manifest }): string {
+    assert(parseInt(parent) < this.next_id, "Database id does not exist")
+    assert(this.status({ dbid: parent }).status !== STATUS_RETIRED, "Database is retired")
+    assert(this.lineage({ dbid: parent }).length < MAX_FORK_DEPTH, "Fork chain too deep")
+    let royalty_bips = this.internalActiveVersion({ dbid: parent }).manifest.fork_royalty_bips || '0'
+
+    let dbid = this.deploy({ manifest })
+    this.db_parents.set(dbid, new ForkLink({ parent, royalty_bips }))
+    let forks = this.idx_fork.get(parent) as Array<string> || []
+    forks.push(dbid)
+    this.idx_fork.set(parent, forks)
+    emit("db_forked", { dbid, parent, royalty_bips: parseInt(royalty_bips) })
+    return dbid
+  }
+
+  // Publishes a new code version that activates after a delay, hosts must
+  // migrate to the new code CID before the activation height
+  @call({})
+  upgrade({ dbid, manifest }: { dbid: string, manifest: Manifest }): number {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let caller = near.signerAccountId()
+    assert(caller === this.db_owners.get(dbid), "Must be database owner to upgrade")
+    this.internalValidateManifest({ manifest })
+
+    let current = this.internalActiveVersion({ dbid })
+    if (manifest.author_id.length === 0) {
+      manifest.author_id = current.manifest.author_id
+    }
+    this.internalCheckAuthor({ manifest })
+
+    // discovery indexes the active and the pending version, drop both
+    // before the history changes
+    let height = near.blockIndex()
+    let versions = this.db_versions.get(dbid) as Array<ManifestVersion> || [current]
+    this.internalUnindexVersions({ dbid, versions })
+
+    // replace an upgrade that has not activated yet
+    if (BigInt(versions[versions.length-1].activation_height) > height) {
+      versions.pop()
+    }
+    let version = versions[versions.length-1].version + 1
+    versions.push(new ManifestVersion({
+      version,
+      manifest,
+      activation_height: (height + UPGRADE_DELAY_BLOCKS).toString(),
+    }))
+    this.db_versions.set(dbid, versions)
+    this.internalIndexVersions({ dbid, versions })
+
+    // the published manifest follows the active version, the new version is
+    // only visible through versions until it activates
+    this.db_manifests.set(dbid, this.internalActiveVersion({ dbid }).manifest)
+    emit("db_upgraded", {
+      dbid,
+      version,
+      code_cid: manifest.code_cid,
+      activation_height: (height + UPGRADE_DELAY_BLOCKS).toString(),
+    })
+    return version
+  }
+
+  // Registers the access key that signs this call as manifest signing key of
+  // the caller, contracts cannot read access keys of other accounts
+  @call({})
+  register_author_key(): void {
+    let caller = near.signerAccountId()
+    let key = signerKey()
+    let keys = this.signing_keys.get(caller) as Array<string> || []
+    assert(!keys.includes(key), "Author key already registered")
+    assert(keys.length < MAX_AUTHOR_KEYS, "Too many author keys")
+    this.internalChargeStorage({ account_id: caller, entries: 1 })
+    keys.push(key)
+    this.signing_keys.set(caller, keys)
+    emit("author_key_added", { author_id: caller, key })
+  }
+
+  // Removes a manifest signing key of the caller, published manifests stay
+  // deployed but nodes no longer accept their signature
+  @call({})
+  remove_author_key({ key }: { key: string }): void {
+    let caller = near.signerAccountId()
+    let keys = this.signing_keys.get(caller) as Array<string> || []
+    assert(keys.includes(key), "Author key not registered")
+    keys = keys.filter(k => k !== key)
+    if (keys.length === 0) {
+      this.signing_keys.remove(caller)
+    } else {
+      this.signing_keys.set(caller, keys)
+    }
+    this.internalRefundStorage({ account_id: caller, cost: STORAGE_ENTRY_COST })
+    emit("author_key_removed", { author_id: caller, key })
+  }
+
+  // Proposes a new database owner who must accept the transfer, an empty
+  // owner cancels a pending proposal
+  @call({})
+  propose_owner({ dbid, owner }: { dbid: string, owner: string }): void {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let caller = near.signerAccountId()
+    assert(caller === this.db_owners.get(dbid), "Must be database owner to transfer ownership")
+    if (owner.length === 0) {
+      let pending = this.db_pending_owners.get(dbid) as string
+      if (pending) {
+        this.db_pending_owners.remove(dbid)
+        emit("owner_cancelled", { dbid, owner: pending })
+      }
+      return
+    }
+    assert(owner !== caller, "Account already owns database")
+    this.db_pending_owners.set(dbid, owner)
+    emit("owner_proposed", { dbid, owner })
+  }
+
+  // Accepts a proposed database ownership transfer, the royalty split of the
+  // previous owner is reset so all royalties go to the new owner
+  @call({})
+  accept_owner({ dbid }: { dbid: string }): void {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let caller = near.signerAccountId()
+    assert(caller === this.db_pending_owners.get(dbid), "Caller is not the proposed owner")
+    this.db_pending_owners.remove(dbid)
+    this.db_royalty_splits.remove(dbid)
+    this.db_owners.set(dbid, caller)
+    emit("owner_transferred", { dbid, owner: caller })
+  }
+
+  // Splits database royalties across beneficiaries by basis points, an empty
+  // list pays all royalties to the owner
+  @call({})
+  set_royalty_split({ dbid, shares }: { dbid: string, shares: Array<RoyaltyShare> }): void {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let caller = near.signerAccountId()
+    assert(caller === this.db_owners.get(dbid), "Must be database owner to split royalties")
+    if (shares.length === 0) {
+      this.db_royalty_splits.remove(dbid)
+      return
+    }
+    assert(shares.length <= MAX_ROYALTY_SPLITS, "Too many royalty beneficiaries")
+    let sum = 0n
+    let seen: Set<string> = new Set()
+    for (let share of shares) {
+      let bips = BigInt(share.bips)
+      assert(share.account_id.length > 0, "Empty royalty beneficiary")
+      assert(!seen.has(share.account_id), "Duplicate royalty beneficiary")
+      assert(bips > 0n && bips <= 10000n, "Royalty share out of range")
+      seen.add(share.account_id)
+      sum += bips
+    }
+    assert(sum === 10000n, "Royalty shares must add up to 10000 bips")
+    this.db_royalty_splits.set(dbid, shares)
+  }
+
+  // Sets the access policy of a database, public databases keep their
+  // allowlist for when they turn private again
+  @call({})
+  set_access_policy({ dbid, policy }: { dbid: string, policy: AccessPolicy }): void {
+    this.internalCheckDatabaseOwner({ dbid })
+    let gate = policy.gate || ''
+    let standard = policy.standard || ''
+    let min_balance = BigInt(policy.min_balance || '0')
+    assert(gate !== '' || (standard === '' && min_balance === 0n), "Access gate without contract")
+    assert(gate === '' || standard === GATE_FUNGIBLE_TOKEN || standard === GATE_NON_FUNGIBLE_TOKEN, "Unsupported gate standard")
+    assert(gate === '' || policy.private, "Access gate requires a private database")
+    if (gate !== '' && min_balance === 0n) {
+      min_balance = 1n
+    }
+    if (!policy.private) {
+      this.db_access.remove(dbid)
+    } else {
+      this.db_access.set(dbid, new AccessPolicy({ private: true, gate, standard, min_balance: min_balance.toString() }))
+    }
+    emit("access_changed", { dbid, private: !!policy.private, gate, standard, min_balance: min_balance.toString() })
+  }
+
+  // Adds users to the allowlist of a database without expiry
+  @call({})
+  allow_users({ dbid, accounts }: { dbid: string, accounts: Array<string> }): void {
+    this.internalCheckDatabaseOwner({ dbid })
+    for (let account_id of accounts) {
+      this.internalGrantAccess({ dbid, account_id, expires: 0n })
+    }
+  }
+
+  // Removes users from the allowlist of a database
+  @call({})
+  revoke_users({ dbid, accounts }: { dbid: string, accounts: Array<string> }): void {
+    this.internalCheckDatabaseOwner({ dbid })
+    for (let account_id of accounts) {
+      let key = makekey(dbid, account_id)
+      let grant = this.db_allowlists.get(key) as AccessGrant
+      if (grant === null) {
+        continue
+      }
+      this.db_allowlists.remove(key)
+      this.internalRefundStorage({ account_id: grant.payer, cost: STORAGE_ENTRY_COST })
+      emit("access_revoked", { dbid, account_id })
+    }
+  }
+
+  // Grants the caller access to a private database for ACCESS_GRANT_BLOCKS
+  // when it holds the gate token. The holding is checked with a view call on
+  // the gate contract and access is granted in the callback.
+  @call({})
+  request_access({ dbid }: { dbid: string }): void {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let policy = this.db_access.get(dbid) as AccessPolicy
+    assert(policy && policy.gate, "Database has no access gate")
+    let account_id = near.signerAccountId()
+    let method = policy.standard === GATE_FUNGIBLE_TOKEN ? 'ft_balance_of' : 'nft_supply_for_owner'
+    const promise = near.promiseCreate(
+      policy.gate,
+      method,
+      JSON.stringify({ account_id }),
+      0n,
+      GATE_VIEW_GAS,
+    )
+    near.promiseThen(
+      promise,
+      near.currentAccountId(),
+      'on_access_checked',
+      JSON.stringify({ dbid, account_id }),
+      0n,
+      GATE_CALLBACK_GAS,
+    )
+  }
+
+  // Resolves an access request, holders of the gate token are granted
+  // access, permanent grants are kept
+  @call({privateFunction: true})
+  on_access_checked({ dbid, account_id }: { dbid: string, account_id: string }): boolean {
+    let balance = 0n
+    try {
+      balance = BigInt(JSON.parse(near.promiseResult(0) as string))
+    } catch (e) {
+      return false
+    }
+    let policy = this.db_access.get(dbid) as AccessPolicy
+    if (!policy || !policy.gate || balance < BigInt(policy.min_balance)) {
+      return false
+    }
+    let grant = this.db_allowlists.get(makekey(dbid, account_id)) as AccessGrant
+    if (grant && grant.expires === '0') {
+      return true
+    }
+    this.internalGrantAccess({ dbid, account_id, expires: near.blockIndex() + ACCESS_GRANT_BLOCKS })
+    return true
+  }
+
+  // Pauses a database, new fee escrows are rejected while pending queries
+  // still settle and finalize
+  @call({})
+  pause({ dbid }: { dbid: string }): void {
+    this.internalCheckDatabaseOwner({ dbid })
+    assert(this.status({ dbid }).status === STATUS_ACTIVE, "Database is not active")
+    this.db_status.set(dbid, new DatabaseStatus({ status: STATUS_PAUSED, sunset_height: '0' }))
+    emit("db_paused", { dbid, status: STATUS_PAUSED })
+  }
+
+  // Resumes a paused database
+  @call({})
+  resume({ dbid }: { dbid: string }): void {
+    this.internalCheckDatabaseOwner({ dbid })
+    assert(this.status({ dbid }).status === STATUS_PAUSED, "Database is not paused")
+    this.db_status.remove(dbid)
+    emit("db_resumed", { dbid, status: STATUS_ACTIVE })
+  }
+
+  // Deprecates a database which retires at the sunset height
+  @call({})
+  deprecate({ dbid, sunset_height }: { dbid: string, sunset_height: string }): void {
+    this.internalCheckDatabaseOwner({ dbid })
+    let status = this.status({ dbid }).status
+    assert(status === STATUS_ACTIVE || status === STATUS_PAUSED, "Database is already deprecated")
+    assert(BigInt(sunset_height) >= near.blockIndex() + MAX_BLOCKS_TO_SETTLE, "Sunset height too early")
+    this.db_status.set(dbid, new DatabaseStatus({ status: STATUS_DEPRECATED, sunset_height }))
+    emit("db_deprecated", { dbid, status: STATUS_DEPRECATED, sunset_height })
+  }
+
+  // Retires a deprecated database after its sunset height and refunds
+  // the storage deposit paid on deploy
+  @call({})
+  retire({ dbid }: { dbid: string }): void {
+    this.internalCheckDatabaseOwner({ dbid })
+    let current = this.db_status.get(dbid) as DatabaseStatus
+    assert(!current || current.status !== STATUS_RETIRED, "Database is already retired")
+    let status = this.status({ dbid })
+    assert(status.status === STATUS_RETIRED, "Database has not reached its sunset height")
+    this.db_status.set(dbid, status)
+
+    // remove all registrations and refund their storage
+    let prefix = makekey(dbid, '')
+    for (let [k] of scanmap(this.db_api_registry, prefix)) {
+      this.db_api_registry.remove(k)
+      this.internalRefundStorage({ account_id: splitkey(k)[1], cost: STORAGE_ENTRY_COST })
+    }
+
+    for (let [k, v] of scanmap(this.db_allowlists, prefix)) {
+      this.db_allowlists.remove(k)
+      this.internalRefundStorage({ account_id: (v as any).payer, cost: STORAGE_ENTRY_COST })
+    }
+
+    // refund storage to the account that paid it, deposits recorded
+    // before payers were tracked go to the owner
+    let refund = BigInt(this.db_storage_deposits.get(dbid) as string || '0')
+    if (refund > 0n) {
+      let payer = this.db_storage_payers.get(dbid) as string || near.signerAccountId()
+      const promise = near.promiseBatchCreate(payer)
+      near.promiseBatchActionTransfer(promise, refund)
+      this.db_storage_deposits.remove(dbid)
+      this.db_storage_payers.remove(dbid)
+      emit("storage_refunded", { dbid, account_id: payer, amount: refund.toString() })
+    }
+    emit("db_retired", { dbid, status: STATUS_RETIRED, sunset_height: status.sunset_height })
+  }
+
   // Locks security deposit when joining a new database or tops up slashed deposit
   @call({payableFunction: true})
   deposit({ dbid }: { dbid: string }): void {
     assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    assert(this.status({ dbid }).status !== STATUS_RETIRED, "Database is retired")
     let caller = near.signerAccountId()
     let key = makekey(dbid, caller)
     let amount: bigint = near.attachedDeposit() as bigint;
-    let newDeposit = BigInt(this.db_deposits.get(key) as string || '0') + amount
+    let current = this.db_deposits.get(key) as string
+    let newDeposit = BigInt(current || '0') + amount
     assert(newDeposit >= SECURITY_DEPOSIT, "Security deposit too low")
+    if (current === null) {
+      this.internalChargeStorage({ account_id: caller, entries: 1 })
+    }
     this.db_deposits.set(key, newDeposit.toString())
+    emit("deposit", { dbid, account_id: caller, amount: amount.toString() })
   }
 
   // Unlocks and returns security deposit on leave
@@ -67,6 +454,7 @@ class Db3Contract {
     let key = makekey(dbid, caller)
     let toTransfer = BigInt(this.db_deposits.get(key) as string || '0')
     assert(toTransfer > 0n, "Caller did not pay deposit")
+    assert(!this.internalHasOpenClaims({ dbid, host: caller }), "Host has open claims")
 
     // send the deposit back
     const promise = near.promiseBatchCreate(caller)
@@ -74,11 +462,16 @@ class Db3Contract {
 
     // remove registrations, but keep in pending and settled maps
     this.db_deposits.remove(key)
-    this.db_api_registry.remove(key)
+    this.internalRefundStorage({ account_id: caller, cost: STORAGE_ENTRY_COST })
+    if (this.db_api_registry.get(key) !== null) {
+      this.db_api_registry.remove(key)
+      this.internalRefundStorage({ account_id: caller, cost: STORAGE_ENTRY_COST })
+    }
+    emit("withdraw", { dbid, account_id: caller, amount: toTransfer.toString() })
   }
 
-  // Registers the host's API endpoint for a database
-  // TODO: require fee for storage accounting
+  // Registers the host's API endpoint for a database, an empty uri removes
+  // the registration
   @call({})
   register_api({ dbid, uri }: { dbid: string, uri: string }): void {
     assert(parseInt(dbid) < this.next_id, "Database id does not exist")
@@ -86,39 +479,98 @@ class Db3Contract {
     let key = makekey(dbid, caller)
     let deposit = BigInt(this.db_deposits.get(key) as string || '0')
     assert(deposit >= SECURITY_DEPOSIT, "Security deposit too low")
+    let exists = this.db_api_registry.get(key) !== null
     if (uri.length === 0) {
-      this.db_api_registry.remove(key)
+      if (exists) {
+        this.db_api_registry.remove(key)
+        this.internalRefundStorage({ account_id: caller, cost: STORAGE_ENTRY_COST })
+      }
     } else {
+      assert(this.status({ dbid }).status !== STATUS_RETIRED, "Database is retired")
+      if (!exists) {
+        this.internalChargeStorage({ account_id: caller, entries: 1 })
+      }
       this.db_api_registry.set(key, uri)
     }
+    emit("api_registered", { dbid, account_id: caller, uri })
   }
 
-  // Pays query fee
+  // Pays query fee and requests a replication quorum, an empty quorum uses
+  // the database minimum. Queries that receive fewer votes than their quorum
+  // are refunded to payers on finalization. The first escrow draws the
+  // committee of hosts assigned to answer the query from the block random seed.
+  // Without ttl height the query expires within_ms milliseconds from now.
+  // Non-commercial queries pay the non-commercial royalty of the license,
+  // all payers of a query must declare the same use.
   @call({payableFunction: true})
-  escrow({ dbid, qid, ttl }: { dbid: string, qid: string, ttl: number }): void {
-    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
-    assert(ttl > near.blockIndex(), "TTL in the past")
+  escrow({ dbid, qid, ttl, quorum, within_ms, non_commercial }: { dbid: string, qid: string, ttl?: number, quorum?: number, within_ms?: string, non_commercial?: boolean }): void {
+    let payer = near.signerAccountId()
+    let amount: bigint = near.attachedDeposit() as bigint;
+    ttl = this.internalTtl({ ttl: Number(ttl || 0), within_ms: within_ms || '0' })
+    let use = non_commercial ? USE_NON_COMMERCIAL : USE_COMMERCIAL
+    this.internalEscrow({ dbid, qid, ttl, quorum: quorum || 0, payer, token: '', amount, use })
+  }
 
-    // add fees paid to current fees for this CID (multiple calls may run in parallel)
-    let key = makekey(dbid, qid)
+  // Pays the fee of a query that joins several databases. The query is
+  // escrowed under the first database and judged against its code version
+  // and royalty rate, the royalty is split across all joined databases by
+  // their shares. Only hosts with a security deposit on every joined
+  // database may answer the query.
+  @call({payableFunction: true})
+  escrow_join({ qid, ttl, quorum, shares }: { qid: string, ttl: number, quorum?: number, shares: Array<JoinShare> }): void {
+    assert(shares && shares.length > 0, "Invalid number of joined databases")
+    let payer = near.signerAccountId()
     let amount: bigint = near.attachedDeposit() as bigint;
-    let newFee = BigInt(this.db_pending_fees.get(key) as string || '0') + amount
-    this.db_pending_fees.set(key, newFee.toString())
+    this.internalEscrow({ dbid: shares[0].dbid, qid, ttl, quorum: quorum || 0, payer, token: '', amount, shares, use: USE_COMMERCIAL })
+  }
 
-    // store TTL unconditionally (this may override a TTL set via Settle,
-    // but this case is expected)
-    this.db_ttls.set(key, ttl)
+  // Pays a query fee in fungible tokens through ft_transfer_call with escrow
+  // arguments {dbid, qid, ttl, within_ms, quorum, joins, non_commercial} as msg. The predecessor is the token
+  // contract, so any account can pretend to be a token and hosts must check
+  // the fee token before serving a query. All fees of a query must be paid
+  // in the same token. Failed escrows are refunded by the token contract.
+  @call({})
+  ft_on_transfer({ sender_id, amount, msg }: { sender_id: string, amount: string, msg: string }): string {
+    let args: any
+    try {
+      args = JSON.parse(msg)
+    } catch (e) {
+      args = null
+    }
+    assert(args !== null && typeof args.qid === 'string' && args.qid.length > 0, "Invalid escrow message")
+    let token = near.predecessorAccountId()
+    this.internalEscrow({
+      dbid: String(args.dbid),
+      qid: args.qid,
+      ttl: this.internalTtl({ ttl: Number(args.ttl || 0), within_ms: String(args.within_ms || '0') }),
+      quorum: Number(args.quorum || 0),
+      payer: sender_id,
+      token,
+      amount: BigInt(amount),
+      shares: args.joins || null,
+      use: args.non_commercial ? USE_NON_COMMERCIAL : USE_COMMERCIAL,
+    })
+    return "0"
   }
 
   // Settle stores a query execution proof
   @call({})
   settle({ dbid, qid, rid }: { dbid: string, qid: string, rid: string }): void {
     assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    this.internalObserveClock()
     let caller = near.signerAccountId()
     let key = makekey(dbid, caller)
     let deposit = BigInt(this.db_deposits.get(key) as string || '0')
     assert(deposit >= SECURITY_DEPOSIT, "Security deposit too low")
 
+    // only assigned hosts answer queries with a committee, results settled
+    // before the committee was drawn are ignored on finalization
+    let committee = this.db_committees.get(makekey(dbid, qid)) as Array<string>
+    assert(committee === null || committee.includes(caller), "Host is not assigned to query")
+
+    // cross-database queries are answered by hosts of all joined databases
+    let shares = this.db_joins.get(makekey(dbid, qid)) as Array<JoinShare>
+    assert(shares === null || this.internalJoinEligible({ shares, host: caller }), "Host is not registered for all joined databases")
 
     // check and init result TTL on first settlement (this should have been done
     // by calling EscrowFee, but we cannot assume this tx was published
@@ -127,17 +579,82 @@ class Db3Contract {
     let ttlval = this.db_ttls.get(ttlkey)
     let ttl: bigint
     if (!ttlval) {
+      // only pending queries settle when the database is not active
+      assert(this.status({ dbid }).status === STATUS_ACTIVE, "Database is not accepting queries")
+      this.internalChargeQueryStorage({ dbid, qid, account_id: caller, entries: 1 })
       ttl = near.blockIndex() + MAX_BLOCKS_TO_SETTLE
       this.db_ttls.set(ttlkey, ttl.toString())
+      this.internalBindQueryVersion({ dbid, qid })
     } else {
       ttl = BigInt(ttlval as string);
     }
     let height = near.blockIndex()
     assert(ttl > height, `Settlement timed out ${ttlval} <= ${height}`)
 
-    // allocate sub map when this is the first call for this query
+    // store this host's result hash
     let votekey = makekey(dbid, qid, caller)
+    if (this.db_pending_votes.get(votekey) === null) {
+      this.internalChargeQueryStorage({ dbid, qid, account_id: caller, entries: 1 })
+    }
     this.db_pending_votes.set(votekey, rid)
+    emit("result_settled", { dbid, qid, host: caller, rid })
+  }
+
+  // Countersigns delivery of a result by a host, this resolves open claims
+  // of the caller against the host and blocks new ones
+  @call({})
+  sign_receipt({ dbid, qid, host, rid }: { dbid: string, qid: string, host: string, rid: string }): void {
+    this.internalCheckPayer({ dbid, qid })
+    let user = near.signerAccountId()
+    let key = makekey(dbid, qid, host)
+    assert(this.db_receipts.get(key) === null, "Receipt already signed")
+    this.internalChargeQueryStorage({ dbid, qid, account_id: user, entries: 1 })
+    this.db_receipts.set(key, { user, rid })
+    emit("receipt_signed", { dbid, qid, host, user, rid })
+
+    // delivery acknowledged, withdraw the caller's claim
+    let claim = this.db_claims.get(key) as any
+    if (claim !== null && claim.claimant === user) {
+      this.internalCloseClaim({ key, claim })
+    }
+  }
+
+  // Files a no response claim against an assigned host within the query TTL,
+  // the host must post its result for the query or will be slashed. The query
+  // must hash to the qid the caller paid for.
+  @call({})
+  file_claim({ dbid, qid, host, query }: { dbid: string, qid: string, host: string, query: string }): void {
+    this.internalCheckPayer({ dbid, qid })
+    assert(query.length > 0, "Empty query")
+    assert(queryCid(query) === qid, "Query does not match qid")
+    assert(this.db_deposits.get(makekey(dbid, host)) !== null, "Host did not pay deposit")
+    let committee = this.db_committees.get(makekey(dbid, qid)) as Array<string>
+    assert(committee === null || committee.includes(host), "Host is not assigned to query")
+    let key = makekey(dbid, qid, host)
+    assert(this.db_receipts.get(key) === null, "Delivery receipt exists")
+    assert(this.db_claims.get(key) === null, "Claim already filed")
+    let claimant = near.signerAccountId()
+    this.internalChargeStorage({ account_id: claimant, entries: 1 })
+    let deadline = (near.blockIndex() + CLAIM_RESPONSE_BLOCKS).toString()
+    this.db_claims.set(key, { claimant, query, deadline })
+    emit("censorship_claimed", { dbid, qid, host, claimant, deadline })
+  }
+
+  // Answers a claim against the caller by posting the query result on-chain,
+  // results must match the caller's settled result
+  @call({})
+  answer_claim({ dbid, qid, rid, result }: { dbid: string, qid: string, rid: string, result: string }): void {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let host = near.signerAccountId()
+    let key = makekey(dbid, qid, host)
+    let claim = this.db_claims.get(key) as any
+    assert(claim !== null, "Claim does not exist")
+    assert(BigInt(claim.deadline) > near.blockIndex(), "Claim deadline passed")
+    assert(result.length > 0, "Empty result")
+    let settled = this.db_pending_votes.get(key)
+    assert(settled === null || settled === rid, "Result does not match settled result")
+    this.internalCloseClaim({ key, claim })
+    emit("claim_answered", { dbid, qid, host, claimant: claim.claimant, deadline: claim.deadline, rid, result })
   }
 
   @call({})
@@ -156,10 +673,72 @@ class Db3Contract {
       const promise = near.promiseBatchCreate(caller)
       near.promiseBatchActionTransfer(promise, toTransfer)
     }
+    if (earnedFees > 0n) {
+      emit("fees_claimed", { account_id: caller, amount: earnedFees.toString() })
+    }
+    if (earnedRoyalties > 0n) {
+      emit("royalties_claimed", { account_id: caller, amount: earnedRoyalties.toString() })
+    }
     this.db_settled_fees.remove(caller)
     this.db_settled_royalties.remove(caller)
   }
 
+  // Sends settled fees and royalties in a fungible token to the caller, the
+  // balances are restored when the token transfer fails, e.g. because the
+  // caller is not registered with the token contract
+  @call({})
+  claim_tokens({ token }: { token: string }): void {
+    this.internalFinalizeResults()
+
+    let caller = near.signerAccountId()
+    let key = makekey(token, caller)
+    let earnedFees = BigInt(this.token_settled_fees.get(key) as string || '0')
+    let earnedRoyalties = BigInt(this.token_settled_royalties.get(key) as string || '0')
+    let toTransfer = earnedFees + earnedRoyalties
+    if (toTransfer === 0n) {
+      return
+    }
+    this.token_settled_fees.remove(key)
+    this.token_settled_royalties.remove(key)
+    const promise = near.promiseCreate(
+      token,
+      'ft_transfer',
+      JSON.stringify({ receiver_id: caller, amount: toTransfer.toString() }),
+      1n,
+      FT_TRANSFER_GAS,
+    )
+    near.promiseThen(
+      promise,
+      near.currentAccountId(),
+      'on_tokens_claimed',
+      JSON.stringify({ token, account_id: caller, fees: earnedFees.toString(), royalties: earnedRoyalties.toString() }),
+      0n,
+      FT_CALLBACK_GAS,
+    )
+  }
+
+  // Resolves a token claim, failed transfers are credited back
+  @call({privateFunction: true})
+  on_tokens_claimed({ token, account_id, fees, royalties }: { token: string, account_id: string, fees: string, royalties: string }): void {
+    let ok = true
+    try {
+      near.promiseResult(0)
+    } catch (e) {
+      ok = false
+    }
+    if (!ok) {
+      this.internalCreditFee({ token, account_id, amount: BigInt(fees) })
+      this.internalCreditRoyalty({ token, account_id, amount: BigInt(royalties) })
+      return
+    }
+    if (BigInt(fees) > 0n) {
+      emit("fees_claimed", { account_id, amount: fees, token })
+    }
+    if (BigInt(royalties) > 0n) {
+      emit("royalties_claimed", { account_id, amount: royalties, token })
+    }
+  }
+
   @call({})
   finalize(): void {
     this.internalFinalizeResults()
@@ -172,21 +751,170 @@ class Db3Contract {
     assert(caller === this.owner, "Must be contract owner to recover funds")
     let slashedAmount = BigInt(this.db_slashed)
     let toTransfer = BigInt(amount)
-    assert(slashedAmount <= toTransfer, "Amount is larger than available funds")
+    assert(toTransfer <= slashedAmount, "Amount is larger than available funds")
     if (toTransfer > 0n) {
       const promise = near.promiseBatchCreate(target)
       near.promiseBatchActionTransfer(promise, toTransfer)
       slashedAmount -= toTransfer
       this.db_slashed = slashedAmount.toString()
+      emit("funds_recovered", { target, amount: toTransfer.toString() })
+    }
+  }
+
+  // Registers an account for storage and adds the attached deposit to its
+  // balance, an empty account registers the caller (NEP-145)
+  @call({payableFunction: true})
+  storage_deposit({ account_id }: { account_id?: string }): StorageBalance {
+    let amount: bigint = near.attachedDeposit() as bigint
+    account_id = account_id || near.signerAccountId()
+    let bal = this.storage_balances.get(account_id) as StorageBalance
+    if (bal === null) {
+      // the balance record itself takes one storage entry
+      assert(amount >= STORAGE_ENTRY_COST, "Storage deposit below minimum balance")
+      bal = new StorageBalance({ total: amount.toString(), available: (amount - STORAGE_ENTRY_COST).toString() })
+    } else {
+      bal = new StorageBalance({
+        total: (BigInt(bal.total) + amount).toString(),
+        available: (BigInt(bal.available) + amount).toString(),
+      })
     }
+    this.storage_balances.set(account_id, bal)
+    return bal
   }
 
-  // Views all registered databases
+  // Withdraws unused storage balance of the caller, an empty amount
+  // withdraws all available funds (NEP-145)
+  @call({})
+  storage_withdraw({ amount }: { amount?: string }): StorageBalance {
+    let caller = near.signerAccountId()
+    let bal = this.storage_balances.get(caller) as StorageBalance
+    assert(bal !== null, "Account is not registered")
+    let available = BigInt(bal.available)
+    let toTransfer = BigInt(amount || '0')
+    if (toTransfer === 0n) {
+      toTransfer = available
+    }
+    assert(toTransfer <= available, "Amount is larger than available storage balance")
+    bal = new StorageBalance({
+      total: (BigInt(bal.total) - toTransfer).toString(),
+      available: (available - toTransfer).toString(),
+    })
+    this.storage_balances.set(caller, bal)
+    if (toTransfer > 0n) {
+      const promise = near.promiseBatchCreate(caller)
+      near.promiseBatchActionTransfer(promise, toTransfer)
+    }
+    return bal
+  }
+
+  // Unregisters the caller and refunds its full storage balance, fails while
+  // the account still occupies contract storage (NEP-145)
+  @call({})
+  storage_unregister(): boolean {
+    let caller = near.signerAccountId()
+    let bal = this.storage_balances.get(caller) as StorageBalance
+    if (bal === null) {
+      return false
+    }
+    assert(BigInt(bal.total) - BigInt(bal.available) <= STORAGE_ENTRY_COST, "Account still uses contract storage")
+    this.storage_balances.remove(caller)
+    const promise = near.promiseBatchCreate(caller)
+    near.promiseBatchActionTransfer(promise, BigInt(bal.total))
+    return true
+  }
+
+  // Views a page of registered databases ordered by id
   @view({})
-  databases(): Array<Manifest> {
+  databases({ from_index, limit }: { from_index?: number, limit?: number }): Array<Manifest> {
     let dbs: Array<Manifest> = new Array()
-    for ( let [_, v] of this.db_manifests) {
-      dbs.push(v as Manifest)
+    for (let v of this.search_databases({ from_index, limit })) {
+      dbs.push(v.manifest)
+    }
+    return dbs
+  }
+
+  // Views a page of registered databases matching a search filter, empty
+  // filter fields match all databases
+  @view({})
+  search_databases({
+    author_id,
+    name,
+    license,
+    tags,
+    commercial,
+    from_index,
+    limit,
+  }: {
+    author_id?: string,
+    name?: string,
+    license?: string,
+    tags?: Array<string>,
+    commercial?: boolean,
+    from_index?: number,
+    limit?: number,
+  }): Array<DatabaseInfo> {
+    let start = from_index || 0
+    assert(start >= 0, "Negative from index")
+    let count = limit || MAX_PAGE_LIMIT
+    if (count > MAX_PAGE_LIMIT) {
+      count = MAX_PAGE_LIMIT
+    }
+
+    // intersect all secondary indexes used by the filter
+    let candidates: Array<string> | null = null
+    let lists: Array<Array<string>> = new Array()
+    if (author_id) {
+      lists.push(this.idx_author.get(author_id) as Array<string> || [])
+    }
+    if (license) {
+      lists.push(this.idx_license.get(license) as Array<string> || [])
+    }
+    for (let tag of tags || []) {
+      lists.push(this.idx_tag.get(tag.trim().toLowerCase()) as Array<string> || [])
+    }
+    for (let l of lists) {
+      candidates = candidates === null ? l : intersect(candidates, l)
+    }
+    if (candidates === null) {
+      candidates = new Array()
+      for (let i = 0; i < this.next_id; i++) {
+        candidates.push(i.toString())
+      }
+    }
+
+    let needle = (name || '').toLowerCase()
+    let dbs: Array<DatabaseInfo> = new Array()
+    for (let dbid of candidates) {
+      if (!this.db_manifests.get(dbid)) {
+        continue
+      }
+      // indexes also cover pending upgrades, match the active version
+      let manifest = this.internalActiveVersion({ dbid }).manifest
+      if ((author_id && manifest.author_id !== author_id) || (license && manifest.license !== license)) {
+        continue
+      }
+      let manifest_tags = (manifest.tags || []).map(t => t.trim().toLowerCase())
+      if (!(tags || []).every(t => manifest_tags.includes(t.trim().toLowerCase()))) {
+        continue
+      }
+      if (needle.length > 0 && !manifest.name.toLowerCase().includes(needle)) {
+        continue
+      }
+      let terms = new LicenseTerms(manifest)
+      if (commercial && !terms.commercial) {
+        continue
+      }
+      if (start > 0) {
+        start--
+        continue
+      }
+      let owner = this.db_owners.get(dbid) as string
+      let parent = this.db_parents.get(dbid) as ForkLink || undefined
+      let forks = this.idx_fork.get(dbid) as Array<string> || []
+      dbs.push(new DatabaseInfo({ dbid, owner, manifest, terms, parent, forks }))
+      if (dbs.length === count) {
+        break
+      }
     }
     return dbs
   }
@@ -199,8 +927,7 @@ class Db3Contract {
       if (owner !== v as string) {
         continue
       }
-      let m = this.db_manifests.get(k as string)
-      dbs.push(m as Manifest)
+      dbs.push(this.internalActiveVersion({ dbid: k as string }).manifest)
     }
     return dbs
   }
@@ -208,121 +935,974 @@ class Db3Contract {
   @view({})
   manifest({ dbid }: { dbid: string }): Manifest {
     assert(parseInt(dbid) < this.next_id, "Database id does not exist")
-    let m = this.db_manifests.get(dbid) as Manifest
-    return m
+    return this.internalActiveVersion({ dbid }).manifest
   }
 
-  // Views all registered API endpoints for a database
+  // Views the proposed owner of a database
   @view({})
-  discover({ dbid }: { dbid: string }): Array<string> {
+  pending_owner({ dbid }: { dbid: string }): string {
     assert(parseInt(dbid) < this.next_id, "Database id does not exist")
-    let uris: Array<string> = new Array()
-    for (let [k, v] of this.db_api_registry) {
-        let key = k as string
-        if (!key.startsWith(dbid + "#")) {
-          continue
-        }
-        uris.push(v as string)
+    return this.db_pending_owners.get(dbid) as string || ''
+  }
+
+  // Views royalty beneficiaries of a database
+  @view({})
+  royalty_split({ dbid }: { dbid: string }): Array<RoyaltyShare> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let shares = this.db_royalty_splits.get(dbid) as Array<RoyaltyShare>
+    if (shares) {
+      return shares
     }
-    return uris
+    let account_id = this.db_owners.get(dbid) as string
+    return [new RoyaltyShare({ account_id, bips: '10000' })]
   }
 
-  // Views own earnings
+  // Views the ancestors of a database, nearest first
   @view({})
-  earned({owner}: {owner: string}): string {
-    // sum settled caller fees and royalties
-    let earnedFees = BigInt(this.db_settled_fees.get(owner) as string || '0')
-    let earnedRoyalties = BigInt(this.db_settled_royalties.get(owner) as string || '0')
-    let totalEarned = earnedFees + earnedRoyalties
-    return totalEarned.toString()
+  lineage({ dbid }: { dbid: string }): Array<ForkLink> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let links: Array<ForkLink> = new Array()
+    let link = this.db_parents.get(dbid) as ForkLink
+    while (link) {
+      links.push(link)
+      link = this.db_parents.get(link.parent) as ForkLink
+    }
+    return links
   }
 
-  internalSplitFeeOrSlash(
-    { dbid,
-      votes,
-      feeToSplit,
-      royalty_bips
-    } : {
-      dbid: string,
-      votes: Map<string, string>,
-      feeToSplit: bigint,
-      royalty_bips: bigint
-  }) {
-    if (feeToSplit === 0n) {
-      return
+  // Views the access policy of a database
+  @view({})
+  access_policy({ dbid }: { dbid: string }): AccessPolicy {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let policy = this.db_access.get(dbid) as AccessPolicy
+    return policy || new AccessPolicy({ private: false, gate: '', standard: '', min_balance: '0' })
+  }
+
+  // Views the allowlist of a database ordered by account, including
+  // expired grants
+  @view({})
+  allowlist({ dbid }: { dbid: string }): Array<[string, AccessGrant]> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let grants: Array<[string, AccessGrant]> = new Array()
+    for (let [k] of scanmap(this.db_allowlists, makekey(dbid, ''))) {
+      grants.push([splitkey(k)[1], this.db_allowlists.get(k) as AccessGrant])
     }
+    return grants.sort((a, b) => a[0] < b[0] ? -1 : a[0] > b[0] ? 1 : 0)
+  }
 
-    // pay developer royalty
-    if (royalty_bips > 0) {
-        let royaltyToPay = feeToSplit * royalty_bips / 10000n
-        let owner = this.db_owners.get(dbid) as string
-        let newRoyalty = BigInt(this.db_settled_royalties.get(owner) as string || '0')
-        newRoyalty += royaltyToPay
-        this.db_settled_royalties.set(owner, newRoyalty.toString())
-        feeToSplit -= royaltyToPay
+  // Views whether an account may escrow fees for a database, nodes check
+  // this before admitting a query
+  @view({})
+  has_access({ dbid, account_id }: { dbid: string, account_id: string }): boolean {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let policy = this.db_access.get(dbid) as AccessPolicy
+    if (!policy || !policy.private || account_id === this.db_owners.get(dbid)) {
+      return true
     }
+    let grant = this.db_allowlists.get(makekey(dbid, account_id)) as AccessGrant
+    return !!grant && (grant.expires === '0' || BigInt(grant.expires) > near.blockIndex())
+  }
 
-    // check result votes, identify majority and slash offender
-    //
-    // SECURITY NOTE
-    // this mechanism is very simple and prone to sybil attacks, so don't
-    // use it in real life!
-    //
-    let election = new Election({votes})
+  // Views the databases joined by a pending query, empty for queries on a
+  // single database
+  @view({})
+  join_shares({ dbid, qid }: { dbid: string, qid: string }): Array<JoinShare> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    return this.db_joins.get(makekey(dbid, qid)) as Array<JoinShare> || []
+  }
 
-    if (election.isSuperMajority()) {
-      // case 1: all agree on the same result, no slashing, split payout
-      // case 2: a >=2/3 supermajority exists -> slash all minority members
+  // Views the license terms of the active code version of a database
+  @view({})
+  license_terms({ dbid }: { dbid: string }): LicenseTerms {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    return new LicenseTerms(this.internalActiveVersion({ dbid }).manifest)
+  }
+
+  // Views the number of queries an account has paid for on a database with
+  // a usage cap
+  @view({})
+  usage({ dbid, account_id }: { dbid: string, account_id: string }): number {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    return this.db_usage.get(makekey(dbid, account_id)) as number || 0
+  }
+
+  // Views the manifest signing keys of an author
+  @view({})
+  author_keys({ author_id }: { author_id: string }): Array<string> {
+    return this.signing_keys.get(author_id) as Array<string> || []
+  }
+
+  // Views the use a pending query was paid for
+  @view({})
+  query_use({ dbid, qid }: { dbid: string, qid: string }): string {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    return this.db_query_uses.get(makekey(dbid, qid)) as string || USE_COMMERCIAL
+  }
+
+  // Views the outcomes of recently finalized queries of a database, oldest
+  // first. Only the last MAX_OUTCOMES outcomes are kept.
+  @view({})
+  outcomes({ dbid }: { dbid: string }): Array<ElectionOutcome> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    return this.db_outcomes.get(dbid) as Array<ElectionOutcome> || []
+  }
+
+  // Views the outcome of a finalized query, null when it is no longer kept
+  @view({})
+  outcome({ dbid, qid }: { dbid: string, qid: string }): ElectionOutcome {
+    let list = this.outcomes({ dbid })
+    for (let i = list.length - 1; i >= 0; i--) {
+      if (list[i].qid === qid) {
+        return list[i]
+      }
+    }
+    return null
+  }
+
+  // Views the estimated block time in nanoseconds
+  @view({})
+  block_time(): string {
+    let estimate = this.clock === null ? 0n : BigInt(this.clock.block_time)
+    return (estimate > 0n ? estimate : BLOCK_TIME_NS).toString()
+  }
+
+  // Views the TTL height a query expires at when it should be answered
+  // within a duration from now, at least the next block
+  @view({})
+  ttl_within({ within_ms }: { within_ms: string }): string {
+    let within = BigInt(within_ms) * 1_000_000n
+    assert(within > 0n, "TTL in the past")
+    let block_time = BigInt(this.block_time())
+    return (near.blockIndex() + (within + block_time - 1n) / block_time).toString()
+  }
+
+  // Views the lifecycle status of a database
+  @view({})
+  status({ dbid }: { dbid: string }): DatabaseStatus {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let status = this.db_status.get(dbid) as DatabaseStatus
+    if (!status) {
+      return new DatabaseStatus({ status: STATUS_ACTIVE, sunset_height: '0' })
+    }
+    if (status.status === STATUS_DEPRECATED && BigInt(status.sunset_height) <= near.blockIndex()) {
+      return new DatabaseStatus({ status: STATUS_RETIRED, sunset_height: status.sunset_height })
+    }
+    return status
+  }
+
+  // Views all published code versions of a database
+  @view({})
+  versions({ dbid }: { dbid: string }): Array<ManifestVersion> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    return this.db_versions.get(dbid) as Array<ManifestVersion>
+  }
+
+  // Views all registered API endpoints for a database
+  @view({})
+  discover({ dbid }: { dbid: string }): Array<string> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let uris: Array<string> = new Array()
+    for (let [k, v] of this.db_api_registry) {
+        let key = k as string
+        if (!key.startsWith(dbid + "#")) {
+          continue
+        }
+        uris.push(v as string)
+    }
+    return uris
+  }
+
+  // Views the hosts assigned to answer a pending query, an empty list means
+  // any host with a security deposit may answer
+  @view({})
+  committee({ dbid, qid }: { dbid: string, qid: string }): Array<string> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    return this.db_committees.get(makekey(dbid, qid)) as Array<string> || []
+  }
+
+  // Views pending queries a host is assigned to answer, nodes poll this to
+  // learn their assignments
+  @view({})
+  assignments({ dbid, host }: { dbid: string, host: string }): Array<string> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let qids: Array<string> = new Array()
+    for (let [k, v] of this.db_committees) {
+      let [id, qid] = splitkey(k as string)
+      if (id === dbid && (v as Array<string>).includes(host)) {
+        qids.push(qid)
+      }
+    }
+    return qids.sort()
+  }
+
+  // Views open claims against a host, nodes poll this to answer in time
+  @view({})
+  open_claims({ dbid, host }: { dbid: string, host: string }): Array<any> {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let claims: Array<any> = new Array()
+    for (let [k, v] of this.db_claims) {
+      let [id, qid, acc] = splitkey(k as string)
+      if (id === dbid && acc === host) {
+        let claim = v as any
+        claims.push({ qid, host, claimant: claim.claimant, query: claim.query, deadline: claim.deadline })
+      }
+    }
+    return claims.sort((a, b) => a.qid < b.qid ? -1 : a.qid > b.qid ? 1 : 0)
+  }
+
+  // Views own earnings in NEAR or a fungible token
+  @view({})
+  earned({owner, token}: {owner: string, token?: string}): string {
+    // sum settled caller fees and royalties
+    let earnedFees: bigint
+    let earnedRoyalties: bigint
+    if (token) {
+      earnedFees = BigInt(this.token_settled_fees.get(makekey(token, owner)) as string || '0')
+      earnedRoyalties = BigInt(this.token_settled_royalties.get(makekey(token, owner)) as string || '0')
+    } else {
+      earnedFees = BigInt(this.db_settled_fees.get(owner) as string || '0')
+      earnedRoyalties = BigInt(this.db_settled_royalties.get(owner) as string || '0')
+    }
+    let totalEarned = earnedFees + earnedRoyalties
+    return totalEarned.toString()
+  }
+
+  // Views the storage balance of an account, null when not registered
+  @view({})
+  storage_balance_of({ account_id }: { account_id: string }): StorageBalance {
+    return this.storage_balances.get(account_id) as StorageBalance
+  }
+
+  // Views the minimum storage balance, there is no maximum
+  @view({})
+  storage_balance_bounds(): { min: string, max: string | null } {
+    return { min: STORAGE_ENTRY_COST.toString(), max: null }
+  }
+
+  // locks storage balance of an account for new map entries
+  internalChargeStorage({ account_id, entries }: { account_id: string, entries: number }): bigint {
+    let cost = STORAGE_ENTRY_COST * BigInt(entries)
+    let bal = this.storage_balances.get(account_id) as StorageBalance
+    assert(bal !== null && BigInt(bal.available) >= cost, "Insufficient storage balance")
+    this.storage_balances.set(account_id, new StorageBalance({
+      total: bal.total,
+      available: (BigInt(bal.available) - cost).toString(),
+    }))
+    return cost
+  }
+
+  // unlocks storage balance of deleted map entries, entries migrated from
+  // state without storage accounting were never charged so refunds stop at
+  // the cost of the balance record
+  internalRefundStorage({ account_id, cost }: { account_id: string, cost: bigint }) {
+    let bal = this.storage_balances.get(account_id) as StorageBalance
+    if (bal === null) {
+      return
+    }
+    let available = BigInt(bal.available) + cost
+    let max = BigInt(bal.total) - STORAGE_ENTRY_COST
+    if (available > max) {
+      available = max
+    }
+    this.storage_balances.set(account_id, new StorageBalance({ total: bal.total, available: available.toString() }))
+  }
+
+  // locks storage for pending query entries, unlocked when the query is
+  // finalized
+  internalChargeQueryStorage({ dbid, qid, account_id, entries }: { dbid: string, qid: string, account_id: string, entries: number }) {
+    let cost = this.internalChargeStorage({ account_id, entries })
+    let key = makekey(dbid, qid, account_id)
+    let charged = BigInt(this.db_storage_charges.get(key) as string || '0')
+    this.db_storage_charges.set(key, (charged + cost).toString())
+  }
+
+  // unlocks all storage charged for a pending query
+  internalRefundQueryStorage({ dbid, qid }: { dbid: string, qid: string }) {
+    for (let [k, v] of scanmap(this.db_storage_charges, makekey(dbid, qid, ''))) {
+      this.db_storage_charges.remove(k)
+      this.internalRefundStorage({ account_id: splitkey(k)[2], cost: BigInt(v as string) })
+    }
+  }
+
+  // removes a censorship claim and unlocks the claimant's storage
+  internalCloseClaim({ key, claim }: { key: string, claim: any }) {
+    this.db_claims.remove(key)
+    this.internalRefundStorage({ account_id: claim.claimant, cost: STORAGE_ENTRY_COST })
+  }
+
+  // upserts an allowlist entry paid by the caller
+  internalGrantAccess({ dbid, account_id, expires }: { dbid: string, account_id: string, expires: bigint }) {
+    let key = makekey(dbid, account_id)
+    let grant = this.db_allowlists.get(key) as AccessGrant
+    let payer = grant ? grant.payer : near.signerAccountId()
+    if (!grant) {
+      this.internalChargeStorage({ account_id: payer, entries: 1 })
+    }
+    this.db_allowlists.set(key, new AccessGrant({ expires: expires.toString(), payer }))
+    emit("access_granted", { dbid, account_id, expires: expires.toString() })
+  }
+
+  internalCheckDatabaseOwner({ dbid }: { dbid: string }) {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    assert(near.signerAccountId() === this.db_owners.get(dbid), "Must be database owner to change status")
+  }
+
+  internalValidateManifest({ manifest }: { manifest: Manifest }) {
+    let royalty_bips = BigInt(manifest.royalty_bips || '0')
+    assert(royalty_bips >= 0n && royalty_bips <= 10000n, "Royalty basis points out of range [0, 10000]")
+    let fork_royalty_bips = BigInt(manifest.fork_royalty_bips || '0')
+    assert(fork_royalty_bips >= 0n && fork_royalty_bips <= 10000n, "Fork royalty out of range")
+    assert(manifest.code_cid.length > 0, "Empty code CID")
+    let min_quorum = parseInt(manifest.min_quorum || '0')
+    let max_quorum = parseInt(manifest.max_quorum || '0')
+    assert(min_quorum >= 0 && min_quorum <= MAX_QUORUM && max_quorum >= 0 && max_quorum <= MAX_QUORUM, "Quorum out of range")
+    assert(max_quorum === 0 || max_quorum >= min_quorum, "Maximum quorum below minimum")
+    this.internalValidateLicense({ manifest })
+  }
+
+  // checks the SPDX license identifier and terms of a manifest, an empty
+  // license is not asserted
+  internalValidateLicense({ manifest }: { manifest: Manifest }) {
+    let license = manifest.license || ''
+    let spdx = SPDX_LICENSES[license]
+    let ref = license.startsWith(LICENSE_REF_PREFIX) && /^[A-Za-z0-9.\-]+$/.test(license.slice(LICENSE_REF_PREFIX.length))
+    assert(spdx !== undefined || ref || license === '' || license === LICENSE_NONE || license === LICENSE_NOASSERTION, "Unknown SPDX license")
+    let non_commercial_royalty_bips = BigInt(manifest.non_commercial_royalty_bips || '0')
+    assert(non_commercial_royalty_bips >= 0n && non_commercial_royalty_bips <= 10000n, "Non-commercial royalty out of range")
+    let attribution = manifest.attribution || ''
+    assert(!(spdx && spdx.attribution) || attribution.trim().length > 0, "License requires attribution")
+    assert(attribution.length <= MAX_ATTRIBUTION_LEN, "Attribution too long")
+    assert(parseInt(manifest.usage_cap || '0') >= 0, "Usage cap out of range")
+  }
+
+  // checks that signed manifests carry a valid signature by a key the author
+  // registered, unsigned manifests are accepted but nodes refuse to serve them.
+  // The payload does not cover the deploying account, so only the author may
+  // submit a signed manifest.
+  internalCheckAuthor({ manifest }: { manifest: Manifest }) {
+    let key = manifest.author_key || ''
+    let signature = manifest.signature || ''
+    if (key.length === 0 && signature.length === 0) {
+      return
+    }
+    assert(key.length > 0 && signature.length > 0, "Incomplete author signature")
+    assert(near.signerAccountId() === manifest.author_id, "Signed manifests must be submitted by their author")
+    let keys = this.signing_keys.get(manifest.author_id) as Array<string> || []
+    assert(keys.includes(key), "Author key not registered")
+    let valid = /^[0-9a-f]{64}$/.test(key) && /^[0-9a-f]{128}$/.test(signature)
+    assert(valid && verify(fromhex(signature), manifestPayload(manifest), fromhex(key)), "Invalid author signature")
+  }
+
+  // Returns registered hosts with a full security deposit
+  internalCommitteeHosts({ dbid }: { dbid: string }): Array<string> {
+    let hosts: Array<string> = new Array()
+    for (let [k] of this.db_api_registry) {
+      let [id, account_id] = splitkey(k as string)
+      if (id !== dbid) {
+        continue
+      }
+      let deposit = BigInt(this.db_deposits.get(makekey(dbid, account_id)) as string || '0')
+      if (deposit >= SECURITY_DEPOSIT) {
+        hosts.push(account_id)
+      }
+    }
+    return hosts
+  }
+
+  // Returns the votes a query requires, a zero request uses the manifest minimum
+  internalCheckQuorum({ manifest, quorum }: { manifest: Manifest, quorum: number }): number {
+    let min = parseInt(manifest.min_quorum || '0') || 1
+    let max = parseInt(manifest.max_quorum || '0') || MAX_QUORUM
+    if (quorum === 0) {
+      return min
+    }
+    assert(quorum >= min && quorum <= max, "Quorum out of range")
+    return quorum
+  }
+
+  internalActiveVersion({ dbid }: { dbid: string }): ManifestVersion {
+    let height = near.blockIndex()
+    let versions = this.db_versions.get(dbid) as Array<ManifestVersion> || []
+    for (let i = versions.length - 1; i > 0; i--) {
+      if (BigInt(versions[i].activation_height) <= height) {
+        return versions[i]
+      }
+    }
+    if (versions.length === 0) {
+      // state without version history serves the stored manifest
+      let manifest = this.db_manifests.get(dbid) as Manifest
+      return new ManifestVersion({ version: 0, manifest, activation_height: '0' })
+    }
+    return versions[0]
+  }
+
+  internalBindQueryVersion({ dbid, qid }: { dbid: string, qid: string }) {
+    let key = makekey(dbid, qid)
+    if (this.db_query_versions.containsKey(key)) {
+      return
+    }
+    this.db_query_versions.set(key, this.internalActiveVersion({ dbid }).version)
+  }
+
+  internalQueryManifest({ dbid, qid }: { dbid: string, qid: string }): Manifest {
+    let version = this.db_query_versions.get(makekey(dbid, qid))
+    if (version === null) {
+      return this.internalActiveVersion({ dbid }).manifest
+    }
+    let versions = this.db_versions.get(dbid) as Array<ManifestVersion>
+    for (let v of versions) {
+      if (v.version === version) {
+        return v.manifest
+      }
+    }
+    return this.db_manifests.get(dbid) as Manifest
+  }
+
+  // indexes the latest two versions of a database, which are the active
+  // version and an upgrade that may still be pending
+  internalIndexVersions({ dbid, versions }: { dbid: string, versions: Array<ManifestVersion> }) {
+    for (let v of versions.slice(-2)) {
+      this.internalIndexDatabase({ dbid, manifest: v.manifest })
+    }
+  }
+
+  internalUnindexVersions({ dbid, versions }: { dbid: string, versions: Array<ManifestVersion> }) {
+    for (let v of versions.slice(-2)) {
+      this.internalUnindexDatabase({ dbid, manifest: v.manifest })
+    }
+  }
+
+  internalUnindexDatabase({ dbid, manifest }: { dbid: string, manifest: Manifest }) {
+    let pop = (m: LookupMap, key: string) => {
+      let ids = m.get(key) as Array<string> || []
+      m.set(key, ids.filter(v => v !== dbid))
+    }
+    pop(this.idx_author, manifest.author_id)
+    pop(this.idx_license, manifest.license)
+    for (let tag of manifest.tags || []) {
+      pop(this.idx_tag, tag.trim().toLowerCase())
+    }
+  }
+
+  internalIndexDatabase({ dbid, manifest }: { dbid: string, manifest: Manifest }) {
+    let push = (m: LookupMap, key: string) => {
+      let ids = m.get(key) as Array<string> || []
+      if (!ids.includes(dbid)) {
+        ids.push(dbid)
+      }
+      m.set(key, ids)
+    }
+    push(this.idx_author, manifest.author_id)
+    if (manifest.license.length > 0) {
+      push(this.idx_license, manifest.license)
+    }
+    for (let tag of manifest.tags || []) {
+      tag = tag.trim().toLowerCase()
+      if (tag.length > 0) {
+        push(this.idx_tag, tag)
+      }
+    }
+  }
+
+  // accounts a fee paid by payer in NEAR (empty token) or a fungible token
+  internalEscrow(
+    { dbid,
+      qid,
+      ttl,
+      quorum,
+      payer,
+      token,
+      amount,
+      shares,
+      use
+    } : {
+      dbid: string,
+      qid: string,
+      ttl: number,
+      quorum: number,
+      payer: string,
+      token: string,
+      amount: bigint,
+      shares?: Array<JoinShare>,
+      use: string
+  }) {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    this.internalObserveClock()
+    assert(ttl > near.blockIndex(), "TTL in the past")
+
+    // private databases only serve allowlisted users
+    assert(this.has_access({ dbid, account_id: payer }), "Database is private")
+
+    this.internalCheckAccepting({ dbid, ttl })
+
+    // the manifest version the query is bound to bounds its quorum,
+    // later escrows can only raise it
+    let key = makekey(dbid, qid)
+    let manifest = this.internalQueryManifest({ dbid, qid })
+    let required = this.internalCheckQuorum({ manifest, quorum })
+    let current = this.db_quorums.get(key) as number || 0
+    if (required < current) {
+      required = current
+    }
+
+    // fees of a query are split in a single token
+    let escrowed = this.db_pending_fees.get(key) !== null
+    assert(!escrowed || (this.db_fee_tokens.get(key) as string || '') === token, "Fee token mismatch")
+
+    // the license must permit the declared use and new payers count
+    // against its usage cap
+    let paykey = makekey(dbid, qid, payer)
+    let usekey = makekey(dbid, payer)
+    let usage = this.db_usage.get(usekey) as number || 0
+    let counted = this.internalCheckUse({ manifest, key, use, escrowed, paid: this.db_payments.get(paykey) !== null, usage })
+
+    // later escrows may omit the join but not change it
+    let joined = this.db_joins.get(key) as Array<JoinShare>
+    let join = !escrowed && !!shares
+    if (!shares) {
+      shares = joined
+    } else if (escrowed) {
+      assert(JSON.stringify(joined) === JSON.stringify(shares.map(v => new JoinShare({ dbid: String(v.dbid), bips: String(v.bips) }))), "Join mismatch")
+    } else {
+      shares = this.internalCheckJoin({ dbid, ttl, payer, shares, use })
+    }
+
+    // draw a committee on first escrow, without registered hosts the query
+    // stays open to all hosts with a security deposit
+    let committee = this.db_committees.get(key) as Array<string>
+    let assign = committee === null && !escrowed
+    if (assign) {
+      let size = Math.max(COMMITTEE_SIZE, required)
+      let hosts = this.internalCommitteeHosts({ dbid })
+      if (shares) {
+        hosts = hosts.filter(host => this.internalJoinEligible({ shares, host }))
+      }
+      committee = selectCommittee(near.randomSeed(), dbid, qid, hosts, size)
+    }
+    committee = committee || []
+    assert(committee.length === 0 || required <= committee.length, "Quorum exceeds committee size")
+
+    // charge storage for new pending query entries
+    let entries = 0
+    if (!escrowed) {
+      entries += 2
+      if (token.length > 0) {
+        entries++
+      }
+      if (use !== USE_COMMERCIAL) {
+        entries++
+      }
+    }
+    if (this.db_payments.get(paykey) === null) {
+      entries++
+    }
+    if (assign && committee.length > 0) {
+      entries++
+    }
+    if (join) {
+      entries++
+    }
+    if (entries > 0) {
+      this.internalChargeQueryStorage({ dbid, qid, account_id: payer, entries })
+    }
+
+    // add fees paid to current fees for this CID (multiple calls may run in parallel)
+    if (!escrowed && token.length > 0) {
+      this.db_fee_tokens.set(key, token)
+    }
+    if (!escrowed && use !== USE_COMMERCIAL) {
+      this.db_query_uses.set(key, use)
+    }
+    if (counted) {
+      // the first count locks storage for the counter which is never released
+      if (this.db_usage.get(usekey) === null) {
+        this.internalChargeStorage({ account_id: payer, entries: 1 })
+      }
+      this.db_usage.set(usekey, usage + 1)
+    }
+    let newFee = BigInt(this.db_pending_fees.get(key) as string || '0') + amount
+    this.db_pending_fees.set(key, newFee.toString())
+    this.db_quorums.set(key, required)
+
+    // track payments per payer for refunds
+    let newPayment = BigInt(this.db_payments.get(paykey) as string || '0') + amount
+    this.db_payments.set(paykey, newPayment.toString())
+
+    // store TTL unconditionally (this may override a TTL set via Settle,
+    // but this case is expected)
+    this.db_ttls.set(key, ttl)
+
+    // bind the query to the currently active code version
+    this.internalBindQueryVersion({ dbid, qid })
+    emit("fee_escrowed", {
+      dbid,
+      qid,
+      payer,
+      amount: amount.toString(),
+      token: token || undefined,
+      ttl: ttl.toString(),
+      quorum: required,
+      non_commercial: use === USE_NON_COMMERCIAL || undefined,
+    })
+    if (join) {
+      this.db_joins.set(key, shares)
+      for (let share of shares) {
+        emit("query_joined", { dbid, qid, joined: share.dbid, bips: parseInt(share.bips) })
+      }
+    }
+    if (assign && committee.length > 0) {
+      this.db_committees.set(key, committee)
+      emit("committee_assigned", { dbid, qid, seed: tohex(near.randomSeed()), members: committee })
+    }
+  }
+
+  // paused and retired databases reject new queries, deprecated databases
+  // accept queries that settle before sunset
+  internalCheckAccepting({ dbid, ttl }: { dbid: string, ttl: number }) {
+    let status = this.status({ dbid })
+    if (status.status === STATUS_DEPRECATED) {
+      assert(BigInt(ttl) < BigInt(status.sunset_height), "Fee TTL exceeds database sunset")
+    } else {
+      assert(status.status === STATUS_ACTIVE, "Database is not accepting queries")
+    }
+  }
+
+  // validates the databases of a new cross-database query and returns the
+  // shares in storage form, the query database itself is checked by escrow
+  internalCheckJoin({ dbid, ttl, payer, shares, use }: { dbid: string, ttl: number, payer: string, shares: Array<JoinShare>, use: string }): Array<JoinShare> {
+    assert(shares.length >= 2 && shares.length <= MAX_JOIN_DATABASES, "Invalid number of joined databases")
+    let res: Array<JoinShare> = new Array()
+    let seen: Set<string> = new Set()
+    let sum = 0n
+    for (let share of shares) {
+      let id = String(share.dbid)
+      let bips = BigInt(share.bips)
+      if (res.length === 0) {
+        assert(id === dbid, "Join must start with the query database")
+      }
+      assert(parseInt(id) < this.next_id, "Database id does not exist")
+      assert(!seen.has(id), "Duplicate joined database")
+      assert(bips > 0n && bips <= 10000n, "Join share out of range")
+      seen.add(id)
+      sum += bips
+      res.push(new JoinShare({ dbid: id, bips: bips.toString() }))
+      if (id === dbid) {
+        continue
+      }
+      assert(this.has_access({ dbid: id, account_id: payer }), "Database is private")
+      assert(use !== USE_COMMERCIAL || this.license_terms({ dbid: id }).commercial, "License forbids commercial use")
+      this.internalCheckAccepting({ dbid: id, ttl })
+    }
+    assert(sum === 10000n, "Join shares must add up to 10000 bips")
+    return res
+  }
+
+  // rejects queries the license of their code version does not permit and
+  // returns whether the payer is counted against the usage cap
+  internalCheckUse({ manifest, key, use, escrowed, paid, usage }: { manifest: Manifest, key: string, use: string, escrowed: boolean, paid: boolean, usage: number }): boolean {
+    assert(use === USE_COMMERCIAL || use === USE_NON_COMMERCIAL, "Invalid query use")
+    assert(use !== USE_COMMERCIAL || new LicenseTerms(manifest).commercial, "License forbids commercial use")
+    assert(!escrowed || (this.db_query_uses.get(key) as string || USE_COMMERCIAL) === use, "Query use mismatch")
+    let cap = parseInt(manifest.usage_cap || '0')
+    if (paid || cap === 0) {
+      return false
+    }
+    assert(usage < cap, "Usage cap reached")
+    return true
+  }
+
+  // reports whether a host is registered with a full security deposit on
+  // every joined database
+  internalJoinEligible({ shares, host }: { shares: Array<JoinShare>, host: string }): boolean {
+    return shares.every(share => {
+      let key = makekey(share.dbid, host)
+      return BigInt(this.db_deposits.get(key) as string || '0') >= SECURITY_DEPOSIT && this.db_api_registry.get(key) !== null
+    })
+  }
+
+  // splits the royalty of a query across its joined databases, the query
+  // database receives the rounding remainder
+  internalJoinRoyalties({ dbid, qid, token, amount }: { dbid: string, qid: string, token: string, amount: bigint }): Array<[string, bigint]> {
+    let shares = this.db_joins.get(makekey(dbid, qid)) as Array<JoinShare>
+    if (shares === null) {
+      return [[dbid, amount]]
+    }
+    let hops: Array<[string, bigint]> = shares.map(share => [share.dbid, amount * BigInt(share.bips) / 10000n])
+    hops[0][1] = amount - hops.slice(1).reduce((sum, hop) => sum + hop[1], 0n)
+    for (let [joined, share] of hops) {
+      emit("royalty_joined", { dbid, joined, qid, amount: share.toString(), token: token || undefined })
+    }
+    return hops
+  }
+
+  // Credits unanswered query fees back to their payers as claimable fees,
+  // fees without payment records are collected as dust
+  internalRefundFee({ dbid, qid, token, payments, feeToSplit, out }: { dbid: string, qid: string, token: string, payments: Map<string, string>, feeToSplit: bigint, out: ElectionOutcome }) {
+    for (let [k, v] of [...payments].sort(bykey)) {
+      let account_id = splitkey(k)[2]
+      let amount = BigInt(v)
+      this.internalCreditFee({ token, account_id, amount })
+      feeToSplit -= amount
+      out.refunds.push(new Payout({ account_id, amount: amount.toString() }))
+      emit("fee_refunded", { dbid, qid, account_id, amount: amount.toString(), token: token || undefined })
+    }
+    this.internalCollectDust({ dbid, qid, token, amount: feeToSplit, out })
+  }
+
+  // credits a claimable fee in NEAR (empty token) or a fungible token
+  internalCreditFee({ token, account_id, amount }: { token: string, account_id: string, amount: bigint }) {
+    if (amount === 0n) {
+      return
+    }
+    let m = token ? this.token_settled_fees : this.db_settled_fees
+    let key = token ? makekey(token, account_id) : account_id
+    let newFee = BigInt(m.get(key) as string || '0') + amount
+    m.set(key, newFee.toString())
+  }
+
+  // credits a claimable royalty in NEAR (empty token) or a fungible token
+  internalCreditRoyalty({ token, account_id, amount }: { token: string, account_id: string, amount: bigint }) {
+    if (amount === 0n) {
+      return
+    }
+    let m = token ? this.token_settled_royalties : this.db_settled_royalties
+    let key = token ? makekey(token, account_id) : account_id
+    let newRoyalty = BigInt(m.get(key) as string || '0') + amount
+    m.set(key, newRoyalty.toString())
+  }
+
+  // ensures the caller paid a fee for a pending query
+  internalCheckPayer({ dbid, qid }: { dbid: string, qid: string }) {
+    assert(parseInt(dbid) < this.next_id, "Database id does not exist")
+    let ttl = this.db_ttls.get(makekey(dbid, qid))
+    assert(ttl !== null && BigInt(ttl as string) > near.blockIndex(), "Query is not pending")
+    let payment = this.db_payments.get(makekey(dbid, qid, near.signerAccountId()))
+    assert(payment !== null, "Caller did not pay for query")
+  }
+
+  // reports whether a host must still answer claims
+  internalHasOpenClaims({ dbid, host }: { dbid: string, host: string }): boolean {
+    for (let [k] of this.db_claims) {
+      let [id, , acc] = splitkey(k as string)
+      if (id === dbid && acc === host) {
+        return true
+      }
+    }
+    return false
+  }
+
+  // slashes hosts that let claims expire. The slash goes to the treasury in
+  // full, claimants and finalizers earn nothing so that filing claims against
+  // honest hosts does not pay.
+  internalFinalizeClaims() {
+    let height = near.blockIndex()
+    let expired: Array<[string, any]> = new Array()
+    for (let [k, v] of this.db_claims) {
+      if (BigInt((v as any).deadline) <= height) {
+        expired.push([k as string, v])
+      }
+    }
+    for (let [k, claim] of expired) {
+      let [dbid, qid, host] = splitkey(k)
+      this.internalCloseClaim({ key: k, claim })
+      let key = makekey(dbid, host)
+      let deposit = BigInt(this.db_deposits.get(key) as string || '0')
+      let amountToSlash = deposit * SLASHED_DEPOSIT_BIPS / 10000n
+      this.db_deposits.set(key, (deposit - amountToSlash).toString())
+      this.internalSlashHost({ dbid, qid, account_id: host, amount: amountToSlash, majority: [], finalizer: '' })
+    }
+  }
+
+  // shares a slashed deposit with majority accounts and the finalizer, the
+  // rest goes to treasury, an empty majority or finalizer forfeits its share
+  internalSlashHost({ dbid, qid, account_id, amount, majority, finalizer, out }: { dbid: string, qid: string, account_id: string, amount: bigint, majority: Array<string>, finalizer: string, out?: ElectionOutcome }) {
+    let majorityShare = 0n
+    if (out) {
+      out.slashes.push(new Payout({ account_id, amount: amount.toString() }))
+    }
+    for (let winner of majority) {
+      let hostShare = amount * SLASH_MAJORITY_BIPS / 10000n / BigInt(majority.length)
+      this.internalCreditSlashReward({ dbid, qid, account_id: winner, amount: hostShare, out })
+      majorityShare += hostShare
+    }
+    let finalizerShare = finalizer ? amount * SLASH_FINALIZER_BIPS / 10000n : 0n
+    if (finalizerShare > 0n) {
+      this.internalCreditSlashReward({ dbid, qid, account_id: finalizer, amount: finalizerShare, out })
+    }
+    let treasuryShare = amount - majorityShare - finalizerShare
+
+    // add to slashed
+    this.db_slashed = (BigInt(this.db_slashed) + treasuryShare).toString()
+    emit("host_slashed", {
+      dbid,
+      qid,
+      account_id,
+      amount: amount.toString(),
+      finalizer_id: finalizer || undefined,
+      majority_share: majorityShare.toString(),
+      finalizer_share: finalizerShare.toString(),
+      treasury_share: treasuryShare.toString(),
+    })
+  }
+
+  // Credits a share of a slashed deposit as claimable fee
+  internalCreditSlashReward({ dbid, qid, account_id, amount, out }: { dbid: string, qid: string, account_id: string, amount: bigint, out?: ElectionOutcome }) {
+    let newFee = BigInt(this.db_settled_fees.get(account_id) as string || '0')
+    newFee += amount
+    this.db_settled_fees.set(account_id, newFee.toString())
+    if (out && amount > 0n) {
+      // rewards of the same account are summed
+      let reward = out.rewards.find((r) => r.account_id === account_id)
+      if (reward) {
+        reward.amount = (BigInt(reward.amount) + amount).toString()
+      } else {
+        out.rewards.push(new Payout({ account_id, amount: amount.toString() }))
+      }
+    }
+    emit("slash_reward", { dbid, qid, account_id, amount: amount.toString() })
+  }
+
+  internalSplitFeeOrSlash(
+    { dbid,
+      qid,
+      token,
+      election,
+      feeToSplit,
+      royalty_bips,
+      out
+    } : {
+      dbid: string,
+      qid: string,
+      token: string,
+      election: Election,
+      feeToSplit: bigint,
+      royalty_bips: bigint,
+      out: ElectionOutcome
+  }) {
+    if (feeToSplit === 0n) {
+      return
+    }
+
+    // pay developer royalty
+    if (royalty_bips > 0) {
+        let royaltyToPay = feeToSplit * royalty_bips / 10000n
+        out.royalty = royaltyToPay.toString()
+        let royaltyDust = royaltyToPay
+        for (let [joined, joinAmount] of this.internalJoinRoyalties({ dbid, qid, token, amount: royaltyToPay })) {
+          for (let [hop, amount] of this.internalRouteRoyalty({ dbid: joined, qid, token, amount: joinAmount })) {
+            for (let share of this.royalty_split({ dbid: hop })) {
+              let shareToPay = amount * BigInt(share.bips) / 10000n
+              this.internalCreditRoyalty({ token, account_id: share.account_id, amount: shareToPay })
+              royaltyDust -= shareToPay
+              emit("royalty_paid", { dbid: hop, qid, account_id: share.account_id, amount: shareToPay.toString(), token: token || undefined })
+            }
+          }
+        }
+        feeToSplit -= royaltyToPay
+
+        // send any dust to slashed
+        this.internalCollectDust({ dbid, qid, token, amount: royaltyDust, out })
+    }
+
+    // check result votes, identify majority and slash offender
+    //
+    // SECURITY NOTE
+    // this mechanism is very simple and prone to sybil attacks, so don't
+    // use it in real life!
+    //
+    if (election.isSuperMajority()) {
+      // case 1: all agree on the same result, no slashing, split payout
+      // case 2: a >=2/3 supermajority exists -> slash all minority members
+      this.internalDecide({ out, status: election.isUnanimous() ? OUTCOME_UNANIMOUS : OUTCOME_SUPERMAJORITY, election })
       let winners = election.superMajority()
       let feeShare = 10000n / BigInt(winners.length)
       let feeToShare = feeToSplit * feeShare / 10000n
 
       // share fee between all winners
       for (let vote of winners) {
-          let newFee = BigInt(this.db_settled_fees.get(vote.account_id) as string || '0')
-          newFee += feeToShare
-          this.db_settled_fees.set(vote.account_id, newFee.toString())
+          this.internalCreditFee({ token, account_id: vote.account_id, amount: feeToShare })
           feeToSplit -= feeToShare
+          out.fee_shares.push(new Payout({ account_id: vote.account_id, amount: feeToShare.toString() }))
+          emit("fee_paid", { dbid, qid, account_id: vote.account_id, amount: feeToShare.toString(), token: token || undefined })
       }
 
       // send any dust to slashed
-      let slashed = BigInt(this.db_slashed) + feeToSplit
+      this.internalCollectDust({ dbid, qid, token, amount: feeToSplit, out })
 
-      // slash minority
+      // slash minority and reward majority and finalizer
       let offenders = election.minority()
-      if (offenders.length > 0) {
-        for (let vote of offenders) {
-            // calculate how much deposit to slash
-            let key = makekey(dbid, vote.account_id)
-            let deposit = BigInt(this.db_deposits.get(key) as string || '0')
-            let amountToSlash = deposit * 10000n / SLASHED_DEPOSIT_BIPS
-
-            // add to slashed
-            slashed += amountToSlash
-
-            // sub from deposit
-            deposit -= amountToSlash
-            this.db_deposits.set(key, deposit.toString())
-        }
-      }
+      let majority = winners.map((vote) => vote.account_id)
 
-      // store final slashed value
-      this.db_slashed = slashed.toString()
+      // a finalizer in the minority earns no reward
+      let finalizer = near.signerAccountId()
+      if (offenders.some((vote) => vote.account_id === finalizer)) {
+        finalizer = ''
+      }
+      for (let vote of offenders) {
+          // calculate how much deposit to slash
+          let key = makekey(dbid, vote.account_id)
+          let deposit = BigInt(this.db_deposits.get(key) as string || '0')
+          let amountToSlash = deposit * SLASHED_DEPOSIT_BIPS / 10000n
 
+          // sub from deposit
+          deposit -= amountToSlash
+          this.db_deposits.set(key, deposit.toString())
+          this.internalSlashHost({ dbid, qid, account_id: vote.account_id, amount: amountToSlash, majority, finalizer, out })
+      }
     } else {
       // case 3: no supermajority exists -> send all fees to slashed pool
       // this case also applies when no result was published but the fee
       // payment was received for some reason
-      let slashed = BigInt(this.db_slashed) + feeToSplit
-      this.db_slashed = slashed.toString()
+      this.internalDecide({ out, status: OUTCOME_NO_MAJORITY, election })
+      this.internalCollectDust({ dbid, qid, token, amount: feeToSplit, out })
     }
   }
 
+  // splits a royalty along the fork chain of a database, each fork keeps its
+  // royalty minus the share it owes its parent and the parent treats the
+  // received share like its own royalty
+  internalRouteRoyalty({ dbid, qid, token, amount }: { dbid: string, qid: string, token: string, amount: bigint }): Array<[string, bigint]> {
+    let hops: Array<[string, bigint]> = new Array()
+    let link = this.db_parents.get(dbid) as ForkLink
+    while (link) {
+      let upstream = amount * BigInt(link.royalty_bips) / 10000n
+      if (upstream === 0n) {
+        break
+      }
+      hops.push([dbid, amount - upstream])
+      emit("royalty_routed", { dbid, parent: link.parent, qid, amount: upstream.toString(), token: token || undefined })
+      dbid = link.parent
+      amount = upstream
+      link = this.db_parents.get(dbid) as ForkLink
+    }
+    hops.push([dbid, amount])
+    return hops
+  }
+
+  // sends unpaid fee remainders to the slashed pool of their token
+  internalCollectDust({ dbid, qid, token, amount, out }: { dbid: string, qid: string, token: string, amount: bigint, out?: ElectionOutcome }) {
+    if (amount === 0n) {
+      return
+    }
+    if (out) {
+      out.dust = (BigInt(out.dust) + amount).toString()
+    }
+    if (token) {
+      let slashed = BigInt(this.token_slashed.get(token) as string || '0') + amount
+      this.token_slashed.set(token, slashed.toString())
+    } else {
+      this.db_slashed = (BigInt(this.db_slashed) + amount).toString()
+    }
+    emit("dust_collected", { dbid, qid, account_id: '', amount: amount.toString(), token: token || undefined })
+  }
+
   internalFinalizeResults() {
     // - find all expired queries
     // - check voting results
     // - split fees
     // - slash offenders
+    // - slash hosts that did not answer claims
+    this.internalFinalizeClaims()
     let height = near.blockIndex()
 
     let expired: Map<string, Map<string, string>> = new Map()
@@ -345,25 +1925,146 @@ class Db3Contract {
       let [dbid, qid] = splitkey(k as string)
       let votes = v as Map<string, string>
 
-      let manifest = this.db_manifests.get(dbid) as Manifest
-      let royalty_bips = BigInt(manifest.royalty_bips)
+      // results are judged against the code version the query was bound to
+      let manifest = this.internalQueryManifest({ dbid, qid })
+      let non_commercial = this.db_query_uses.get(k) === USE_NON_COMMERCIAL
+      let royalty_bips = BigInt((non_commercial ? manifest.non_commercial_royalty_bips : manifest.royalty_bips) || '0')
+
+      let quorum = this.db_quorums.get(k) as number || this.internalCheckQuorum({ manifest, quorum: 0 })
 
       // fetch fee paid for this query; this assumes the fee payment transaction
       // was actually sent before TTL expired
       let fee = this.db_pending_fees.get(k)
       let feeToSplit = BigInt(fee as string || '0')
+      let token = this.db_fee_tokens.get(k) as string || ''
+      let payments = scanmap(this.db_payments, makekey(dbid, qid, ''))
 
-      // check result votes, pay fees and optionally slash offenders
-      this.internalSplitFeeOrSlash({ dbid, votes, feeToSplit, royalty_bips })
+      // only committee votes count when the query has a committee
+      let committee = this.db_committees.get(k) as Array<string>
+      let counted = votes
+      if (committee !== null) {
+        counted = new Map([...votes].filter(([vk]) => committee.includes(splitkey(vk)[2])))
+      }
+
+      // hosts that left a joined database forfeit their vote
+      let shares = this.db_joins.get(k) as Array<JoinShare>
+      if (shares !== null) {
+        counted = new Map([...counted].filter(([vk]) => this.internalJoinEligible({ shares, host: splitkey(vk)[2] })))
+      }
+
+      // count votes in account order so payouts are reproducible
+      counted = new Map([...counted].sort(bykey))
+      let election = new Election({ votes: counted })
+
+      // keep an audit record of votes and payouts
+      let version = this.db_query_versions.get(k) as number || 0
+      let out = new ElectionOutcome({ qid, height: height.toString(), version, token, fee: feeToSplit.toString(), quorum })
+      out.ignored = [...votes.keys()].filter((vk) => !counted.has(vk)).map((vk) => splitkey(vk)[2]).sort()
+      if (feeToSplit === 0n) {
+        this.internalDecide({ out, status: OUTCOME_UNPAID, election })
+      }
+
+      if (feeToSplit > 0n && counted.size < quorum) {
+        // too few hosts answered, refund payers without royalty or slashing
+        this.internalDecide({ out, status: OUTCOME_REFUNDED, election })
+        this.internalRefundFee({ dbid, qid, token, payments, feeToSplit, out })
+      } else {
+        // check result votes, pay fees and optionally slash offenders
+        this.internalSplitFeeOrSlash({ dbid, qid, token, election, feeToSplit, royalty_bips, out })
+      }
+      this.internalRecordOutcome({ dbid, out })
 
       // clean up maps
       this.db_pending_fees.remove(k)
       this.db_ttls.remove(k)
+      this.db_query_versions.remove(k)
+      this.db_quorums.remove(k)
+      this.db_committees.remove(k)
+      this.db_fee_tokens.remove(k)
+      this.db_joins.remove(k)
+      this.db_query_uses.remove(k)
       for ( [k] of votes ) {
         this.db_pending_votes.remove(k)
       }
+      for ( [k] of payments ) {
+        this.db_payments.remove(k)
+      }
+      for ( [k] of scanmap(this.db_receipts, makekey(dbid, qid, '')) ) {
+        this.db_receipts.remove(k)
+      }
+      this.internalRefundQueryStorage({ dbid, qid })
     }
   }
 
-}
+  // converts a TTL duration to a height when no TTL height is given
+  internalTtl({ ttl, within_ms }: { ttl: number, within_ms: string }): number {
+    if (ttl > 0 || BigInt(within_ms) <= 0n) {
+      return ttl
+    }
+    this.internalObserveClock()
+    return Number(this.ttl_within({ within_ms }))
+  }
+
+  // samples the block timestamp, the first call anchors the clock and later
+  // calls sample once a window has passed
+  internalObserveClock() {
+    let height = near.blockIndex()
+    let timestamp = near.blockTimestamp()
+    let c = this.clock
+    if (c === null || height < BigInt(c.height) || timestamp < BigInt(c.timestamp)) {
+      let block_time = c === null ? '0' : c.block_time
+      this.clock = new BlockClock({ height: height.toString(), timestamp: timestamp.toString(), block_time })
+      return
+    }
+    let blocks = height - BigInt(c.height)
+    if (blocks < CLOCK_WINDOW_BLOCKS) {
+      return
+    }
+    let sample = (timestamp - BigInt(c.timestamp)) / blocks
+    let old = BigInt(c.block_time)
+    let block_time = old === 0n ? sample : (3n * old + sample) / 4n
+    this.clock = new BlockClock({ height: height.toString(), timestamp: timestamp.toString(), block_time: block_time.toString() })
+  }
+
+  // migrates state from one schema version to the next
+  internalMigrate({ from }: { from: number }) {
+    switch (from) {
+      case 1:
+        // the first release stored neither manifest versions, discovery
+        // indexes nor storage deposits, deploy required the storage cost
+        for (let i = 0; i < this.next_id; i++) {
+          let dbid = i.toString()
+          let manifest = this.db_manifests.get(dbid) as Manifest
+          this.db_versions.set(dbid, [new ManifestVersion({ version: 0, manifest, activation_height: '0' })])
+          this.db_storage_deposits.set(dbid, STORAGE_COST.toString())
+          this.db_storage_payers.set(dbid, this.db_owners.get(dbid) as string)
+          this.internalIndexDatabase({ dbid, manifest })
+        }
+        break
+      default:
+        assert(false, `Missing migration from state version ${from}`)
+    }
+  }
+
+  // records the election result, majority and minority are only set when
+  // the election decided the payout
+  internalDecide({ out, status, election }: { out: ElectionOutcome, status: string, election: Election }) {
+    out.status = status
+    out.tallies = election.tallies()
+    if (status !== OUTCOME_UNANIMOUS && status !== OUTCOME_SUPERMAJORITY) {
+      return
+    }
+    out.winner = election.winner()
+    out.majority = election.superMajority().map((v) => v.account_id)
+    out.minority = election.minority().map((v) => v.account_id)
+  }
 
+  // appends an outcome to the history of a database and drops the oldest
+  // outcomes beyond MAX_OUTCOMES
+  internalRecordOutcome({ dbid, out }: { dbid: string, out: ElectionOutcome }) {
+    let list = this.db_outcomes.get(dbid) as Array<ElectionOutcome> || []
+    list.push(out)
+    this.db_outcomes.set(dbid, list.slice(-MAX_OUTCOMES))
+  }
+
+}
@@ -0,0 +1,231 @@
+// ed25519 signature verification (RFC 8032) for author signatures.
+// near-sdk-js has no ed25519 host function, so points and SHA-512 are
+// computed with BigInt. Byte arrays are strings of char codes like the
+// values near-sdk-js returns.
+
+const P = 2n ** 255n - 19n
+const L = 2n ** 252n + 27742317777372353535851937790883648493n
+const D = 37095705934669439343138083508754565189542113879843219016388785533085940283555n
+const SQRT_M1 = 19681161376707505956807079304988542015446066515923890162744021073123829784752n
+const BASE: Point = [
+  15112221349535400772501151409588531511454012693041857206046113283949847762202n,
+  46316835694926478169428394003475163141307993866256225615783033603165251855960n,
+  1n,
+  46827403850823179245072216630277197565144205554125654976674165829533817101731n,
+]
+
+// point in extended coordinates (X, Y, Z, T) with x = X/Z, y = Y/Z, xy = T/Z
+type Point = [bigint, bigint, bigint, bigint]
+
+const ZERO: Point = [0n, 1n, 1n, 0n]
+
+// verify checks an ed25519 signature of msg, pubkey and signature are the
+// raw 32 and 64 byte strings
+export function verify(signature: string, msg: string, pubkey: string): boolean {
+  if (signature.length !== 64 || pubkey.length !== 32) {
+    return false
+  }
+  let A = decodePoint(pubkey)
+  let R = signature.slice(0, 32)
+  let S = decodeLE(signature.slice(32))
+  if (A === null || S >= L) {
+    return false
+  }
+  let k = decodeLE(sha512(R + pubkey + msg)) % L
+
+  // R == [S]B - [k]A, both scalars are walked in one double-and-add pass
+  let negA: Point = [mod(-A[0]), A[1], A[2], mod(-A[3])]
+  let both = add(BASE, negA)
+  let Q = ZERO
+  for (let i = 255n; i >= 0n; i--) {
+    Q = double(Q)
+    let s = (S >> i) & 1n
+    let t = (k >> i) & 1n
+    if (s && t) {
+      Q = add(Q, both)
+    } else if (s) {
+      Q = add(Q, BASE)
+    } else if (t) {
+      Q = add(Q, negA)
+    }
+  }
+  return encodePoint(Q) === R
+}
+
+function mod(a: bigint): bigint {
+  let r = a % P
+  return r < 0n ? r + P : r
+}
+
+function pow(b: bigint, e: bigint): bigint {
+  let r = 1n
+  b = mod(b)
+  while (e > 0n) {
+    if (e & 1n) {
+      r = r * b % P
+    }
+    b = b * b % P
+    e >>= 1n
+  }
+  return r
+}
+
+function add(p: Point, q: Point): Point {
+  let a = mod((p[1] - p[0]) * (q[1] - q[0]))
+  let b = mod((p[1] + p[0]) * (q[1] + q[0]))
+  let c = mod(2n * D * p[3] % P * q[3])
+  let d = mod(2n * p[2] * q[2])
+  let e = b - a
+  let f = d - c
+  let g = d + c
+  let h = b + a
+  return [mod(e * f), mod(g * h), mod(f * g), mod(e * h)]
+}
+
+function double(p: Point): Point {
+  let a = p[0] * p[0] % P
+  let b = p[1] * p[1] % P
+  let c = 2n * p[2] * p[2] % P
+  let h = a + b
+  let e = h - mod((p[0] + p[1]) * (p[0] + p[1]))
+  let g = a - b
+  let f = c + g
+  return [mod(e * f), mod(g * h), mod(f * g), mod(e * h)]
+}
+
+function decodeLE(s: string): bigint {
+  let n = 0n
+  for (let i = s.length - 1; i >= 0; i--) {
+    n = (n << 8n) | BigInt(s.charCodeAt(i))
+  }
+  return n
+}
+
+function encodeLE(n: bigint, size: number): string {
+  let s = ''
+  for (let i = 0; i < size; i++) {
+    s += String.fromCharCode(Number(n & 0xffn))
+    n >>= 8n
+  }
+  return s
+}
+
+// decodePoint recovers x from y and its sign bit, it returns null for
+// encodings that are not on the curve
+function decodePoint(s: string): Point | null {
+  let y = decodeLE(s)
+  let sign = y >> 255n
+  y &= (1n << 255n) - 1n
+  if (y >= P) {
+    return null
+  }
+  let y2 = y * y % P
+  let u = mod(y2 - 1n)
+  let v = mod(D * y2 + 1n)
+  let v3 = v * v % P * v % P
+  let x = u * v3 % P * pow(u * v3 % P * v3 % P * v, (P - 5n) / 8n) % P
+  let vx2 = v * x % P * x % P
+  if (vx2 === mod(-u)) {
+    x = x * SQRT_M1 % P
+  } else if (vx2 !== u) {
+    return null
+  }
+  if (x === 0n && sign === 1n) {
+    return null
+  }
+  if ((x & 1n) !== sign) {
+    x = P - x
+  }
+  return [x, y, 1n, x * y % P]
+}
+
+function encodePoint(p: Point): string {
+  let zinv = pow(p[2], P - 2n)
+  let x = p[0] * zinv % P
+  let y = p[1] * zinv % P
+  return encodeLE(y | ((x & 1n) << 255n), 32)
+}
+
+const MASK = (1n << 64n) - 1n
+
+const H0 = [
+  0x6a09e667f3bcc908n, 0xbb67ae8584caa73bn, 0x3c6ef372fe94f82bn, 0xa54ff53a5f1d36f1n,
+  0x510e527fade682d1n, 0x9b05688c2b3e6c1fn, 0x1f83d9abfb41bd6bn, 0x5be0cd19137e2179n,
+]
+
+const K = [
+  0x428a2f98d728ae22n, 0x7137449123ef65cdn, 0xb5c0fbcfec4d3b2fn, 0xe9b5dba58189dbbcn,
+  0x3956c25bf348b538n, 0x59f111f1b605d019n, 0x923f82a4af194f9bn, 0xab1c5ed5da6d8118n,
+  0xd807aa98a3030242n, 0x12835b0145706fben, 0x243185be4ee4b28cn, 0x550c7dc3d5ffb4e2n,
+  0x72be5d74f27b896fn, 0x80deb1fe3b1696b1n, 0x9bdc06a725c71235n, 0xc19bf174cf692694n,
+  0xe49b69c19ef14ad2n, 0xefbe4786384f25e3n, 0x0fc19dc68b8cd5b5n, 0x240ca1cc77ac9c65n,
+  0x2de92c6f592b0275n, 0x4a7484aa6ea6e483n, 0x5cb0a9dcbd41fbd4n, 0x76f988da831153b5n,
+  0x983e5152ee66dfabn, 0xa831c66d2db43210n, 0xb00327c898fb213fn, 0xbf597fc7beef0ee4n,
+  0xc6e00bf33da88fc2n, 0xd5a79147930aa725n, 0x06ca6351e003826fn, 0x142929670a0e6e70n,
+  0x27b70a8546d22ffcn, 0x2e1b21385c26c926n, 0x4d2c6dfc5ac42aedn, 0x53380d139d95b3dfn,
+  0x650a73548baf63den, 0x766a0abb3c77b2a8n, 0x81c2c92e47edaee6n, 0x92722c851482353bn,
+  0xa2bfe8a14cf10364n, 0xa81a664bbc423001n, 0xc24b8b70d0f89791n, 0xc76c51a30654be30n,
+  0xd192e819d6ef5218n, 0xd69906245565a910n, 0xf40e35855771202an, 0x106aa07032bbd1b8n,
+  0x19a4c116b8d2d0c8n, 0x1e376c085141ab53n, 0x2748774cdf8eeb99n, 0x34b0bcb5e19b48a8n,
+  0x391c0cb3c5c95a63n, 0x4ed8aa4ae3418acbn, 0x5b9cca4f7763e373n, 0x682e6ff3d6b2b8a3n,
+  0x748f82ee5defb2fcn, 0x78a5636f43172f60n, 0x84c87814a1f0ab72n, 0x8cc702081a6439ecn,
+  0x90befffa23631e28n, 0xa4506cebde82bde9n, 0xbef9a3f7b2c67915n, 0xc67178f2e372532bn,
+  0xca273eceea26619cn, 0xd186b8c721c0c207n, 0xeada7dd6cde0eb1en, 0xf57d4f7fee6ed178n,
+  0x06f067aa72176fban, 0x0a637dc5a2c898a6n, 0x113f9804bef90daen, 0x1b710b35131c471bn,
+  0x28db77f523047d84n, 0x32caab7b40c72493n, 0x3c9ebe0a15c9bebcn, 0x431d67c49c100d4cn,
+  0x4cc5d4becb3e42b6n, 0x597f299cfc657e2an, 0x5fcb6fab3ad6faecn, 0x6c44198c4a475817n
+]
+
+function rotr(x: bigint, n: bigint): bigint {
+  return ((x >> n) | (x << (64n - n))) & MASK
+}
+
+// sha512 hashes a byte string (FIPS 180-4)
+export function sha512(msg: string): string {
+  let bits = BigInt(msg.length) * 8n
+  msg += '\x80' + '\x00'.repeat((239 - msg.length % 128) % 128) + encodeLE(0n, 8)
+  for (let i = 7n; i >= 0n; i--) {
+    msg += String.fromCharCode(Number((bits >> (i * 8n)) & 0xffn))
+  }
+  let H = H0.slice()
+  let W: Array<bigint> = new Array(80)
+  for (let off = 0; off < msg.length; off += 128) {
+    for (let t = 0; t < 16; t++) {
+      let w = 0n
+      for (let j = 0; j < 8; j++) {
+        w = (w << 8n) | BigInt(msg.charCodeAt(off + t * 8 + j))
+      }
+      W[t] = w
+    }
+    for (let t = 16; t < 80; t++) {
+      let s0 = rotr(W[t-15], 1n) ^ rotr(W[t-15], 8n) ^ (W[t-15] >> 7n)
+      let s1 = rotr(W[t-2], 19n) ^ rotr(W[t-2], 61n) ^ (W[t-2] >> 6n)
+      W[t] = (W[t-16] + s0 + W[t-7] + s1) & MASK
+    }
+    let [a, b, c, d, e, f, g, h] = H
+    for (let t = 0; t < 80; t++) {
+      let S1 = rotr(e, 14n) ^ rotr(e, 18n) ^ rotr(e, 41n)
+      let ch = (e & f) ^ (~e & MASK & g)
+      let t1 = (h + S1 + ch + K[t] + W[t]) & MASK
+      let S0 = rotr(a, 28n) ^ rotr(a, 34n) ^ rotr(a, 39n)
+      let maj = (a & b) ^ (a & c) ^ (b & c)
+      let t2 = (S0 + maj) & MASK
+      h = g
+      g = f
+      f = e
+      e = (d + t1) & MASK
+      d = c
+      c = b
+      b = a
+      a = (t1 + t2) & MASK
+    }
+    H = [a, b, c, d, e, f, g, h].map((v, i) => (H[i] + v) & MASK)
+  }
+  let res = ''
+  for (let v of H) {
+    for (let i = 7n; i >= 0n; i--) {
+      res += String.fromCharCode(Number((v >> (i * 8n)) & 0xffn))
+    }
+  }
+  return res
+}
@@ -1,7 +1,39 @@
+export const STATE_VERSION: number = 2 // schema version of the contract state, 1 is unversioned
 export const STORAGE_COST: bigint = BigInt("1000000000000000000000000") // 1 NEAR
+export const STORAGE_ENTRY_COST: bigint = BigInt("10000000000000000000000") // 0.01 NEAR staked per map entry
 export const SECURITY_DEPOSIT: bigint = BigInt("10000000000000000000000000") // 10 NEAR
 export const SLASHED_DEPOSIT_BIPS: bigint = 2500n // 25% per offence
+export const SLASH_MAJORITY_BIPS: bigint = 5000n // slash share paid to majority hosts
+export const SLASH_FINALIZER_BIPS: bigint = 1000n // slash share paid to the finalizing account
 export const MAX_BLOCKS_TO_SETTLE: bigint = 120n // 120 blocks ~ 2min
+export const MAX_PAGE_LIMIT: number = 100
+export const MAX_ROYALTY_SPLITS: number = 16
+export const MAX_QUORUM: number = 16 // highest replication quorum a query may request
+export const COMMITTEE_SIZE: number = 3 // hosts assigned to answer each query
+export const CLAIM_RESPONSE_BLOCKS: bigint = 600n // ~10 minutes for a host to answer a censorship claim
+export const EVENT_STANDARD: string = "db3"
+export const EVENT_VERSION: string = "1.0.0"
+export const UPGRADE_DELAY_BLOCKS: bigint = 1200n // 1200 blocks ~ 20min
+export const FT_TRANSFER_GAS: bigint = 10_000_000_000_000n // 10 TGas for ft_transfer
+export const FT_CALLBACK_GAS: bigint = 10_000_000_000_000n // 10 TGas to resolve a token claim
+export const MAX_FORK_DEPTH: number = 8 // longest fork chain royalties are routed along
+export const ACCESS_GRANT_BLOCKS: bigint = 86400n // ~1 day access of token gate holders
+export const GATE_VIEW_GAS: bigint = 5_000_000_000_000n // 5 TGas to view a gate balance
+export const GATE_CALLBACK_GAS: bigint = 10_000_000_000_000n // 10 TGas to resolve an access request
+export const MAX_JOIN_DATABASES: number = 4 // most databases a cross-database query may join
+export const BLOCK_TIME_NS: bigint = 1_000_000_000n // target block time, used until the clock has a sample
+export const CLOCK_WINDOW_BLOCKS: bigint = 100n // blocks between block time samples
+export const MAX_OUTCOMES: number = 32 // finalized query outcomes kept per database
+export const MAX_ATTRIBUTION_LEN: number = 256 // longest credit line a license may require
+export const MAX_AUTHOR_KEYS: number = 8 // manifest signing keys an author may register
+export const MANIFEST_SIGNING_TAG: string = "db3-manifest" // domain tag that prefixes signed manifest payloads
+export const USE_COMMERCIAL: string = "commercial"
+export const USE_NON_COMMERCIAL: string = "non_commercial"
+export const LICENSE_NONE: string = "NONE" // no license, all rights reserved
+export const LICENSE_NOASSERTION: string = "NOASSERTION" // license not stated
+export const LICENSE_REF_PREFIX: string = "LicenseRef-" // custom license defined by the author
+export const GATE_FUNGIBLE_TOKEN: string = "nep141" // holders of at least min_balance tokens
+export const GATE_NON_FUNGIBLE_TOKEN: string = "nep171" // holders of at least min_balance NFTs
 
 export class Manifest {
   author_id: string;
@@ -9,6 +41,15 @@ export class Manifest {
   license: string;
   code_cid: string;
   royalty_bips: string;
+  tags: Array<string>;
+  min_quorum?: string; // votes required to answer a query (empty means 1)
+  max_quorum?: string; // highest quorum users may request (empty means MAX_QUORUM)
+  fork_royalty_bips?: string; // share of fork royalties passed up to this database
+  non_commercial_royalty_bips?: string; // royalty on non-commercial queries, royalty_bips applies to commercial use
+  attribution?: string; // credit line results must carry
+  usage_cap?: string; // most queries an account may pay for (empty means unlimited)
+  author_key?: string; // registered signing key of the author (hex), empty for unsigned bundles
+  signature?: string; // ed25519 signature of the author over the manifest payload (hex)
 
   constructor({
     author_id,
@@ -16,17 +57,301 @@ export class Manifest {
     license,
     code_cid,
     royalty_bips,
+    tags,
+    min_quorum,
+    max_quorum,
+    fork_royalty_bips,
+    non_commercial_royalty_bips,
+    attribution,
+    usage_cap,
+    author_key,
+    signature,
   }:{
     author_id: string,
     name: string,
     license: string,
     code_cid: string,
     royalty_bips: string,
+    tags: Array<string>,
+    min_quorum?: string,
+    max_quorum?: string,
+    fork_royalty_bips?: string,
+    non_commercial_royalty_bips?: string,
+    attribution?: string,
+    usage_cap?: string,
+    author_key?: string,
+    signature?: string,
   }) {
     this.author_id = author_id;
     this.name = name;
     this.license = license;
     this.code_cid = code_cid;
     this.royalty_bips = royalty_bips;
+    this.tags = tags || [];
+    this.min_quorum = min_quorum;
+    this.max_quorum = max_quorum;
+    this.fork_royalty_bips = fork_royalty_bips;
+    this.non_commercial_royalty_bips = non_commercial_royalty_bips;
+    this.attribution = attribution;
+    this.usage_cap = usage_cap;
+    this.author_key = author_key;
+    this.signature = signature;
   }
-}
\ No newline at end of file
+}
+
+// Usage terms of SPDX licenses the contract knows about, licenses that are
+// missing here can be declared as LicenseRef-<id>
+export const SPDX_LICENSES: { [id: string]: { non_commercial?: boolean, attribution?: boolean } } = {
+  "0BSD": {},
+  "AGPL-3.0-only": {},
+  "AGPL-3.0-or-later": {},
+  "Apache-2.0": {},
+  "BSD-2-Clause": {},
+  "BSD-3-Clause": {},
+  "BUSL-1.1": {},
+  "CC-BY-4.0": { attribution: true },
+  "CC-BY-NC-4.0": { non_commercial: true, attribution: true },
+  "CC-BY-NC-ND-4.0": { non_commercial: true, attribution: true },
+  "CC-BY-NC-SA-4.0": { non_commercial: true, attribution: true },
+  "CC-BY-ND-4.0": { attribution: true },
+  "CC-BY-SA-4.0": { attribution: true },
+  "CC0-1.0": {},
+  "CDLA-Permissive-2.0": {},
+  "CDLA-Sharing-1.0": {},
+  "GPL-3.0-only": {},
+  "GPL-3.0-or-later": {},
+  "LGPL-3.0-only": {},
+  "LGPL-3.0-or-later": {},
+  "MIT": {},
+  "MPL-2.0": {},
+  "ODC-By-1.0": { attribution: true },
+  "ODbL-1.0": { attribution: true },
+  "PDDL-1.0": {},
+  "PolyForm-Noncommercial-1.0.0": { non_commercial: true },
+  "Unlicense": {},
+}
+
+// Machine-readable usage terms of a database, nodes check them when
+// admitting queries
+export class LicenseTerms {
+  license: string;
+  commercial: boolean; // commercial use permitted
+  commercial_royalty_bips: string;
+  non_commercial_royalty_bips: string;
+  attribution: string; // empty without requirement
+  usage_cap: string; // "0" means unlimited
+
+  constructor(manifest: Manifest) {
+    let spdx = SPDX_LICENSES[manifest.license] || {}
+    this.license = manifest.license;
+    this.commercial = !spdx.non_commercial;
+    this.commercial_royalty_bips = manifest.royalty_bips || '0';
+    this.non_commercial_royalty_bips = manifest.non_commercial_royalty_bips || '0';
+    this.attribution = manifest.attribution || '';
+    this.usage_cap = manifest.usage_cap || '0';
+  }
+}
+
+// Link from a fork to its parent, the royalty share is the parent's fork
+// royalty at fork time
+export class ForkLink {
+  parent: string;
+  royalty_bips: string;
+
+  constructor({ parent, royalty_bips }:{ parent: string, royalty_bips: string }) {
+    this.parent = parent;
+    this.royalty_bips = royalty_bips;
+  }
+}
+
+// Access rules of a database, only allowlisted users may escrow fees for
+// private databases and a gate lets token holders request temporary access
+export class AccessPolicy {
+  private: boolean;
+  gate: string;
+  standard: string;
+  min_balance: string;
+
+  constructor({ private: isPrivate, gate, standard, min_balance }:{ private: boolean, gate: string, standard: string, min_balance: string }) {
+    this.private = isPrivate;
+    this.gate = gate;
+    this.standard = standard;
+    this.min_balance = min_balance;
+  }
+}
+
+// Royalty share of a database joined by a cross-database query, the first
+// share names the database that keeps the query
+export class JoinShare {
+  dbid: string;
+  bips: string;
+
+  constructor({ dbid, bips }:{ dbid: string, bips: string }) {
+    this.dbid = dbid;
+    this.bips = bips;
+  }
+}
+
+// Estimate of the block production rate, timestamps in nanoseconds. The
+// block time is smoothed over samples taken at most once per window and is
+// zero before the first sample.
+export class BlockClock {
+  height: string;
+  timestamp: string;
+  block_time: string;
+
+  constructor({ height, timestamp, block_time }:{ height: string, timestamp: string, block_time: string }) {
+    this.height = height;
+    this.timestamp = timestamp;
+    this.block_time = block_time;
+  }
+}
+
+// NEP-145 storage balance of an account, amounts in yoctoNEAR
+export class StorageBalance {
+  total: string;
+  available: string;
+
+  constructor({ total, available }:{ total: string, available: string }) {
+    this.total = total;
+    this.available = available;
+  }
+}
+
+// Allowlist entry of a user, zero expiry never expires
+export class AccessGrant {
+  expires: string;
+  payer: string;
+
+  constructor({ expires, payer }:{ expires: string, payer: string }) {
+    this.expires = expires;
+    this.payer = payer;
+  }
+}
+
+export class DatabaseInfo {
+  dbid: string;
+  owner: string;
+  manifest: Manifest;
+  terms: LicenseTerms; // license terms of the active code version
+  parent?: ForkLink; // empty unless the database is a fork
+  forks: Array<string>; // direct forks
+
+  constructor({ dbid, owner, manifest, terms, parent, forks }:{ dbid: string, owner: string, manifest: Manifest, terms: LicenseTerms, parent?: ForkLink, forks?: Array<string> }) {
+    this.dbid = dbid;
+    this.owner = owner;
+    this.manifest = manifest;
+    this.terms = terms;
+    this.parent = parent;
+    this.forks = forks || [];
+  }
+}
+export class ManifestVersion {
+  version: number;
+  manifest: Manifest;
+  activation_height: string;
+
+  constructor({ version, manifest, activation_height }:{ version: number, manifest: Manifest, activation_height: string }) {
+    this.version = version;
+    this.manifest = manifest;
+    this.activation_height = activation_height;
+  }
+}
+
+export class RoyaltyShare {
+  account_id: string;
+  bips: string;
+
+  constructor({ account_id, bips }:{ account_id: string, bips: string }) {
+    this.account_id = account_id;
+    this.bips = bips;
+  }
+}
+
+export const STATUS_ACTIVE = "active"
+export const STATUS_PAUSED = "paused"
+export const STATUS_DEPRECATED = "deprecated"
+export const STATUS_RETIRED = "retired"
+
+export const OUTCOME_UNPAID = "unpaid" // no fee was escrowed
+export const OUTCOME_REFUNDED = "refunded" // too few votes, fees went back to payers
+export const OUTCOME_UNANIMOUS = "unanimous" // all votes agree
+export const OUTCOME_SUPERMAJORITY = "supermajority" // a 2/3 supermajority agrees, the minority is slashed
+export const OUTCOME_NO_MAJORITY = "no_majority" // no supermajority, fees went to the treasury
+
+export class ResultTally {
+  rid: string;
+  votes: number;
+
+  constructor({ rid, votes }:{ rid: string, votes: number }) {
+    this.rid = rid;
+    this.votes = votes;
+  }
+}
+
+export class Payout {
+  account_id: string;
+  amount: string;
+
+  constructor({ account_id, amount }:{ account_id: string, amount: string }) {
+    this.account_id = account_id;
+    this.amount = amount;
+  }
+}
+
+// Audit record of a finalized query. Fee amounts are in the fee token,
+// slashes and slash rewards in yoctoNEAR. Votes of hosts outside the
+// committee or without deposits on all joined databases are listed as ignored.
+export class ElectionOutcome {
+  qid: string;
+  height: string;
+  version: number;
+  token: string;
+  fee: string;
+  royalty: string;
+  quorum: number;
+  status: string;
+  winner: string;
+  tallies: Array<ResultTally>;
+  majority: Array<string>;
+  minority: Array<string>;
+  ignored: Array<string>;
+  fee_shares: Array<Payout>;
+  pooled: string;
+  refunds: Array<Payout>;
+  slashes: Array<Payout>;
+  rewards: Array<Payout>;
+  dust: string;
+
+  constructor({ qid, height, version, token, fee, quorum }:{ qid: string, height: string, version: number, token: string, fee: string, quorum: number }) {
+    this.qid = qid;
+    this.height = height;
+    this.version = version;
+    this.token = token;
+    this.fee = fee;
+    this.royalty = "0";
+    this.quorum = quorum;
+    this.status = OUTCOME_UNPAID;
+    this.winner = "";
+    this.tallies = [];
+    this.majority = [];
+    this.minority = [];
+    this.ignored = [];
+    this.fee_shares = [];
+    this.pooled = "0";
+    this.refunds = [];
+    this.slashes = [];
+    this.rewards = [];
+    this.dust = "0";
+  }
+}
+
+export class DatabaseStatus {
+  status: string;
+  sunset_height: string;
+
+  constructor({ status, sunset_height }:{ status: string, sunset_height: string }) {
+    this.status = status;
+    this.sunset_height = sunset_height;
+  }
+}
@@ -1,4 +1,5 @@
-import { UnorderedMap } from 'near-sdk-js';
+import { UnorderedMap, near } from 'near-sdk-js';
+import { EVENT_STANDARD, EVENT_VERSION, Manifest, MANIFEST_SIGNING_TAG } from './model'
 
 export function assert(statement, message) {
   if (!statement) {
@@ -24,4 +25,116 @@ export function scanmap(m: UnorderedMap, prefix: string): Map<string,string> {
     res.set(key, v as string)
   }
   return res
-}
\ No newline at end of file
+}
+
+// bykey orders map entries by key, e.g. to iterate votes by account
+export function bykey([a]: [string, string], [b]: [string, string]): number {
+  return a < b ? -1 : a > b ? 1 : 0
+}
+
+export function intersect(a: Array<string>, b: Array<string>): Array<string> {
+  let set = new Set(b)
+  return a.filter(v => set.has(v))
+}
+
+// selectCommittee draws k hosts for a query from the block random seed, a
+// partial Fisher-Yates shuffle of the sorted hosts driven by
+// sha256(seed || dbid || "#" || qid) that anyone can verify
+export function selectCommittee(seed: string, dbid: string, qid: string, hosts: Array<string>, k: number): Array<string> {
+  let list = hosts.slice().sort()
+  k = Math.min(k, list.length)
+  let base = near.sha256(seed + makekey(dbid, qid)) as string
+  for (let i = 0; i < k; i++) {
+    let idx = String.fromCharCode(i & 0xff, (i >> 8) & 0xff, (i >> 16) & 0xff, (i >>> 24) & 0xff)
+    let r = near.sha256(base + idx) as string
+
+    // first 8 hash bytes as little endian integer
+    let n = 0n
+    for (let b = 7; b >= 0; b--) {
+      n = (n << 8n) | BigInt(r.charCodeAt(b))
+    }
+    let j = i + Number(n % BigInt(list.length - i))
+    let tmp = list[i]
+    list[i] = list[j]
+    list[j] = tmp
+  }
+  return list.slice(0, k)
+}
+
+export function tohex(bytes: string): string {
+  let res = ''
+  for (let i = 0; i < bytes.length; i++) {
+    res += bytes.charCodeAt(i).toString(16).padStart(2, '0')
+  }
+  return res
+}
+
+export function fromhex(hex: string): string {
+  let res = ''
+  for (let i = 0; i + 1 < hex.length; i += 2) {
+    res += String.fromCharCode(parseInt(hex.slice(i, i + 2), 16))
+  }
+  return res
+}
+
+// queryCid returns the content id of a query, a CIDv1 with raw codec and
+// sha2-256 multihash in lower case base32 as IPFS assigns to raw blocks, it
+// matches db3.QueryCIDOf
+export function queryCid(query: string): string {
+  let bytes = '\x01\x55\x12\x20' + near.sha256(unescape(encodeURIComponent(query)))
+  let alphabet = 'abcdefghijklmnopqrstuvwxyz234567'
+  let res = 'b'
+  let bits = 0
+  let value = 0
+  for (let i = 0; i < bytes.length; i++) {
+    value = (value << 8) | bytes.charCodeAt(i)
+    bits += 8
+    while (bits >= 5) {
+      res += alphabet[(value >>> (bits - 5)) & 31]
+      bits -= 5
+    }
+  }
+  if (bits > 0) {
+    res += alphabet[(value << (5 - bits)) & 31]
+  }
+  return res
+}
+
+// manifestPayload returns the bytes an author signs, the Borsh encoding of
+// the domain tag and every manifest field except the signature, it matches
+// db3.ManifestPayload
+export function manifestPayload(manifest: Manifest): string {
+  let u32 = (v: number) => String.fromCharCode(v & 0xff, (v >> 8) & 0xff, (v >> 16) & 0xff, (v >>> 24) & 0xff)
+  let str = (s: string) => {
+    let utf8 = unescape(encodeURIComponent(s))
+    return u32(utf8.length) + utf8
+  }
+  let int = (v: string | undefined) => parseInt(v || '0')
+  let tags = manifest.tags || []
+  let usage_cap = BigInt(manifest.usage_cap || '0')
+  return str(MANIFEST_SIGNING_TAG) + str(manifest.author_id) + str(manifest.name) +
+    str(manifest.license) + str(manifest.code_cid) + u32(int(manifest.royalty_bips)) +
+    u32(tags.length) + tags.map(str).join('') +
+    u32(int(manifest.min_quorum)) + u32(int(manifest.max_quorum)) +
+    u32(int(manifest.fork_royalty_bips)) + u32(int(manifest.non_commercial_royalty_bips)) +
+    str(manifest.attribution || '') +
+    u32(Number(usage_cap & 0xffffffffn)) + u32(Number(usage_cap >> 32n))
+}
+
+// signerKey returns the hex encoded ed25519 key that signed the transaction,
+// the raw key is prefixed by its curve type
+export function signerKey(): string {
+  let pk = near.signerAccountPk() as string
+  assert(pk.length === 33 && pk.charCodeAt(0) === 0, "Invalid author key")
+  return tohex(pk.slice(1))
+}
+
+// emit logs a NEP-297 event
+export function emit(event: string, data: object) {
+  near.log(`EVENT_JSON:${JSON.stringify({
+    standard: EVENT_STANDARD,
+    version: EVENT_VERSION,
+    event,
+    data,
+  })}`)
+}
@@ -1,4 +1,5 @@
 import { splitkey } from './utils';
+import { ResultTally } from './model';
 
 export class Vote {
   account_id: string;
@@ -72,4 +73,22 @@ export class Election {
     }
     return majority
   }
-}
\ No newline at end of file
+
+  // result of the supermajority, empty without supermajority
+  winner(): string {
+    let cutoff = 200 * this.votes.length / 3
+    for (let [ rid, v ] of this.results) {
+      if (v*100 >= cutoff) {
+        return rid
+      }
+    }
+    return ''
+  }
+
+  // votes per result, most votes first
+  tallies(): Array<ResultTally> {
+    let tallies = [...this.results].map(([ rid, votes ]) => new ResultTally({ rid, votes }))
+    tallies.sort((a, b) => a.votes !== b.votes ? b.votes - a.votes : (a.rid < b.rid ? -1 : a.rid > b.rid ? 1 : 0))
+    return tallies
+  }
+}
@@ -73,7 +73,7 @@ document.querySelector('#new-db-form').onsubmit = async (event) => {
   event.preventDefault()
 
   // get elements from the form using their id attribute
-  const { fieldset, author_id, name, license, code_cid, royalty_bips } = event.target.elements
+  const { fieldset, author_id, name, license, attribution, code_cid, royalty_bips } = event.target.elements
 
   // disable the form while the value gets updated on-chain
   fieldset.disabled = true
@@ -82,7 +82,9 @@ document.querySelector('#new-db-form').onsubmit = async (event) => {
     await contract.deploy({
       author_id: author_id.value,
       name: name.value,
-      license: license.value,
+      // the contract only accepts SPDX identifiers, fall back to no assertion
+      license: license.value.trim() || 'NOASSERTION',
+      attribution: attribution.value.trim(),
       code_cid: code_cid.value,
       royalty_bips: royalty_bips.value,
     })
@@ -190,9 +192,9 @@ async function getAndShowAllDatabasesUser(){
       var uris = await contract.discover({dbid: id.toString()});
       console.log("discovered", uris)
 
-      // calculate content id
+      // calculate content id (CIDv1 raw sha2-256, as checked by the contract)
       const data = Buffer.from(query);
-      const cid = await Hash.of(data);
+      const cid = await Hash.of(data, { cidVersion: 1, rawLeaves: true });
       console.log("cid", cid)
 
       // get latest block and add TTL to height
@@ -201,7 +203,7 @@ async function getAndShowAllDatabasesUser(){
       console.log("latest block", res)
 
       // send paymeng tx
-      await contract.escrow({dbid:id.toString(), qid, ttl});
+      await contract.escrow({dbid:id.toString(), qid: cid, ttl});
 
       // run query against one of the uris
       // TODO
@@ -7,8 +7,12 @@ export class Contract{
 
   // Views
 
-  async databases(){
-    return await this.wallet.viewMethod({method: 'databases'});
+  async databases({ from_index = 0, limit = 100 } = {}){
+    return await this.wallet.viewMethod({method: 'databases', args:{ from_index, limit }});
+  }
+
+  async searchDatabases({ author_id, name, license, tags, from_index = 0, limit = 100 } = {}){
+    return await this.wallet.viewMethod({method: 'search_databases', args:{ author_id, name, license, tags, from_index, limit }});
   }
 
   async ownDatabases(){
@@ -19,6 +23,22 @@ export class Contract{
     return await this.wallet.viewMethod({method: 'manifest', args:{ dbid }});
   }
 
+  async status({ dbid }){
+    return await this.wallet.viewMethod({method: 'status', args:{ dbid }});
+  }
+
+  async versions({ dbid }){
+    return await this.wallet.viewMethod({method: 'versions', args:{ dbid }});
+  }
+
+  async pendingOwner({ dbid }){
+    return await this.wallet.viewMethod({method: 'pending_owner', args:{ dbid }});
+  }
+
+  async royaltySplit({ dbid }){
+    return await this.wallet.viewMethod({method: 'royalty_split', args:{ dbid }});
+  }
+
   async discover({ dbid }){
     return await this.wallet.viewMethod({method: 'discover', args:{ dbid }});
   }
@@ -32,20 +52,56 @@ export class Contract{
   async deploy( {
     author_id,
     name,
-    license,
+    license = "NOASSERTION",
+    attribution = "",
     code_cid,
     royalty_bips,
+    tags = [],
     deposit = "1000000000000000000000000"
   } ){
     return await this.wallet.callMethod({method: 'deploy', args:{manifest: {
       author_id,
       name,
       license,
+      attribution,
       code_cid,
       royalty_bips,
+      tags,
     }}, deposit });
   }
 
+  async upgrade( { dbid, manifest } ){
+    return await this.wallet.callMethod({method: 'upgrade', args:{ dbid, manifest }});
+  }
+
+  async propose_owner( { dbid, owner } ){
+    return await this.wallet.callMethod({method: 'propose_owner', args:{ dbid, owner }});
+  }
+
+  async accept_owner( { dbid } ){
+    return await this.wallet.callMethod({method: 'accept_owner', args:{ dbid }});
+  }
+
+  async set_royalty_split( { dbid, shares } ){
+    return await this.wallet.callMethod({method: 'set_royalty_split', args:{ dbid, shares }});
+  }
+
+  async pause( { dbid } ){
+    return await this.wallet.callMethod({method: 'pause', args:{ dbid }});
+  }
+
+  async resume( { dbid } ){
+    return await this.wallet.callMethod({method: 'resume', args:{ dbid }});
+  }
+
+  async deprecate( { dbid, sunset_height } ){
+    return await this.wallet.callMethod({method: 'deprecate', args:{ dbid, sunset_height }});
+  }
+
+  async retire( { dbid } ){
+    return await this.wallet.callMethod({method: 'retire', args:{ dbid }});
+  }
+
   async deposit( { dbid, deposit = "10000000000000000000000000" } ){
     return await this.wallet.callMethod({method: 'deposit', args:{ dbid }, deposit });
   }
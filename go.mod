@@ -4,6 +4,7 @@ go 1.19
 
 require (
 	blockwatch.cc/near-api-go v0.0.0-20220913215632-8fa53af44021
+	github.com/btcsuite/btcutil v1.0.2
 	github.com/echa/log v1.2.1
 	github.com/ipfs/go-cid v0.3.2
 	github.com/multiformats/go-multicodec v0.6.0
@@ -14,7 +15,6 @@ require (
 
 require (
 	github.com/aurora-is-near/go-jsonrpc/v3 v3.1.1 // indirect
-	github.com/btcsuite/btcutil v1.0.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fatih/color v1.13.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
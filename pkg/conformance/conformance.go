@@ -0,0 +1,754 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+// Package conformance runs language-neutral contract scenarios against the
+// Go model and emits them as fixtures for the TypeScript contract tests, so
+// both implementations are proven to agree.
+//
+// A scenario is a sequence of contract calls using the on-chain method names
+// and JSON arguments. Each step has a caller, an attached amount in
+// yoctoNEAR, a block height and optionally an expected result or an expected
+// error message substring. Steps without an expected error must succeed. The
+// expected final state lists contract maps by their field names in
+// contract.ts with '#' joined keys like makekey. Sections that are null are
+// not checked, amounts are yoctoNEAR strings and zero amounts are omitted.
+//
+// Accounts listed in keys sign their calls with the ed25519 key derived from
+// the hex seed, e.g. to register author keys, other accounts use any key.
+//
+// Heights are relative, runners may offset all step heights and height
+// arguments (ttl, sunset) and height results (ttl_within) by a constant base.
+package conformance
+
+import (
+    "crypto/ed25519"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "blockwatch.cc/db3-near/pkg/db3"
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+type Scenario struct {
+    Name        string                    `json:"name"`
+    Description string                    `json:"description,omitempty"`
+    Owner       near.AccountID            `json:"owner"`
+    Keys        map[near.AccountID]string `json:"keys,omitempty"` // hex ed25519 seeds of account keys
+    Steps       []Step                    `json:"steps"`
+    State       *Snapshot                 `json:"state,omitempty"`
+}
+
+type Step struct {
+    Method string          `json:"method"`
+    Caller near.AccountID  `json:"caller"`
+    Amount string          `json:"amount,omitempty"`
+    Height int64           `json:"height"`
+    Args   json.RawMessage `json:"args,omitempty"`
+    Result json.RawMessage `json:"result,omitempty"`
+    Error  string          `json:"error,omitempty"`
+}
+
+// Contract state in neutral form, field names match contract.ts
+type Snapshot struct {
+    NextId             *uint64           `json:"next_id"`
+    DbSlashed          *string           `json:"db_slashed"`
+    DbDeposits         map[string]string `json:"db_deposits"`
+    DbApiRegistry      map[string]string `json:"db_api_registry"`
+    DbPendingFees      map[string]string `json:"db_pending_fees"`
+    DbTtls             map[string]string `json:"db_ttls"`
+    DbPendingVotes     map[string]string `json:"db_pending_votes"`
+    DbQuorums          map[string]string `json:"db_quorums"`
+    DbPayments         map[string]string `json:"db_payments"`
+    DbCommittees       map[string]string `json:"db_committees"`
+    DbReceipts         map[string]string `json:"db_receipts"`
+    DbClaims           map[string]string `json:"db_claims"`
+    DbSettledFees      map[string]string `json:"db_settled_fees"`
+    DbSettledRoyalties map[string]string `json:"db_settled_royalties"`
+    StorageBalances    map[string]string `json:"storage_balances"`
+}
+
+// Outcome of a single step
+type StepResult struct {
+    Result json.RawMessage
+    Error  string
+}
+
+// Run executes a scenario against a new Go model and returns the outcome of
+// all steps and the final contract. Malformed scenarios return an error,
+// contract errors are part of the step results.
+func Run(s Scenario) ([]StepResult, *db3.DB3, error) {
+    db3.SetCallContext(near.CallContext{Caller: s.Owner})
+    d := db3.NewDB3()
+    d.Owner = s.Owner
+
+    keys := make(map[near.AccountID]near.Pubkey)
+    for acc, seed := range s.Keys {
+        buf, err := hex.DecodeString(seed)
+        if err != nil || len(buf) != ed25519.SeedSize {
+            return nil, nil, fmt.Errorf("key of %s: invalid ed25519 seed", acc)
+        }
+        pub := ed25519.NewKeyFromSeed(buf).Public().(ed25519.PublicKey)
+        keys[acc] = near.Pubkey(hex.EncodeToString(pub))
+    }
+
+    res := make([]StepResult, len(s.Steps))
+    for i, step := range s.Steps {
+        fn, ok := methods[step.Method]
+        if !ok {
+            return nil, nil, fmt.Errorf("step %d: unsupported method %q", i, step.Method)
+        }
+        var amount near.Money
+        if step.Amount != "" {
+            var err error
+            if amount, err = near.ParseYocto(step.Amount); err != nil {
+                return nil, nil, fmt.Errorf("step %d: %v", i, err)
+            }
+            if amount.Yocto() != step.Amount {
+                return nil, nil, fmt.Errorf("step %d: amount %s is not a multiple of %s yocto", i, step.Amount, near.YOCTO_PER_MONEY)
+            }
+        }
+        db3.SetCallContext(near.CallContext{
+            Caller:   step.Caller,
+            SignedBy: keys[step.Caller],
+            Amount:   amount,
+            Height:   step.Height,
+        })
+        result, cerr, err := call(d, fn, step.Args)
+        if err != nil {
+            return nil, nil, fmt.Errorf("step %d %s: %v", i, step.Method, err)
+        }
+        res[i].Error = cerr
+        if result != nil {
+            buf, err := json.Marshal(result)
+            if err != nil {
+                return nil, nil, fmt.Errorf("step %d %s: %v", i, step.Method, err)
+            }
+            res[i].Result = buf
+        }
+    }
+    return res, d, nil
+}
+
+// Check compares step outcomes and the final state against the scenario's
+// expectations
+func (s Scenario) Check(res []StepResult, d *db3.DB3) []error {
+    errs := make([]error, 0)
+    for i, step := range s.Steps {
+        r := res[i]
+        switch {
+        case step.Error == "" && r.Error != "":
+            errs = append(errs, fmt.Errorf("step %d %s: unexpected error %q", i, step.Method, r.Error))
+        case step.Error != "" && !strings.Contains(r.Error, step.Error):
+            errs = append(errs, fmt.Errorf("step %d %s: got error %q, want %q", i, step.Method, r.Error, step.Error))
+        }
+        if len(step.Result) > 0 && !jsonEqual(step.Result, r.Result) {
+            errs = append(errs, fmt.Errorf("step %d %s: got result %s, want %s", i, step.Method, r.Result, step.Result))
+        }
+    }
+    if s.State != nil {
+        errs = append(errs, s.State.Compare(NewSnapshot(d))...)
+    }
+    return errs
+}
+
+// Fixture returns the scenario with recorded results and the full final
+// state as expectations for other implementations
+func (s Scenario) Fixture(res []StepResult, d *db3.DB3) Scenario {
+    f := s
+    f.Steps = make([]Step, len(s.Steps))
+    for i, step := range s.Steps {
+        if len(res[i].Result) > 0 {
+            step.Result = res[i].Result
+        }
+        f.Steps[i] = step
+    }
+    f.State = NewSnapshot(d)
+    return f
+}
+
+// Accounts lists the owner and all callers in order of appearance
+func (s Scenario) Accounts() []near.AccountID {
+    seen := map[near.AccountID]bool{s.Owner: true}
+    accs := []near.AccountID{s.Owner}
+    for _, step := range s.Steps {
+        if !seen[step.Caller] {
+            seen[step.Caller] = true
+            accs = append(accs, step.Caller)
+        }
+    }
+    return accs
+}
+
+// NewSnapshot converts the Go model state into neutral form
+func NewSnapshot(d *db3.DB3) *Snapshot {
+    nextId := uint64(d.NextId)
+    slashed := d.Slashed.Yocto()
+    s := &Snapshot{
+        NextId:             &nextId,
+        DbSlashed:          &slashed,
+        DbDeposits:         make(map[string]string),
+        DbApiRegistry:      make(map[string]string),
+        DbPendingFees:      make(map[string]string),
+        DbTtls:             make(map[string]string),
+        DbPendingVotes:     make(map[string]string),
+        DbQuorums:          make(map[string]string),
+        DbPayments:         make(map[string]string),
+        DbCommittees:       make(map[string]string),
+        DbReceipts:         make(map[string]string),
+        DbClaims:           make(map[string]string),
+        DbSettledFees:      make(map[string]string),
+        DbSettledRoyalties: make(map[string]string),
+        StorageBalances:    make(map[string]string),
+    }
+    for dbid, m := range d.Deposits {
+        for acc, v := range m {
+            setAmount(s.DbDeposits, makekey(dbid, acc), v)
+        }
+    }
+    for dbid, m := range d.ApiRegistry {
+        for acc, uri := range m {
+            s.DbApiRegistry[makekey(dbid, acc)] = string(uri)
+        }
+    }
+    for dbid, m := range d.PendingFees {
+        for qid, v := range m {
+            setAmount(s.DbPendingFees, makekey(dbid, qid), v)
+        }
+    }
+    for dbid, m := range d.ResultTTL {
+        for qid, ttl := range m {
+            s.DbTtls[makekey(dbid, qid)] = strconv.FormatInt(ttl, 10)
+        }
+    }
+    for dbid, m := range d.PendingResults {
+        for qid, votes := range m {
+            for acc, rid := range votes {
+                s.DbPendingVotes[makekey(dbid, qid, acc)] = string(rid)
+            }
+        }
+    }
+    for dbid, m := range d.QueryQuorums {
+        for qid, v := range m {
+            s.DbQuorums[makekey(dbid, qid)] = strconv.Itoa(v)
+        }
+    }
+    for dbid, m := range d.QueryPayments {
+        for qid, accs := range m {
+            for acc, v := range accs {
+                setAmount(s.DbPayments, makekey(dbid, qid, acc), v)
+            }
+        }
+    }
+    for dbid, m := range d.Committees {
+        for qid, members := range m {
+            // committees compare as sorted member lists, the draw order
+            // depends on the block random seed
+            names := make([]string, 0, len(members))
+            for _, acc := range members {
+                names = append(names, string(acc))
+            }
+            sort.Strings(names)
+            s.DbCommittees[makekey(dbid, qid)] = strings.Join(names, ",")
+        }
+    }
+    for dbid, m := range d.Receipts {
+        for qid, hosts := range m {
+            for host, r := range hosts {
+                s.DbReceipts[makekey(dbid, qid, host)] = string(r.Rid)
+            }
+        }
+    }
+    for dbid, m := range d.Claims {
+        for qid, hosts := range m {
+            // deadlines depend on the sandbox height, claims compare by claimant
+            for host, c := range hosts {
+                s.DbClaims[makekey(dbid, qid, host)] = string(c.Claimant)
+            }
+        }
+    }
+    for acc, v := range d.SettledFees {
+        setAmount(s.DbSettledFees, string(acc), v)
+    }
+    for acc, v := range d.SettledRoyalties {
+        setAmount(s.DbSettledRoyalties, string(acc), v)
+    }
+    for acc, v := range d.StorageBalances {
+        setAmount(s.StorageBalances, string(acc), v.Available)
+    }
+    return s
+}
+
+// Compare checks all sections set in the expected snapshot
+func (s *Snapshot) Compare(got *Snapshot) []error {
+    errs := make([]error, 0)
+    if s.NextId != nil && *s.NextId != *got.NextId {
+        errs = append(errs, fmt.Errorf("next_id: got %d, want %d", *got.NextId, *s.NextId))
+    }
+    if s.DbSlashed != nil && *s.DbSlashed != *got.DbSlashed {
+        errs = append(errs, fmt.Errorf("db_slashed: got %s, want %s", *got.DbSlashed, *s.DbSlashed))
+    }
+    for _, v := range []struct {
+        name      string
+        want, got map[string]string
+    }{
+        {"db_deposits", s.DbDeposits, got.DbDeposits},
+        {"db_api_registry", s.DbApiRegistry, got.DbApiRegistry},
+        {"db_pending_fees", s.DbPendingFees, got.DbPendingFees},
+        {"db_ttls", s.DbTtls, got.DbTtls},
+        {"db_pending_votes", s.DbPendingVotes, got.DbPendingVotes},
+        {"db_quorums", s.DbQuorums, got.DbQuorums},
+        {"db_payments", s.DbPayments, got.DbPayments},
+        {"db_committees", s.DbCommittees, got.DbCommittees},
+        {"db_receipts", s.DbReceipts, got.DbReceipts},
+        {"db_claims", s.DbClaims, got.DbClaims},
+        {"db_settled_fees", s.DbSettledFees, got.DbSettledFees},
+        {"db_settled_royalties", s.DbSettledRoyalties, got.DbSettledRoyalties},
+        {"storage_balances", s.StorageBalances, got.StorageBalances},
+    } {
+        if v.want == nil {
+            continue
+        }
+        keys := make(map[string]bool)
+        for k := range v.want {
+            keys[k] = true
+        }
+        for k := range v.got {
+            keys[k] = true
+        }
+        sorted := make([]string, 0, len(keys))
+        for k := range keys {
+            sorted = append(sorted, k)
+        }
+        sort.Strings(sorted)
+        for _, k := range sorted {
+            want, wok := v.want[k]
+            have, gok := v.got[k]
+            switch {
+            case !gok:
+                errs = append(errs, fmt.Errorf("%s[%s]: missing, want %q", v.name, k, want))
+            case !wok:
+                errs = append(errs, fmt.Errorf("%s[%s]: unexpected %q", v.name, k, have))
+            case want != have:
+                errs = append(errs, fmt.Errorf("%s[%s]: got %q, want %q", v.name, k, have, want))
+            }
+        }
+    }
+    return errs
+}
+
+// contract method called with JSON arguments
+type method func(d *db3.DB3, args json.RawMessage) (interface{}, error)
+
+// call runs a method and returns contract panics as error message
+func call(d *db3.DB3, fn method, args json.RawMessage) (result interface{}, cerr string, err error) {
+    defer func() {
+        if e := recover(); e != nil {
+            cerr = fmt.Sprint(e)
+        }
+    }()
+    result, err = fn(d, args)
+    return
+}
+
+type manifestArgs struct {
+    Author      near.AccountID `json:"author_id"`
+    Name        string         `json:"name"`
+    License     string         `json:"license"`
+    CID         db3.CodeCID    `json:"code_cid"`
+    RoyaltyBips flexInt        `json:"royalty_bips"`
+    Tags        []string       `json:"tags"`
+    MinQuorum   flexInt        `json:"min_quorum"`
+    MaxQuorum   flexInt        `json:"max_quorum"`
+
+    ForkRoyaltyBips flexInt `json:"fork_royalty_bips"`
+
+    NonCommercialRoyaltyBips flexInt `json:"non_commercial_royalty_bips"`
+    Attribution              string  `json:"attribution"`
+    UsageCap                 flexInt `json:"usage_cap"`
+
+    AuthorKey near.Pubkey    `json:"author_key"`
+    Signature near.Signature `json:"signature"`
+}
+
+func (m manifestArgs) Manifest() db3.Manifest {
+    return db3.Manifest{
+        Author:      m.Author,
+        Name:        m.Name,
+        License:     m.License,
+        CID:         m.CID,
+        RoyaltyBips: int(m.RoyaltyBips),
+        Tags:        m.Tags,
+        MinQuorum:   int(m.MinQuorum),
+        MaxQuorum:   int(m.MaxQuorum),
+
+        ForkRoyaltyBips: int(m.ForkRoyaltyBips),
+
+        NonCommercialRoyaltyBips: int(m.NonCommercialRoyaltyBips),
+        Attribution:              m.Attribution,
+        UsageCap:                 int(m.UsageCap),
+
+        AuthorKey: m.AuthorKey,
+        Signature: m.Signature,
+    }
+}
+
+type dbArgs struct {
+    Dbid flexInt `json:"dbid"`
+}
+
+type accountsArgs struct {
+    Dbid     flexInt          `json:"dbid"`
+    Accounts []near.AccountID `json:"accounts"`
+}
+
+type queryArgs struct {
+    Dbid flexInt      `json:"dbid"`
+    Qid  db3.QueryCID `json:"qid"`
+}
+
+var methods = map[string]method{
+    "deploy": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Manifest manifestArgs `json:"manifest"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        return strconv.FormatUint(uint64(d.Deploy(args.Manifest.Manifest())), 10), nil
+    },
+    "fork": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Parent   flexInt      `json:"parent"`
+            Manifest manifestArgs `json:"manifest"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        return strconv.FormatUint(uint64(d.Fork(db3.DBId(args.Parent), args.Manifest.Manifest())), 10), nil
+    },
+    "upgrade": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Dbid     flexInt      `json:"dbid"`
+            Manifest manifestArgs `json:"manifest"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        return d.Upgrade(db3.DBId(args.Dbid), args.Manifest.Manifest()), nil
+    },
+    "register_author_key": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        d.RegisterAuthorKey()
+        return nil, nil
+    },
+    "remove_author_key": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Key near.Pubkey `json:"key"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.RemoveAuthorKey(args.Key)
+        return nil, nil
+    },
+    "pause": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args dbArgs
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.Pause(db3.DBId(args.Dbid))
+        return nil, nil
+    },
+    "resume": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args dbArgs
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.Resume(db3.DBId(args.Dbid))
+        return nil, nil
+    },
+    "set_access_policy": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Dbid   flexInt `json:"dbid"`
+            Policy struct {
+                Private    bool           `json:"private"`
+                Gate       near.AccountID `json:"gate"`
+                Standard   string         `json:"standard"`
+                MinBalance flexInt        `json:"min_balance"`
+            } `json:"policy"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.SetAccessPolicy(db3.DBId(args.Dbid), db3.AccessPolicy{
+            Private:    args.Policy.Private,
+            Gate:       args.Policy.Gate,
+            Standard:   args.Policy.Standard,
+            MinBalance: near.Money(args.Policy.MinBalance),
+        })
+        return nil, nil
+    },
+    "allow_users": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args accountsArgs
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.AllowUsers(db3.DBId(args.Dbid), args.Accounts)
+        return nil, nil
+    },
+    "revoke_users": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args accountsArgs
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.RevokeUsers(db3.DBId(args.Dbid), args.Accounts)
+        return nil, nil
+    },
+    "has_access": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Dbid    flexInt        `json:"dbid"`
+            Account near.AccountID `json:"account_id"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        return d.HasAccess(db3.DBId(args.Dbid), args.Account), nil
+    },
+    "deposit": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args dbArgs
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.Deposit(db3.DBId(args.Dbid))
+        return nil, nil
+    },
+    "withdraw": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args dbArgs
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.Withdraw(db3.DBId(args.Dbid))
+        return nil, nil
+    },
+    "register_api": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Dbid flexInt         `json:"dbid"`
+            Uri  db3.ApiEndpoint `json:"uri"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.Register(db3.DBId(args.Dbid), args.Uri)
+        return nil, nil
+    },
+    "escrow": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            queryArgs
+            TTL           flexInt `json:"ttl"`
+            Quorum        flexInt `json:"quorum"`
+            WithinMs      flexInt `json:"within_ms"`
+            NonCommercial bool    `json:"non_commercial"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        if args.NonCommercial {
+            d.EscrowFeeFor(db3.DBId(args.Dbid), args.Qid, int64(args.TTL), int(args.Quorum), db3.UseNonCommercial)
+            return nil, nil
+        }
+        if args.TTL == 0 && args.WithinMs != 0 {
+            d.EscrowFeeWithin(db3.DBId(args.Dbid), args.Qid, time.Duration(args.WithinMs)*time.Millisecond, int(args.Quorum))
+            return nil, nil
+        }
+        d.EscrowFee(db3.DBId(args.Dbid), args.Qid, int64(args.TTL), int(args.Quorum))
+        return nil, nil
+    },
+    "ttl_within": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            WithinMs flexInt `json:"within_ms"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        return strconv.FormatInt(d.TTLWithin(time.Duration(args.WithinMs)*time.Millisecond), 10), nil
+    },
+    "escrow_join": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Qid    db3.QueryCID `json:"qid"`
+            TTL    flexInt      `json:"ttl"`
+            Quorum flexInt      `json:"quorum"`
+            Shares []struct {
+                Dbid flexInt `json:"dbid"`
+                Bips flexInt `json:"bips"`
+            } `json:"shares"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        shares := make([]db3.JoinShare, 0, len(args.Shares))
+        for _, v := range args.Shares {
+            shares = append(shares, db3.JoinShare{Dbid: db3.DBId(v.Dbid), Bips: int(v.Bips)})
+        }
+        d.EscrowJoinFee(args.Qid, int64(args.TTL), int(args.Quorum), shares)
+        return nil, nil
+    },
+    "settle": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            queryArgs
+            Rid db3.ResultCID `json:"rid"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.Settle(db3.DBId(args.Dbid), args.Qid, args.Rid)
+        return nil, nil
+    },
+    "assignments": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Dbid flexInt        `json:"dbid"`
+            Host near.AccountID `json:"host"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        return d.Assignments(db3.DBId(args.Dbid), args.Host), nil
+    },
+    "sign_receipt": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            queryArgs
+            Host near.AccountID `json:"host"`
+            Rid  db3.ResultCID  `json:"rid"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.SignReceipt(db3.DBId(args.Dbid), args.Qid, args.Host, args.Rid)
+        return nil, nil
+    },
+    "file_claim": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            queryArgs
+            Host  near.AccountID `json:"host"`
+            Query string         `json:"query"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.FileClaim(db3.DBId(args.Dbid), args.Qid, args.Host, args.Query)
+        return nil, nil
+    },
+    "answer_claim": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            queryArgs
+            Rid    db3.ResultCID `json:"rid"`
+            Result string        `json:"result"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        d.AnswerClaim(db3.DBId(args.Dbid), args.Qid, args.Rid, args.Result)
+        return nil, nil
+    },
+    "claim": func(d *db3.DB3, _ json.RawMessage) (interface{}, error) {
+        // the on-chain contract claims fees and royalties in one call
+        d.ClaimFees()
+        d.ClaimRoyalties()
+        return nil, nil
+    },
+    "finalize": func(d *db3.DB3, _ json.RawMessage) (interface{}, error) {
+        d.Finalize()
+        return nil, nil
+    },
+    "storage_deposit": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Account near.AccountID `json:"account_id"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        return newStorageBalance(d.StorageDeposit(args.Account)), nil
+    },
+    "storage_withdraw": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Amount string `json:"amount"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        var amount near.Money
+        if args.Amount != "" {
+            var err error
+            if amount, err = near.ParseYocto(args.Amount); err != nil {
+                return nil, err
+            }
+        }
+        return newStorageBalance(d.StorageWithdraw(amount)), nil
+    },
+    "storage_unregister": func(d *db3.DB3, _ json.RawMessage) (interface{}, error) {
+        return d.StorageUnregister(), nil
+    },
+    "recover": func(d *db3.DB3, buf json.RawMessage) (interface{}, error) {
+        var args struct {
+            Amount string         `json:"amount"`
+            Target near.AccountID `json:"target"`
+        }
+        if err := json.Unmarshal(buf, &args); err != nil {
+            return nil, err
+        }
+        amount, err := near.ParseYocto(args.Amount)
+        if err != nil {
+            return nil, err
+        }
+        d.Recover(amount, args.Target)
+        return nil, nil
+    },
+}
+
+// storage balance as returned by the contract in yoctoNEAR
+type storageBalance struct {
+    Total     string `json:"total"`
+    Available string `json:"available"`
+}
+
+func newStorageBalance(b db3.StorageBalance) storageBalance {
+    return storageBalance{Total: b.Total.Yocto(), Available: b.Available.Yocto()}
+}
+
+// flexInt decodes integers passed as JSON numbers or strings
+type flexInt int64
+
+func (i *flexInt) UnmarshalJSON(buf []byte) error {
+    v, err := strconv.ParseInt(strings.Trim(string(buf), `"`), 10, 64)
+    if err != nil {
+        return err
+    }
+    *i = flexInt(v)
+    return nil
+}
+
+func makekey(dbid db3.DBId, args ...interface{}) string {
+    parts := []string{strconv.FormatUint(uint64(dbid), 10)}
+    for _, v := range args {
+        parts = append(parts, fmt.Sprint(v))
+    }
+    return strings.Join(parts, "#")
+}
+
+func setAmount(m map[string]string, key string, v near.Money) {
+    if v > 0 {
+        m[key] = v.Yocto()
+    }
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+    var x, y interface{}
+    if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+        return false
+    }
+    return reflect.DeepEqual(x, y)
+}
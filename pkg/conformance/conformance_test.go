@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package conformance
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "github.com/stretchr/testify/assert"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// fixtures consumed by the TypeScript contract tests
+const FIXTURE_DIR = "../../contract/integration-tests/fixtures"
+
+var update = flag.Bool("update", false, "rewrite contract test fixtures")
+
+func loadScenarios(t *testing.T) []Scenario {
+    files, err := filepath.Glob("testdata/*.json")
+    assert.NoError(t, err, "list scenarios")
+    assert.NotEmpty(t, files, "scenarios")
+    scenarios := make([]Scenario, 0, len(files))
+    for _, name := range files {
+        buf, err := os.ReadFile(name)
+        assert.NoError(t, err, name)
+        var s Scenario
+        assert.NoError(t, json.Unmarshal(buf, &s), name)
+        scenarios = append(scenarios, s)
+    }
+    return scenarios
+}
+
+func TestScenarios(t *testing.T) {
+    for _, s := range loadScenarios(t) {
+        t.Run(s.Name, func(t *testing.T) {
+            res, d, err := Run(s)
+            if !assert.NoError(t, err, "run") {
+                return
+            }
+            for _, err := range s.Check(res, d) {
+                t.Error(err)
+            }
+            assert.NoError(t, d.CheckInvariants(), "invariants")
+
+            // fixtures carry the full recorded state
+            buf, err := json.MarshalIndent(s.Fixture(res, d), "", "  ")
+            assert.NoError(t, err, "encode fixture")
+            buf = append(buf, '\n')
+            name := filepath.Join(FIXTURE_DIR, s.Name+".json")
+            if *update {
+                assert.NoError(t, os.WriteFile(name, buf, 0644), "write fixture")
+                return
+            }
+            have, err := os.ReadFile(name)
+            assert.NoError(t, err, "read fixture, run with -update")
+            assert.True(t, bytes.Equal(have, buf), "fixture %s out of date, run with -update", name)
+        })
+    }
+}
+
+func TestCheck(t *testing.T) {
+    s := Scenario{
+        Name:  "check",
+        Owner: "owner",
+        Steps: []Step{
+            {Method: "recover", Caller: "owner", Args: []byte(`{"amount":"0","target":"owner"}`)},
+            {Method: "recover", Caller: "user", Args: []byte(`{"amount":"0","target":"user"}`)},
+        },
+    }
+    res, d, err := Run(s)
+    assert.NoError(t, err, "run")
+    assert.Equal(t, res[0].Error, "", "owner call")
+    assert.Equal(t, res[1].Error, "Must be contract owner to recover funds", "recorded error")
+    assert.Len(t, s.Check(res, d), 1, "unexpected error")
+
+    s.Steps[0].Error = "Amount"
+    s.Steps[1].Error = "contract owner"
+    assert.Len(t, s.Check(res, d), 1, "missing error")
+
+    s.Steps[0].Error = ""
+    slashed := "1"
+    s.State = &Snapshot{DbSlashed: &slashed, DbDeposits: map[string]string{"0#host": "1"}}
+    assert.Len(t, s.Check(res, d), 2, "state mismatch")
+}
+
+func TestRunFail(t *testing.T) {
+    _, _, err := Run(Scenario{Steps: []Step{{Method: "unknown"}}})
+    assert.Error(t, err, "unknown method")
+    _, _, err = Run(Scenario{Steps: []Step{{Method: "deposit", Args: []byte(`{"dbid":"x"}`)}}})
+    assert.Error(t, err, "malformed args")
+    _, _, err = Run(Scenario{Steps: []Step{{Method: "deposit", Amount: "1", Args: []byte(`{"dbid":"0"}`)}}})
+    assert.Error(t, err, "amount below model precision")
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "sort"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Token standards an access gate can check
+const (
+    GateFungibleToken    = "nep141" // holders of at least MinBalance tokens
+    GateNonFungibleToken = "nep171" // holders of at least MinBalance NFTs (NEP-181 nft_supply_for_owner)
+)
+
+// Access rules of a database. Only allowlisted users may escrow fees for
+// private databases. A gate lets holders of a token or NFT grant themselves
+// temporary access with RequestAccess.
+type AccessPolicy struct {
+    Private    bool
+    Gate       near.AccountID // token or NFT contract, empty without gate
+    Standard   string         // token standard of the gate
+    MinBalance near.Money     // smallest holding that grants access
+}
+
+// Allowlist entry of a user, storage is paid by the account that created
+// the entry and refunded to it on revoke
+type AccessGrant struct {
+    Account near.AccountID
+    Expires int64 // zero for grants that never expire
+    Payer   near.AccountID
+}
+
+// Sets the access policy of a database, public databases keep their
+// allowlist for when they turn private again
+// Called by: developer
+func (d *DB3) SetAccessPolicy(dbid DBId, p AccessPolicy) {
+    d.checkDatabaseOwner(dbid)
+    switch {
+    case p.Gate == "" && (p.Standard != "" || p.MinBalance > 0):
+        panic("Access gate without contract")
+    case p.Gate != "" && p.Standard != GateFungibleToken && p.Standard != GateNonFungibleToken:
+        panic("Unsupported gate standard")
+    case p.Gate != "" && !p.Private:
+        panic("Access gate requires a private database")
+    }
+    if p.Gate != "" && p.MinBalance == 0 {
+        p.MinBalance = 1
+    }
+    if p == (AccessPolicy{}) {
+        delete(d.Access, dbid)
+    } else {
+        d.Access[dbid] = p
+    }
+    d.emit("access_changed", AccessEvent{
+        Dbid:       dbid,
+        Private:    p.Private,
+        Gate:       p.Gate,
+        Standard:   p.Standard,
+        MinBalance: p.MinBalance,
+    })
+}
+
+// Views the access policy of a database
+// Called by: user
+func (d *DB3) AccessPolicy(dbid DBId) AccessPolicy {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    return d.Access[dbid]
+}
+
+// Adds users to the allowlist of a database without expiry, the caller
+// pays storage for new entries
+// Called by: developer
+func (d *DB3) AllowUsers(dbid DBId, accounts []near.AccountID) {
+    d.checkDatabaseOwner(dbid)
+    for _, acc := range accounts {
+        d.grantAccess(dbid, acc, 0)
+    }
+}
+
+// Removes users from the allowlist of a database
+// Called by: developer
+func (d *DB3) RevokeUsers(dbid DBId, accounts []near.AccountID) {
+    d.checkDatabaseOwner(dbid)
+    for _, acc := range accounts {
+        g, ok := d.Allowlists[dbid][acc]
+        if !ok {
+            continue
+        }
+        delete(d.Allowlists[dbid], acc)
+        d.refundStorage(g.Payer, STORAGE_ENTRY_COST)
+        d.emit("access_revoked", AccessGrantEvent{Dbid: dbid, Account: acc})
+    }
+}
+
+// Grants the caller access to a private database for ACCESS_GRANT_BLOCKS
+// when it holds the gate token, existing grants are renewed. The on-chain
+// contract checks the holding with a cross-contract call and grants access
+// in the callback, the result tells whether access was granted.
+// Called by: user
+func (d *DB3) RequestAccess(dbid DBId) bool {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    p := d.Access[dbid]
+    if p.Gate == "" {
+        panic("Database has no access gate")
+    }
+    var (
+        balance near.Money
+        err     error
+    )
+    if p.Standard == GateFungibleToken {
+        balance, err = near.FtBalanceOf(p.Gate, ctx.Caller)
+    } else {
+        balance, err = near.NftSupplyForOwner(p.Gate, ctx.Caller)
+    }
+    if err != nil || balance < p.MinBalance {
+        return false
+    }
+    if g, ok := d.Allowlists[dbid][ctx.Caller]; ok && g.Expires == 0 {
+        // keep permanent grants
+        return true
+    }
+    d.grantAccess(dbid, ctx.Caller, ctx.Height+ACCESS_GRANT_BLOCKS)
+    return true
+}
+
+// Views the allowlist of a database ordered by account, including
+// expired grants
+// Called by: developer
+func (d *DB3) Allowlist(dbid DBId) []AccessGrant {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    res := make([]AccessGrant, 0, len(d.Allowlists[dbid]))
+    for _, g := range d.Allowlists[dbid] {
+        res = append(res, g)
+    }
+    sort.Slice(res, func(i, j int) bool { return res[i].Account < res[j].Account })
+    return res
+}
+
+// Views whether an account may escrow fees for a database, nodes check
+// this before admitting a query
+// Called by: host
+func (d *DB3) HasAccess(dbid DBId, account near.AccountID) bool {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    if !d.Access[dbid].Private || account == d.Owners[dbid] {
+        return true
+    }
+    g, ok := d.Allowlists[dbid][account]
+    return ok && (g.Expires == 0 || g.Expires > ctx.Height)
+}
+
+// grantAccess upserts an allowlist entry, new entries are charged to the caller
+func (d *DB3) grantAccess(dbid DBId, account near.AccountID, expires int64) {
+    g, ok := d.Allowlists[dbid][account]
+    if !ok {
+        d.chargeStorage(ctx.Caller, 1)
+        g = AccessGrant{Account: account, Payer: ctx.Caller}
+        if _, ok := d.Allowlists[dbid]; !ok {
+            d.Allowlists[dbid] = make(map[near.AccountID]AccessGrant)
+        }
+    }
+    g.Expires = expires
+    d.Allowlists[dbid][account] = g
+    d.emit("access_granted", AccessGrantEvent{Dbid: dbid, Account: account, Expires: expires})
+}
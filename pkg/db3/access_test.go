@@ -0,0 +1,116 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+const NFT = "pass.near"
+
+func TestAccessAllowlist(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    assert.True(t, db.HasAccess(id, USER), "public by default")
+
+    // only allowlisted users may escrow fees for private databases
+    db.SetAccessPolicy(id, AccessPolicy{Private: true})
+    assert.Equal(t, filterEvents(db, "access_changed")[0].Data, AccessEvent{Dbid: id, Private: true}, "policy event")
+    assert.False(t, db.HasAccess(id, USER), "not allowlisted")
+    assert.True(t, db.HasAccess(id, CALLER), "owner")
+    setCtx(USER, PK, 100, 10)
+    assert.PanicsWithValue(t, "Database is private", func() { db.EscrowFee(id, "qid-1", 20, 0) }, "private escrow")
+    assert.Panics(t, func() { db.AllowUsers(id, []near.AccountID{USER}) }, "not owner")
+
+    setCtx(CALLER, PK, 0, 10)
+    storage := db.StorageBalanceOf(CALLER).Available
+    db.AllowUsers(id, []near.AccountID{USER, NO_CALLER})
+    db.AllowUsers(id, []near.AccountID{USER})
+    assert.Equal(t, db.StorageBalanceOf(CALLER).Available, storage-2*STORAGE_ENTRY_COST, "storage per entry")
+    assert.Equal(t, db.Allowlist(id), []AccessGrant{{NO_CALLER, 0, CALLER}, {USER, 0, CALLER}}, "allowlist")
+    assert.Len(t, filterEvents(db, "access_granted"), 3, "grant events")
+    setCtx(USER, PK, 100, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+
+    // revoked users lose access and storage is refunded
+    setCtx(CALLER, PK, 0, 11)
+    db.RevokeUsers(id, []near.AccountID{USER, OWNER})
+    assert.Equal(t, db.StorageBalanceOf(CALLER).Available, storage-STORAGE_ENTRY_COST, "storage refunded")
+    assert.Equal(t, filterEvents(db, "access_revoked")[0].Data, AccessGrantEvent{Dbid: id, Account: USER}, "revoke event")
+    setCtx(USER, PK, 100, 11)
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-2", 20, 0) }, "revoked")
+
+    // public databases keep their allowlist
+    setCtx(CALLER, PK, 0, 11)
+    db.SetAccessPolicy(id, AccessPolicy{})
+    assert.Empty(t, db.Access, "policy removed")
+    assert.Len(t, db.Allowlist(id), 1, "allowlist kept")
+    setCtx(USER, PK, 100, 11)
+    db.EscrowFee(id, "qid-2", 20, 0)
+
+    // invalid policies
+    setCtx(CALLER, PK, 0, 11)
+    assert.PanicsWithValue(t, "Access gate without contract", func() { db.SetAccessPolicy(id, AccessPolicy{Private: true, MinBalance: 5}) }, "no gate")
+    assert.PanicsWithValue(t, "Unsupported gate standard", func() { db.SetAccessPolicy(id, AccessPolicy{Private: true, Gate: TOKEN, Standard: "nep999"}) }, "standard")
+    assert.PanicsWithValue(t, "Access gate requires a private database", func() { db.SetAccessPolicy(id, AccessPolicy{Gate: TOKEN, Standard: GateFungibleToken}) }, "public gate")
+    assert.Panics(t, func() { db.HasAccess(9, USER) }, "unknown database")
+
+    // retiring a database releases allowlist storage
+    db.SetAccessPolicy(id, AccessPolicy{Private: true})
+    db.Deprecate(id, ctx.Height+MAX_BLOCKS_TO_SETTLE)
+    setCtx(CALLER, PK, 0, ctx.Height+MAX_BLOCKS_TO_SETTLE)
+    db.Retire(id)
+    assert.Empty(t, db.Allowlist(id), "allowlist removed")
+    assert.Equal(t, db.StorageBalanceOf(CALLER).Available, storage, "all storage refunded")
+}
+
+func TestAccessGate(t *testing.T) {
+    ft := near.NewFungibleToken(TOKEN)
+    ft.Mint(USER, 500)
+    nft := near.NewNonFungibleToken(NFT)
+    nft.Mint("pass-1", NO_CALLER)
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    nftId := deployTestDb(db, m1)
+    assert.PanicsWithValue(t, "Database has no access gate", func() { db.RequestAccess(id) }, "no gate")
+    db.SetAccessPolicy(id, AccessPolicy{Private: true, Gate: TOKEN, Standard: GateFungibleToken, MinBalance: 500})
+    db.SetAccessPolicy(nftId, AccessPolicy{Private: true, Gate: NFT, Standard: GateNonFungibleToken})
+    assert.Equal(t, db.AccessPolicy(nftId).MinBalance, near.Money(1), "default minimum")
+
+    // token holders grant themselves temporary access
+    setCtx(NO_CALLER, PK, 0, 10)
+    assert.False(t, db.RequestAccess(id), "no tokens")
+    assert.True(t, db.RequestAccess(nftId), "nft holder")
+    setCtx(USER, PK, 0, 10)
+    assert.False(t, db.RequestAccess(nftId), "no nft")
+    assert.True(t, db.RequestAccess(id), "token holder")
+    assert.Equal(t, db.Allowlist(id), []AccessGrant{{USER, 10 + ACCESS_GRANT_BLOCKS, USER}}, "expiring grant")
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, near.Money(1000-STORAGE_ENTRY_COST), "user pays storage")
+    setCtx(TOKEN, PK, 0, 11)
+    _, err := ft.TransferCall(USER, CONTRACT_ID, db, 100, `{"dbid":"0","qid":"qid-1","ttl":20}`)
+    assert.NoError(t, err, "token escrow")
+
+    // grants expire and renew while the balance lasts
+    setCtx(USER, PK, 0, 10+ACCESS_GRANT_BLOCKS)
+    assert.False(t, db.HasAccess(id, USER), "expired")
+    assert.False(t, db.RequestAccess(id), "balance too low")
+    ft.Mint(USER, 100)
+    storage := db.StorageBalanceOf(USER).Available
+    assert.True(t, db.RequestAccess(id), "renewed")
+    assert.True(t, db.HasAccess(id, USER), "renewed access")
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, storage, "renewal is free")
+
+    // permanent grants are kept
+    setCtx(CALLER, PK, 0, 10+ACCESS_GRANT_BLOCKS)
+    db.AllowUsers(nftId, []near.AccountID{NO_CALLER})
+    setCtx(NO_CALLER, PK, 0, 10+ACCESS_GRANT_BLOCKS)
+    assert.True(t, db.RequestAccess(nftId), "permanent")
+    assert.Equal(t, db.Allowlist(nftId)[0].Expires, int64(0), "not expiring")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "crypto/ed25519"
+    "encoding/binary"
+    "encoding/hex"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Domain tag that prefixes signed manifest payloads
+const MANIFEST_SIGNING_TAG = "db3-manifest"
+
+// Author key event data
+type AuthorKeyEvent struct {
+    Author near.AccountID `json:"author_id"`
+    Key    near.Pubkey    `json:"key"`
+}
+
+// Registers the access key that signs this call as manifest signing key of
+// the caller. Contracts cannot read access keys of other accounts, so the
+// registry is how deploys learn which keys belong to an author.
+// Called by: developer
+func (d *DB3) RegisterAuthorKey() {
+    key := ctx.SignedBy
+    if _, err := parseAuthorKey(key); err != nil {
+        panic("Invalid author key")
+    }
+    for _, k := range d.SigningKeys[ctx.Caller] {
+        if k == key {
+            panic("Author key already registered")
+        }
+    }
+    if len(d.SigningKeys[ctx.Caller]) >= MAX_AUTHOR_KEYS {
+        panic("Too many author keys")
+    }
+    d.chargeStorage(ctx.Caller, 1)
+    d.SigningKeys[ctx.Caller] = append(d.SigningKeys[ctx.Caller], key)
+    d.emit("author_key_added", AuthorKeyEvent{Author: ctx.Caller, Key: key})
+}
+
+// Removes a manifest signing key of the caller, published manifests stay
+// deployed but nodes no longer accept their signature
+// Called by: developer
+func (d *DB3) RemoveAuthorKey(key near.Pubkey) {
+    keys := d.SigningKeys[ctx.Caller]
+    for i, k := range keys {
+        if k != key {
+            continue
+        }
+        keys = append(keys[:i:i], keys[i+1:]...)
+        if len(keys) == 0 {
+            delete(d.SigningKeys, ctx.Caller)
+        } else {
+            d.SigningKeys[ctx.Caller] = keys
+        }
+        d.refundStorage(ctx.Caller, STORAGE_ENTRY_COST)
+        d.emit("author_key_removed", AuthorKeyEvent{Author: ctx.Caller, Key: key})
+        return
+    }
+    panic("Author key not registered")
+}
+
+// Views the manifest signing keys of an author
+// Called by: host, user
+func (d *DB3) AuthorKeys(author near.AccountID) []near.Pubkey {
+    return d.SigningKeys[author]
+}
+
+// ManifestPayload returns the bytes an author signs, the Borsh encoding of
+// the domain tag followed by every manifest field except the signature:
+// author, name, license and code CID as u32 length prefixed strings, royalty
+// bips as little endian u32, tags as u32 count of strings, min and max
+// quorum, fork and non-commercial royalty bips as u32, the attribution
+// string and the usage cap as u64.
+func ManifestPayload(m Manifest) []byte {
+    buf := make([]byte, 0, 128)
+    putString := func(s string) {
+        buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+        buf = append(buf, s...)
+    }
+    putString(MANIFEST_SIGNING_TAG)
+    putString(string(m.Author))
+    putString(m.Name)
+    putString(m.License)
+    putString(string(m.CID))
+    buf = binary.LittleEndian.AppendUint32(buf, uint32(m.RoyaltyBips))
+    buf = binary.LittleEndian.AppendUint32(buf, uint32(len(m.Tags)))
+    for _, tag := range m.Tags {
+        putString(tag)
+    }
+    for _, v := range []int{m.MinQuorum, m.MaxQuorum, m.ForkRoyaltyBips, m.NonCommercialRoyaltyBips} {
+        buf = binary.LittleEndian.AppendUint32(buf, uint32(v))
+    }
+    putString(m.Attribution)
+    return binary.LittleEndian.AppendUint64(buf, uint64(m.UsageCap))
+}
+
+// SignManifest sets the author key and signature of a manifest
+func SignManifest(m Manifest, key ed25519.PrivateKey) Manifest {
+    m.AuthorKey = near.Pubkey(hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+    m.Signature = near.Signature(hex.EncodeToString(ed25519.Sign(key, ManifestPayload(m))))
+    return m
+}
+
+// VerifyManifest checks the author signature of a manifest, it does not
+// check whether the key belongs to the author
+func VerifyManifest(m Manifest) bool {
+    pub, err := parseAuthorKey(m.AuthorKey)
+    if err != nil {
+        return false
+    }
+    sig, err := hex.DecodeString(string(m.Signature))
+    if err != nil || len(sig) != ed25519.SignatureSize {
+        return false
+    }
+    return ed25519.Verify(pub, ManifestPayload(m), sig)
+}
+
+// checkAuthor verifies the signature of signed manifests against the keys
+// the author registered, unsigned manifests are accepted but nodes refuse
+// to serve them. The payload does not cover the deploying account, so only
+// the author may submit a signed manifest.
+func (d *DB3) checkAuthor(m Manifest) {
+    if m.AuthorKey == "" && m.Signature == "" {
+        return
+    }
+    if m.AuthorKey == "" || m.Signature == "" {
+        panic("Incomplete author signature")
+    }
+    if ctx.Caller != m.Author {
+        panic("Signed manifests must be submitted by their author")
+    }
+    if !d.isAuthorKey(m.Author, m.AuthorKey) {
+        panic("Author key not registered")
+    }
+    if !VerifyManifest(m) {
+        panic("Invalid author signature")
+    }
+}
+
+func (d *DB3) isAuthorKey(author near.AccountID, key near.Pubkey) bool {
+    for _, k := range d.SigningKeys[author] {
+        if k == key {
+            return true
+        }
+    }
+    return false
+}
+
+// parseAuthorKey decodes a hex encoded ed25519 public key
+func parseAuthorKey(key near.Pubkey) (ed25519.PublicKey, error) {
+    buf, err := hex.DecodeString(string(key))
+    if err == nil && len(buf) != ed25519.PublicKeySize {
+        err = hex.ErrLength
+    }
+    return ed25519.PublicKey(buf), err
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "crypto/ed25519"
+    "encoding/hex"
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+var (
+    authorKey  = ed25519.NewKeyFromSeed([]byte("db3 test author key seed 0123456"))
+    otherKey   = ed25519.NewKeyFromSeed([]byte("db3 test other key seed 01234567"))
+    AUTHOR_PK  = hex.EncodeToString(authorKey.Public().(ed25519.PublicKey))
+    OTHER_PK   = hex.EncodeToString(otherKey.Public().(ed25519.PublicKey))
+    signedM1   = SignManifest(Manifest{Author: CALLER, Name: "Hello", License: "MIT", CID: "cid-1", RoyaltyBips: 1000}, authorKey)
+    INVALID_PK = "ed25519:not-hex"
+)
+
+func TestAuthorRegisterKey(t *testing.T) {
+    setCtx(CALLER, AUTHOR_PK, 0, 10)
+    db := newTestDB3()
+    db.RegisterAuthorKey()
+    assert.Equal(t, db.AuthorKeys(CALLER), []near.Pubkey{near.Pubkey(AUTHOR_PK)}, "registered key")
+    assert.Equal(t, db.StorageBalanceOf(CALLER).Available, near.Money(1000-STORAGE_ENTRY_COST), "key storage")
+    assert.Panics(t, func() { db.RegisterAuthorKey() }, "duplicate key")
+    assert.Len(t, filterEvents(db, "author_key_added"), 1, "key event")
+
+    setCtx(CALLER, INVALID_PK, 0, 10)
+    assert.Panics(t, func() { db.RegisterAuthorKey() }, "invalid key")
+
+    setCtx(CALLER, OTHER_PK, 0, 10)
+    db.RegisterAuthorKey()
+    assert.Len(t, db.AuthorKeys(CALLER), 2, "second key")
+    assert.Len(t, db.AuthorKeys(USER), 0, "other author")
+
+    db.RemoveAuthorKey(near.Pubkey(AUTHOR_PK))
+    assert.Equal(t, db.AuthorKeys(CALLER), []near.Pubkey{near.Pubkey(OTHER_PK)}, "removed key")
+    assert.Panics(t, func() { db.RemoveAuthorKey(near.Pubkey(AUTHOR_PK)) }, "unknown key")
+    db.RemoveAuthorKey(near.Pubkey(OTHER_PK))
+    assert.Len(t, db.SigningKeys, 0, "registry cleaned up")
+    assert.Equal(t, db.StorageBalanceOf(CALLER).Available, near.Money(1000), "storage refunded")
+    assert.Len(t, filterEvents(db, "author_key_removed"), 2, "remove events")
+}
+
+func TestAuthorSignedDeploy(t *testing.T) {
+    setCtx(CALLER, AUTHOR_PK, 0, 10)
+    db := newTestDB3()
+    assert.True(t, VerifyManifest(signedM1), "valid signature")
+    assert.Panics(t, func() { deployTestDb(db, signedM1) }, "key not registered")
+
+    db.RegisterAuthorKey()
+    id := deployTestDb(db, signedM1)
+    assert.Equal(t, db.Manifests[id].Signature, signedM1.Signature, "signature stored")
+
+    // the signature does not cover the owner, only the author may deploy it
+    setCtx(USER, PK, 0, 10)
+    assert.PanicsWithValue(t, "Signed manifests must be submitted by their author", func() { deployTestDb(db, signedM1) }, "deploy by other account")
+    setCtx(CALLER, AUTHOR_PK, 0, 10)
+
+    for name, m := range map[string]Manifest{
+        "Incomplete author signature": {Author: CALLER, CID: "cid-1", AuthorKey: signedM1.AuthorKey},
+        "Author key not registered":   SignManifest(Manifest{Author: CALLER, CID: "cid-1"}, otherKey),
+        "Author mismatch":             SignManifest(Manifest{Author: USER, CID: "cid-1"}, authorKey),
+        "Default author":              SignManifest(Manifest{CID: "cid-1"}, authorKey),
+    } {
+        m := m
+        assert.Panics(t, func() { deployTestDb(db, m) }, name)
+    }
+
+    // signed fields cannot change without a new signature
+    for name, f := range map[string]func(m *Manifest){
+        "name":    func(m *Manifest) { m.Name = "Bye" },
+        "license": func(m *Manifest) { m.License = "Apache-2.0" },
+        "cid":     func(m *Manifest) { m.CID = "cid-2" },
+        "royalty": func(m *Manifest) { m.RoyaltyBips = 0 },
+        "author":  func(m *Manifest) { m.Author = USER },
+        "tags":    func(m *Manifest) { m.Tags = []string{"defi"} },
+        "min":     func(m *Manifest) { m.MinQuorum = 2 },
+        "max":     func(m *Manifest) { m.MaxQuorum = 3 },
+        "fork":    func(m *Manifest) { m.ForkRoyaltyBips = 500 },
+        "nc":      func(m *Manifest) { m.NonCommercialRoyaltyBips = 100 },
+        "credit":  func(m *Manifest) { m.Attribution = "by someone else" },
+        "cap":     func(m *Manifest) { m.UsageCap = 10 },
+        "sig":     func(m *Manifest) { m.Signature = near.Signature(hex.EncodeToString(make([]byte, 64))) },
+        "hex":     func(m *Manifest) { m.Signature = "zz" },
+    } {
+        m := signedM1
+        f(&m)
+        assert.False(t, VerifyManifest(m), name)
+        assert.Panics(t, func() { deployTestDb(db, m) }, name)
+    }
+
+    // upgrades are checked the same way
+    setCtx(CALLER, AUTHOR_PK, 0, 10)
+    m := signedM1
+    m.CID = "cid-2"
+    assert.Panics(t, func() { db.Upgrade(id, m) }, "tampered upgrade")
+    m = SignManifest(Manifest{Author: CALLER, Name: "Hello", License: "MIT", CID: "cid-2"}, authorKey)
+    m.Author = ""
+    assert.NotPanics(t, func() { db.Upgrade(id, m) }, "signed upgrade inherits author")
+    assert.Equal(t, db.Manifests[id].Author, near.AccountID(CALLER), "inherited author")
+}
+
+func TestAuthorManifestPayload(t *testing.T) {
+    m := Manifest{
+        Author:                   "d",
+        Name:                     "a",
+        License:                  "MIT",
+        CID:                      "c",
+        RoyaltyBips:              258,
+        Tags:                     []string{"x", "yz"},
+        MinQuorum:                1,
+        MaxQuorum:                3,
+        ForkRoyaltyBips:          5,
+        NonCommercialRoyaltyBips: 6,
+        Attribution:              "b",
+        UsageCap:                 7,
+        AuthorKey:                near.Pubkey(AUTHOR_PK),
+    }
+    assert.Equal(t, hex.EncodeToString(ManifestPayload(m)),
+        "0c000000"+hex.EncodeToString([]byte(MANIFEST_SIGNING_TAG))+
+            "0100000064"+"0100000061"+"030000004d4954"+"0100000063"+"02010000"+
+            "02000000"+"0100000078"+"02000000797a"+
+            "01000000"+"03000000"+"05000000"+"06000000"+
+            "0100000062"+"0700000000000000", "payload layout")
+
+    // the signature itself is not covered
+    m.AuthorKey, m.Signature = "", "00"
+    assert.Equal(t, ManifestPayload(m), ManifestPayload(SignManifest(m, authorKey)), "signature fields")
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "crypto/sha256"
+    "encoding/base32"
+    "sort"
+    "strings"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Delivery receipt countersigned by a query payer after receiving a result
+type Receipt struct {
+    User near.AccountID
+    Rid  ResultCID
+}
+
+// Censorship claim of a query payer against a host that did not deliver a
+// result, the host must answer the query before the deadline
+type CensorshipClaim struct {
+    Qid      QueryCID
+    Host     near.AccountID
+    Claimant near.AccountID
+    Query    string
+    Deadline int64
+}
+
+// Receipt event data
+type ReceiptEvent struct {
+    Dbid DBId           `json:"dbid,string"`
+    Qid  QueryCID       `json:"qid"`
+    Host near.AccountID `json:"host"`
+    User near.AccountID `json:"user"`
+    Rid  ResultCID      `json:"rid"`
+}
+
+// Censorship claim event data, answers carry the posted result
+type CensorshipEvent struct {
+    Dbid     DBId           `json:"dbid,string"`
+    Qid      QueryCID       `json:"qid"`
+    Host     near.AccountID `json:"host"`
+    Claimant near.AccountID `json:"claimant"`
+    Deadline int64          `json:"deadline,string"`
+    Rid      ResultCID      `json:"rid,omitempty"`
+    Result   string         `json:"result,omitempty"`
+}
+
+// Countersigns delivery of a result by a host, this resolves open claims
+// of the caller against the host and blocks new ones
+// Called by: user
+func (d *DB3) SignReceipt(dbid DBId, qid QueryCID, host near.AccountID, rid ResultCID) {
+    d.checkPayer(dbid, qid)
+    if _, ok := d.Receipts[dbid][qid][host]; ok {
+        panic("Receipt already signed")
+    }
+    d.chargeQueryStorage(dbid, qid, 1)
+    if _, ok := d.Receipts[dbid][qid]; !ok {
+        d.Receipts[dbid][qid] = make(map[near.AccountID]Receipt)
+    }
+    d.Receipts[dbid][qid][host] = Receipt{User: ctx.Caller, Rid: rid}
+    d.emit("receipt_signed", ReceiptEvent{Dbid: dbid, Qid: qid, Host: host, User: ctx.Caller, Rid: rid})
+
+    // delivery acknowledged, withdraw the caller's claim
+    if c, ok := d.Claims[dbid][qid][host]; ok && c.Claimant == ctx.Caller {
+        d.closeClaim(dbid, c)
+    }
+}
+
+// Files a no response claim against an assigned host within the query TTL,
+// the host must post its result for the query or will be slashed. The query
+// must hash to the qid the caller paid for.
+// Called by: user
+func (d *DB3) FileClaim(dbid DBId, qid QueryCID, host near.AccountID, query string) {
+    d.checkPayer(dbid, qid)
+    if query == "" {
+        panic("Empty query")
+    }
+    if QueryCIDOf(query) != qid {
+        panic("Query does not match qid")
+    }
+    if _, ok := d.Deposits[dbid][host]; !ok {
+        panic("Host did not pay deposit")
+    }
+    if members, ok := d.Committees[dbid][qid]; ok && !isMember(members, host) {
+        panic("Host is not assigned to query")
+    }
+    if _, ok := d.Receipts[dbid][qid][host]; ok {
+        panic("Delivery receipt exists")
+    }
+    if _, ok := d.Claims[dbid][qid][host]; ok {
+        panic("Claim already filed")
+    }
+    d.chargeStorage(ctx.Caller, 1)
+    c := CensorshipClaim{
+        Qid:      qid,
+        Host:     host,
+        Claimant: ctx.Caller,
+        Query:    query,
+        Deadline: ctx.Height + d.Params.ClaimResponseBlocks,
+    }
+    if _, ok := d.Claims[dbid][qid]; !ok {
+        d.Claims[dbid][qid] = make(map[near.AccountID]CensorshipClaim)
+    }
+    d.Claims[dbid][qid][host] = c
+    d.emit("censorship_claimed", CensorshipEvent{
+        Dbid:     dbid,
+        Qid:      qid,
+        Host:     host,
+        Claimant: ctx.Caller,
+        Deadline: c.Deadline,
+    })
+}
+
+// Answers a claim against the caller by posting the query result on-chain,
+// results must match the caller's settled result
+// Called by: host
+func (d *DB3) AnswerClaim(dbid DBId, qid QueryCID, rid ResultCID, result string) {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    c, ok := d.Claims[dbid][qid][ctx.Caller]
+    if !ok {
+        panic("Claim does not exist")
+    }
+    if c.Deadline <= ctx.Height {
+        panic("Claim deadline passed")
+    }
+    if result == "" {
+        panic("Empty result")
+    }
+    if settled, ok := d.PendingResults[dbid][qid][ctx.Caller]; ok && settled != rid {
+        panic("Result does not match settled result")
+    }
+    d.closeClaim(dbid, c)
+    d.emit("claim_answered", CensorshipEvent{
+        Dbid:     dbid,
+        Qid:      qid,
+        Host:     ctx.Caller,
+        Claimant: c.Claimant,
+        Deadline: c.Deadline,
+        Rid:      rid,
+        Result:   result,
+    })
+}
+
+// Views open claims against a host, nodes poll this to answer in time
+// Called by: host
+func (d *DB3) OpenClaims(dbid DBId, host near.AccountID) []CensorshipClaim {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    claims := make([]CensorshipClaim, 0)
+    for _, m := range d.Claims[dbid] {
+        if c, ok := m[host]; ok {
+            claims = append(claims, c)
+        }
+    }
+    sort.Slice(claims, func(i, j int) bool { return claims[i].Qid < claims[j].Qid })
+    return claims
+}
+
+// QueryCIDOf returns the content id of a query, a CIDv1 with raw codec and
+// sha2-256 multihash in lower case base32 as IPFS assigns to raw blocks
+func QueryCIDOf(query string) QueryCID {
+    sum := sha256.Sum256([]byte(query))
+    buf := append([]byte{0x01, 0x55, 0x12, 0x20}, sum[:]...)
+    return QueryCID("b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)))
+}
+
+// checkPayer ensures the caller paid a fee for a pending query
+func (d *DB3) checkPayer(dbid DBId, qid QueryCID) {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    ttl, ok := d.ResultTTL[dbid][qid]
+    if !ok || ttl <= ctx.Height {
+        panic("Query is not pending")
+    }
+    if _, ok := d.QueryPayments[dbid][qid][ctx.Caller]; !ok {
+        panic("Caller did not pay for query")
+    }
+}
+
+// hasOpenClaims reports whether a host must still answer claims
+func (d *DB3) hasOpenClaims(dbid DBId, host near.AccountID) bool {
+    for _, m := range d.Claims[dbid] {
+        if _, ok := m[host]; ok {
+            return true
+        }
+    }
+    return false
+}
+
+// closeClaim removes a resolved claim and refunds the claimant's storage
+func (d *DB3) closeClaim(dbid DBId, c CensorshipClaim) {
+    delete(d.Claims[dbid][c.Qid], c.Host)
+    if len(d.Claims[dbid][c.Qid]) == 0 {
+        delete(d.Claims[dbid], c.Qid)
+    }
+    d.refundStorage(c.Claimant, STORAGE_ENTRY_COST)
+}
+
+// finalizeClaims slashes hosts that let claims expire. The slash goes to the
+// treasury in full, claimants and finalizers earn nothing so that filing
+// claims against honest hosts does not pay.
+func (d *DB3) finalizeClaims() {
+    for dbid, m := range d.Claims {
+        for _, hosts := range m {
+            for _, c := range hosts {
+                if c.Deadline > ctx.Height {
+                    continue
+                }
+                d.closeClaim(dbid, c)
+                amountToSlash := d.Deposits[dbid][c.Host].Mul(d.Params.SlashedDepositBips).Div(10000)
+                d.Deposits[dbid][c.Host] -= amountToSlash
+                d.distributeSlash(dbid, c.Qid, c.Host, amountToSlash, nil, "")
+            }
+        }
+    }
+}
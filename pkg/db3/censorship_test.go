@@ -0,0 +1,137 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+var (
+    QID_1 = QueryCIDOf("SELECT 1")
+    QID_2 = QueryCIDOf("SELECT 2")
+)
+
+// newClaimDB3 deploys a database with a registered host and two escrowed queries
+func newClaimDB3() (*DB3, DBId) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    db.Register(id, "api")
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, QID_1, 20, 0)
+    db.EscrowFee(id, QID_2, 20, 0)
+    return db, id
+}
+
+func TestReceipt(t *testing.T) {
+    db, id := newClaimDB3()
+    setCtx(NO_CALLER, PK, 0, 11)
+    assert.Panics(t, func() { db.SignReceipt(id, QID_1, CALLER, "rid-1") }, "not a payer")
+    setCtx(USER, PK, 0, 11)
+    assert.Panics(t, func() { db.SignReceipt(id, QueryCIDOf("SELECT 3"), CALLER, "rid-1") }, "unknown query")
+    db.SignReceipt(id, QID_1, CALLER, "rid-1")
+    assert.Equal(t, db.Receipts[id][QID_1][CALLER], Receipt{User: USER, Rid: "rid-1"}, "receipt stored")
+    assert.Equal(t, filterEvents(db, "receipt_signed")[0].Data, ReceiptEvent{id, QID_1, CALLER, USER, "rid-1"}, "receipt event")
+    assert.Panics(t, func() { db.SignReceipt(id, QID_1, CALLER, "rid-1") }, "duplicate receipt")
+    assert.Panics(t, func() { db.FileClaim(id, QID_1, CALLER, "SELECT 1") }, "delivery receipt exists")
+
+    // receipts are removed with their query
+    setCtx(USER, PK, 0, 20)
+    db.Finalize()
+    assert.Empty(t, db.Receipts[id], "receipts cleaned up")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestClaimAnswered(t *testing.T) {
+    db, id := newClaimDB3()
+    setCtx(USER, PK, 0, 11)
+    assert.Panics(t, func() { db.FileClaim(id, QID_1, CALLER, "") }, "empty query")
+    assert.Panics(t, func() { db.FileClaim(id, QID_1, NO_CALLER, "SELECT 1") }, "host without deposit")
+    assert.PanicsWithValue(t, "Query does not match qid", func() { db.FileClaim(id, QID_1, CALLER, "SELECT 2") }, "other query")
+    db.FileClaim(id, QID_1, CALLER, "SELECT 1")
+    assert.Panics(t, func() { db.FileClaim(id, QID_1, CALLER, "SELECT 1") }, "duplicate claim")
+    assert.Equal(t, db.OpenClaims(id, CALLER), []CensorshipClaim{{
+        Qid:      QID_1,
+        Host:     CALLER,
+        Claimant: USER,
+        Query:    "SELECT 1",
+        Deadline: 11 + CLAIM_RESPONSE_BLOCKS,
+    }}, "open claim")
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, near.Money(1000-9*STORAGE_ENTRY_COST), "claim storage charged")
+
+    // hosts cannot leave with open claims
+    setCtx(CALLER, PK, 0, 12)
+    assert.Panics(t, func() { db.Withdraw(id) }, "open claims")
+
+    // answers must match the settled result
+    db.Settle(id, QID_1, "rid-1")
+    assert.Panics(t, func() { db.AnswerClaim(id, QID_1, "rid-2", "42") }, "result mismatch")
+    assert.Panics(t, func() { db.AnswerClaim(id, QID_1, "rid-1", "") }, "empty result")
+    assert.Panics(t, func() { db.AnswerClaim(id, QID_2, "rid-1", "42") }, "no claim")
+    db.AnswerClaim(id, QID_1, "rid-1", "42")
+    assert.Empty(t, db.OpenClaims(id, CALLER), "claim closed")
+    assert.Equal(t, filterEvents(db, "claim_answered")[0].Data, CensorshipEvent{
+        Dbid:     id,
+        Qid:      QID_1,
+        Host:     CALLER,
+        Claimant: USER,
+        Deadline: 11 + CLAIM_RESPONSE_BLOCKS,
+        Rid:      "rid-1",
+        Result:   "42",
+    }, "answer event")
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, near.Money(1000-8*STORAGE_ENTRY_COST), "claim storage refunded")
+
+    // a receipt withdraws the claimant's claim
+    setCtx(USER, PK, 0, 13)
+    db.FileClaim(id, QID_2, CALLER, "SELECT 2")
+    db.SignReceipt(id, QID_2, CALLER, "rid-2")
+    assert.Empty(t, db.OpenClaims(id, CALLER), "claim withdrawn")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestClaimExpired(t *testing.T) {
+    db, id := newClaimDB3()
+    setCtx(USER, PK, 0, 11)
+    db.FileClaim(id, QID_1, CALLER, "SELECT 1")
+
+    // the claim outlives its query
+    setCtx(CALLER, PK, 0, 20)
+    db.Finalize()
+    assert.Len(t, db.OpenClaims(id, CALLER), 1, "claim still open")
+    setCtx(CALLER, PK, 0, 11+CLAIM_RESPONSE_BLOCKS)
+    assert.Panics(t, func() { db.AnswerClaim(id, QID_1, "rid-1", "42") }, "deadline passed")
+
+    // unanswered claims slash the host in favor of the treasury only
+    setCtx(NO_CALLER, PK, 0, 11+CLAIM_RESPONSE_BLOCKS)
+    db.Finalize()
+    assert.Empty(t, db.OpenClaims(id, CALLER), "claim closed")
+    assert.Equal(t, db.Deposits[id][CALLER], near.Money(7500), "host slashed")
+    assert.Equal(t, db.SettledFees[USER], near.Money(2000), "refund without claimant share")
+    assert.Equal(t, db.SettledFees[NO_CALLER], near.Money(0), "no finalizer share")
+    assert.Equal(t, db.Slashed, near.Money(2500), "slash to treasury")
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, near.Money(1000), "storage refunded")
+    setCtx(CALLER, PK, 0, 11+CLAIM_RESPONSE_BLOCKS)
+    assert.NotPanics(t, func() { db.Withdraw(id) }, "host may leave")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestClaimResponseWindow(t *testing.T) {
+    db, id := newClaimDB3()
+    db.Params.ClaimResponseBlocks = 1000
+    setCtx(USER, PK, 0, 11)
+    db.FileClaim(id, QID_1, CALLER, "SELECT 1")
+    assert.Equal(t, db.OpenClaims(id, CALLER)[0].Deadline, int64(1011), "governed deadline")
+    setCtx(CALLER, PK, 0, 1010)
+    db.AnswerClaim(id, QID_1, "rid-1", "42")
+    assert.Empty(t, db.OpenClaims(id, CALLER), "answered in window")
+}
+
+func TestQueryCID(t *testing.T) {
+    assert.Equal(t, QueryCIDOf(""), QueryCID("bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"), "empty block")
+    assert.NotEqual(t, QID_1, QID_2, "distinct queries")
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "time"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Estimate of the block production rate, used to convert TTL durations to
+// block heights. The contract samples block timestamps at most once per
+// window and smoothes the observed block time, so single slow blocks do not
+// move TTLs much.
+type BlockClock struct {
+    Height    int64 // height of the last sample
+    Timestamp int64 // block timestamp of the last sample in nanoseconds
+    BlockTime int64 // smoothed block time in nanoseconds, zero before the first sample
+}
+
+// Views the estimated block time
+// Called by: user
+func (d *DB3) BlockTime() time.Duration {
+    if d.Clock.BlockTime <= 0 {
+        return near.BLOCK_TIME
+    }
+    return time.Duration(d.Clock.BlockTime)
+}
+
+// Views the TTL height a query expires at when it should be answered within
+// a duration from now, at least the next block
+// Called by: user
+func (d *DB3) TTLWithin(within time.Duration) int64 {
+    if within <= 0 {
+        panic("TTL in the past")
+    }
+    return ctx.Height + near.BlocksWithin(within, d.BlockTime())
+}
+
+// Pays query fee like EscrowFee with a TTL given as duration from now
+// Called by: user (maybe injected by host)
+func (d *DB3) EscrowFeeWithin(dbid DBId, qid QueryCID, within time.Duration, quorum int) {
+    d.observeClock()
+    d.EscrowFee(dbid, qid, d.TTLWithin(within), quorum)
+}
+
+// observeClock samples the block timestamp of the current call. The first
+// call anchors the clock, later calls sample once a window has passed.
+func (d *DB3) observeClock() {
+    if ctx.Timestamp <= 0 {
+        return
+    }
+    c := &d.Clock
+    if c.Timestamp == 0 || ctx.Height < c.Height || ctx.Timestamp < c.Timestamp {
+        c.Height, c.Timestamp = ctx.Height, ctx.Timestamp
+        return
+    }
+    blocks := ctx.Height - c.Height
+    if blocks < CLOCK_WINDOW_BLOCKS {
+        return
+    }
+    sample := (ctx.Timestamp - c.Timestamp) / blocks
+    if c.BlockTime == 0 {
+        c.BlockTime = sample
+    } else {
+        c.BlockTime = (3*c.BlockTime + sample) / 4
+    }
+    c.Height, c.Timestamp = ctx.Height, ctx.Timestamp
+}
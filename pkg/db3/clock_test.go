@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+    "time"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// setClock sets the call context like setCtx with a block timestamp
+func setClock(caller string, amount int64, height int64, ts time.Duration) {
+    setCtx(caller, PK, amount, height)
+    ctx.Timestamp = int64(ts)
+}
+
+func TestBlockClock(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    assert.Equal(t, db.BlockTime(), near.BLOCK_TIME, "default block time")
+    assert.Equal(t, db.TTLWithin(5*time.Second), int64(15), "default conversion")
+    assert.Equal(t, db.TTLWithin(time.Millisecond), int64(11), "at least one block")
+    assert.Panics(t, func() { db.TTLWithin(0) }, "no duration")
+
+    // first timestamp anchors the clock
+    setClock(USER, 100, 100, 1000*time.Second)
+    db.EscrowFee(id, "qid-1", 200, 0)
+    assert.Equal(t, db.Clock, BlockClock{Height: 100, Timestamp: int64(1000 * time.Second)}, "anchored")
+
+    // samples are taken once per window
+    setClock(USER, 100, 150, 1100*time.Second)
+    db.EscrowFee(id, "qid-2", 200, 0)
+    assert.Equal(t, db.Clock.Height, int64(100), "within window")
+    setClock(USER, 100, 200, 1200*time.Second)
+    db.EscrowFee(id, "qid-3", 300, 0)
+    assert.Equal(t, db.BlockTime(), 2*time.Second, "first sample")
+    setClock(USER, 100, 300, 1300*time.Second)
+    db.EscrowFee(id, "qid-4", 400, 0)
+    assert.Equal(t, db.BlockTime(), 1750*time.Millisecond, "smoothed")
+
+    // durations convert with the estimated block time
+    setClock(USER, 100, 310, 1317*time.Second)
+    db.EscrowFeeWithin(id, "qid-5", 7*time.Second, 0)
+    assert.Equal(t, db.ResultTTL[id]["qid-5"], int64(314), "rounded up")
+    assert.Panics(t, func() { db.EscrowFeeWithin(id, "qid-6", 0, 0) }, "no duration")
+
+    // calls without timestamp keep the estimate
+    setCtx(USER, PK, 100, 500)
+    db.EscrowFee(id, "qid-7", 600, 0)
+    assert.Equal(t, db.Clock.Height, int64(300), "unknown timestamp")
+
+    // token fees accept durations too
+    setClock(TOKEN, 0, 500, 1650*time.Second)
+    db.FtOnTransfer(USER, 100, `{"dbid":"0","qid":"qid-8","within_ms":"3500"}`)
+    assert.Equal(t, db.ResultTTL[id]["qid-8"], int64(502), "token ttl")
+    assert.Panics(t, func() { db.FtOnTransfer(USER, 100, `{"dbid":"0","qid":"qid-9"}`) }, "missing ttl")
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "sort"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// SelectCommittee draws k hosts for a query from the block random seed. The
+// draw is a partial Fisher-Yates shuffle of the sorted host list driven by
+// sha256(seed || dbid || "#" || qid), so anyone who knows the seed can verify
+// an assignment. All hosts are selected when k exceeds the host count.
+func SelectCommittee(seed []byte, dbid DBId, qid QueryCID, hosts []near.AccountID, k int) []near.AccountID {
+    list := append([]near.AccountID{}, hosts...)
+    sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+    if k > len(list) {
+        k = len(list)
+    }
+    h := sha256.New()
+    h.Write(seed)
+    h.Write([]byte(makekey(dbkey(dbid), string(qid))))
+    base := h.Sum(nil)
+
+    var idx [4]byte
+    for i := 0; i < k; i++ {
+        binary.LittleEndian.PutUint32(idx[:], uint32(i))
+        r := sha256.Sum256(append(append([]byte{}, base...), idx[:]...))
+        j := i + int(binary.LittleEndian.Uint64(r[:8])%uint64(len(list)-i))
+        list[i], list[j] = list[j], list[i]
+    }
+    return list[:k]
+}
+
+// Committee assignment event data
+type CommitteeEvent struct {
+    Dbid    DBId             `json:"dbid,string"`
+    Qid     QueryCID         `json:"qid"`
+    Seed    string           `json:"seed"`
+    Members []near.AccountID `json:"members"`
+}
+
+// Views the hosts assigned to answer a pending query, an empty list means
+// any host with a security deposit may answer
+// Called by: user
+func (d *DB3) Committee(dbid DBId, qid QueryCID) []near.AccountID {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    return append([]near.AccountID{}, d.Committees[dbid][qid]...)
+}
+
+// Views pending queries a host is assigned to answer, nodes poll this to
+// learn their assignments
+// Called by: host
+func (d *DB3) Assignments(dbid DBId, host near.AccountID) []QueryCID {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    qids := make([]QueryCID, 0)
+    for qid, members := range d.Committees[dbid] {
+        if isMember(members, host) {
+            qids = append(qids, qid)
+        }
+    }
+    sort.Slice(qids, func(i, j int) bool { return qids[i] < qids[j] })
+    return qids
+}
+
+// committeeHosts returns registered hosts with a full security deposit
+func (d *DB3) committeeHosts(dbid DBId) []near.AccountID {
+    hosts := make([]near.AccountID, 0, len(d.ApiRegistry[dbid]))
+    for acc := range d.ApiRegistry[dbid] {
+        if d.Deposits[dbid][acc] >= d.Params.SecurityDeposit {
+            hosts = append(hosts, acc)
+        }
+    }
+    return hosts
+}
+
+// drawCommittee selects the committee of a new query, committees are never
+// smaller than the query quorum unless too few hosts are registered.
+// Committees of cross-database queries are drawn from hosts of all joined
+// databases.
+func (d *DB3) drawCommittee(dbid DBId, qid QueryCID, quorum int, shares []JoinShare) []near.AccountID {
+    k := d.Params.CommitteeSize
+    if quorum > k {
+        k = quorum
+    }
+    hosts := d.committeeHosts(dbid)
+    if len(shares) > 0 {
+        eligible := hosts[:0]
+        for _, acc := range hosts {
+            if d.joinEligible(shares, acc) {
+                eligible = append(eligible, acc)
+            }
+        }
+        hosts = eligible
+    }
+    return SelectCommittee(randomSeed(), dbid, qid, hosts, k)
+}
+
+// assignCommittee stores a drawn committee, storage must be charged by the caller
+func (d *DB3) assignCommittee(dbid DBId, qid QueryCID, members []near.AccountID) {
+    d.Committees[dbid][qid] = members
+    d.emit("committee_assigned", CommitteeEvent{
+        Dbid:    dbid,
+        Qid:     qid,
+        Seed:    hex.EncodeToString(randomSeed()),
+        Members: members,
+    })
+}
+
+// randomSeed returns the block random seed, outside a contract runtime the
+// seed is emulated by hashing the block height
+func randomSeed() []byte {
+    if len(ctx.RandomSeed) > 0 {
+        return ctx.RandomSeed
+    }
+    var buf [8]byte
+    binary.LittleEndian.PutUint64(buf[:], uint64(ctx.Height))
+    h := sha256.Sum256(buf[:])
+    return h[:]
+}
+
+func isMember(members []near.AccountID, acc near.AccountID) bool {
+    for _, v := range members {
+        if v == acc {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+func TestSelectCommittee(t *testing.T) {
+    hosts := []near.AccountID{"h1.near", "h2.near", "h3.near", "h4.near", "h5.near"}
+    seed := []byte("seed")
+    c := SelectCommittee(seed, 0, "qid-1", hosts, 3)
+    assert.Len(t, c, 3, "committee size")
+    assert.Subset(t, hosts, c, "members are hosts")
+    seen := make(map[near.AccountID]bool)
+    for _, v := range c {
+        assert.False(t, seen[v], "no duplicate members")
+        seen[v] = true
+    }
+
+    // the draw is verifiable, host order does not matter
+    reversed := []near.AccountID{"h5.near", "h4.near", "h3.near", "h2.near", "h1.near"}
+    assert.Equal(t, SelectCommittee(seed, 0, "qid-1", reversed, 3), c, "deterministic")
+    assert.Equal(t, hosts[0], near.AccountID("h1.near"), "input not modified")
+    assert.ElementsMatch(t, SelectCommittee(seed, 0, "qid-1", hosts, 10), hosts, "all hosts when k is larger")
+    assert.Empty(t, SelectCommittee(seed, 0, "qid-1", nil, 3), "no hosts")
+
+    // every host is drawn roughly equally often
+    counts := make(map[near.AccountID]int)
+    for i := 0; i < 1000; i++ {
+        for _, v := range SelectCommittee(seed, 0, QueryCID(dbkey(DBId(i))), hosts, 3) {
+            counts[v]++
+        }
+    }
+    for _, h := range hosts {
+        assert.InDelta(t, counts[h], 600, 90, "fair draw for %s", h)
+    }
+}
+
+func TestCommittee(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    hosts := []near.AccountID{"h1.near", "h2.near", "h3.near", "h4.near"}
+    for _, h := range hosts {
+        setCtx(string(h), PK, SECURITY_DEPOSIT, 10)
+        db.StorageDeposit("")
+        db.Deposit(id)
+        db.Register(id, "api")
+    }
+
+    // an unassigned host settles before the fee escrow is processed
+    setCtx(USER, PK, 0, 11)
+    c := SelectCommittee(randomSeed(), id, "qid-1", hosts, COMMITTEE_SIZE)
+    var outsider near.AccountID
+    for _, h := range hosts {
+        if !isMember(c, h) {
+            outsider = h
+        }
+    }
+    setCtx(string(outsider), PK, 0, 10)
+    db.Settle(id, "qid-1", "rid-2")
+
+    // the first escrow draws the committee
+    setCtx(USER, PK, 900, 11)
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-1", 20, 5) }, "quorum exceeds host count")
+    db.EscrowFee(id, "qid-1", 20, 0)
+    assert.Equal(t, db.Committee(id, "qid-1"), c, "committee assigned")
+    assert.Equal(t, filterEvents(db, "committee_assigned")[0].Data.(CommitteeEvent).Members, c, "committee event")
+    setCtx(USER, PK, 100, 12)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    assert.Equal(t, db.Committee(id, "qid-1"), c, "committee kept")
+    assert.Len(t, filterEvents(db, "committee_assigned"), 1, "assigned once")
+    assert.Equal(t, db.Assignments(id, c[0]), []QueryCID{"qid-1"}, "member assignment")
+    assert.Empty(t, db.Assignments(id, outsider), "outsider not assigned")
+
+    setCtx(string(outsider), PK, 0, 12)
+    assert.Panics(t, func() { db.Settle(id, "qid-1", "rid-2") }, "outsider rejected")
+    for _, h := range c {
+        setCtx(string(h), PK, 0, 12)
+        db.Settle(id, "qid-1", "rid-1")
+    }
+
+    // only committee votes count, the early outsider vote is ignored
+    setCtx(USER, PK, 0, 20)
+    db.Finalize()
+    for _, h := range c {
+        assert.Equal(t, db.SettledFees[h], near.Money(299), "member fee")
+    }
+    assert.Equal(t, db.Deposits[id][outsider], near.Money(SECURITY_DEPOSIT), "outsider not slashed")
+    assert.Empty(t, db.Committees[id], "committee cleaned up")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+
+    // databases without registered hosts are open to all depositors
+    setCtx(CALLER, PK, 0, 20)
+    open := deployTestDb(db, m1)
+    setCtx(USER, PK, 1000, 20)
+    db.EscrowFee(open, "qid-1", 30, 0)
+    assert.Empty(t, db.Committee(open, "qid-1"), "no committee")
+    setCtx(string(outsider), PK, SECURITY_DEPOSIT, 21)
+    db.Deposit(open)
+    assert.NotPanics(t, func() { db.Settle(open, "qid-1", "rid-1") }, "open settlement")
+}
@@ -9,20 +9,59 @@ import (
 
 type DB3 ContractState
 
+var _ Contract = (*DB3)(nil)
+
 func NewDB3() *DB3 {
     return &DB3{
-        Owner:            "blockwatch.near",
-        NextId:           0,
-        Owners:           make(map[DBId]near.AccountID),
-        Manifests:        make(map[DBId]Manifest),
-        ApiRegistry:      make(map[DBId]map[near.AccountID]ApiEndpoint),
-        Deposits:         make(map[DBId]map[near.AccountID]near.Money),
-        Slashed:          0,
-        ResultTTL:        make(map[DBId]map[QueryCID]int64),
-        PendingResults:   make(map[DBId]map[QueryCID]map[near.AccountID]ResultCID),
-        PendingFees:      make(map[DBId]map[QueryCID]near.Money),
-        SettledFees:      make(map[near.AccountID]near.Money),
-        SettledRoyalties: make(map[near.AccountID]near.Money),
+        Owner:                 "blockwatch.near",
+        Params:                DefaultParams(),
+        Proposals:             make(map[ProposalId]*Proposal),
+        NextId:                0,
+        Owners:                make(map[DBId]near.AccountID),
+        Manifests:             make(map[DBId]Manifest),
+        ManifestVersions:      make(map[DBId][]ManifestVersion),
+        ApiRegistry:           make(map[DBId]map[near.AccountID]ApiEndpoint),
+        PendingOwners:         make(map[DBId]near.AccountID),
+        RoyaltySplits:         make(map[DBId][]RoyaltyShare),
+        Access:                make(map[DBId]AccessPolicy),
+        Allowlists:            make(map[DBId]map[near.AccountID]AccessGrant),
+        Parents:               make(map[DBId]ForkLink),
+        Forks:                 make(map[DBId][]DBId),
+        Status:                make(map[DBId]DBStatus),
+        SunsetHeights:         make(map[DBId]int64),
+        StorageDeposits:       make(map[DBId]near.Money),
+        StoragePayers:         make(map[DBId]near.AccountID),
+        AuthorIndex:           make(map[near.AccountID][]DBId),
+        LicenseIndex:          make(map[string][]DBId),
+        TagIndex:              make(map[string][]DBId),
+        Deposits:              make(map[DBId]map[near.AccountID]near.Money),
+        Slashed:               0,
+        ResultTTL:             make(map[DBId]map[QueryCID]int64),
+        PendingResults:        make(map[DBId]map[QueryCID]map[near.AccountID]ResultCID),
+        PendingFees:           make(map[DBId]map[QueryCID]near.Money),
+        QueryVersions:         make(map[DBId]map[QueryCID]int),
+        QueryQuorums:          make(map[DBId]map[QueryCID]int),
+        QueryPayments:         make(map[DBId]map[QueryCID]map[near.AccountID]near.Money),
+        Committees:            make(map[DBId]map[QueryCID][]near.AccountID),
+        StorageCharges:        make(map[DBId]map[QueryCID]map[near.AccountID]near.Money),
+        Joins:                 make(map[DBId]map[QueryCID][]JoinShare),
+        QueryUses:             make(map[DBId]map[QueryCID]Use),
+        UsageCounts:           make(map[DBId]map[near.AccountID]int),
+        SigningKeys:           make(map[near.AccountID][]near.Pubkey),
+        History:               make(map[DBId][]ElectionOutcome),
+        StorageBalances:       make(map[near.AccountID]StorageBalance),
+        SettledFees:           make(map[near.AccountID]near.Money),
+        SettledRoyalties:      make(map[near.AccountID]near.Money),
+        Epochs:                make(map[DBId]*Epoch),
+        Vesting:               make(map[near.AccountID][]VestingGrant),
+        FeeTokens:             make(map[DBId]map[QueryCID]near.AccountID),
+        SettledTokenFees:      make(map[near.AccountID]map[near.AccountID]near.Money),
+        SettledTokenRoyalties: make(map[near.AccountID]map[near.AccountID]near.Money),
+        SlashedTokens:         make(map[near.AccountID]near.Money),
+        TokenInflows:          make(map[near.AccountID]near.Money),
+        TokenOutflows:         make(map[near.AccountID]near.Money),
+        Receipts:              make(map[DBId]map[QueryCID]map[near.AccountID]Receipt),
+        Claims:                make(map[DBId]map[QueryCID]map[near.AccountID]CensorshipClaim),
     }
 }
 
@@ -31,21 +70,34 @@ var (
     signer near.Signer
 )
 
-// Registers a new database
+// SetCallContext sets the transaction context for subsequent calls when the
+// model is driven outside a contract runtime, e.g. by simulations
+func SetCallContext(c near.CallContext) {
+    ctx = c
+}
+
+// Registers a new database, the attached storage deposit is refunded when
+// the database retires
 func (d *DB3) Deploy(m Manifest) DBId {
-    if m.RoyaltyBips < 0 || m.RoyaltyBips > 10000 {
-        panic("Royalty out of range")
-    }
-    if m.CID == "" {
-        panic("Empty code CID")
+    if ctx.Amount < STORAGE_COST {
+        panic("Attach at least " + near.Money(STORAGE_COST).Yocto() + " yoctoNEAR for storage")
     }
+    validateManifest(m)
     if m.Author == "" {
         m.Author = ctx.Caller
     }
+    d.checkAuthor(m)
 
     dbid := d.NextId
     d.Owners[dbid] = ctx.Caller
     d.Manifests[dbid] = m
+    d.ManifestVersions[dbid] = []ManifestVersion{{
+        Version:          0,
+        Manifest:         m,
+        ActivationHeight: ctx.Height,
+    }}
+    d.StorageDeposits[dbid] = d.receive()
+    d.StoragePayers[dbid] = ctx.Caller
 
     // allocate accounting maps
     d.ApiRegistry[dbid] = make(map[near.AccountID]ApiEndpoint)
@@ -53,6 +105,26 @@ func (d *DB3) Deploy(m Manifest) DBId {
     d.ResultTTL[dbid] = make(map[QueryCID]int64)
     d.PendingResults[dbid] = make(map[QueryCID]map[near.AccountID]ResultCID)
     d.PendingFees[dbid] = make(map[QueryCID]near.Money)
+    d.QueryVersions[dbid] = make(map[QueryCID]int)
+    d.QueryQuorums[dbid] = make(map[QueryCID]int)
+    d.QueryPayments[dbid] = make(map[QueryCID]map[near.AccountID]near.Money)
+    d.Committees[dbid] = make(map[QueryCID][]near.AccountID)
+    d.StorageCharges[dbid] = make(map[QueryCID]map[near.AccountID]near.Money)
+    d.Joins[dbid] = make(map[QueryCID][]JoinShare)
+    d.QueryUses[dbid] = make(map[QueryCID]Use)
+    d.UsageCounts[dbid] = make(map[near.AccountID]int)
+    d.Receipts[dbid] = make(map[QueryCID]map[near.AccountID]Receipt)
+    d.Claims[dbid] = make(map[QueryCID]map[near.AccountID]CensorshipClaim)
+    d.FeeTokens[dbid] = make(map[QueryCID]near.AccountID)
+
+    // update discovery indexes
+    d.indexDatabase(dbid, m)
+    d.emit("db_deployed", DeployEvent{
+        Dbid:    dbid,
+        Owner:   ctx.Caller,
+        Author:  m.Author,
+        CodeCID: m.CID,
+    })
 
     d.NextId++
     return dbid
@@ -63,14 +135,23 @@ func (d *DB3) Deposit(dbid DBId) {
     if dbid >= d.NextId {
         panic("Database id does not exist")
     }
-    deposit := d.Deposits[dbid][ctx.Caller]
-    if deposit+ctx.Amount < SECURITY_DEPOSIT {
+    if d.DatabaseStatus(dbid) == StatusRetired {
+        panic("Database is retired")
+    }
+    deposit, ok := d.Deposits[dbid][ctx.Caller]
+    if deposit+ctx.Amount < d.Params.SecurityDeposit {
         panic("Security deposit too low")
     }
-    d.Deposits[dbid][ctx.Caller] += ctx.Amount
+    if !ok {
+        d.chargeStorage(ctx.Caller, 1)
+    }
+    d.Deposits[dbid][ctx.Caller] += d.receive()
+    d.emit("deposit", DepositEvent{Dbid: dbid, Account: ctx.Caller, Amount: ctx.Amount})
 }
 
-// Unlocks and returns security deposit on leave
+// Unlocks and returns security deposit on leave and removes the host's API
+// registration. Hosts with open claims must answer them first, also after
+// a database retired.
 // Called by: host
 func (d *DB3) Withdraw(dbid DBId) {
     if dbid >= d.NextId {
@@ -80,8 +161,19 @@ func (d *DB3) Withdraw(dbid DBId) {
     if !ok {
         panic("Caller did not pay deposit")
     }
+    if d.hasOpenClaims(dbid, ctx.Caller) {
+        panic("Host has open claims")
+    }
     delete(d.Deposits[dbid], ctx.Caller)
-    near.TransferTo(ctx.Caller, deposit, signer)
+    d.refundStorage(ctx.Caller, STORAGE_ENTRY_COST)
+
+    // remove registrations, but keep in pending and settled maps
+    if _, ok := d.ApiRegistry[dbid][ctx.Caller]; ok {
+        delete(d.ApiRegistry[dbid], ctx.Caller)
+        d.refundStorage(ctx.Caller, STORAGE_ENTRY_COST)
+    }
+    d.transfer(ctx.Caller, deposit)
+    d.emit("withdraw", DepositEvent{Dbid: dbid, Account: ctx.Caller, Amount: deposit})
 }
 
 // Registers the host's API endpoint for a database
@@ -92,22 +184,37 @@ func (d *DB3) Register(dbid DBId, uri ApiEndpoint) {
     }
     // ensure security deposit is paid
     deposit := d.Deposits[dbid][ctx.Caller]
-    if deposit < SECURITY_DEPOSIT {
+    if deposit < d.Params.SecurityDeposit {
         panic("Security deposit too low")
     }
+    _, exists := d.ApiRegistry[dbid][ctx.Caller]
     if uri == "" {
         // remove
-        delete(d.ApiRegistry[dbid], ctx.Caller)
+        if exists {
+            delete(d.ApiRegistry[dbid], ctx.Caller)
+            d.refundStorage(ctx.Caller, STORAGE_ENTRY_COST)
+        }
     } else {
+        if d.DatabaseStatus(dbid) == StatusRetired {
+            panic("Database is retired")
+        }
+        if !exists {
+            d.chargeStorage(ctx.Caller, 1)
+        }
         // upsert
         d.ApiRegistry[dbid][ctx.Caller] = uri
     }
+    d.emit("api_registered", RegisterEvent{Dbid: dbid, Account: ctx.Caller, Uri: uri})
 }
 
 // Views all registered databases
 // Called by: user
 func (d *DB3) Databases() map[DBId]Manifest {
-    return d.Manifests
+    res := make(map[DBId]Manifest, len(d.Manifests))
+    for dbid := range d.Manifests {
+        res[dbid] = d.ActiveVersion(dbid, ctx.Height).Manifest
+    }
+    return res
 }
 
 // Views all registered API endpoints for a database
@@ -123,23 +230,150 @@ func (d *DB3) Discover(dbid DBId) []ApiEndpoint {
     return uris
 }
 
-// Pays query fee
+// Pays query fee and requests a replication quorum, a zero quorum uses the
+// database minimum. Queries that receive fewer votes than their quorum are
+// refunded to payers on finalization. The first escrow draws the committee
+// of hosts assigned to answer the query from the block random seed.
+// Called by: user (maybe injected by host)
+func (d *DB3) EscrowFee(dbid DBId, qid QueryCID, ttl int64, quorum int) {
+    d.EscrowFeeFor(dbid, qid, ttl, quorum, UseCommercial)
+}
+
+// Pays query fee like EscrowFee for commercial or non-commercial use, which
+// selects the royalty rate of the license. All payers of a query must
+// declare the same use.
 // Called by: user (maybe injected by host)
-func (d *DB3) EscrowFee(dbid DBId, qid QueryCID, ttl int64) {
+func (d *DB3) EscrowFeeFor(dbid DBId, qid QueryCID, ttl int64, quorum int, use Use) {
+    d.escrow(dbid, qid, ttl, quorum, ctx.Caller, "", ctx.Amount, nil, use)
+    d.receive()
+}
+
+// escrow accounts a fee paid by payer in NEAR (empty token) or a fungible
+// token, all fees of a query must be paid in the same token. Cross-database
+// queries declare their joined databases on first escrow.
+func (d *DB3) escrow(dbid DBId, qid QueryCID, ttl int64, quorum int, payer, token near.AccountID, amount near.Money, shares []JoinShare, use Use) {
     if dbid >= d.NextId {
         panic("Database id does not exist")
     }
+    d.observeClock()
+
+    if ttl <= ctx.Height {
+        panic("TTL in the past")
+    }
+
+    // private databases only serve allowlisted users
+    if !d.HasAccess(dbid, payer) {
+        panic("Database is private")
+    }
+
+    d.checkAccepting(dbid, ttl)
+
+    // the manifest version the query is bound to bounds its quorum,
+    // later escrows can only raise it
+    manifest := d.queryManifest(dbid, qid)
+    quorum = checkQuorum(manifest, quorum)
+    if quorum < d.QueryQuorums[dbid][qid] {
+        quorum = d.QueryQuorums[dbid][qid]
+    }
 
-    if ttl < ctx.Height {
-        panic("Fee payment is expired")
+    // fees of a query are split in a single token
+    _, escrowed := d.PendingFees[dbid][qid]
+    if escrowed && d.FeeTokens[dbid][qid] != token {
+        panic("Fee token mismatch")
+    }
+
+    // the license must permit the declared use and new payers count
+    // against its usage cap
+    counted := d.checkUse(manifest, dbid, qid, payer, use, escrowed)
+
+    // later escrows may omit the join but not change it
+    joined, isJoin := d.Joins[dbid][qid]
+    switch {
+    case shares == nil:
+        shares = joined
+    case escrowed && !sameJoin(joined, shares):
+        panic("Join mismatch")
+    case !escrowed:
+        d.checkJoin(dbid, ttl, payer, shares, use)
+    }
+
+    // draw a committee on first escrow, without registered hosts the query
+    // stays open to all hosts with a security deposit
+    committee, assigned := d.Committees[dbid][qid]
+    if !escrowed && !assigned {
+        committee = d.drawCommittee(dbid, qid, quorum, shares)
+    }
+    if len(committee) > 0 && quorum > len(committee) {
+        panic("Quorum exceeds committee size")
+    }
+
+    // charge storage for new pending query entries
+    var entries int
+    if !escrowed {
+        entries += 2
+        if token != "" {
+            entries++
+        }
+        if use != UseCommercial {
+            entries++
+        }
+    }
+    if _, ok := d.QueryPayments[dbid][qid][payer]; !ok {
+        entries++
+    }
+    if !assigned && len(committee) > 0 {
+        entries++
+    }
+    if !isJoin && len(shares) > 0 {
+        entries++
+    }
+    if entries > 0 {
+        d.chargeQueryStorageTo(dbid, qid, payer, entries)
+    }
+    if counted {
+        d.countUsage(dbid, payer)
+    }
+    if _, ok := d.QueryPayments[dbid][qid]; !ok {
+        d.QueryPayments[dbid][qid] = make(map[near.AccountID]near.Money)
     }
 
     // account fees paid
-    d.PendingFees[dbid][qid] += ctx.Amount
+    if !escrowed && token != "" {
+        d.FeeTokens[dbid][qid] = token
+    }
+    if !escrowed && use != UseCommercial {
+        d.QueryUses[dbid][qid] = use
+    }
+    d.PendingFees[dbid][qid] += amount
+    d.QueryPayments[dbid][qid][payer] += amount
+    d.QueryQuorums[dbid][qid] = quorum
 
     // store TTL unconditionally (this may override a TTL set via Settle,
     // but this case is expected)
     d.ResultTTL[dbid][qid] = ttl
+
+    // bind the query to the currently active code version
+    d.bindQueryVersion(dbid, qid)
+    d.emit("fee_escrowed", EscrowEvent{
+        Dbid:   dbid,
+        Qid:    qid,
+        Payer:  payer,
+        Amount: amount,
+        Token:  token,
+        TTL:    ttl,
+        Quorum: quorum,
+
+        NonCommercial: use == UseNonCommercial,
+    })
+    if !isJoin && len(shares) > 0 {
+        d.Joins[dbid][qid] = append([]JoinShare{}, shares...)
+        for _, s := range shares {
+            d.emit("query_joined", JoinEvent{Dbid: dbid, Qid: qid, Joined: s.Dbid, Bips: s.Bips})
+        }
+    }
+    if !assigned && len(committee) > 0 {
+        d.assignCommittee(dbid, qid, committee)
+    }
 }
 
 // Forwards fee payment tx and query execution proof
@@ -147,21 +381,39 @@ func (d *DB3) Settle(dbid DBId, qid QueryCID, rid ResultCID) {
     if dbid >= d.NextId {
         panic("Database id does not exist")
     }
+    d.observeClock()
 
     // check security deposit is sufficient
-    if d.Deposits[dbid][ctx.Caller] < SECURITY_DEPOSIT {
+    if d.Deposits[dbid][ctx.Caller] < d.Params.SecurityDeposit {
         panic("Security deposit too low")
     }
 
+    // only assigned hosts answer queries with a committee, results settled
+    // before the committee was drawn are ignored on finalization
+    if members, ok := d.Committees[dbid][qid]; ok && !isMember(members, ctx.Caller) {
+        panic("Host is not assigned to query")
+    }
+
+    // cross-database queries are answered by hosts of all joined databases
+    if shares, ok := d.Joins[dbid][qid]; ok && !d.joinEligible(shares, ctx.Caller) {
+        panic("Host is not registered for all joined databases")
+    }
+
     // check and init result TTL on first settlement (this should have been done
     // by calling EscrowFee, but we cannot assume this tx was published
     // or processed yet, this makes sure we can later garbage collect either way)
     ttl, ok := d.ResultTTL[dbid][qid]
     if !ok {
-        d.ResultTTL[dbid][qid] = ctx.Height + MAX_BLOCKS_TO_SETTLE
+        // only pending queries settle when the database is not active
+        if d.DatabaseStatus(dbid) != StatusActive {
+            panic("Database is not accepting queries")
+        }
+        d.chargeQueryStorage(dbid, qid, 1)
+        d.ResultTTL[dbid][qid] = ctx.Height + d.Params.MaxBlocksToSettle
+        d.bindQueryVersion(dbid, qid)
     } else if ttl <= ctx.Height {
         // TTL expired, we no longer accept results
-        return
+        panic("Settlement timed out")
     }
 
     // allocate sub map when this is the first call for this query
@@ -169,7 +421,11 @@ func (d *DB3) Settle(dbid DBId, qid QueryCID, rid ResultCID) {
         d.PendingResults[dbid][qid] = make(map[near.AccountID]ResultCID)
     }
     // store this host's result hash
+    if _, ok = d.PendingResults[dbid][qid][ctx.Caller]; !ok {
+        d.chargeQueryStorage(dbid, qid, 1)
+    }
     d.PendingResults[dbid][qid][ctx.Caller] = rid
+    d.emit("result_settled", SettleEvent{Dbid: dbid, Qid: qid, Host: ctx.Caller, Rid: rid})
 }
 
 // Sends settled fees and royalties to claimer
@@ -181,8 +437,9 @@ func (d *DB3) ClaimFees() {
     // check and return earned fees
     earned := d.SettledFees[ctx.Caller]
     if earned > 0 {
-        near.TransferTo(ctx.Caller, earned, signer)
+        d.transfer(ctx.Caller, earned)
         d.SettledFees[ctx.Caller] -= earned
+        d.emit("fees_claimed", ClaimEvent{Account: ctx.Caller, Amount: earned})
     }
 }
 
@@ -195,42 +452,120 @@ func (d *DB3) ClaimRoyalties() {
     // check and return earned fees
     earned := d.SettledRoyalties[ctx.Caller]
     if earned > 0 {
-        near.TransferTo(ctx.Caller, earned, signer)
+        d.transfer(ctx.Caller, earned)
         d.SettledRoyalties[ctx.Caller] -= earned
+        d.emit("royalties_claimed", ClaimEvent{Account: ctx.Caller, Amount: earned})
     }
 }
 
-// Recovers and transfers slashed funds
-// Called by: contract owner (DAO)
+// Finalizes all expired queries, this also happens on claims
+// Called by: anyone
+func (d *DB3) Finalize() {
+    d.finalizeResults()
+}
+
+// Recovers and transfers slashed funds, once a council is set up funds can
+// only be recovered through an approved governance proposal
+// Called by: contract owner
 func (d *DB3) Recover(amount near.Money, target near.AccountID) {
     if ctx.Caller != d.Owner {
         panic("Must be contract owner to recover funds")
     }
+    if len(d.Council) > 0 {
+        panic("Must recover funds through governance")
+    }
+    d.recover(amount, target)
+}
+
+func (d *DB3) recover(amount near.Money, target near.AccountID) {
     if d.Slashed < amount {
         panic("Amount is larger than available funds")
     }
     d.Slashed -= amount
-    near.TransferTo(target, amount, signer)
+    d.transfer(target, amount)
+    d.emit("funds_recovered", RecoverEvent{Target: target, Amount: amount})
 }
 
 func (d *DB3) finalizeResults() {
+    // slash hosts that did not answer censorship claims in time
+    d.finalizeClaims()
+
+    // pay out epochs that ended before fees of later queries are pooled
+    // into the next epoch, and release vested royalties
+    d.closeEpochs()
+    d.releaseVesting()
+
     // for all expired queries, check result ids match and split fees and slash any offenders
     for dbid, ttls := range d.ResultTTL {
-        royaltyBips := d.Manifests[dbid].RoyaltyBips
         for qid, ttl := range ttls {
             if ttl > ctx.Height {
                 continue
             }
 
+            // results are judged against the code version the query was bound to
+            manifest := d.queryManifest(dbid, qid)
+            royaltyBips := royaltyBips(manifest, d.QueryUses[dbid][qid])
+            quorum, ok := d.QueryQuorums[dbid][qid]
+            if !ok {
+                quorum = checkQuorum(manifest, 0)
+            }
+
             // fetch fee paid for this query; this assumes the fee payment transaction
             // was actually sent before TTL expired
-            if feeToSplit := d.PendingFees[dbid][qid]; feeToSplit > 0 {
+            feeToSplit := d.PendingFees[dbid][qid]
+            token := d.FeeTokens[dbid][qid]
+            votes := d.committeeVotes(dbid, qid)
+
+            // count votes in account order so payouts are reproducible
+            election := NewElection()
+            voters := make([]near.AccountID, 0, len(votes))
+            for acc := range votes {
+                voters = append(voters, acc)
+            }
+            sortAccounts(voters)
+            for _, acc := range voters {
+                election.AddVote(acc, votes[acc])
+            }
+
+            // keep an audit record of votes and payouts
+            out := d.newOutcome(dbid, qid, d.QueryVersions[dbid][qid], quorum, token, feeToSplit, votes)
+            if feeToSplit == 0 {
+                out.decide(OutcomeUnpaid, election)
+            }
+
+            if feeToSplit > 0 && len(votes) < quorum {
+                // too few hosts answered, refund payers without royalty or slashing
+                out.decide(OutcomeRefunded, election)
+                d.refundFee(dbid, qid, token, feeToSplit, out)
+            } else if feeToSplit > 0 {
 
                 // pay developer royalty
-                if royaltyBips > 0 {
+                if royaltyBips > 0 && d.epochMode(token) {
+                    // royalties vest at the end of the epoch
                     royaltyToPay := feeToSplit.Mul(royaltyBips).Div(10000)
-                    d.SettledRoyalties[d.Owners[dbid]] += royaltyToPay
                     feeToSplit -= royaltyToPay
+                    out.Royalty = royaltyToPay
+                    for _, join := range d.joinRoyalties(dbid, qid, token, royaltyToPay) {
+                        d.poolRoyalty(join.Dbid, qid, join.Amount)
+                    }
+                } else if royaltyBips > 0 {
+                    royaltyToPay := feeToSplit.Mul(royaltyBips).Div(10000)
+                    feeToSplit -= royaltyToPay
+                    out.Royalty = royaltyToPay
+                    royaltyDust := royaltyToPay
+                    for _, join := range d.joinRoyalties(dbid, qid, token, royaltyToPay) {
+                        for _, hop := range d.routeRoyalty(join.Dbid, qid, token, join.Amount) {
+                            for _, share := range d.RoyaltySplit(hop.Dbid) {
+                                shareToPay := hop.Amount.Mul(share.Bips).Div(10000)
+                                d.creditRoyalty(token, share.Account, shareToPay)
+                                royaltyDust -= shareToPay
+                                d.emit("royalty_paid", PayoutEvent{Dbid: hop.Dbid, Qid: qid, Account: share.Account, Amount: shareToPay, Token: token})
+                            }
+                        }
+                    }
+                    // send any dust to slashed
+                    d.collectDust(dbid, qid, token, royaltyDust)
+                    out.Dust += royaltyDust
                 }
 
                 // check results match, identify majority and slash offender
@@ -239,55 +574,196 @@ func (d *DB3) finalizeResults() {
                 // this mechanism is very simple and prone to sybil attacks, so don't
                 // use this in real life!
                 //
-                election := NewElection()
-                for acc, rid := range d.PendingResults[dbid][qid] {
-                    election.AddVote(acc, rid)
-                }
-
                 // check for majority
                 switch {
+                case election.IsSuperMajority() && d.epochMode(token):
+                    // fees are shared by correct results at the end of the epoch
+                    status := OutcomeSuperMajority
+                    if election.IsUnanimous() {
+                        status = OutcomeUnanimous
+                    }
+                    out.decide(status, election)
+                    d.poolFee(dbid, qid, feeToSplit, election.SuperMajority())
+                    out.Pooled = feeToSplit
+
+                    // slash minority and reward majority and finalizer
+                    d.slashMinority(dbid, qid, election, out)
+
                 case election.IsUnanimous():
                     // case 1: all agree on the same result, no slashing, split payout
+                    out.decide(OutcomeUnanimous, election)
                     feeShare := 10000 / election.NumSuperMajority()
                     feeToShare := feeToSplit.Mul(feeShare).Div(10000)
                     for _, v := range election.SuperMajority() {
                         feeToSplit -= feeToShare
-                        d.SettledFees[v.AccountId] += feeToShare
+                        d.creditFee(token, v.AccountId, feeToShare)
+                        out.FeeShares = append(out.FeeShares, Payout{v.AccountId, feeToShare})
+                        d.emit("fee_paid", PayoutEvent{Dbid: dbid, Qid: qid, Account: v.AccountId, Amount: feeToShare, Token: token})
                     }
                     // send any dust to slashed
-                    d.Slashed += feeToSplit
+                    d.collectDust(dbid, qid, token, feeToSplit)
+                    out.Dust += feeToSplit
 
                 case election.IsSuperMajority():
                     // case 2: a >=2/3 supermajority exists -> slash all minority members
+                    out.decide(OutcomeSuperMajority, election)
                     feeShare := 10000 / election.NumSuperMajority()
                     feeToShare := feeToSplit.Mul(feeShare).Div(10000)
                     for _, v := range election.SuperMajority() {
                         feeToSplit -= feeToShare
-                        d.SettledFees[v.AccountId] += feeToShare
+                        d.creditFee(token, v.AccountId, feeToShare)
+                        out.FeeShares = append(out.FeeShares, Payout{v.AccountId, feeToShare})
+                        d.emit("fee_paid", PayoutEvent{Dbid: dbid, Qid: qid, Account: v.AccountId, Amount: feeToShare, Token: token})
                     }
                     // send any dust to slashed
-                    d.Slashed += feeToSplit
+                    d.collectDust(dbid, qid, token, feeToSplit)
+                    out.Dust += feeToSplit
 
-                    // slash minority
-                    for _, v := range election.Minority() {
-                        amountToSlash := d.Deposits[dbid][v.AccountId] * 10000 / SLASHED_DEPOSIT_BIPS
-                        d.Slashed += amountToSlash
-                        d.Deposits[dbid][v.AccountId] -= amountToSlash
-                    }
+                    // slash minority and reward majority and finalizer
+                    d.slashMinority(dbid, qid, election, out)
 
                 default:
                     // case 3: no supermajority exists -> send all fees to slashed pool
                     // this case also applies when no result was published but the fee
                     // payment was received for some reason
-                    d.Slashed += feeToSplit
+                    out.decide(OutcomeNoMajority, election)
+                    d.collectDust(dbid, qid, token, feeToSplit)
+                    out.Dust += feeToSplit
                 }
 
             }
+            d.recordOutcome(dbid, out)
 
             // clean up maps
             delete(d.PendingFees[dbid], qid)
             delete(d.PendingResults[dbid], qid)
             delete(d.ResultTTL[dbid], qid)
+            delete(d.QueryVersions[dbid], qid)
+            delete(d.QueryQuorums[dbid], qid)
+            delete(d.QueryPayments[dbid], qid)
+            delete(d.Committees[dbid], qid)
+            delete(d.Receipts[dbid], qid)
+            delete(d.FeeTokens[dbid], qid)
+            delete(d.Joins[dbid], qid)
+            delete(d.QueryUses[dbid], qid)
+            d.refundQueryStorage(dbid, qid)
         }
     }
 }
+
+// committeeVotes returns the results settled by a query's committee, all
+// results count for queries without committee
+func (d *DB3) committeeVotes(dbid DBId, qid QueryCID) map[near.AccountID]ResultCID {
+    members, assigned := d.Committees[dbid][qid]
+    shares, joined := d.Joins[dbid][qid]
+    if !assigned && !joined {
+        return d.PendingResults[dbid][qid]
+    }
+    votes := make(map[near.AccountID]ResultCID)
+    for acc, rid := range d.PendingResults[dbid][qid] {
+        if assigned && !isMember(members, acc) {
+            continue
+        }
+        // hosts that left a joined database forfeit their vote
+        if joined && !d.joinEligible(shares, acc) {
+            continue
+        }
+        votes[acc] = rid
+    }
+    return votes
+}
+
+// refundFee credits unanswered query fees back to their payers as claimable
+// fees, fees without payment records are collected as dust
+func (d *DB3) refundFee(dbid DBId, qid QueryCID, token near.AccountID, fee near.Money, out *ElectionOutcome) {
+    payers := make([]near.AccountID, 0, len(d.QueryPayments[dbid][qid]))
+    for acc := range d.QueryPayments[dbid][qid] {
+        payers = append(payers, acc)
+    }
+    sortAccounts(payers)
+    for _, acc := range payers {
+        amount := d.QueryPayments[dbid][qid][acc]
+        d.creditFee(token, acc, amount)
+        fee -= amount
+        out.Refunds = append(out.Refunds, Payout{acc, amount})
+        d.emit("fee_refunded", PayoutEvent{Dbid: dbid, Qid: qid, Account: acc, Amount: amount, Token: token})
+    }
+    d.collectDust(dbid, qid, token, fee)
+    out.Dust += fee
+}
+
+// slashMinority slashes the deposits of all minority hosts and rewards the
+// majority and the finalizer, a finalizer in the minority earns no reward
+func (d *DB3) slashMinority(dbid DBId, qid QueryCID, e *Election, out *ElectionOutcome) {
+    finalizer := ctx.Caller
+    for _, v := range e.Minority() {
+        if v.AccountId == finalizer {
+            finalizer = ""
+        }
+    }
+    for _, v := range e.Minority() {
+        amountToSlash := d.Deposits[dbid][v.AccountId].Mul(d.Params.SlashedDepositBips).Div(10000)
+        d.Deposits[dbid][v.AccountId] -= amountToSlash
+        ev := d.distributeSlash(dbid, qid, v.AccountId, amountToSlash, e.SuperMajority(), finalizer)
+        out.Slashes = append(out.Slashes, Payout{v.AccountId, amountToSlash})
+        for _, m := range e.SuperMajority() {
+            out.reward(m.AccountId, ev.MajorityShare.Div(len(e.SuperMajority())))
+        }
+        out.reward(finalizer, ev.FinalizerShare)
+    }
+}
+
+// distributeSlash shares a slashed deposit between majority hosts and the
+// account that triggered finalization, the remainder goes to treasury. An
+// empty majority or finalizer forfeits its share to treasury.
+func (d *DB3) distributeSlash(dbid DBId, qid QueryCID, offender near.AccountID, amount near.Money, majority []Vote, finalizer near.AccountID) SlashEvent {
+    ev := SlashEvent{
+        Dbid:      dbid,
+        Qid:       qid,
+        Account:   offender,
+        Amount:    amount,
+        Finalizer: finalizer,
+    }
+    for _, v := range majority {
+        hostShare := amount.Mul(d.Params.SlashMajorityBips).Div(10000).Div(len(majority))
+        d.SettledFees[v.AccountId] += hostShare
+        ev.MajorityShare += hostShare
+        d.emit("slash_reward", PayoutEvent{Dbid: dbid, Qid: qid, Account: v.AccountId, Amount: hostShare})
+    }
+    if finalizer != "" {
+        ev.FinalizerShare = amount.Mul(d.Params.SlashFinalizerBips).Div(10000)
+    }
+    if ev.FinalizerShare > 0 {
+        d.SettledFees[finalizer] += ev.FinalizerShare
+        d.emit("slash_reward", PayoutEvent{Dbid: dbid, Qid: qid, Account: finalizer, Amount: ev.FinalizerShare})
+    }
+    ev.TreasuryShare = amount - ev.MajorityShare - ev.FinalizerShare
+    d.Slashed += ev.TreasuryShare
+    d.emit("host_slashed", ev)
+    return ev
+}
+
+// collectDust sends unpaid fee remainders to the slashed pool of their token
+func (d *DB3) collectDust(dbid DBId, qid QueryCID, token near.AccountID, amount near.Money) {
+    if amount == 0 {
+        return
+    }
+    if token == "" {
+        d.Slashed += amount
+    } else {
+        d.SlashedTokens[token] += amount
+    }
+    d.emit("dust_collected", PayoutEvent{Dbid: dbid, Qid: qid, Amount: amount, Token: token})
+}
+
+// receive accepts the attached deposit of the current call
+func (d *DB3) receive() near.Money {
+    d.TotalInflows += ctx.Amount
+    return ctx.Amount
+}
+
+// transfer sends funds out of the contract
+func (d *DB3) transfer(target near.AccountID, amount near.Money) {
+    d.TotalOutflows += amount
+    near.TransferTo(target, amount, signer)
+}
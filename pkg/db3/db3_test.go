@@ -27,20 +27,50 @@ const (
 )
 
 var (
+    // free-form licenses like "n/a" no longer validate, see TestLicenseLegacy
     m1 = Manifest{
         Author:      "blockwatch.near",
         Name:        "Hello",
-        License:     "n/a",
+        License:     "NOASSERTION",
         CID:         "cid-1",
         RoyaltyBips: 1000,
     }
 )
 
-func TestDeploy(t *testing.T) {
-    setCtx(CALLER, PK, 0, 10)
+// newTestDB3 creates a contract with 1000 available storage balance for
+// test accounts, their balance records are paid like in StorageDeposit
+func newTestDB3() *DB3 {
     db := NewDB3()
-    id := db.Deploy(m1)
+    for _, acc := range []near.AccountID{CALLER, USER, NO_CALLER} {
+        db.StorageBalances[acc] = StorageBalance{Total: 1000 + STORAGE_ENTRY_COST, Available: 1000}
+        db.TotalInflows += 1000 + STORAGE_ENTRY_COST
+    }
+    return db
+}
+
+// deployTestDb deploys a database with the required storage deposit attached
+func deployTestDb(db *DB3, m Manifest) DBId {
+    amount := ctx.Amount
+    ctx.Amount = STORAGE_COST
+    defer func() { ctx.Amount = amount }()
+    return db.Deploy(m)
+}
+
+// forkTestDb forks a database with the required storage deposit attached
+func forkTestDb(db *DB3, parent DBId, m Manifest) DBId {
+    amount := ctx.Amount
+    ctx.Amount = STORAGE_COST
+    defer func() { ctx.Amount = amount }()
+    return db.Fork(parent, m)
+}
+
+func TestDeploy(t *testing.T) {
+    setCtx(CALLER, PK, STORAGE_COST-1, 10)
+    db := newTestDB3()
+    assert.Panics(t, func() { db.Deploy(m1) }, "storage deposit too low")
+    id := deployTestDb(db, m1)
     assert.Equal(t, id, DBId(0), "first id")
+    assert.Equal(t, db.StorageDeposits[id], near.Money(STORAGE_COST), "storage deposit")
     assert.Len(t, db.Manifests, 1, "manifest is stored")
     assert.NotNil(t, db.ApiRegistry[id], "registry map entry exists")
     assert.NotNil(t, db.Deposits[id], "deposits map entry exists")
@@ -48,9 +78,9 @@ func TestDeploy(t *testing.T) {
     assert.NotNil(t, db.PendingResults[id], "results map entry exists")
     assert.NotNil(t, db.PendingFees[id], "fees map entry exists")
 
-    id = db.Deploy(Manifest{
+    id = deployTestDb(db, Manifest{
         Name:        "Second without author",
-        License:     "n/a",
+        License:     "NOASSERTION",
         CID:         "cid-2",
         RoyaltyBips: 1000,
     })
@@ -64,10 +94,10 @@ func TestDeploy(t *testing.T) {
     assert.NotNil(t, db.PendingFees[id], "fees map entry exists")
 
     assert.Panics(t, func() {
-        db.Deploy(Manifest{
+        deployTestDb(db, Manifest{
             Name:        "Negative royalty",
             Author:      "blockwatch.near",
-            License:     "n/a",
+            License:     "NOASSERTION",
             CID:         "cid-1",
             RoyaltyBips: -1,
         })
@@ -75,10 +105,10 @@ func TestDeploy(t *testing.T) {
     assert.Len(t, db.Manifests, 2, "manifest is not stored")
 
     assert.Panics(t, func() {
-        db.Deploy(Manifest{
+        deployTestDb(db, Manifest{
             Name:        "large royalty",
             Author:      "blockwatch.near",
-            License:     "n/a",
+            License:     "NOASSERTION",
             CID:         "cid-1",
             RoyaltyBips: 10001,
         })
@@ -88,33 +118,36 @@ func TestDeploy(t *testing.T) {
 
 func TestDepositSuccess(t *testing.T) {
     setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
-    db := NewDB3()
-    id := db.Deploy(m1)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
     assert.NotPanics(t, func() { db.Deposit(id) }, "successful deposit")
     assert.Equal(t, db.Deposits[id][CALLER], near.Money(SECURITY_DEPOSIT), "correct deposit")
 }
 
 func TestDepositFail(t *testing.T) {
     setCtx(CALLER, PK, 1, 10)
-    db := NewDB3()
-    id := db.Deploy(m1)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
     assert.Panics(t, func() { db.Deposit(id + 1) }, "no db")
     assert.Panics(t, func() { db.Deposit(id) }, "wrong deposit amount")
 }
 
 func TestWithdrawSuccess(t *testing.T) {
     setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
-    db := NewDB3()
-    id := db.Deploy(m1)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
     db.Deposit(id)
+    db.Register(id, "myurl")
     assert.NotPanics(t, func() { db.Withdraw(id) }, "successful withdraw")
     assert.Zero(t, db.Deposits[id][CALLER], "zero deposit")
+    assert.Empty(t, db.Discover(id), "registration removed")
+    assert.Equal(t, db.StorageBalances[CALLER].Available, near.Money(1000), "storage refunded")
 }
 
 func TestWithdrawFail(t *testing.T) {
     setCtx(CALLER, PK, 1, 10)
-    db := NewDB3()
-    id := db.Deploy(m1)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
     assert.Panics(t, func() { db.Deposit(id + 1) }, "no db")
     setCtx(NO_CALLER, PK, 1, 10)
     assert.Panics(t, func() { db.Withdraw(id) }, "no deposit")
@@ -122,8 +155,8 @@ func TestWithdrawFail(t *testing.T) {
 
 func TestRegisterSuccess(t *testing.T) {
     setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
-    db := NewDB3()
-    id := db.Deploy(m1)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
     db.Deposit(id)
     assert.NotPanics(t, func() { db.Register(id, "myurl") }, "successful register")
     assert.Len(t, db.Discover(id), 1, "uri is discoverable")
@@ -139,8 +172,8 @@ func TestRegisterSuccess(t *testing.T) {
 
 func TestRegisterFail(t *testing.T) {
     setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
-    db := NewDB3()
-    id := db.Deploy(m1)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
     db.Deposit(id)
     assert.Panics(t, func() { db.Register(id+1, "api") }, "no db")
     // simulate slash
@@ -150,22 +183,167 @@ func TestRegisterFail(t *testing.T) {
 
 func TestFeeSuccess(t *testing.T) {
     setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
-    db := NewDB3()
-    id := db.Deploy(m1)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
     db.Deposit(id)
     setCtx(USER, PK, 1, 10)
-    assert.NotPanics(t, func() { db.EscrowFee(id, "cid-1", 10+MAX_BLOCKS_TO_SETTLE-1) }, "successful escrow")
+    assert.NotPanics(t, func() { db.EscrowFee(id, "cid-1", 10+MAX_BLOCKS_TO_SETTLE-1, 0) }, "successful escrow")
     assert.Equal(t, db.PendingFees[id]["cid-1"], near.Money(1), "correct fee")
 }
 
 func TestFeeFail(t *testing.T) {
     setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
-    db := NewDB3()
-    id := db.Deploy(m1)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
     db.Deposit(id)
-    assert.Panics(t, func() { db.EscrowFee(id+1, "qid-1", 10+MAX_BLOCKS_TO_SETTLE) }, "no db")
+    assert.Panics(t, func() { db.EscrowFee(id+1, "qid-1", 10+MAX_BLOCKS_TO_SETTLE, 0) }, "no db")
     setCtx(CALLER, PK, SECURITY_DEPOSIT, 1000)
-    assert.Panics(t, func() { db.EscrowFee(id, "qid-1", MAX_BLOCKS_TO_SETTLE) }, "expired")
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-1", MAX_BLOCKS_TO_SETTLE, 0) }, "expired")
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-1", 1000, 0) }, "ttl at current height")
+}
+
+func TestSettleTimeout(t *testing.T) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    setCtx(USER, PK, 1, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    setCtx(CALLER, PK, 0, 19)
+    assert.NotPanics(t, func() { db.Settle(id, "qid-1", "rid-1") }, "before ttl")
+    setCtx(CALLER, PK, 0, 20)
+    assert.Panics(t, func() { db.Settle(id, "qid-1", "rid-1") }, "at ttl")
+}
+
+func TestSlashDistribution(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    hosts := []near.AccountID{"h1.near", "h2.near", "h3.near"}
+    for _, h := range hosts {
+        setCtx(string(h), PK, SECURITY_DEPOSIT, 10)
+        db.StorageDeposit("")
+        db.Deposit(id)
+    }
+    settle := func(qid QueryCID, height int64) {
+        setCtx(USER, PK, 1000, height)
+        db.EscrowFee(id, qid, height+10, 0)
+        for i, h := range hosts {
+            setCtx(string(h), PK, 0, height+1)
+            db.Settle(id, qid, []ResultCID{"rid-1", "rid-1", "rid-2"}[i])
+        }
+    }
+
+    // default split: 50% majority, 10% finalizer, 40% treasury
+    settle("qid-1", 10)
+    setCtx(USER, PK, 0, 20)
+    db.Finalize()
+    assert.Equal(t, db.Deposits[id][hosts[2]], near.Money(7500), "offender slashed")
+    assert.Equal(t, db.SettledFees[hosts[0]], near.Money(450+625), "majority fee and slash share")
+    assert.Equal(t, db.SettledFees[hosts[1]], near.Money(450+625), "majority fee and slash share")
+    assert.Equal(t, db.SettledFees[USER], near.Money(250), "finalizer share")
+    assert.Equal(t, db.Slashed, near.Money(1000), "treasury share")
+    var ev SlashEvent
+    for _, e := range db.EventLog {
+        if e.Event == "host_slashed" {
+            ev = e.Data.(SlashEvent)
+        }
+    }
+    assert.Equal(t, ev, SlashEvent{
+        Dbid:           id,
+        Qid:            "qid-1",
+        Account:        hosts[2],
+        Amount:         2500,
+        Finalizer:      USER,
+        MajorityShare:  1250,
+        FinalizerShare: 250,
+        TreasuryShare:  1000,
+    }, "slash event")
+
+    // rewards are claimable like fees
+    setCtx(USER, PK, 0, 20)
+    db.ClaimFees()
+    assert.Equal(t, db.SettledFees[USER], near.Money(0), "finalizer claimed")
+
+    // zero shares send everything to treasury
+    db.Params.SlashMajorityBips = 0
+    db.Params.SlashFinalizerBips = 0
+    setCtx(string(hosts[2]), PK, 2500, 20)
+    db.Deposit(id)
+    settle("qid-2", 20)
+    setCtx(USER, PK, 0, 30)
+    db.Finalize()
+    assert.Equal(t, db.Slashed, near.Money(1000+2500), "all to treasury")
+    assert.Equal(t, db.SettledFees[USER], near.Money(0), "no finalizer share")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestSlashedFinalizer(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    hosts := []near.AccountID{"h1.near", "h2.near", "h3.near"}
+    for _, h := range hosts {
+        setCtx(string(h), PK, SECURITY_DEPOSIT, 10)
+        db.StorageDeposit("")
+        db.Deposit(id)
+    }
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    for i, h := range hosts {
+        setCtx(string(h), PK, 0, 11)
+        db.Settle(id, "qid-1", []ResultCID{"rid-1", "rid-1", "rid-2"}[i])
+    }
+
+    // the slashed host cannot earn the finalizer share of its own slash
+    setCtx(string(hosts[2]), PK, 0, 20)
+    db.Finalize()
+    assert.Equal(t, db.Deposits[id][hosts[2]], near.Money(7500), "offender slashed")
+    assert.Equal(t, db.SettledFees[hosts[2]], near.Money(0), "no finalizer share")
+    assert.Equal(t, db.Slashed, near.Money(1000+250), "finalizer share to treasury")
+    ev := filterEvents(db, "host_slashed")[0].Data.(SlashEvent)
+    assert.Equal(t, ev.Finalizer, near.AccountID(""), "no finalizer")
+    assert.Equal(t, ev.FinalizerShare, near.Money(0), "no finalizer share")
+    assert.Equal(t, ev.TreasuryShare, near.Money(1250), "treasury share")
+    out := db.Outcome(id, "qid-1")
+    assert.Len(t, out.Rewards, 2, "majority rewards only")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestQuorum(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    assert.Panics(t, func() { deployTestDb(db, Manifest{CID: "cid", MinQuorum: MAX_QUORUM + 1}) }, "min quorum too high")
+    assert.Panics(t, func() { deployTestDb(db, Manifest{CID: "cid", MinQuorum: 3, MaxQuorum: 2}) }, "max below min")
+    id := deployTestDb(db, Manifest{CID: "cid", RoyaltyBips: 1000, MinQuorum: 2, MaxQuorum: 3})
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+
+    setCtx(USER, PK, 1000, 10)
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-1", 20, 1) }, "below manifest minimum")
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-1", 20, 4) }, "above manifest maximum")
+    db.EscrowFee(id, "qid-1", 20, 0)
+    assert.Equal(t, db.QueryQuorums[id]["qid-1"], 2, "manifest minimum")
+    setCtx(NO_CALLER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 3)
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 2)
+    assert.Equal(t, db.QueryQuorums[id]["qid-1"], 3, "quorum only raised")
+    assert.Equal(t, db.QueryPayments[id]["qid-1"], map[near.AccountID]near.Money{USER: 2000, NO_CALLER: 1000}, "payments")
+
+    // a lone host does not reach quorum, payers are refunded in full
+    setCtx(CALLER, PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    setCtx(CALLER, PK, 0, 20)
+    db.Finalize()
+    assert.Equal(t, db.SettledFees[USER], near.Money(2000), "refund")
+    assert.Equal(t, db.SettledFees[NO_CALLER], near.Money(1000), "refund")
+    assert.Equal(t, db.SettledFees[CALLER], near.Money(0), "no fee")
+    assert.Equal(t, db.SettledRoyalties[CALLER], near.Money(0), "no royalty")
+    assert.Empty(t, db.QueryQuorums[id], "quorum cleaned up")
+    assert.Empty(t, db.QueryPayments[id], "payments cleaned up")
+    assert.Len(t, filterEvents(db, "fee_refunded"), 2, "refund events")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
 }
 
 // TODO:
@@ -0,0 +1,229 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "math/bits"
+    "sort"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Fee pool of a database in epoch payout mode. Fees of finalized queries
+// accumulate until the epoch ends and are then shared between hosts pro
+// rata to their correct results weighted by stake, royalties vest linearly
+// to the database's royalty beneficiaries. Remainders of integer division
+// carry over to the next epoch instead of being collected as dust.
+type Epoch struct {
+    Start     int64
+    End       int64
+    Fees      near.Money             // host fees incl. carry-over
+    Royalties near.Money             // developer royalties incl. carry-over
+    Results   map[near.AccountID]int // correct results per host
+}
+
+// Royalty granted at the end of an epoch, vests linearly from start to end
+type VestingGrant struct {
+    Dbid     DBId
+    Amount   near.Money
+    Released near.Money // already moved to settled royalties
+    Start    int64
+    End      int64
+}
+
+// Views the open payout epoch of a database, nil when no fees are pooled
+// Called by: host
+func (d *DB3) CurrentEpoch(dbid DBId) *Epoch {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    e, ok := d.Epochs[dbid]
+    if !ok {
+        return nil
+    }
+    res := *e
+    res.Results = make(map[near.AccountID]int, len(e.Results))
+    for acc, n := range e.Results {
+        res.Results[acc] = n
+    }
+    return &res
+}
+
+// Views royalty grants of an account that did not fully vest yet
+// Called by: developer
+func (d *DB3) VestingGrants(account near.AccountID) []VestingGrant {
+    return append([]VestingGrant{}, d.Vesting[account]...)
+}
+
+// epochMode reports whether fees of a finalized query are pooled, token
+// fees are always paid per query
+func (d *DB3) epochMode(token near.AccountID) bool {
+    return token == "" && d.Params.EpochBlocks > 0
+}
+
+// openEpoch returns the current epoch of a database, a new epoch starts
+// with the first pooled fee
+func (d *DB3) openEpoch(dbid DBId) *Epoch {
+    e, ok := d.Epochs[dbid]
+    if !ok {
+        e = &Epoch{
+            Start:   ctx.Height,
+            End:     ctx.Height + d.Params.EpochBlocks,
+            Results: make(map[near.AccountID]int),
+        }
+        d.Epochs[dbid] = e
+    }
+    return e
+}
+
+// poolRoyalty adds the royalty of a query to the epoch royalty pool
+func (d *DB3) poolRoyalty(dbid DBId, qid QueryCID, amount near.Money) {
+    if amount == 0 {
+        return
+    }
+    d.openEpoch(dbid).Royalties += amount
+    d.emit("royalty_pooled", PayoutEvent{Dbid: dbid, Qid: qid, Amount: amount})
+}
+
+// poolFee adds the host fee of a query to the epoch fee pool and counts
+// a correct result for each majority host
+func (d *DB3) poolFee(dbid DBId, qid QueryCID, amount near.Money, majority []Vote) {
+    e := d.openEpoch(dbid)
+    e.Fees += amount
+    d.emit("fee_pooled", PayoutEvent{Dbid: dbid, Qid: qid, Amount: amount})
+    for _, v := range majority {
+        e.Results[v.AccountId]++
+        d.emit("result_counted", PayoutEvent{Dbid: dbid, Qid: qid, Account: v.AccountId})
+    }
+}
+
+// closeEpochs distributes all epochs that reached their end height
+func (d *DB3) closeEpochs() {
+    for dbid, e := range d.Epochs {
+        if e.End > ctx.Height {
+            continue
+        }
+        d.closeEpoch(dbid, e)
+    }
+}
+
+// closeEpoch pays out an epoch and carries remainders over to the next one
+func (d *DB3) closeEpoch(dbid DBId, e *Epoch) {
+    // weigh correct results by the current stake of each host, hosts that
+    // withdrew their deposit forfeit their share
+    hosts := make([]near.AccountID, 0, len(e.Results))
+    for acc := range e.Results {
+        hosts = append(hosts, acc)
+    }
+    sort.Slice(hosts, func(i, j int) bool { return hosts[i] < hosts[j] })
+    weights := make([]uint64, len(hosts))
+    var total uint64
+    for i, acc := range hosts {
+        weights[i] = uint64(e.Results[acc]) * uint64(d.Deposits[dbid][acc])
+        total += weights[i]
+    }
+    var paid near.Money
+    if total > 0 {
+        for i, acc := range hosts {
+            share := mulDiv(e.Fees, weights[i], total)
+            if share == 0 {
+                continue
+            }
+            d.SettledFees[acc] += share
+            paid += share
+            d.emit("fee_paid", PayoutEvent{Dbid: dbid, Account: acc, Amount: share})
+        }
+    }
+
+    // royalties vest per beneficiary, forks pass a share up their chain
+    var granted near.Money
+    for _, hop := range d.routeRoyalty(dbid, "", "", e.Royalties) {
+        for _, share := range d.RoyaltySplit(hop.Dbid) {
+            amount := hop.Amount.Mul(share.Bips).Div(10000)
+            if amount == 0 {
+                continue
+            }
+            d.grantRoyalty(hop.Dbid, share.Account, amount)
+            granted += amount
+        }
+    }
+
+    carry := e.Fees - paid + e.Royalties - granted
+    d.emit("epoch_closed", EpochEvent{
+        Dbid:      dbid,
+        Start:     e.Start,
+        End:       e.End,
+        Fees:      paid,
+        Royalties: granted,
+        Carry:     carry,
+    })
+
+    // without epoch mode or once the database retired there is no next
+    // epoch, remainders are collected as dust
+    delete(d.Epochs, dbid)
+    if carry == 0 {
+        return
+    }
+    if d.Params.EpochBlocks == 0 || d.DatabaseStatus(dbid) == StatusRetired {
+        d.collectDust(dbid, "", "", carry)
+        return
+    }
+    next := d.openEpoch(dbid)
+    next.Fees = e.Fees - paid
+    next.Royalties = e.Royalties - granted
+}
+
+// grantRoyalty starts vesting an epoch royalty, royalties are credited
+// immediately without a vesting period
+func (d *DB3) grantRoyalty(dbid DBId, account near.AccountID, amount near.Money) {
+    if d.Params.VestingBlocks == 0 {
+        d.SettledRoyalties[account] += amount
+        d.emit("royalty_paid", PayoutEvent{Dbid: dbid, Account: account, Amount: amount})
+        return
+    }
+    d.Vesting[account] = append(d.Vesting[account], VestingGrant{
+        Dbid:   dbid,
+        Amount: amount,
+        Start:  ctx.Height,
+        End:    ctx.Height + d.Params.VestingBlocks,
+    })
+    d.emit("royalty_granted", PayoutEvent{Dbid: dbid, Account: account, Amount: amount})
+}
+
+// releaseVesting moves vested royalties to the claimable balance and
+// removes fully vested grants
+func (d *DB3) releaseVesting() {
+    for acc, grants := range d.Vesting {
+        kept := grants[:0]
+        for _, g := range grants {
+            vested := g.Amount
+            switch {
+            case ctx.Height <= g.Start:
+                vested = 0
+            case ctx.Height < g.End:
+                vested = mulDiv(g.Amount, uint64(ctx.Height-g.Start), uint64(g.End-g.Start))
+            }
+            if vested > g.Released {
+                d.SettledRoyalties[acc] += vested - g.Released
+                d.emit("royalty_vested", PayoutEvent{Dbid: g.Dbid, Account: acc, Amount: vested - g.Released})
+                g.Released = vested
+            }
+            if g.Released < g.Amount {
+                kept = append(kept, g)
+            }
+        }
+        if len(kept) == 0 {
+            delete(d.Vesting, acc)
+        } else {
+            d.Vesting[acc] = kept
+        }
+    }
+}
+
+// mulDiv computes a*b/c without intermediate overflow, b must not exceed c
+func mulDiv(a near.Money, b, c uint64) near.Money {
+    hi, lo := bits.Mul64(uint64(a), b)
+    q, _ := bits.Div64(hi, lo, c)
+    return near.Money(q)
+}
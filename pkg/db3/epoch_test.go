@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// newEpochDB3 deploys a database in epoch mode with two hosts of unequal
+// stake and two finalized queries
+func newEpochDB3() (*DB3, DBId) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    db.Params.EpochBlocks = 100
+    db.Params.VestingBlocks = 100
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    setCtx(NO_CALLER, PK, 2*SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    setCtx(USER, PK, 1001, 10)
+    db.EscrowFee(id, "qid-2", 20, 0)
+    setCtx(CALLER, PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    db.Settle(id, "qid-2", "rid-2")
+    setCtx(NO_CALLER, PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    setCtx(USER, PK, 0, 20)
+    db.Finalize()
+    return db, id
+}
+
+func TestEpochPool(t *testing.T) {
+    db, id := newEpochDB3()
+    assert.Empty(t, db.SettledFees, "no per query payout")
+    assert.Empty(t, db.SettledRoyalties, "no per query royalty")
+    assert.Equal(t, db.CurrentEpoch(id), &Epoch{
+        Start:     20,
+        End:       120,
+        Fees:      900 + 901,
+        Royalties: 100 + 100,
+        Results:   map[near.AccountID]int{CALLER: 2, NO_CALLER: 1},
+    }, "pooled fees")
+    assert.Len(t, filterEvents(db, "fee_pooled"), 2, "pool events")
+    assert.Empty(t, filterEvents(db, "dust_collected"), "no dust")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+
+    // token fees are paid per query
+    assert.False(t, db.epochMode("usdc.near"), "token fees")
+    assert.Panics(t, func() { db.CurrentEpoch(7) }, "unknown db")
+}
+
+func TestEpochPayout(t *testing.T) {
+    db, id := newEpochDB3()
+
+    // results are weighted by stake, the division remainder carries over
+    setCtx(USER, PK, 0, 120)
+    db.Finalize()
+    assert.Equal(t, db.SettledFees[CALLER], near.Money(900), "2 results at 1x stake")
+    assert.Equal(t, db.SettledFees[NO_CALLER], near.Money(900), "1 result at 2x stake")
+    assert.Equal(t, filterEvents(db, "epoch_closed")[0].Data, EpochEvent{id, 20, 120, 1800, 200, 1}, "epoch event")
+    assert.Equal(t, db.CurrentEpoch(id), &Epoch{
+        Start:   120,
+        End:     220,
+        Fees:    1,
+        Results: map[near.AccountID]int{},
+    }, "carry over")
+    assert.Equal(t, db.VestingGrants(CALLER), []VestingGrant{{Dbid: id, Amount: 200, Start: 120, End: 220}}, "royalty grant")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+
+    // royalties vest linearly
+    setCtx(CALLER, PK, 0, 170)
+    db.ClaimRoyalties()
+    assert.Equal(t, filterEvents(db, "royalties_claimed")[0].Data, ClaimEvent{Account: CALLER, Amount: 100}, "half vested")
+    assert.Equal(t, db.VestingGrants(CALLER)[0].Released, near.Money(100), "released")
+    setCtx(CALLER, PK, 0, 300)
+    db.Finalize()
+    assert.Equal(t, db.SettledRoyalties[CALLER], near.Money(100), "fully vested")
+    assert.Empty(t, db.VestingGrants(CALLER), "grant removed")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestEpochWithdraw(t *testing.T) {
+    db, id := newEpochDB3()
+
+    // hosts that leave before the epoch ends forfeit their share
+    setCtx(NO_CALLER, PK, 0, 50)
+    db.Withdraw(id)
+    setCtx(USER, PK, 0, 120)
+    db.Finalize()
+    assert.Equal(t, db.SettledFees[CALLER], near.Money(1801), "whole pool")
+    assert.Empty(t, db.SettledFees[NO_CALLER], "forfeited")
+    assert.Nil(t, db.CurrentEpoch(id), "nothing carried")
+
+    // leaving epoch mode collects remainders as dust
+    setCtx(CALLER, PK, 0, 120)
+    db.SetRoyaltySplit(id, []RoyaltyShare{{CALLER, 3333}, {USER, 6667}})
+    setCtx(USER, PK, 1001, 120)
+    db.EscrowFee(id, "qid-3", 130, 0)
+    setCtx(CALLER, PK, 0, 121)
+    db.Settle(id, "qid-3", "rid-3")
+    setCtx(CALLER, PK, 0, 130)
+    db.Finalize()
+    db.Params.EpochBlocks = 0
+    db.Params.VestingBlocks = 0
+    slashed := db.Slashed
+    setCtx(CALLER, PK, 0, 230)
+    db.Finalize()
+    assert.Equal(t, db.SettledFees[CALLER], near.Money(1801+901), "epoch paid")
+    assert.Equal(t, db.SettledRoyalties[CALLER], near.Money(200+33), "paid without vesting")
+    assert.Equal(t, db.SettledRoyalties[USER], near.Money(66), "paid without vesting")
+    assert.Equal(t, db.Slashed, slashed+1, "remainder collected")
+    assert.Nil(t, db.CurrentEpoch(id), "epoch mode off")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
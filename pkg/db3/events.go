@@ -0,0 +1,376 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "strconv"
+    "strings"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+const (
+    EVENT_STANDARD    = "db3"
+    EVENT_VERSION     = "1.0.0"
+    EVENT_JSON_PREFIX = "EVENT_JSON:"
+)
+
+// Contract event in NEP-297 format
+type Event struct {
+    Standard string      `json:"standard"`
+    Version  string      `json:"version"`
+    Event    string      `json:"event"`
+    Data     interface{} `json:"data"`
+}
+
+// Database deploy event data
+type DeployEvent struct {
+    Dbid    DBId           `json:"dbid,string"`
+    Owner   near.AccountID `json:"owner"`
+    Author  near.AccountID `json:"author_id"`
+    CodeCID CodeCID        `json:"code_cid"`
+}
+
+// Database fork event data
+type ForkEvent struct {
+    Dbid        DBId `json:"dbid,string"`
+    Parent      DBId `json:"parent,string"`
+    RoyaltyBips int  `json:"royalty_bips"`
+}
+
+// Code upgrade event data
+type UpgradeEvent struct {
+    Dbid             DBId    `json:"dbid,string"`
+    Version          int     `json:"version"`
+    CodeCID          CodeCID `json:"code_cid"`
+    ActivationHeight int64   `json:"activation_height,string"`
+}
+
+// Ownership transfer event data
+type OwnerEvent struct {
+    Dbid  DBId           `json:"dbid,string"`
+    Owner near.AccountID `json:"owner"`
+}
+
+// Host deposit and withdraw event data
+type DepositEvent struct {
+    Dbid    DBId           `json:"dbid,string"`
+    Account near.AccountID `json:"account_id"`
+    Amount  near.Money     `json:"amount,string"`
+}
+
+// API registration event data, an empty uri unregisters the host
+type RegisterEvent struct {
+    Dbid    DBId           `json:"dbid,string"`
+    Account near.AccountID `json:"account_id"`
+    Uri     ApiEndpoint    `json:"uri"`
+}
+
+// Access policy event data
+type AccessEvent struct {
+    Dbid       DBId           `json:"dbid,string"`
+    Private    bool           `json:"private"`
+    Gate       near.AccountID `json:"gate,omitempty"`
+    Standard   string         `json:"standard,omitempty"`
+    MinBalance near.Money     `json:"min_balance,string,omitempty"`
+}
+
+// Allowlist change event data
+type AccessGrantEvent struct {
+    Dbid    DBId           `json:"dbid,string"`
+    Account near.AccountID `json:"account_id"`
+    Expires int64          `json:"expires,string,omitempty"`
+}
+
+// Fee escrow event data
+type EscrowEvent struct {
+    Dbid   DBId           `json:"dbid,string"`
+    Qid    QueryCID       `json:"qid"`
+    Payer  near.AccountID `json:"payer"`
+    Amount near.Money     `json:"amount,string"`
+    Token  near.AccountID `json:"token,omitempty"` // empty for NEAR
+    TTL    int64          `json:"ttl,string"`
+    Quorum int            `json:"quorum"`
+
+    NonCommercial bool `json:"non_commercial,omitempty"`
+}
+
+// Result settlement event data
+type SettleEvent struct {
+    Dbid DBId           `json:"dbid,string"`
+    Qid  QueryCID       `json:"qid"`
+    Host near.AccountID `json:"host"`
+    Rid  ResultCID      `json:"rid"`
+}
+
+// Fee, royalty and dust payout event data emitted on finalization
+type PayoutEvent struct {
+    Dbid    DBId           `json:"dbid,string"`
+    Qid     QueryCID       `json:"qid"`
+    Account near.AccountID `json:"account_id"`
+    Amount  near.Money     `json:"amount,string"`
+    Token   near.AccountID `json:"token,omitempty"` // empty for NEAR
+}
+
+// Upstream royalty event data, emitted for each hop of a fork chain
+type ForkRoyaltyEvent struct {
+    Dbid   DBId           `json:"dbid,string"`
+    Parent DBId           `json:"parent,string"`
+    Qid    QueryCID       `json:"qid"`
+    Amount near.Money     `json:"amount,string"`
+    Token  near.AccountID `json:"token,omitempty"` // empty for NEAR
+}
+
+// Cross-database query event data, emitted for each joined database
+type JoinEvent struct {
+    Dbid   DBId     `json:"dbid,string"`
+    Qid    QueryCID `json:"qid"`
+    Joined DBId     `json:"joined,string"`
+    Bips   int      `json:"bips"`
+}
+
+// Royalty share of a joined database, emitted on finalization
+type JoinRoyaltyEvent struct {
+    Dbid   DBId           `json:"dbid,string"`
+    Joined DBId           `json:"joined,string"`
+    Qid    QueryCID       `json:"qid"`
+    Amount near.Money     `json:"amount,string"`
+    Token  near.AccountID `json:"token,omitempty"` // empty for NEAR
+}
+
+// Epoch payout event data
+type EpochEvent struct {
+    Dbid      DBId       `json:"dbid,string"`
+    Start     int64      `json:"start_height,string"`
+    End       int64      `json:"end_height,string"`
+    Fees      near.Money `json:"fees,string"`      // paid to hosts
+    Royalties near.Money `json:"royalties,string"` // granted to royalty beneficiaries
+    Carry     near.Money `json:"carry,string"`     // carried over to the next epoch
+}
+
+// Deposit slash event data with the slash distribution
+type SlashEvent struct {
+    Dbid           DBId           `json:"dbid,string"`
+    Qid            QueryCID       `json:"qid"`
+    Account        near.AccountID `json:"account_id"`
+    Amount         near.Money     `json:"amount,string"`
+    Finalizer      near.AccountID `json:"finalizer_id,omitempty"`
+    MajorityShare  near.Money     `json:"majority_share,string"`
+    FinalizerShare near.Money     `json:"finalizer_share,string"`
+    TreasuryShare  near.Money     `json:"treasury_share,string"`
+}
+
+// Fee and royalty claim event data
+type ClaimEvent struct {
+    Account near.AccountID `json:"account_id"`
+    Amount  near.Money     `json:"amount,string"`
+    Token   near.AccountID `json:"token,omitempty"` // empty for NEAR
+}
+
+// Slashed fund recovery event data
+type RecoverEvent struct {
+    Target near.AccountID `json:"target"`
+    Amount near.Money     `json:"amount,string"`
+}
+
+// event names mapped to their data types, used to decode logs
+var eventTypes = map[string]reflect.Type{
+    "db_deployed":        reflect.TypeOf(DeployEvent{}),
+    "db_forked":          reflect.TypeOf(ForkEvent{}),
+    "db_upgraded":        reflect.TypeOf(UpgradeEvent{}),
+    "author_key_added":   reflect.TypeOf(AuthorKeyEvent{}),
+    "author_key_removed": reflect.TypeOf(AuthorKeyEvent{}),
+    "owner_proposed":     reflect.TypeOf(OwnerEvent{}),
+    "owner_transferred":  reflect.TypeOf(OwnerEvent{}),
+    "owner_cancelled":    reflect.TypeOf(OwnerEvent{}),
+    "db_paused":          reflect.TypeOf(StatusEvent{}),
+    "db_resumed":         reflect.TypeOf(StatusEvent{}),
+    "db_deprecated":      reflect.TypeOf(StatusEvent{}),
+    "db_retired":         reflect.TypeOf(StatusEvent{}),
+    "storage_refunded":   reflect.TypeOf(PayoutEvent{}),
+    "deposit":            reflect.TypeOf(DepositEvent{}),
+    "withdraw":           reflect.TypeOf(DepositEvent{}),
+    "api_registered":     reflect.TypeOf(RegisterEvent{}),
+    "access_changed":     reflect.TypeOf(AccessEvent{}),
+    "access_granted":     reflect.TypeOf(AccessGrantEvent{}),
+    "access_revoked":     reflect.TypeOf(AccessGrantEvent{}),
+    "fee_escrowed":       reflect.TypeOf(EscrowEvent{}),
+    "committee_assigned": reflect.TypeOf(CommitteeEvent{}),
+    "query_joined":       reflect.TypeOf(JoinEvent{}),
+    "receipt_signed":     reflect.TypeOf(ReceiptEvent{}),
+    "censorship_claimed": reflect.TypeOf(CensorshipEvent{}),
+    "claim_answered":     reflect.TypeOf(CensorshipEvent{}),
+    "result_settled":     reflect.TypeOf(SettleEvent{}),
+    "fee_paid":           reflect.TypeOf(PayoutEvent{}),
+    "royalty_paid":       reflect.TypeOf(PayoutEvent{}),
+    "royalty_routed":     reflect.TypeOf(ForkRoyaltyEvent{}),
+    "royalty_joined":     reflect.TypeOf(JoinRoyaltyEvent{}),
+    "dust_collected":     reflect.TypeOf(PayoutEvent{}),
+    "fee_refunded":       reflect.TypeOf(PayoutEvent{}),
+    "fee_pooled":         reflect.TypeOf(PayoutEvent{}),
+    "royalty_pooled":     reflect.TypeOf(PayoutEvent{}),
+    "result_counted":     reflect.TypeOf(PayoutEvent{}),
+    "epoch_closed":       reflect.TypeOf(EpochEvent{}),
+    "royalty_granted":    reflect.TypeOf(PayoutEvent{}),
+    "royalty_vested":     reflect.TypeOf(PayoutEvent{}),
+    "host_slashed":       reflect.TypeOf(SlashEvent{}),
+    "slash_reward":       reflect.TypeOf(PayoutEvent{}),
+    "fees_claimed":       reflect.TypeOf(ClaimEvent{}),
+    "royalties_claimed":  reflect.TypeOf(ClaimEvent{}),
+    "funds_recovered":    reflect.TypeOf(RecoverEvent{}),
+    "proposal_created":   reflect.TypeOf(ProposalEvent{}),
+    "proposal_approved":  reflect.TypeOf(ProposalEvent{}),
+    "proposal_executed":  reflect.TypeOf(ProposalEvent{}),
+    "proposal_revoked":   reflect.TypeOf(ProposalEvent{}),
+}
+
+// String formats the event as log line like near.log
+func (e Event) String() string {
+    e.Data = encodeAmounts(e.Data)
+    buf, _ := json.Marshal(e)
+    return EVENT_JSON_PREFIX + string(buf)
+}
+
+// ParseEvent decodes a contract log line emitted by the Go model or the
+// on-chain contract. Data of known events is decoded into its typed struct,
+// unknown events keep their raw JSON data.
+func ParseEvent(line string) (Event, error) {
+    var e Event
+    if !strings.HasPrefix(line, EVENT_JSON_PREFIX) {
+        return e, fmt.Errorf("missing %s prefix", EVENT_JSON_PREFIX)
+    }
+    var raw struct {
+        Standard string          `json:"standard"`
+        Version  string          `json:"version"`
+        Event    string          `json:"event"`
+        Data     json.RawMessage `json:"data"`
+    }
+    if err := json.Unmarshal([]byte(line[len(EVENT_JSON_PREFIX):]), &raw); err != nil {
+        return e, fmt.Errorf("decoding event: %v", err)
+    }
+    if raw.Standard != EVENT_STANDARD {
+        return e, fmt.Errorf("unsupported event standard %q", raw.Standard)
+    }
+    e.Standard = raw.Standard
+    e.Version = raw.Version
+    e.Event = raw.Event
+    typ, ok := eventTypes[raw.Event]
+    if !ok {
+        e.Data = raw.Data
+        return e, nil
+    }
+    wire := reflect.New(wireType(typ))
+    if err := json.Unmarshal(raw.Data, wire.Interface()); err != nil {
+        return e, fmt.Errorf("decoding %s event data: %v", raw.Event, err)
+    }
+    data, err := decodeAmounts(typ, wire.Elem())
+    if err != nil {
+        return e, fmt.Errorf("decoding %s event data: %v", raw.Event, err)
+    }
+    e.Data = data
+    return e, nil
+}
+
+var moneyType = reflect.TypeOf(near.Money(0))
+
+// wireType mirrors an event data struct with its amounts as strings. Like
+// the on-chain contract, logs carry NEAR amounts in yoctoNEAR and fungible
+// token amounts in token base units.
+func wireType(typ reflect.Type) reflect.Type {
+    fields := make([]reflect.StructField, typ.NumField())
+    for i := range fields {
+        f := typ.Field(i)
+        if f.Type == moneyType {
+            f.Type = reflect.TypeOf("")
+            f.Tag = reflect.StructTag(strings.Replace(string(f.Tag), ",string", "", 1))
+        }
+        fields[i] = f
+    }
+    return reflect.StructOf(fields)
+}
+
+// isTokenEvent reports whether amounts of an event are fungible token units
+func isTokenEvent(val reflect.Value) bool {
+    token := val.FieldByName("Token")
+    return token.IsValid() && token.String() != ""
+}
+
+// encodeAmounts converts event data into its wire type
+func encodeAmounts(data interface{}) interface{} {
+    val := reflect.ValueOf(data)
+    if val.Kind() != reflect.Struct {
+        return data
+    }
+    wire := reflect.New(wireType(val.Type())).Elem()
+    for i := 0; i < val.NumField(); i++ {
+        f := val.Field(i)
+        if f.Type() != moneyType {
+            wire.Field(i).Set(f)
+            continue
+        }
+        v := near.Money(f.Uint())
+        switch {
+        case v == 0 && strings.Contains(string(val.Type().Field(i).Tag), "omitempty"):
+        case isTokenEvent(val):
+            wire.Field(i).SetString(tokenAmount(v))
+        default:
+            wire.Field(i).SetString(v.Yocto())
+        }
+    }
+    return wire.Interface()
+}
+
+// decodeAmounts converts wire data back into the event data type
+func decodeAmounts(typ reflect.Type, wire reflect.Value) (interface{}, error) {
+    val := reflect.New(typ).Elem()
+    for i := 0; i < typ.NumField(); i++ {
+        f := wire.Field(i)
+        if typ.Field(i).Type != moneyType {
+            val.Field(i).Set(f)
+            continue
+        }
+        if f.String() == "" {
+            continue
+        }
+        var (
+            v   near.Money
+            err error
+        )
+        if isTokenEvent(wire) {
+            var n uint64
+            n, err = strconv.ParseUint(f.String(), 10, 64)
+            v = near.Money(n)
+        } else {
+            v, err = near.ParseYocto(f.String())
+        }
+        if err != nil {
+            return nil, err
+        }
+        val.Field(i).SetUint(uint64(v))
+    }
+    return val.Interface(), nil
+}
+
+// Views emitted events as log lines
+// Called by: anyone
+func (d *DB3) Logs() []string {
+    logs := make([]string, 0, len(d.EventLog))
+    for _, e := range d.EventLog {
+        logs = append(logs, e.String())
+    }
+    return logs
+}
+
+// emit appends an event to the log (emulates near.log)
+func (d *DB3) emit(name string, data interface{}) {
+    d.EventLog = append(d.EventLog, Event{
+        Standard: EVENT_STANDARD,
+        Version:  EVENT_VERSION,
+        Event:    name,
+        Data:     data,
+    })
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "encoding/json"
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+func filterEvents(db *DB3, name string) []Event {
+    res := make([]Event, 0)
+    for _, e := range db.EventLog {
+        if e.Event == name {
+            res = append(res, e)
+        }
+    }
+    return res
+}
+
+func TestEventFlow(t *testing.T) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    db.Register(id, "api")
+    setCtx(NO_CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+    db.Register(id, "api-2")
+    setCtx(USER, PK, 10000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    setCtx(CALLER, PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    setCtx(NO_CALLER, PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    setCtx(CALLER, PK, 0, 20)
+    db.ClaimFees()
+
+    assert.Equal(t, filterEvents(db, "db_deployed")[0].Data, DeployEvent{
+        Dbid:    id,
+        Owner:   CALLER,
+        Author:  m1.Author,
+        CodeCID: m1.CID,
+    }, "deploy event")
+    assert.Len(t, filterEvents(db, "deposit"), 2, "deposit events")
+    assert.Equal(t, filterEvents(db, "api_registered")[0].Data, RegisterEvent{id, CALLER, "api"}, "register event")
+    assert.Equal(t, filterEvents(db, "fee_escrowed")[0].Data, EscrowEvent{id, "qid-1", USER, 10000, "", 20, 1, false}, "escrow event")
+    assert.Equal(t, filterEvents(db, "committee_assigned")[0].Data.(CommitteeEvent).Members,
+        []near.AccountID{NO_CALLER, CALLER}, "committee event")
+    assert.Len(t, filterEvents(db, "result_settled"), 2, "settle events")
+    assert.Equal(t, filterEvents(db, "royalty_paid")[0].Data, PayoutEvent{id, "qid-1", CALLER, 1000, ""}, "royalty event")
+    assert.ElementsMatch(t, filterEvents(db, "fee_paid"), []Event{
+        {EVENT_STANDARD, EVENT_VERSION, "fee_paid", PayoutEvent{id, "qid-1", CALLER, 4500, ""}},
+        {EVENT_STANDARD, EVENT_VERSION, "fee_paid", PayoutEvent{id, "qid-1", NO_CALLER, 4500, ""}},
+    }, "fee events")
+    assert.Empty(t, filterEvents(db, "dust_collected"), "no dust")
+    assert.Equal(t, filterEvents(db, "fees_claimed")[0].Data, ClaimEvent{CALLER, 4500, ""}, "claim event")
+}
+
+func TestEventRecover(t *testing.T) {
+    setCtx(OWNER, PK, 0, 10)
+    db := newTestDB3()
+    db.Slashed = 100
+    db.Recover(60, USER)
+    assert.Equal(t, filterEvents(db, "funds_recovered")[0].Data, RecoverEvent{USER, 60}, "recover event")
+}
+
+func TestParseEvent(t *testing.T) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    db.Deprecate(id, 500)
+    for i, line := range db.Logs() {
+        e, err := ParseEvent(line)
+        assert.NoError(t, err, "parse event")
+        assert.Equal(t, e, db.EventLog[i], "decoded event matches")
+    }
+
+    assert.Contains(t, db.Logs()[1], `"amount":"`+near.Money(SECURITY_DEPOSIT).Yocto()+`"`, "amounts are logged in yocto")
+
+    // logs emitted by the on-chain contract carry yoctoNEAR
+    e, err := ParseEvent(`EVENT_JSON:{"standard":"db3","version":"1.0.0","event":"fee_escrowed","data":{"dbid":"3","qid":"q","payer":"u.near","amount":"1000000000000000000000000","ttl":"100112999","quorum":2}}`)
+    assert.NoError(t, err, "parse contract event")
+    assert.Equal(t, e.Data, EscrowEvent{3, "q", "u.near", 1000, "", 100112999, 2, false}, "contract event data")
+    assert.Equal(t, e.String(), `EVENT_JSON:{"standard":"db3","version":"1.0.0","event":"fee_escrowed","data":{"dbid":"3","qid":"q","payer":"u.near","amount":"1000000000000000000000000","ttl":"100112999","quorum":2}}`, "round trip")
+
+    // token amounts are base units of the token
+    e, err = ParseEvent(`EVENT_JSON:{"standard":"db3","version":"1.0.0","event":"fee_paid","data":{"dbid":"3","qid":"q","account_id":"h.near","amount":"4500","token":"usdc.near"}}`)
+    assert.NoError(t, err, "parse token event")
+    assert.Equal(t, e.Data, PayoutEvent{3, "q", "h.near", 4500, "usdc.near"}, "token event data")
+    _, err = ParseEvent(`EVENT_JSON:{"standard":"db3","version":"1.0.0","event":"withdraw","data":{"dbid":"3","account_id":"h.near","amount":"-1"}}`)
+    assert.Error(t, err, "invalid amount")
+
+    _, err = ParseEvent(`{"standard":"db3"}`)
+    assert.Error(t, err, "missing prefix")
+    _, err = ParseEvent(`EVENT_JSON:{"standard":"nep171","event":"nft_mint","data":[]}`)
+    assert.Error(t, err, "foreign standard")
+    e, err = ParseEvent(`EVENT_JSON:{"standard":"db3","version":"1.0.0","event":"future_event","data":{"x":1}}`)
+    assert.NoError(t, err, "unknown event")
+    assert.JSONEq(t, string(e.Data.(json.RawMessage)), `{"x":1}`, "raw data is kept")
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Link from a fork to its parent database. The royalty share is the parent's
+// fork royalty at fork time, later parent upgrades do not change it.
+type ForkLink struct {
+    Parent      DBId
+    RoyaltyBips int // share of the fork's royalties passed to the parent
+}
+
+// Registers a fork of a database. The fork is deployed like a new database
+// and records its parent, royalties of the fork pass the fork royalty
+// declared by the parent's active manifest up the fork chain.
+// Called by: developer
+func (d *DB3) Fork(parent DBId, m Manifest) DBId {
+    if parent >= d.NextId {
+        panic("Database id does not exist")
+    }
+    if d.DatabaseStatus(parent) == StatusRetired {
+        panic("Database is retired")
+    }
+    if len(d.Lineage(parent)) >= MAX_FORK_DEPTH {
+        panic("Fork chain too deep")
+    }
+    link := ForkLink{
+        Parent:      parent,
+        RoyaltyBips: d.ActiveVersion(parent, ctx.Height).Manifest.ForkRoyaltyBips,
+    }
+    dbid := d.Deploy(m)
+    d.Parents[dbid] = link
+    d.Forks[parent] = insert(d.Forks[parent], dbid)
+    d.emit("db_forked", ForkEvent{Dbid: dbid, Parent: parent, RoyaltyBips: link.RoyaltyBips})
+    return dbid
+}
+
+// Views the ancestors of a database, nearest first
+// Called by: user
+func (d *DB3) Lineage(dbid DBId) []ForkLink {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    res := make([]ForkLink, 0)
+    for {
+        link, ok := d.Parents[dbid]
+        if !ok {
+            return res
+        }
+        res = append(res, link)
+        dbid = link.Parent
+    }
+}
+
+// royalty kept by one database of a fork chain
+type royaltyHop struct {
+    Dbid   DBId
+    Amount near.Money
+}
+
+// routeRoyalty splits a royalty along the fork chain of a database. Each fork
+// keeps its royalty minus the share it owes its parent, the parent treats
+// the received share like its own royalty and so on up the chain.
+func (d *DB3) routeRoyalty(dbid DBId, qid QueryCID, token near.AccountID, amount near.Money) []royaltyHop {
+    hops := make([]royaltyHop, 0, 1)
+    for {
+        link, ok := d.Parents[dbid]
+        if !ok {
+            break
+        }
+        upstream := amount.Mul(link.RoyaltyBips).Div(10000)
+        if upstream == 0 {
+            break
+        }
+        hops = append(hops, royaltyHop{Dbid: dbid, Amount: amount - upstream})
+        d.emit("royalty_routed", ForkRoyaltyEvent{
+            Dbid:   dbid,
+            Parent: link.Parent,
+            Qid:    qid,
+            Amount: upstream,
+            Token:  token,
+        })
+        dbid, amount = link.Parent, upstream
+    }
+    return append(hops, royaltyHop{Dbid: dbid, Amount: amount})
+}
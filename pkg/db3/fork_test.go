@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// newForkDB3 deploys a fork chain root <- fork <- fork of fork, each owned
+// by a different account
+func newForkDB3() (*DB3, DBId, DBId, DBId) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    root := m1
+    root.ForkRoyaltyBips = 2000
+    rootId := deployTestDb(db, root)
+    setCtx(USER, PK, 0, 10)
+    fork := Manifest{Name: "Fork", CID: "cid-f", RoyaltyBips: 1000, ForkRoyaltyBips: 5000}
+    forkId := forkTestDb(db, rootId, fork)
+    setCtx(NO_CALLER, PK, 0, 10)
+    leafId := forkTestDb(db, forkId, Manifest{Name: "Leaf", CID: "cid-l", RoyaltyBips: 1000})
+    return db, rootId, forkId, leafId
+}
+
+func TestFork(t *testing.T) {
+    db, root, fork, leaf := newForkDB3()
+    assert.Equal(t, db.Owners[fork], near.AccountID(USER), "fork owner")
+    assert.Equal(t, db.Lineage(leaf), []ForkLink{{fork, 5000}, {root, 2000}}, "lineage")
+    assert.Empty(t, db.Lineage(root), "root")
+    assert.Equal(t, filterEvents(db, "db_forked")[1].Data, ForkEvent{leaf, fork, 5000}, "fork event")
+    assert.Len(t, filterEvents(db, "db_deployed"), 3, "forks deploy")
+
+    // discovery exposes the fork tree
+    infos := db.ListDatabases(0, 0)
+    assert.Nil(t, infos[0].Parent, "root parent")
+    assert.Equal(t, infos[0].Forks, []DBId{fork}, "root forks")
+    assert.Equal(t, infos[1].Parent, &ForkLink{root, 2000}, "fork parent")
+    assert.Equal(t, infos[1].Forks, []DBId{leaf}, "fork forks")
+    assert.Empty(t, infos[2].Forks, "leaf")
+
+    // parent upgrades do not change existing links
+    setCtx(CALLER, PK, 0, 11)
+    m := db.Manifests[root]
+    m.ForkRoyaltyBips = 9000
+    db.Upgrade(root, m)
+    setCtx(CALLER, PK, 0, 11+UPGRADE_DELAY_BLOCKS)
+    second := forkTestDb(db, root, m2)
+    assert.Equal(t, db.Lineage(fork)[0].RoyaltyBips, 2000, "old link")
+    assert.Equal(t, db.Lineage(second)[0].RoyaltyBips, 9000, "new link")
+    assert.Equal(t, db.Forks[root], []DBId{fork, second}, "fork index")
+
+    // invalid forks
+    assert.Panics(t, func() { forkTestDb(db, 9, m2) }, "unknown parent")
+    bad := m2
+    bad.ForkRoyaltyBips = 10001
+    assert.Panics(t, func() { forkTestDb(db, root, bad) }, "fork royalty out of range")
+    db.Deprecate(second, ctx.Height+MAX_BLOCKS_TO_SETTLE)
+    setCtx(CALLER, PK, 0, ctx.Height+MAX_BLOCKS_TO_SETTLE)
+    assert.Panics(t, func() { forkTestDb(db, second, m2) }, "retired parent")
+    parent := leaf
+    for i := 2; i < MAX_FORK_DEPTH; i++ {
+        parent = forkTestDb(db, parent, m2)
+    }
+    assert.Len(t, db.Lineage(parent), MAX_FORK_DEPTH, "deepest fork")
+    assert.Panics(t, func() { forkTestDb(db, parent, m2) }, "chain too deep")
+}
+
+func TestForkRoyalty(t *testing.T) {
+    db, root, fork, leaf := newForkDB3()
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(leaf)
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(leaf, "qid-1", 20, 0)
+    setCtx(CALLER, PK, 0, 11)
+    db.Settle(leaf, "qid-1", "rid-1")
+
+    // each fork passes its parent's share of the royalty it received
+    setCtx(CALLER, PK, 0, 20)
+    db.Finalize()
+    assert.Equal(t, db.SettledRoyalties[NO_CALLER], near.Money(50), "leaf keeps half")
+    assert.Equal(t, db.SettledRoyalties[USER], near.Money(40), "fork keeps 80% of its half")
+    assert.Equal(t, db.SettledRoyalties[CALLER], near.Money(10), "root")
+    assert.Equal(t, db.SettledFees[CALLER], near.Money(900), "host fee")
+    routed := filterEvents(db, "royalty_routed")
+    assert.Len(t, routed, 2, "two hops")
+    assert.Equal(t, routed[0].Data, ForkRoyaltyEvent{Dbid: leaf, Parent: fork, Qid: "qid-1", Amount: 50}, "first hop")
+    assert.Equal(t, routed[1].Data, ForkRoyaltyEvent{Dbid: fork, Parent: root, Qid: "qid-1", Amount: 10}, "second hop")
+    paid := filterEvents(db, "royalty_paid")
+    assert.Equal(t, paid[2].Data, PayoutEvent{Dbid: root, Qid: "qid-1", Account: CALLER, Amount: 10}, "paid by root")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+
+    // epoch royalties are routed when the epoch closes
+    db.Params.EpochBlocks = 10
+    db.Params.VestingBlocks = 0
+    setCtx(USER, PK, 1000, 20)
+    db.EscrowFee(leaf, "qid-2", 30, 0)
+    setCtx(CALLER, PK, 0, 21)
+    db.Settle(leaf, "qid-2", "rid-2")
+    setCtx(CALLER, PK, 0, 30)
+    db.Finalize()
+    assert.Equal(t, db.SettledRoyalties[CALLER], near.Money(10), "pooled")
+    setCtx(CALLER, PK, 0, 40)
+    db.Finalize()
+    assert.Equal(t, db.SettledRoyalties[NO_CALLER], near.Money(100), "leaf")
+    assert.Equal(t, db.SettledRoyalties[USER], near.Money(80), "fork")
+    assert.Equal(t, db.SettledRoyalties[CALLER], near.Money(20), "root")
+    assert.Equal(t, filterEvents(db, "royalty_routed")[3].Data, ForkRoyaltyEvent{Dbid: fork, Parent: root, Amount: 10}, "epoch hop")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
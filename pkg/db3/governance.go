@@ -0,0 +1,301 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Global protocol parameters that can be changed by governance
+type Params struct {
+    SecurityDeposit     near.Money
+    SlashedDepositBips  int
+    SlashMajorityBips   int // share of each slash paid to majority hosts
+    SlashFinalizerBips  int // share of each slash paid to the finalizer, the rest stays in treasury
+    MaxBlocksToSettle   int64
+    CommitteeSize       int   // hosts assigned to each query, raised to the query quorum
+    EpochBlocks         int64 // blocks per payout epoch, zero pays fees per query
+    VestingBlocks       int64 // blocks over which epoch royalties vest, zero pays them at once
+    ClaimResponseBlocks int64 // blocks a host has to answer a censorship claim
+}
+
+func DefaultParams() Params {
+    return Params{
+        SecurityDeposit:     SECURITY_DEPOSIT,
+        SlashedDepositBips:  SLASHED_DEPOSIT_BIPS,
+        SlashMajorityBips:   SLASH_MAJORITY_BIPS,
+        SlashFinalizerBips:  SLASH_FINALIZER_BIPS,
+        MaxBlocksToSettle:   MAX_BLOCKS_TO_SETTLE,
+        CommitteeSize:       COMMITTEE_SIZE,
+        EpochBlocks:         EPOCH_BLOCKS,
+        VestingBlocks:       VESTING_BLOCKS,
+        ClaimResponseBlocks: CLAIM_RESPONSE_BLOCKS,
+    }
+}
+
+func (p Params) Validate() {
+    if p.SecurityDeposit == 0 {
+        panic("Zero security deposit")
+    }
+    if p.SlashedDepositBips <= 0 || p.SlashedDepositBips > 10000 {
+        panic("Slash rate out of range")
+    }
+    if p.SlashMajorityBips < 0 || p.SlashFinalizerBips < 0 || p.SlashMajorityBips+p.SlashFinalizerBips > 10000 {
+        panic("Slash distribution out of range")
+    }
+    if p.MaxBlocksToSettle <= 0 {
+        panic("Settlement window must be positive")
+    }
+    if p.CommitteeSize <= 0 || p.CommitteeSize > MAX_QUORUM {
+        panic("Committee size out of range")
+    }
+    if p.EpochBlocks < 0 || p.VestingBlocks < 0 {
+        panic("Negative epoch or vesting period")
+    }
+    if p.ClaimResponseBlocks <= 0 {
+        panic("Claim response window must be positive")
+    }
+}
+
+type ProposalId uint64
+
+type ProposalKind byte
+
+const (
+    ProposalRecover ProposalKind = iota
+    ProposalParams
+    ProposalOwner
+    ProposalCouncil
+)
+
+func (k ProposalKind) String() string {
+    switch k {
+    case ProposalRecover:
+        return "recover"
+    case ProposalParams:
+        return "params"
+    case ProposalOwner:
+        return "owner"
+    case ProposalCouncil:
+        return "council"
+    default:
+        return "invalid"
+    }
+}
+
+// Governance proposal, only fields used by its kind are set
+type Proposal struct {
+    Id             ProposalId
+    Kind           ProposalKind
+    Proposer       near.AccountID
+    Amount         near.Money       // recover
+    Target         near.AccountID   // recover, owner
+    Params         Params           // params
+    Members        []near.AccountID // council
+    Threshold      int              // council
+    Approvals      []near.AccountID
+    CreatedHeight  int64
+    Approved       bool
+    ApprovedHeight int64 // height when the threshold was reached
+    Executed       bool
+}
+
+// Governance event data
+type ProposalEvent struct {
+    Id     ProposalId     `json:"id,string"`
+    Kind   string         `json:"kind"`
+    Member near.AccountID `json:"member"`
+}
+
+// Installs the governance council. Can only be called once, afterwards
+// council changes require a proposal.
+// Called by: contract owner
+func (d *DB3) SetupCouncil(members []near.AccountID, threshold int, timelock int64) {
+    if ctx.Caller != d.Owner {
+        panic("Must be contract owner to set up council")
+    }
+    if len(d.Council) > 0 {
+        panic("Council already exists")
+    }
+    if timelock < 0 {
+        panic("Negative time-lock")
+    }
+    validateCouncil(members, threshold)
+    d.Council = append([]near.AccountID{}, members...)
+    d.Threshold = threshold
+    d.TimeLock = timelock
+}
+
+// Submits a governance proposal, the proposer's approval is counted
+// Called by: council member
+func (d *DB3) Propose(p Proposal) ProposalId {
+    d.checkCouncilMember()
+    switch p.Kind {
+    case ProposalRecover:
+        if p.Amount == 0 || p.Target == "" {
+            panic("Empty recover amount or target")
+        }
+    case ProposalParams:
+        p.Params.Validate()
+    case ProposalOwner:
+        if p.Target == "" {
+            panic("Empty owner")
+        }
+    case ProposalCouncil:
+        validateCouncil(p.Members, p.Threshold)
+    default:
+        panic("Invalid proposal kind")
+    }
+
+    id := d.NextProposalId
+    d.Proposals[id] = &Proposal{
+        Id:            id,
+        Kind:          p.Kind,
+        Proposer:      ctx.Caller,
+        Amount:        p.Amount,
+        Target:        p.Target,
+        Params:        p.Params,
+        Members:       append([]near.AccountID{}, p.Members...),
+        Threshold:     p.Threshold,
+        CreatedHeight: ctx.Height,
+    }
+    d.NextProposalId++
+    d.emit("proposal_created", ProposalEvent{Id: id, Kind: p.Kind.String(), Member: ctx.Caller})
+    d.Approve(id)
+    return id
+}
+
+// Approves a governance proposal
+// Called by: council member
+func (d *DB3) Approve(id ProposalId) {
+    d.checkCouncilMember()
+    p := d.getProposal(id)
+    if p.Approved {
+        panic("Proposal is already approved")
+    }
+    if p.CreatedHeight+PROPOSAL_TTL_BLOCKS <= ctx.Height {
+        panic("Proposal is expired")
+    }
+    for _, v := range p.Approvals {
+        if v == ctx.Caller {
+            panic("Member already approved")
+        }
+    }
+    p.Approvals = append(p.Approvals, ctx.Caller)
+    d.emit("proposal_approved", ProposalEvent{Id: id, Kind: p.Kind.String(), Member: ctx.Caller})
+    if len(p.Approvals) >= d.Threshold {
+        p.Approved = true
+        p.ApprovedHeight = ctx.Height
+    }
+}
+
+// Executes an approved proposal after its time-lock expired, proposals that
+// are not executed within PROPOSAL_TTL_BLOCKS after the time-lock lapse
+// Called by: anyone
+func (d *DB3) Execute(id ProposalId) {
+    p := d.getProposal(id)
+    if !p.Approved {
+        panic("Proposal is not approved")
+    }
+    if p.Executed {
+        panic("Proposal is already executed")
+    }
+    if p.ApprovedHeight+d.TimeLock > ctx.Height {
+        panic("Proposal is time-locked")
+    }
+    if p.ApprovedHeight+d.TimeLock+PROPOSAL_TTL_BLOCKS <= ctx.Height {
+        panic("Proposal is expired")
+    }
+
+    switch p.Kind {
+    case ProposalRecover:
+        d.recover(p.Amount, p.Target)
+    case ProposalParams:
+        d.Params = p.Params
+    case ProposalOwner:
+        d.Owner = p.Target
+    case ProposalCouncil:
+        d.Council = append([]near.AccountID{}, p.Members...)
+        d.Threshold = p.Threshold
+    }
+    p.Executed = true
+    d.emit("proposal_executed", ProposalEvent{Id: id, Kind: p.Kind.String(), Member: ctx.Caller})
+    if p.Kind == ProposalCouncil {
+        d.recountApprovals()
+    }
+}
+
+// recountApprovals drops approvals of removed council members from all
+// proposals that are not executed yet and checks them against the new
+// threshold. Proposals that fall below it are pending again and restart
+// their time-lock once re-approved.
+func (d *DB3) recountApprovals() {
+    for id := ProposalId(0); id < d.NextProposalId; id++ {
+        p, ok := d.Proposals[id]
+        if !ok || p.Executed {
+            continue
+        }
+        approvals := p.Approvals[:0:0]
+        for _, v := range p.Approvals {
+            if d.isCouncilMember(v) {
+                approvals = append(approvals, v)
+            }
+        }
+        p.Approvals = approvals
+        switch {
+        case len(approvals) < d.Threshold && p.Approved:
+            p.Approved = false
+            p.ApprovedHeight = 0
+            d.emit("proposal_revoked", ProposalEvent{Id: id, Kind: p.Kind.String(), Member: ctx.Caller})
+        case len(approvals) >= d.Threshold && !p.Approved && p.CreatedHeight+PROPOSAL_TTL_BLOCKS > ctx.Height:
+            p.Approved = true
+            p.ApprovedHeight = ctx.Height
+        }
+    }
+}
+
+// Views a governance proposal
+// Called by: anyone
+func (d *DB3) Proposal(id ProposalId) Proposal {
+    return *d.getProposal(id)
+}
+
+func (d *DB3) getProposal(id ProposalId) *Proposal {
+    p, ok := d.Proposals[id]
+    if !ok {
+        panic("Proposal does not exist")
+    }
+    return p
+}
+
+func (d *DB3) checkCouncilMember() {
+    if !d.isCouncilMember(ctx.Caller) {
+        panic("Must be council member")
+    }
+}
+
+func (d *DB3) isCouncilMember(account near.AccountID) bool {
+    for _, v := range d.Council {
+        if v == account {
+            return true
+        }
+    }
+    return false
+}
+
+func validateCouncil(members []near.AccountID, threshold int) {
+    if len(members) == 0 || len(members) > MAX_COUNCIL_SIZE {
+        panic("Council size out of range")
+    }
+    seen := make(map[near.AccountID]bool)
+    for _, v := range members {
+        if v == "" || seen[v] {
+            panic("Empty or duplicate council member")
+        }
+        seen[v] = true
+    }
+    if threshold <= 0 || threshold > len(members) {
+        panic("Threshold out of range")
+    }
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+const (
+    OWNER    = "blockwatch.near"
+    MEMBER_A = "a.near"
+    MEMBER_B = "b.near"
+    MEMBER_C = "c.near"
+)
+
+func newGovernedDB3() *DB3 {
+    setCtx(OWNER, PK, 0, 10)
+    db := newTestDB3()
+    db.Slashed = 1000
+    db.SetupCouncil([]near.AccountID{MEMBER_A, MEMBER_B, MEMBER_C}, 2, 100)
+    return db
+}
+
+func TestSetupCouncil(t *testing.T) {
+    setCtx(NO_CALLER, PK, 0, 10)
+    db := newTestDB3()
+    assert.Panics(t, func() { db.SetupCouncil([]near.AccountID{MEMBER_A}, 1, 0) }, "not owner")
+    setCtx(OWNER, PK, 0, 10)
+    assert.Panics(t, func() { db.SetupCouncil(nil, 1, 0) }, "empty council")
+    assert.Panics(t, func() { db.SetupCouncil([]near.AccountID{MEMBER_A, MEMBER_A}, 1, 0) }, "duplicate member")
+    assert.Panics(t, func() { db.SetupCouncil([]near.AccountID{MEMBER_A}, 2, 0) }, "threshold too large")
+    assert.Panics(t, func() { db.SetupCouncil([]near.AccountID{MEMBER_A}, 1, -1) }, "negative time-lock")
+    assert.NotPanics(t, func() { db.SetupCouncil([]near.AccountID{MEMBER_A}, 1, 0) }, "successful setup")
+    assert.Panics(t, func() { db.SetupCouncil([]near.AccountID{MEMBER_B}, 1, 0) }, "council exists")
+}
+
+func TestRecoverThroughGovernance(t *testing.T) {
+    db := newGovernedDB3()
+    assert.Panics(t, func() { db.Recover(100, OWNER) }, "owner can no longer recover")
+
+    setCtx(NO_CALLER, PK, 0, 10)
+    assert.Panics(t, func() { db.Propose(Proposal{Kind: ProposalRecover, Amount: 100, Target: USER}) }, "not a member")
+
+    setCtx(MEMBER_A, PK, 0, 10)
+    assert.Panics(t, func() { db.Propose(Proposal{Kind: ProposalRecover, Target: USER}) }, "empty amount")
+    id := db.Propose(Proposal{Kind: ProposalRecover, Amount: 100, Target: USER})
+    assert.Len(t, db.Proposal(id).Approvals, 1, "proposer approves")
+    assert.Panics(t, func() { db.Approve(id) }, "double approval")
+    assert.Panics(t, func() { db.Execute(id) }, "not approved")
+
+    setCtx(MEMBER_B, PK, 0, 20)
+    assert.NotPanics(t, func() { db.Approve(id) }, "successful approval")
+    assert.True(t, db.Proposal(id).Approved, "approved")
+    assert.Equal(t, db.Proposal(id).ApprovedHeight, int64(20), "approval height")
+    setCtx(MEMBER_C, PK, 0, 20)
+    assert.Panics(t, func() { db.Approve(id) }, "already approved")
+
+    setCtx(NO_CALLER, PK, 0, 119)
+    assert.Panics(t, func() { db.Execute(id) }, "time-locked")
+    setCtx(NO_CALLER, PK, 0, 120)
+    assert.NotPanics(t, func() { db.Execute(id) }, "successful execute")
+    assert.Equal(t, db.Slashed, near.Money(900), "funds recovered")
+    assert.Panics(t, func() { db.Execute(id) }, "already executed")
+}
+
+func TestCouncilRotationRecountsApprovals(t *testing.T) {
+    db := newGovernedDB3()
+    setCtx(MEMBER_A, PK, 0, 0)
+    approved := db.Propose(Proposal{Kind: ProposalOwner, Target: USER})
+    pending := db.Propose(Proposal{Kind: ProposalRecover, Amount: 100, Target: USER})
+    rotate := db.Propose(Proposal{Kind: ProposalCouncil, Members: []near.AccountID{MEMBER_B, MEMBER_C, OWNER}, Threshold: 2})
+    setCtx(MEMBER_C, PK, 0, 0)
+    db.Approve(approved)
+    db.Approve(rotate)
+    assert.True(t, db.Proposal(approved).Approved, "approved at height zero")
+
+    setCtx(NO_CALLER, PK, 0, 100)
+    db.Execute(rotate)
+    assert.False(t, db.Proposal(approved).Approved, "removed member no longer counts")
+    assert.Equal(t, db.Proposal(approved).Approvals, []near.AccountID{MEMBER_C}, "approvals recounted")
+    assert.Equal(t, db.Proposal(pending).Approvals, []near.AccountID{}, "pending recounted")
+    assert.Len(t, filterEvents(db, "proposal_revoked"), 1, "unapprove event")
+    assert.Panics(t, func() { db.Execute(approved) }, "not approved after rotation")
+
+    setCtx(MEMBER_A, PK, 0, 100)
+    assert.Panics(t, func() { db.Approve(pending) }, "removed member")
+    setCtx(OWNER, PK, 0, 100)
+    db.Approve(approved)
+    assert.Equal(t, db.Proposal(approved).ApprovedHeight, int64(100), "time-lock restarts")
+    setCtx(NO_CALLER, PK, 0, 200)
+    db.Execute(approved)
+    assert.Equal(t, db.Owner, near.AccountID(USER), "owner rotated")
+}
+
+func TestProposalExpiry(t *testing.T) {
+    db := newGovernedDB3()
+    setCtx(MEMBER_A, PK, 0, 10)
+    id := db.Propose(Proposal{Kind: ProposalOwner, Target: USER})
+    setCtx(MEMBER_B, PK, 0, 10+PROPOSAL_TTL_BLOCKS)
+    assert.Panics(t, func() { db.Approve(id) }, "expired")
+
+    // approved proposals lapse when nobody executes them in time
+    setCtx(MEMBER_A, PK, 0, 20)
+    id = db.Propose(Proposal{Kind: ProposalOwner, Target: USER})
+    setCtx(MEMBER_B, PK, 0, 20)
+    db.Approve(id)
+    setCtx(NO_CALLER, PK, 0, 20+db.TimeLock+PROPOSAL_TTL_BLOCKS)
+    assert.PanicsWithValue(t, "Proposal is expired", func() { db.Execute(id) }, "expired execution")
+    setCtx(NO_CALLER, PK, 0, 20+db.TimeLock+PROPOSAL_TTL_BLOCKS-1)
+    db.Execute(id)
+    assert.Equal(t, db.Owner, near.AccountID(USER), "executed before expiry")
+}
+
+func TestGovernanceParamsAndOwner(t *testing.T) {
+    db := newGovernedDB3()
+    params := Params{SecurityDeposit: 500, SlashedDepositBips: 2500, MaxBlocksToSettle: 60, CommitteeSize: 5, ClaimResponseBlocks: 120}
+
+    setCtx(MEMBER_A, PK, 0, 10)
+    assert.Panics(t, func() { db.Propose(Proposal{Kind: ProposalParams}) }, "invalid params")
+    invalid := params
+    invalid.SlashMajorityBips, invalid.SlashFinalizerBips = 9000, 1001
+    assert.Panics(t, func() { db.Propose(Proposal{Kind: ProposalParams, Params: invalid}) }, "invalid slash distribution")
+    invalid = params
+    invalid.CommitteeSize = MAX_QUORUM + 1
+    assert.Panics(t, func() { db.Propose(Proposal{Kind: ProposalParams, Params: invalid}) }, "invalid committee size")
+    invalid = params
+    invalid.ClaimResponseBlocks = 0
+    assert.Panics(t, func() { db.Propose(Proposal{Kind: ProposalParams, Params: invalid}) }, "invalid claim response window")
+    p1 := db.Propose(Proposal{Kind: ProposalParams, Params: params})
+    p2 := db.Propose(Proposal{Kind: ProposalOwner, Target: USER})
+    p3 := db.Propose(Proposal{Kind: ProposalCouncil, Members: []near.AccountID{MEMBER_A, MEMBER_B}, Threshold: 1})
+    setCtx(MEMBER_C, PK, 0, 10)
+    db.Approve(p1)
+    db.Approve(p2)
+    db.Approve(p3)
+
+    setCtx(NO_CALLER, PK, 0, 110)
+    db.Execute(p1)
+    db.Execute(p2)
+    db.Execute(p3)
+    assert.Equal(t, db.Params, params, "params changed")
+    assert.Equal(t, db.Owner, near.AccountID(USER), "owner rotated")
+    assert.Equal(t, db.Council, []near.AccountID{MEMBER_A, MEMBER_B}, "council changed")
+    assert.Equal(t, db.Threshold, 1, "threshold changed")
+
+    // new params apply
+    setCtx(CALLER, PK, 500, 110)
+    id := deployTestDb(db, m1)
+    assert.NotPanics(t, func() { db.Deposit(id) }, "lower deposit accepted")
+}
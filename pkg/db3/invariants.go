@@ -0,0 +1,258 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "fmt"
+    "math/bits"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Contract books, the sum of all ledgers must equal inflows minus outflows
+type Books struct {
+    Deposits         near.Money
+    PendingFees      near.Money
+    SettledFees      near.Money
+    SettledRoyalties near.Money
+    EpochPools       near.Money // pooled fees and royalties of open epochs
+    VestingRoyalties near.Money // granted royalties not yet released
+    Slashed          near.Money
+    StorageDeposits  near.Money
+    StorageBalances  near.Money
+    Inflows          near.Money
+    Outflows         near.Money
+}
+
+// Views the contract books
+// Called by: anyone
+func (d *DB3) Books() (Books, error) {
+    var (
+        b   Books
+        err error
+    )
+    b.Inflows = d.TotalInflows
+    b.Outflows = d.TotalOutflows
+    b.Slashed = d.Slashed
+    for _, m := range d.Deposits {
+        for _, v := range m {
+            b.Deposits, err = add(b.Deposits, v, "deposits", err)
+        }
+    }
+    for dbid, m := range d.PendingFees {
+        for qid, v := range m {
+            if d.FeeTokens[dbid][qid] != "" {
+                continue
+            }
+            b.PendingFees, err = add(b.PendingFees, v, "pending fees", err)
+        }
+    }
+    for _, v := range d.SettledFees {
+        b.SettledFees, err = add(b.SettledFees, v, "settled fees", err)
+    }
+    for _, v := range d.SettledRoyalties {
+        b.SettledRoyalties, err = add(b.SettledRoyalties, v, "settled royalties", err)
+    }
+    for _, e := range d.Epochs {
+        b.EpochPools, err = add(b.EpochPools, e.Fees, "epoch pools", err)
+        b.EpochPools, err = add(b.EpochPools, e.Royalties, "epoch pools", err)
+    }
+    for _, grants := range d.Vesting {
+        for _, g := range grants {
+            b.VestingRoyalties, err = add(b.VestingRoyalties, g.Amount-g.Released, "vesting royalties", err)
+        }
+    }
+    for _, v := range d.StorageDeposits {
+        b.StorageDeposits, err = add(b.StorageDeposits, v, "storage deposits", err)
+    }
+    for _, v := range d.StorageBalances {
+        b.StorageBalances, err = add(b.StorageBalances, v.Total, "storage balances", err)
+    }
+    return b, err
+}
+
+// Views the books of all fungible tokens, token books have no deposit
+// and storage ledgers
+// Called by: anyone
+func (d *DB3) TokenBooks() (map[near.AccountID]Books, error) {
+    var err error
+    books := make(map[near.AccountID]Books)
+    update := func(token near.AccountID, fn func(b *Books)) {
+        b := books[token]
+        fn(&b)
+        books[token] = b
+    }
+    for token, v := range d.TokenInflows {
+        update(token, func(b *Books) { b.Inflows = v })
+    }
+    for token, v := range d.TokenOutflows {
+        update(token, func(b *Books) { b.Outflows = v })
+    }
+    for token, v := range d.SlashedTokens {
+        update(token, func(b *Books) { b.Slashed = v })
+    }
+    for dbid, m := range d.FeeTokens {
+        for qid, token := range m {
+            update(token, func(b *Books) {
+                b.PendingFees, err = add(b.PendingFees, d.PendingFees[dbid][qid], "pending token fees", err)
+            })
+        }
+    }
+    for token, m := range d.SettledTokenFees {
+        for _, v := range m {
+            update(token, func(b *Books) { b.SettledFees, err = add(b.SettledFees, v, "settled token fees", err) })
+        }
+    }
+    for token, m := range d.SettledTokenRoyalties {
+        for _, v := range m {
+            update(token, func(b *Books) {
+                b.SettledRoyalties, err = add(b.SettledRoyalties, v, "settled token royalties", err)
+            })
+        }
+    }
+    return books, err
+}
+
+// Total sums all ledgers
+func (b Books) Total() (near.Money, error) {
+    var (
+        sum near.Money
+        err error
+    )
+    for _, v := range []near.Money{
+        b.Deposits,
+        b.PendingFees,
+        b.SettledFees,
+        b.SettledRoyalties,
+        b.EpochPools,
+        b.VestingRoyalties,
+        b.Slashed,
+        b.StorageDeposits,
+        b.StorageBalances,
+    } {
+        sum, err = add(sum, v, "books", err)
+    }
+    return sum, err
+}
+
+// CheckInvariants verifies that the contract is solvent, i.e. no funds
+// were created or destroyed and no ledger went negative, and that pending
+// query maps are consistent.
+func (d *DB3) CheckInvariants() error {
+    b, err := d.Books()
+    if err != nil {
+        return err
+    }
+    if b.Outflows > b.Inflows {
+        return fmt.Errorf("outflows %d exceed inflows %d", b.Outflows, b.Inflows)
+    }
+    total, err := b.Total()
+    if err != nil {
+        return err
+    }
+    if total != b.Inflows-b.Outflows {
+        return fmt.Errorf("books total %d != inflows %d - outflows %d (%+v)",
+            total, b.Inflows, b.Outflows, b)
+    }
+
+    // token books balance like NEAR books
+    tokenBooks, err := d.TokenBooks()
+    if err != nil {
+        return err
+    }
+    for token, tb := range tokenBooks {
+        if tb.Outflows > tb.Inflows {
+            return fmt.Errorf("%s outflows %d exceed inflows %d", token, tb.Outflows, tb.Inflows)
+        }
+        total, err := tb.Total()
+        if err != nil {
+            return err
+        }
+        if total != tb.Inflows-tb.Outflows {
+            return fmt.Errorf("%s books total %d != inflows %d - outflows %d (%+v)",
+                token, total, tb.Inflows, tb.Outflows, tb)
+        }
+    }
+
+    // wrapped uint64 ledgers show up as values larger than all inflows
+    for dbid, m := range d.Deposits {
+        for acc, v := range m {
+            if v > b.Inflows {
+                return fmt.Errorf("negative deposit %d for %s in db %d", int64(v), acc, dbid)
+            }
+        }
+    }
+    for acc, v := range d.StorageBalances {
+        if v.Available > v.Total {
+            return fmt.Errorf("storage available %d exceeds total %d for %s", v.Available, v.Total, acc)
+        }
+    }
+
+    // all pending entries must be garbage collectable through their TTL
+    for dbid, m := range d.PendingFees {
+        for qid := range m {
+            if _, ok := d.ResultTTL[dbid][qid]; !ok {
+                return fmt.Errorf("pending fee without ttl for query %s in db %d", qid, dbid)
+            }
+        }
+    }
+    for dbid, m := range d.PendingResults {
+        for qid := range m {
+            if _, ok := d.ResultTTL[dbid][qid]; !ok {
+                return fmt.Errorf("pending results without ttl for query %s in db %d", qid, dbid)
+            }
+        }
+    }
+    for dbid, m := range d.Committees {
+        for qid := range m {
+            if _, ok := d.ResultTTL[dbid][qid]; !ok {
+                return fmt.Errorf("committee without ttl for query %s in db %d", qid, dbid)
+            }
+        }
+    }
+    for dbid, m := range d.FeeTokens {
+        for qid := range m {
+            if _, ok := d.ResultTTL[dbid][qid]; !ok {
+                return fmt.Errorf("fee token without ttl for query %s in db %d", qid, dbid)
+            }
+        }
+    }
+    for dbid, m := range d.Joins {
+        for qid := range m {
+            if _, ok := d.PendingFees[dbid][qid]; !ok {
+                return fmt.Errorf("join without fee for query %s in db %d", qid, dbid)
+            }
+        }
+    }
+    for dbid, m := range d.Receipts {
+        for qid := range m {
+            if _, ok := d.ResultTTL[dbid][qid]; !ok {
+                return fmt.Errorf("receipts without ttl for query %s in db %d", qid, dbid)
+            }
+        }
+    }
+
+    // refunds can never exceed the escrowed fee
+    for dbid, m := range d.QueryPayments {
+        for qid, payments := range m {
+            var sum near.Money
+            for _, v := range payments {
+                sum += v
+            }
+            if sum > d.PendingFees[dbid][qid] {
+                return fmt.Errorf("payments %d exceed pending fee %d for query %s in db %d", sum, d.PendingFees[dbid][qid], qid, dbid)
+            }
+        }
+    }
+    return nil
+}
+
+// add sums ledger values and reports overflows
+func add(sum, v near.Money, name string, err error) (near.Money, error) {
+    res, carry := bits.Add64(uint64(sum), uint64(v), 0)
+    if carry != 0 && err == nil {
+        err = fmt.Errorf("%s overflow", name)
+    }
+    return near.Money(res), err
+}
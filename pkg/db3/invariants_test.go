@@ -0,0 +1,367 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "fmt"
+    "github.com/stretchr/testify/assert"
+    "math/rand"
+    "reflect"
+    "runtime/debug"
+    "testing"
+    "time"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+func TestCheckInvariants(t *testing.T) {
+    setCtx(CALLER, PK, 100, 10)
+    db := NewDB3()
+    id := deployTestDb(db, m1)
+    db.StorageDeposit("")
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+
+    b, err := db.Books()
+    assert.NoError(t, err, "books")
+    assert.Equal(t, b.Inflows, near.Money(STORAGE_COST+100+SECURITY_DEPOSIT), "inflows")
+
+    // money created
+    db.SettledFees[USER] = 1
+    assert.Error(t, db.CheckInvariants(), "money created")
+    delete(db.SettledFees, USER)
+
+    // wrapped ledger
+    db.Deposits[id][CALLER] -= SECURITY_DEPOSIT + 1
+    db.Slashed += SECURITY_DEPOSIT + 1
+    assert.Error(t, db.CheckInvariants(), "negative deposit")
+    db.Deposits[id][CALLER] += SECURITY_DEPOSIT + 1
+    db.Slashed -= SECURITY_DEPOSIT + 1
+
+    // dangling pending entry
+    db.PendingFees[id]["qid-1"] = 0
+    assert.Error(t, db.CheckInvariants(), "pending fee without ttl")
+    delete(db.PendingFees[id], "qid-1")
+
+    db.QueryPayments[id]["qid-1"] = map[near.AccountID]near.Money{USER: 1}
+    assert.Error(t, db.CheckInvariants(), "payments exceed fee")
+}
+
+func TestSlashKeepsBooks(t *testing.T) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    hosts := []string{"h1.near", "h2.near", "h3.near"}
+    for _, h := range hosts {
+        setCtx(CALLER, PK, 100, 10)
+        db.StorageDeposit(near.AccountID(h))
+        setCtx(h, PK, SECURITY_DEPOSIT, 10)
+        db.Deposit(id)
+    }
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    setCtx(hosts[0], PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    setCtx(hosts[1], PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    setCtx(hosts[2], PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-2")
+    setCtx(USER, PK, 0, 20)
+    db.finalizeResults()
+    assert.Equal(t, db.Deposits[id][near.AccountID(hosts[2])], near.Money(SECURITY_DEPOSIT-SECURITY_DEPOSIT*SLASHED_DEPOSIT_BIPS/10000), "slashed by rate")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+// contract operation used by the fuzzer
+type fuzzOp struct {
+    name    string
+    weight  int     // relative frequency
+    amounts []int64 // attached deposits to pick from
+    call    func(db *DB3, r *rand.Rand)
+}
+
+var (
+    fuzzAccounts = []near.AccountID{OWNER, MEMBER_A, MEMBER_B, CALLER, USER, NO_CALLER}
+    fuzzQueries  = []QueryCID{QueryCIDOf("SELECT 1"), QueryCIDOf("SELECT 2")}
+    fuzzResults  = []ResultCID{"rid-1", "rid-1", "rid-1", "rid-2"} // biased towards a majority
+    fuzzLicenses = []string{"", "MIT", "CC-BY-NC-4.0", "n/a"}
+    payable      = []int64{0, 1, 99, 1000, SECURITY_DEPOSIT}
+    fuzzToken    *near.FungibleToken
+)
+
+func fuzzDbid(db *DB3, r *rand.Rand) DBId {
+    // stick to a few databases so hosts meet on the same queries, and
+    // include one id past the end to exercise error paths
+    n := int(db.NextId)
+    if n > 3 {
+        n = 3
+    }
+    return DBId(r.Intn(n + 1))
+}
+
+func fuzzAccount(r *rand.Rand) near.AccountID {
+    return fuzzAccounts[r.Intn(len(fuzzAccounts))]
+}
+
+var fuzzOps = []fuzzOp{
+    {"Deploy", 1, payable, func(db *DB3, r *rand.Rand) {
+        deployTestDb(db, Manifest{Name: "fuzz", CID: "cid", RoyaltyBips: r.Intn(10002), ForkRoyaltyBips: r.Intn(10001),
+            License: fuzzLicenses[r.Intn(len(fuzzLicenses))], Attribution: "fuzz", NonCommercialRoyaltyBips: r.Intn(10002), UsageCap: r.Intn(3)})
+    }},
+    {"DeploySigned", 1, payable, func(db *DB3, r *rand.Rand) { deployTestDb(db, signedM1) }},
+    {"RegisterAuthorKey", 1, nil, func(db *DB3, r *rand.Rand) {
+        ctx.SignedBy = near.Pubkey(AUTHOR_PK)
+        db.RegisterAuthorKey()
+    }},
+    {"RemoveAuthorKey", 1, nil, func(db *DB3, r *rand.Rand) { db.RemoveAuthorKey(near.Pubkey(AUTHOR_PK)) }},
+    {"Fork", 1, payable, func(db *DB3, r *rand.Rand) {
+        forkTestDb(db, fuzzDbid(db, r), Manifest{Name: "fork", CID: "cid", RoyaltyBips: r.Intn(10001), ForkRoyaltyBips: r.Intn(10002)})
+    }},
+    {"Upgrade", 1, nil, func(db *DB3, r *rand.Rand) {
+        db.Upgrade(fuzzDbid(db, r), Manifest{Name: "fuzz", CID: "cid-2", RoyaltyBips: r.Intn(10001)})
+    }},
+    {"ProposeOwner", 1, nil, func(db *DB3, r *rand.Rand) { db.ProposeOwner(fuzzDbid(db, r), fuzzAccount(r)) }},
+    {"AcceptOwner", 1, nil, func(db *DB3, r *rand.Rand) { db.AcceptOwner(fuzzDbid(db, r)) }},
+    {"SetRoyaltySplit", 1, nil, func(db *DB3, r *rand.Rand) {
+        bips := r.Intn(10001)
+        db.SetRoyaltySplit(fuzzDbid(db, r), []RoyaltyShare{{fuzzAccount(r), bips}, {"split.near", 10000 - bips}})
+    }},
+    {"Pause", 1, nil, func(db *DB3, r *rand.Rand) { db.Pause(fuzzDbid(db, r)) }},
+    {"Resume", 1, nil, func(db *DB3, r *rand.Rand) { db.Resume(fuzzDbid(db, r)) }},
+    {"Deprecate", 1, nil, func(db *DB3, r *rand.Rand) { db.Deprecate(fuzzDbid(db, r), ctx.Height+int64(r.Intn(400))) }},
+    {"Retire", 1, nil, func(db *DB3, r *rand.Rand) { db.Retire(fuzzDbid(db, r)) }},
+    {"SetAccessPolicy", 1, nil, func(db *DB3, r *rand.Rand) {
+        switch r.Intn(3) {
+        case 0:
+            db.SetAccessPolicy(fuzzDbid(db, r), AccessPolicy{})
+        case 1:
+            db.SetAccessPolicy(fuzzDbid(db, r), AccessPolicy{Private: true})
+        default:
+            db.SetAccessPolicy(fuzzDbid(db, r), AccessPolicy{Private: true, Gate: TOKEN, Standard: GateFungibleToken, MinBalance: near.Money(r.Intn(100))})
+        }
+    }},
+    {"AllowUsers", 1, nil, func(db *DB3, r *rand.Rand) { db.AllowUsers(fuzzDbid(db, r), []near.AccountID{fuzzAccount(r)}) }},
+    {"RevokeUsers", 1, nil, func(db *DB3, r *rand.Rand) { db.RevokeUsers(fuzzDbid(db, r), []near.AccountID{fuzzAccount(r)}) }},
+    {"RequestAccess", 1, nil, func(db *DB3, r *rand.Rand) { db.RequestAccess(fuzzDbid(db, r)) }},
+    {"StorageDeposit", 3, payable, func(db *DB3, r *rand.Rand) { db.StorageDeposit(fuzzAccount(r)) }},
+    {"StorageWithdraw", 1, nil, func(db *DB3, r *rand.Rand) { db.StorageWithdraw(near.Money(r.Intn(100))) }},
+    {"StorageUnregister", 1, nil, func(db *DB3, r *rand.Rand) { db.StorageUnregister() }},
+    {"Deposit", 4, []int64{0, SECURITY_DEPOSIT / 2, SECURITY_DEPOSIT}, func(db *DB3, r *rand.Rand) { db.Deposit(fuzzDbid(db, r)) }},
+    {"Withdraw", 1, nil, func(db *DB3, r *rand.Rand) { db.Withdraw(fuzzDbid(db, r)) }},
+    {"Register", 2, nil, func(db *DB3, r *rand.Rand) {
+        db.Register(fuzzDbid(db, r), []ApiEndpoint{"", "api"}[r.Intn(2)])
+    }},
+    {"EscrowFee", 4, payable, func(db *DB3, r *rand.Rand) {
+        db.EscrowFee(fuzzDbid(db, r), fuzzQueries[r.Intn(len(fuzzQueries))], ctx.Height+int64(r.Intn(200))-10, r.Intn(4))
+    }},
+    {"EscrowFeeFor", 2, payable, func(db *DB3, r *rand.Rand) {
+        db.EscrowFeeFor(fuzzDbid(db, r), fuzzQueries[r.Intn(len(fuzzQueries))], ctx.Height+int64(r.Intn(200))-10, r.Intn(4), Use(r.Intn(3)))
+    }},
+    {"EscrowFeeWithin", 1, payable, func(db *DB3, r *rand.Rand) {
+        ctx.Timestamp = ctx.Height * int64(time.Second+time.Duration(r.Intn(500))*time.Millisecond)
+        db.EscrowFeeWithin(fuzzDbid(db, r), fuzzQueries[r.Intn(len(fuzzQueries))], time.Duration(r.Intn(200))*time.Second, r.Intn(4))
+    }},
+    {"EscrowJoinFee", 2, payable, func(db *DB3, r *rand.Rand) {
+        bips := r.Intn(10002)
+        shares := []JoinShare{{fuzzDbid(db, r), bips}, {fuzzDbid(db, r), 10000 - bips}}
+        db.EscrowJoinFee(fuzzQueries[r.Intn(len(fuzzQueries))], ctx.Height+int64(r.Intn(200))-10, r.Intn(4), shares)
+    }},
+    {"Settle", 8, nil, func(db *DB3, r *rand.Rand) {
+        db.Settle(fuzzDbid(db, r), fuzzQueries[r.Intn(len(fuzzQueries))], fuzzResults[r.Intn(len(fuzzResults))])
+    }},
+    {"FtOnTransfer", 2, nil, func(db *DB3, r *rand.Rand) {
+        sender := ctx.Caller
+        amount := near.Money(payable[r.Intn(len(payable))])
+        fuzzToken.Mint(sender, amount)
+        setCtx(TOKEN, PK, 0, ctx.Height)
+        msg := fmt.Sprintf(`{"dbid":%d,"qid":"%s","ttl":%d,"quorum":%d}`,
+            fuzzDbid(db, r), fuzzQueries[r.Intn(len(fuzzQueries))], ctx.Height+int64(r.Intn(200))-10, r.Intn(4))
+        if _, err := fuzzToken.TransferCall(sender, CONTRACT_ID, db, amount, msg); err != nil {
+            // the token refunded the transfer, the receiver's changes roll back
+            panic(err.Error())
+        }
+    }},
+    {"SignReceipt", 2, nil, func(db *DB3, r *rand.Rand) {
+        db.SignReceipt(fuzzDbid(db, r), fuzzQueries[r.Intn(len(fuzzQueries))], fuzzAccount(r), fuzzResults[r.Intn(len(fuzzResults))])
+    }},
+    {"FileClaim", 2, nil, func(db *DB3, r *rand.Rand) {
+        n := r.Intn(len(fuzzQueries))
+        db.FileClaim(fuzzDbid(db, r), fuzzQueries[n], fuzzAccount(r), fmt.Sprintf("SELECT %d", 1+n))
+    }},
+    {"AnswerClaim", 2, nil, func(db *DB3, r *rand.Rand) {
+        db.AnswerClaim(fuzzDbid(db, r), fuzzQueries[r.Intn(len(fuzzQueries))], fuzzResults[r.Intn(len(fuzzResults))], "42")
+    }},
+    {"ClaimFees", 1, nil, func(db *DB3, r *rand.Rand) { db.ClaimFees() }},
+    {"ClaimRoyalties", 1, nil, func(db *DB3, r *rand.Rand) { db.ClaimRoyalties() }},
+    {"ClaimTokens", 1, nil, func(db *DB3, r *rand.Rand) { db.ClaimTokens(TOKEN) }},
+    {"Recover", 1, nil, func(db *DB3, r *rand.Rand) { db.Recover(near.Money(r.Intn(1000)), fuzzAccount(r)) }},
+    {"SetupCouncil", 1, nil, func(db *DB3, r *rand.Rand) {
+        db.SetupCouncil([]near.AccountID{MEMBER_A, MEMBER_B}, 1+r.Intn(2), int64(r.Intn(20)))
+    }},
+    {"Propose", 1, nil, func(db *DB3, r *rand.Rand) {
+        switch r.Intn(3) {
+        case 0:
+            db.Propose(Proposal{Kind: ProposalRecover, Amount: near.Money(1 + r.Intn(1000)), Target: fuzzAccount(r)})
+        case 1:
+            db.Propose(Proposal{Kind: ProposalParams, Params: Params{
+                SecurityDeposit:     near.Money(1 + r.Intn(SECURITY_DEPOSIT)),
+                SlashedDepositBips:  1 + r.Intn(10000),
+                SlashMajorityBips:   r.Intn(5001),
+                SlashFinalizerBips:  r.Intn(5001),
+                MaxBlocksToSettle:   int64(1 + r.Intn(200)),
+                CommitteeSize:       1 + r.Intn(4),
+                EpochBlocks:         int64(r.Intn(3) * r.Intn(100)),
+                VestingBlocks:       int64(r.Intn(200)),
+                ClaimResponseBlocks: int64(1 + r.Intn(100)),
+            }})
+        default:
+            db.Propose(Proposal{Kind: ProposalOwner, Target: fuzzAccount(r)})
+        }
+    }},
+    {"Approve", 1, nil, func(db *DB3, r *rand.Rand) { db.Approve(ProposalId(r.Intn(int(db.NextProposalId) + 1))) }},
+    {"Execute", 1, nil, func(db *DB3, r *rand.Rand) { db.Execute(ProposalId(r.Intn(int(db.NextProposalId) + 1))) }},
+    {"Views", 1, nil, func(db *DB3, r *rand.Rand) {
+        db.Databases()
+        db.ListDatabases(r.Intn(3), r.Intn(3))
+        db.AuthorKeys(fuzzAccount(r))
+        dbid := fuzzDbid(db, r)
+        db.Versions(dbid)
+        db.Lineage(dbid)
+        db.AccessPolicy(dbid)
+        db.Allowlist(dbid)
+        db.HasAccess(dbid, fuzzAccount(r))
+        db.RoyaltySplit(dbid)
+        db.DatabaseStatus(dbid)
+        db.Discover(dbid)
+        db.Committee(dbid, fuzzQueries[r.Intn(len(fuzzQueries))])
+        db.JoinShares(dbid, fuzzQueries[r.Intn(len(fuzzQueries))])
+        db.BlockTime()
+        db.LicenseTerms(dbid)
+        db.Usage(dbid, fuzzAccount(r))
+        db.QueryUse(dbid, fuzzQueries[r.Intn(len(fuzzQueries))])
+        db.Outcomes(dbid)
+        db.Outcome(dbid, fuzzQueries[r.Intn(len(fuzzQueries))])
+        db.Assignments(dbid, fuzzAccount(r))
+        db.OpenClaims(dbid, fuzzAccount(r))
+        db.CurrentEpoch(dbid)
+        db.VestingGrants(fuzzAccount(r))
+    }},
+}
+
+// pickOp selects a random operation by weight
+func pickOp(r *rand.Rand) fuzzOp {
+    var total int
+    for _, op := range fuzzOps {
+        total += op.weight
+    }
+    n := r.Intn(total)
+    for _, op := range fuzzOps {
+        if n < op.weight {
+            return op
+        }
+        n -= op.weight
+    }
+    return fuzzOps[len(fuzzOps)-1]
+}
+
+// cloneValue deep copies maps, slices and pointers so a snapshot shares no
+// mutable state with the model, nil and empty containers stay distinct
+func cloneValue(v reflect.Value) reflect.Value {
+    switch v.Kind() {
+    case reflect.Ptr:
+        if v.IsNil() {
+            return v
+        }
+        c := reflect.New(v.Elem().Type())
+        c.Elem().Set(cloneValue(v.Elem()))
+        return c
+    case reflect.Map:
+        if v.IsNil() {
+            return v
+        }
+        c := reflect.MakeMapWithSize(v.Type(), v.Len())
+        for it := v.MapRange(); it.Next(); {
+            c.SetMapIndex(it.Key(), cloneValue(it.Value()))
+        }
+        return c
+    case reflect.Slice:
+        if v.IsNil() {
+            return v
+        }
+        c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+        for i := 0; i < v.Len(); i++ {
+            c.Index(i).Set(cloneValue(v.Index(i)))
+        }
+        return c
+    case reflect.Struct:
+        c := reflect.New(v.Type()).Elem()
+        c.Set(v)
+        for i := 0; i < v.NumField(); i++ {
+            if c.Field(i).CanSet() {
+                c.Field(i).Set(cloneValue(v.Field(i)))
+            }
+        }
+        return c
+    default:
+        return v
+    }
+}
+
+// runFuzz executes a random sequence of contract calls and checks
+// invariants after each call. String panics are contract asserts that
+// reject the call, NEAR discards all changes of a rejected call so the
+// model is restored from a snapshot. Any other panic is a crash.
+func runFuzz(t *testing.T, seed int64, steps int) {
+    r := rand.New(rand.NewSource(seed))
+    setCtx(OWNER, PK, 0, 1)
+    db := NewDB3()
+    fuzzToken = near.NewFungibleToken(TOKEN)
+    if seed%2 == 1 {
+        // odd seeds start in epoch payout mode
+        db.Params.EpochBlocks = 50
+        db.Params.VestingBlocks = 100
+    }
+    height := int64(1)
+    for i := 0; i < steps; i++ {
+        op := pickOp(r)
+        height += int64(r.Intn(10))
+        var amount int64
+        if len(op.amounts) > 0 {
+            amount = op.amounts[r.Intn(len(op.amounts))]
+        }
+        setCtx(string(fuzzAccount(r)), PK, amount, height)
+        // the event log only grows, a rollback truncates it
+        events := db.EventLog
+        db.EventLog = nil
+        snapshot := cloneValue(reflect.ValueOf(db)).Interface().(*DB3)
+        db.EventLog = events
+        func() {
+            defer func() {
+                e := recover()
+                if e == nil {
+                    return
+                }
+                if _, ok := e.(string); !ok {
+                    t.Fatalf("seed %d step %d %s by %s: crash: %v\n%s", seed, i, op.name, ctx.Caller, e, debug.Stack())
+                }
+                *db = *snapshot
+                db.EventLog = events
+            }()
+            op.call(db, r)
+        }()
+        if err := db.CheckInvariants(); err != nil {
+            t.Fatalf("seed %d step %d %s by %s: %v", seed, i, op.name, ctx.Caller, err)
+        }
+    }
+}
+
+func FuzzContract(f *testing.F) {
+    for seed := int64(0); seed < 50; seed++ {
+        f.Add(seed)
+    }
+    f.Fuzz(func(t *testing.T, seed int64) {
+        runFuzz(t, seed, 2000)
+    })
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Share of a cross-database query's royalty paid to one of the joined
+// databases. A join lists all databases of the query, the first one keeps
+// the query and its fee escrow.
+type JoinShare struct {
+    Dbid DBId
+    Bips int
+}
+
+// Pays the fee of a query that joins several databases. The query is
+// escrowed under the first database and judged against its code version
+// and royalty rate, the royalty is split across all joined databases by
+// their shares. Only hosts with a security deposit on every joined database
+// may answer the query.
+// Called by: user (maybe injected by host)
+func (d *DB3) EscrowJoinFee(qid QueryCID, ttl int64, quorum int, shares []JoinShare) {
+    if len(shares) == 0 {
+        panic("Invalid number of joined databases")
+    }
+    d.escrow(shares[0].Dbid, qid, ttl, quorum, ctx.Caller, "", ctx.Amount, shares, UseCommercial)
+    d.receive()
+}
+
+// Views the databases joined by a pending query, empty for queries on a
+// single database
+// Called by: host
+func (d *DB3) JoinShares(dbid DBId, qid QueryCID) []JoinShare {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    return append([]JoinShare{}, d.Joins[dbid][qid]...)
+}
+
+// checkJoin validates the databases of a new cross-database query, the
+// query database itself is checked by escrow
+func (d *DB3) checkJoin(dbid DBId, ttl int64, payer near.AccountID, shares []JoinShare, use Use) {
+    if len(shares) < 2 || len(shares) > MAX_JOIN_DATABASES {
+        panic("Invalid number of joined databases")
+    }
+    if shares[0].Dbid != dbid {
+        panic("Join must start with the query database")
+    }
+    var sum int
+    seen := make(map[DBId]bool)
+    for _, s := range shares {
+        if s.Dbid >= d.NextId {
+            panic("Database id does not exist")
+        }
+        if seen[s.Dbid] {
+            panic("Duplicate joined database")
+        }
+        if s.Bips <= 0 || s.Bips > 10000 {
+            panic("Join share out of range")
+        }
+        seen[s.Dbid] = true
+        sum += s.Bips
+        if s.Dbid == dbid {
+            continue
+        }
+        if !d.HasAccess(s.Dbid, payer) {
+            panic("Database is private")
+        }
+        if use == UseCommercial && !licenseTerms(d.ActiveVersion(s.Dbid, ctx.Height).Manifest).Commercial {
+            panic("License forbids commercial use")
+        }
+        d.checkAccepting(s.Dbid, ttl)
+    }
+    if sum != 10000 {
+        panic("Join shares must add up to 10000 bips")
+    }
+}
+
+// sameJoin reports whether a later escrow declares the join of a query
+func sameJoin(a, b []JoinShare) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// joinEligible reports whether a host is registered with a full security
+// deposit on every joined database
+func (d *DB3) joinEligible(shares []JoinShare, host near.AccountID) bool {
+    for _, s := range shares {
+        if d.Deposits[s.Dbid][host] < d.Params.SecurityDeposit {
+            return false
+        }
+        if _, ok := d.ApiRegistry[s.Dbid][host]; !ok {
+            return false
+        }
+    }
+    return true
+}
+
+// joinRoyalties splits the royalty of a query across its joined databases,
+// the query database receives the rounding remainder. Queries on a single
+// database keep the full royalty.
+func (d *DB3) joinRoyalties(dbid DBId, qid QueryCID, token near.AccountID, amount near.Money) []royaltyHop {
+    shares, ok := d.Joins[dbid][qid]
+    if !ok {
+        return []royaltyHop{{Dbid: dbid, Amount: amount}}
+    }
+    hops := make([]royaltyHop, len(shares))
+    rest := amount
+    for i, s := range shares[1:] {
+        hops[i+1] = royaltyHop{Dbid: s.Dbid, Amount: amount.Mul(s.Bips).Div(10000)}
+        rest -= hops[i+1].Amount
+    }
+    hops[0] = royaltyHop{Dbid: dbid, Amount: rest}
+    for _, hop := range hops {
+        d.emit("royalty_joined", JoinRoyaltyEvent{
+            Dbid:   dbid,
+            Joined: hop.Dbid,
+            Qid:    qid,
+            Amount: hop.Amount,
+            Token:  token,
+        })
+    }
+    return hops
+}
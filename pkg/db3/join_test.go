@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// newJoinDB3 deploys two databases owned by different accounts, CALLER
+// hosts both and NO_CALLER only the first
+func newJoinDB3() (*DB3, DBId, DBId) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    a := deployTestDb(db, m1)
+    setCtx(USER, PK, 0, 10)
+    b := deployTestDb(db, m1)
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(a)
+    db.Deposit(b)
+    setCtx(NO_CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(a)
+    return db, a, b
+}
+
+func TestJoinEscrow(t *testing.T) {
+    db, a, b := newJoinDB3()
+    shares := []JoinShare{{a, 7000}, {b, 3000}}
+
+    // invalid joins
+    setCtx(USER, PK, 100, 11)
+    assert.PanicsWithValue(t, "Invalid number of joined databases", func() { db.EscrowJoinFee("qid-1", 20, 0, nil) }, "empty")
+    assert.PanicsWithValue(t, "Invalid number of joined databases", func() { db.EscrowJoinFee("qid-1", 20, 0, shares[:1]) }, "single")
+    assert.PanicsWithValue(t, "Duplicate joined database", func() { db.EscrowJoinFee("qid-1", 20, 0, []JoinShare{{a, 5000}, {a, 5000}}) }, "duplicate")
+    assert.PanicsWithValue(t, "Join shares must add up to 10000 bips", func() { db.EscrowJoinFee("qid-1", 20, 0, []JoinShare{{a, 5000}, {b, 3000}}) }, "sum")
+    assert.PanicsWithValue(t, "Join share out of range", func() { db.EscrowJoinFee("qid-1", 20, 0, []JoinShare{{a, 10000}, {b, 0}}) }, "zero share")
+    assert.PanicsWithValue(t, "Database id does not exist", func() { db.EscrowJoinFee("qid-1", 20, 0, []JoinShare{{a, 5000}, {7, 5000}}) }, "unknown")
+    setCtx(USER, PK, 0, 11)
+    db.Pause(b)
+    setCtx(USER, PK, 100, 11)
+    assert.PanicsWithValue(t, "Database is not accepting queries", func() { db.EscrowJoinFee("qid-1", 20, 0, shares) }, "paused")
+    setCtx(USER, PK, 0, 11)
+    db.Resume(b)
+    db.SetAccessPolicy(b, AccessPolicy{Private: true})
+    setCtx(NO_CALLER, PK, 100, 11)
+    assert.PanicsWithValue(t, "Database is private", func() { db.EscrowJoinFee("qid-1", 20, 0, shares) }, "private")
+    setCtx(USER, PK, 0, 11)
+    db.SetAccessPolicy(b, AccessPolicy{})
+
+    // the query is kept under the first database
+    setCtx(USER, PK, 1000, 11)
+    storage := db.StorageBalanceOf(USER).Available
+    db.EscrowJoinFee("qid-1", 20, 0, shares)
+    assert.Equal(t, db.PendingFees[a]["qid-1"], near.Money(1000), "fee")
+    assert.Equal(t, db.JoinShares(a, "qid-1"), shares, "join")
+    assert.Empty(t, db.JoinShares(b, "qid-1"), "not under joined db")
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, storage-4*STORAGE_ENTRY_COST, "join storage")
+    assert.Equal(t, filterEvents(db, "query_joined")[1].Data, JoinEvent{a, "qid-1", b, 3000}, "join event")
+
+    // later escrows may omit the join but not change it
+    setCtx(USER, PK, 100, 11)
+    db.EscrowFee(a, "qid-1", 20, 0)
+    assert.PanicsWithValue(t, "Join mismatch", func() { db.EscrowJoinFee("qid-1", 20, 0, []JoinShare{{a, 5000}, {b, 5000}}) }, "changed")
+    db.EscrowFee(a, "qid-2", 20, 0)
+    assert.PanicsWithValue(t, "Join mismatch", func() { db.EscrowJoinFee("qid-2", 20, 0, shares) }, "single db query")
+    assert.Equal(t, db.PendingFees[a]["qid-1"], near.Money(1100), "topped up")
+
+    // token fees declare the join in the transfer message
+    ft := near.NewFungibleToken(TOKEN)
+    ft.Mint(USER, 1001)
+    _, err := ftEscrow(db, ft, USER, 1000, `{"dbid":"0","qid":"qid-3","ttl":20,"joins":[{"dbid":"0","bips":"5000"},{"dbid":"1","bips":"5000"}]}`, 11)
+    assert.NoError(t, err, "token join")
+    assert.Equal(t, db.JoinShares(a, "qid-3"), []JoinShare{{a, 5000}, {b, 5000}}, "token join shares")
+    _, err = ftEscrow(db, ft, USER, 1, `{"dbid":"1","qid":"qid-4","ttl":20,"joins":[{"dbid":"0","bips":"5000"},{"dbid":"1","bips":"5000"}]}`, 11)
+    assert.EqualError(t, err, "Join must start with the query database", "first db")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestJoinSettle(t *testing.T) {
+    db, a, b := newJoinDB3()
+    setCtx(USER, PK, 1000, 11)
+    db.EscrowJoinFee("qid-1", 20, 0, []JoinShare{{a, 7000}, {b, 3000}})
+
+    // only hosts registered on all joined databases settle
+    setCtx(NO_CALLER, PK, 0, 12)
+    db.Register(a, "http://a2")
+    assert.PanicsWithValue(t, "Host is not registered for all joined databases", func() { db.Settle(a, "qid-1", "rid-2") }, "not hosting b")
+    setCtx(NO_CALLER, PK, SECURITY_DEPOSIT, 12)
+    db.Deposit(b)
+    assert.PanicsWithValue(t, "Host is not registered for all joined databases", func() { db.Settle(a, "qid-1", "rid-2") }, "deposit without registration")
+    db.Register(b, "http://b2")
+    db.Settle(a, "qid-1", "rid-2")
+    setCtx(CALLER, PK, 0, 12)
+    db.Register(a, "http://a")
+    db.Register(b, "http://b")
+    db.Settle(a, "qid-1", "rid-1")
+
+    // hosts that leave a joined database forfeit their vote
+    setCtx(NO_CALLER, PK, 0, 13)
+    db.Withdraw(b)
+
+    // the royalty is split across the joined databases
+    setCtx(CALLER, PK, 0, 20)
+    db.Finalize()
+    assert.Equal(t, db.SettledFees[CALLER], near.Money(900), "host fee")
+    assert.Equal(t, db.SettledFees[NO_CALLER], near.Money(0), "forfeited")
+    assert.Equal(t, db.SettledRoyalties[CALLER], near.Money(70), "query db royalty")
+    assert.Equal(t, db.SettledRoyalties[USER], near.Money(30), "joined db royalty")
+    joined := filterEvents(db, "royalty_joined")
+    assert.Len(t, joined, 2, "split events")
+    assert.Equal(t, joined[1].Data, JoinRoyaltyEvent{Dbid: a, Joined: b, Qid: "qid-1", Amount: 30}, "joined share")
+    assert.Empty(t, db.Joins[a], "cleaned up")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+
+    // committees are drawn from hosts of all joined databases
+    setCtx(USER, PK, 1000, 21)
+    db.EscrowJoinFee("qid-2", 40, 0, []JoinShare{{a, 5000}, {b, 5000}})
+    assert.Equal(t, db.Committee(a, "qid-2"), []near.AccountID{CALLER}, "committee")
+    db.EscrowFee(a, "qid-3", 40, 0)
+    assert.Len(t, db.Committee(a, "qid-3"), 2, "single db committee")
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "strings"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Use a query fee is paid for, the manifest royalty applies to commercial
+// queries and the non-commercial royalty to non-commercial queries
+type Use int
+
+const (
+    UseCommercial Use = iota
+    UseNonCommercial
+)
+
+func (u Use) String() string {
+    switch u {
+    case UseCommercial:
+        return "commercial"
+    case UseNonCommercial:
+        return "non_commercial"
+    default:
+        return "invalid"
+    }
+}
+
+// SPDX license expressions without a license
+const (
+    LicenseNone        = "NONE"        // no license, all rights reserved
+    LicenseNoAssertion = "NOASSERTION" // license not stated
+    LicenseRefPrefix   = "LicenseRef-" // custom license defined by the author
+)
+
+// Usage terms of an SPDX license the contract knows about
+type spdxLicense struct {
+    NonCommercial bool // forbids commercial use
+    Attribution   bool // results must credit the database
+}
+
+// SPDX identifiers accepted in manifests, licenses that are missing here can
+// be declared as LicenseRef-<id>
+var spdxLicenses = map[string]spdxLicense{
+    "0BSD":                         {},
+    "AGPL-3.0-only":                {},
+    "AGPL-3.0-or-later":            {},
+    "Apache-2.0":                   {},
+    "BSD-2-Clause":                 {},
+    "BSD-3-Clause":                 {},
+    "BUSL-1.1":                     {},
+    "CC-BY-4.0":                    {Attribution: true},
+    "CC-BY-NC-4.0":                 {NonCommercial: true, Attribution: true},
+    "CC-BY-NC-ND-4.0":              {NonCommercial: true, Attribution: true},
+    "CC-BY-NC-SA-4.0":              {NonCommercial: true, Attribution: true},
+    "CC-BY-ND-4.0":                 {Attribution: true},
+    "CC-BY-SA-4.0":                 {Attribution: true},
+    "CC0-1.0":                      {},
+    "CDLA-Permissive-2.0":          {},
+    "CDLA-Sharing-1.0":             {},
+    "GPL-3.0-only":                 {},
+    "GPL-3.0-or-later":             {},
+    "LGPL-3.0-only":                {},
+    "LGPL-3.0-or-later":            {},
+    "MIT":                          {},
+    "MPL-2.0":                      {},
+    "ODC-By-1.0":                   {Attribution: true},
+    "ODbL-1.0":                     {Attribution: true},
+    "PDDL-1.0":                     {},
+    "PolyForm-Noncommercial-1.0.0": {NonCommercial: true},
+    "Unlicense":                    {},
+}
+
+// Machine-readable usage terms of a database, nodes check them when
+// admitting queries
+type LicenseTerms struct {
+    License                  string // SPDX identifier
+    Commercial               bool   // commercial use permitted
+    CommercialRoyaltyBips    int
+    NonCommercialRoyaltyBips int
+    Attribution              string // credit line results must carry, empty without requirement
+    UsageCap                 int    // most queries an account may pay for (0 means unlimited)
+}
+
+// Views the license terms of the active code version of a database
+// Called by: host, user
+func (d *DB3) LicenseTerms(dbid DBId) LicenseTerms {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    return licenseTerms(d.ActiveVersion(dbid, ctx.Height).Manifest)
+}
+
+// Views the number of queries an account has paid for on a database with a
+// usage cap
+// Called by: host, user
+func (d *DB3) Usage(dbid DBId, account near.AccountID) int {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    return d.UsageCounts[dbid][account]
+}
+
+// Views the use a pending query was paid for
+// Called by: host
+func (d *DB3) QueryUse(dbid DBId, qid QueryCID) Use {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    return d.QueryUses[dbid][qid]
+}
+
+func licenseTerms(m Manifest) LicenseTerms {
+    return LicenseTerms{
+        License:                  m.License,
+        Commercial:               !spdxLicenses[m.License].NonCommercial,
+        CommercialRoyaltyBips:    m.RoyaltyBips,
+        NonCommercialRoyaltyBips: m.NonCommercialRoyaltyBips,
+        Attribution:              m.Attribution,
+        UsageCap:                 m.UsageCap,
+    }
+}
+
+// royaltyBips returns the royalty rate of a query use
+func royaltyBips(m Manifest, use Use) int {
+    if use == UseNonCommercial {
+        return m.NonCommercialRoyaltyBips
+    }
+    return m.RoyaltyBips
+}
+
+// validateLicense checks the license identifier and terms of a manifest, an
+// empty license is not asserted
+func validateLicense(m Manifest) {
+    lic, known := spdxLicenses[m.License]
+    switch {
+    case known, m.License == "", m.License == LicenseNone, m.License == LicenseNoAssertion:
+    case isLicenseRef(m.License):
+    default:
+        panic("Unknown SPDX license")
+    }
+    if m.NonCommercialRoyaltyBips < 0 || m.NonCommercialRoyaltyBips > 10000 {
+        panic("Non-commercial royalty out of range")
+    }
+    if lic.Attribution && strings.TrimSpace(m.Attribution) == "" {
+        panic("License requires attribution")
+    }
+    if len(m.Attribution) > MAX_ATTRIBUTION_LEN {
+        panic("Attribution too long")
+    }
+    if m.UsageCap < 0 {
+        panic("Usage cap out of range")
+    }
+}
+
+// isLicenseRef checks the SPDX syntax of custom license references
+func isLicenseRef(s string) bool {
+    id := strings.TrimPrefix(s, LicenseRefPrefix)
+    if id == s || id == "" {
+        return false
+    }
+    for _, c := range id {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-':
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+// checkUse rejects queries the license of their code version does not
+// permit and returns whether the payer is counted against the usage cap
+func (d *DB3) checkUse(m Manifest, dbid DBId, qid QueryCID, payer near.AccountID, use Use, escrowed bool) bool {
+    if use != UseCommercial && use != UseNonCommercial {
+        panic("Invalid query use")
+    }
+    if use == UseCommercial && spdxLicenses[m.License].NonCommercial {
+        panic("License forbids commercial use")
+    }
+    if escrowed && d.QueryUses[dbid][qid] != use {
+        panic("Query use mismatch")
+    }
+    if _, paid := d.QueryPayments[dbid][qid][payer]; paid || m.UsageCap == 0 {
+        return false
+    }
+    if d.UsageCounts[dbid][payer] >= m.UsageCap {
+        panic("Usage cap reached")
+    }
+    return true
+}
+
+// countUsage counts a query against the usage cap of a payer, the first
+// count locks storage for the counter which is never released
+func (d *DB3) countUsage(dbid DBId, payer near.AccountID) {
+    if _, ok := d.UsageCounts[dbid][payer]; !ok {
+        d.chargeStorage(payer, 1)
+    }
+    d.UsageCounts[dbid][payer]++
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "strings"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+func TestLicenseValidate(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    for _, v := range []string{"", "MIT", "NONE", "NOASSERTION", "LicenseRef-Blockwatch-1.0"} {
+        m := m1
+        m.License = v
+        assert.NotPanics(t, func() { deployTestDb(db, m) }, v)
+    }
+    for name, m := range map[string]Manifest{
+        "Unknown SPDX license":                {CID: "cid", License: "all rights reserved"},
+        "Unknown SPDX license ref":            {CID: "cid", License: "LicenseRef-"},
+        "Non-commercial royalty out of range": {CID: "cid", License: "MIT", NonCommercialRoyaltyBips: 10001},
+        "License requires attribution":        {CID: "cid", License: "CC-BY-4.0"},
+        "Attribution too long":                {CID: "cid", License: "MIT", Attribution: strings.Repeat("a", MAX_ATTRIBUTION_LEN+1)},
+        "Usage cap out of range":              {CID: "cid", License: "MIT", UsageCap: -1},
+    } {
+        m := m
+        assert.Panics(t, func() { deployTestDb(db, m) }, name)
+    }
+
+    id := deployTestDb(db, Manifest{CID: "cid", License: "CC-BY-NC-4.0", RoyaltyBips: 500, NonCommercialRoyaltyBips: 100, Attribution: "DB3", UsageCap: 5})
+    assert.Equal(t, db.LicenseTerms(id), LicenseTerms{
+        License:                  "CC-BY-NC-4.0",
+        Commercial:               false,
+        CommercialRoyaltyBips:    500,
+        NonCommercialRoyaltyBips: 100,
+        Attribution:              "DB3",
+        UsageCap:                 5,
+    }, "license terms")
+    assert.Panics(t, func() { db.Upgrade(id, Manifest{CID: "cid-2", License: "CC-BY-4.0"}) }, "upgrade validates")
+    assert.Panics(t, func() { db.LicenseTerms(99) }, "unknown database")
+}
+
+func TestLicenseLegacy(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+
+    // free-form licenses accepted before SPDX validation are rejected now
+    legacy := m1
+    legacy.License = "n/a"
+    assert.PanicsWithValue(t, "Unknown SPDX license", func() { deployTestDb(db, legacy) }, "free-form deploy")
+
+    // databases deployed with a free-form license keep serving it
+    id := deployTestDb(db, m1)
+    db.Manifests[id] = legacy
+    db.ManifestVersions[id][0].Manifest = legacy
+    assert.Equal(t, db.LicenseTerms(id).License, "n/a", "legacy terms")
+    assert.True(t, db.LicenseTerms(id).Commercial, "legacy commercial use")
+
+    // and migrate to an SPDX identifier or license ref with the next upgrade
+    assert.PanicsWithValue(t, "Unknown SPDX license", func() { db.Upgrade(id, legacy) }, "free-form upgrade")
+    legacy.License = "LicenseRef-Legacy"
+    assert.NotPanics(t, func() { db.Upgrade(id, legacy) }, "license ref upgrade")
+}
+
+func TestLicenseRoyalty(t *testing.T) {
+    db, _, hosts := newOutcomeDB3()
+    m := m1
+    m.NonCommercialRoyaltyBips = 200
+    setCtx(CALLER, PK, 0, 10)
+    id := deployTestDb(db, m)
+    for _, h := range hosts {
+        setCtx(string(h), PK, SECURITY_DEPOSIT, 10)
+        db.Deposit(id)
+    }
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    db.EscrowFeeFor(id, "qid-2", 20, 0, UseNonCommercial)
+    assert.Equal(t, db.QueryUse(id, "qid-2"), UseNonCommercial, "query use")
+    assert.Panics(t, func() { db.EscrowFeeFor(id, "qid-2", 20, 0, UseCommercial) }, "use mismatch")
+    assert.Panics(t, func() { db.EscrowFeeFor(id, "qid-3", 20, 0, Use(2)) }, "invalid use")
+    for _, qid := range []QueryCID{"qid-1", "qid-2"} {
+        setCtx(string(hosts[0]), PK, 0, 11)
+        db.Settle(id, qid, "rid-1")
+    }
+    setCtx(USER, PK, 0, 20)
+    db.Finalize()
+
+    assert.Equal(t, db.Outcome(id, "qid-1").Royalty, near.Money(100), "commercial royalty")
+    assert.Equal(t, db.Outcome(id, "qid-2").Royalty, near.Money(20), "non-commercial royalty")
+    assert.Len(t, db.QueryUses[id], 0, "use cleaned up")
+    assert.Len(t, filterEvents(db, "fee_escrowed"), 2, "escrow events")
+    assert.Equal(t, filterEvents(db, "fee_escrowed")[1].Data.(EscrowEvent).NonCommercial, true, "escrow event use")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestLicenseNonCommercial(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    nc := deployTestDb(db, Manifest{CID: "cid", License: "CC-BY-NC-SA-4.0", Attribution: "DB3"})
+
+    setCtx(USER, PK, 1000, 10)
+    assert.Panics(t, func() { db.EscrowFee(nc, "qid-1", 20, 0) }, "commercial use")
+    assert.NotPanics(t, func() { db.EscrowFeeFor(nc, "qid-1", 20, 0, UseNonCommercial) }, "non-commercial use")
+
+    // joined databases must permit the use of the query
+    shares := []JoinShare{{id, 5000}, {nc, 5000}}
+    assert.Panics(t, func() { db.EscrowJoinFee("qid-2", 20, 0, shares) }, "commercial join")
+
+    msg := `{"dbid":"1","qid":"qid-3","ttl":"20","non_commercial":true}`
+    setCtx(TOKEN, PK, 0, 10)
+    assert.Equal(t, db.FtOnTransfer(USER, 1000, msg), near.Money(0), "token escrow")
+    assert.Equal(t, db.QueryUse(nc, "qid-3"), UseNonCommercial, "token query use")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestLicenseUsageCap(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, Manifest{CID: "cid", License: "MIT", UsageCap: 2})
+
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    assert.Equal(t, db.Usage(id, USER), 1, "repeated payment counts once")
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, near.Money(1000-4*STORAGE_ENTRY_COST), "counter storage")
+    db.EscrowFee(id, "qid-2", 20, 0)
+    assert.Equal(t, db.Usage(id, USER), 2, "usage")
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-3", 20, 0) }, "cap reached")
+
+    // other accounts and finalized queries keep their count
+    setCtx(NO_CALLER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-3", 20, 0)
+    setCtx(USER, PK, 0, 20)
+    db.Finalize()
+    assert.Equal(t, db.Usage(id, USER), 2, "usage after finalize")
+    assert.Equal(t, db.Usage(id, NO_CALLER), 1, "other account")
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, near.Money(1000-STORAGE_ENTRY_COST), "counter storage kept")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
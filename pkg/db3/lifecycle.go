@@ -0,0 +1,161 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+type DBStatus byte
+
+const (
+    StatusActive DBStatus = iota
+    StatusPaused
+    StatusDeprecated
+    StatusRetired
+)
+
+func (s DBStatus) String() string {
+    switch s {
+    case StatusActive:
+        return "active"
+    case StatusPaused:
+        return "paused"
+    case StatusDeprecated:
+        return "deprecated"
+    case StatusRetired:
+        return "retired"
+    default:
+        return "invalid"
+    }
+}
+
+// Lifecycle event data
+type StatusEvent struct {
+    Dbid         DBId   `json:"dbid,string"`
+    Status       string `json:"status"`
+    SunsetHeight int64  `json:"sunset_height,string,omitempty"`
+}
+
+// Views the lifecycle status of a database at the current height
+// Called by: host
+func (d *DB3) DatabaseStatus(dbid DBId) DBStatus {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    status := d.Status[dbid]
+    if status == StatusDeprecated && d.SunsetHeights[dbid] <= ctx.Height {
+        return StatusRetired
+    }
+    return status
+}
+
+// Pauses a database, new fee escrows are rejected while pending queries
+// still settle and finalize
+// Called by: developer
+func (d *DB3) Pause(dbid DBId) {
+    d.checkDatabaseOwner(dbid)
+    if d.DatabaseStatus(dbid) != StatusActive {
+        panic("Database is not active")
+    }
+    d.Status[dbid] = StatusPaused
+    d.emit("db_paused", StatusEvent{Dbid: dbid, Status: StatusPaused.String()})
+}
+
+// Resumes a paused database
+// Called by: developer
+func (d *DB3) Resume(dbid DBId) {
+    d.checkDatabaseOwner(dbid)
+    if d.DatabaseStatus(dbid) != StatusPaused {
+        panic("Database is not paused")
+    }
+    delete(d.Status, dbid)
+    d.emit("db_resumed", StatusEvent{Dbid: dbid, Status: StatusActive.String()})
+}
+
+// Deprecates a database, it retires at the sunset height after which
+// no queries are accepted. Sunset must leave pending queries enough
+// time to settle.
+// Called by: developer
+func (d *DB3) Deprecate(dbid DBId, sunset int64) {
+    d.checkDatabaseOwner(dbid)
+    switch d.DatabaseStatus(dbid) {
+    case StatusActive, StatusPaused:
+    default:
+        panic("Database is already deprecated")
+    }
+    if sunset < ctx.Height+d.Params.MaxBlocksToSettle {
+        panic("Sunset height too early")
+    }
+    d.Status[dbid] = StatusDeprecated
+    d.SunsetHeights[dbid] = sunset
+    d.emit("db_deprecated", StatusEvent{
+        Dbid:         dbid,
+        Status:       StatusDeprecated.String(),
+        SunsetHeight: sunset,
+    })
+}
+
+// Retires a deprecated database after its sunset height and refunds
+// the storage deposit to the account that paid it on deploy. Hosts may
+// withdraw deposits, registrations and allowlists are removed.
+// Called by: developer
+func (d *DB3) Retire(dbid DBId) {
+    d.checkDatabaseOwner(dbid)
+    if d.Status[dbid] == StatusRetired {
+        panic("Database is already retired")
+    }
+    if d.DatabaseStatus(dbid) != StatusRetired {
+        panic("Database has not reached its sunset height")
+    }
+    d.Status[dbid] = StatusRetired
+    for acc := range d.ApiRegistry[dbid] {
+        d.refundStorage(acc, STORAGE_ENTRY_COST)
+    }
+    d.ApiRegistry[dbid] = make(map[near.AccountID]ApiEndpoint)
+    for _, g := range d.Allowlists[dbid] {
+        d.refundStorage(g.Payer, STORAGE_ENTRY_COST)
+    }
+    delete(d.Allowlists, dbid)
+    if refund := d.StorageDeposits[dbid]; refund > 0 {
+        payer, ok := d.StoragePayers[dbid]
+        if !ok {
+            // deposits recorded before payers were tracked go to the owner
+            payer = ctx.Caller
+        }
+        delete(d.StorageDeposits, dbid)
+        delete(d.StoragePayers, dbid)
+        d.transfer(payer, refund)
+        d.emit("storage_refunded", PayoutEvent{Dbid: dbid, Account: payer, Amount: refund})
+    }
+    d.emit("db_retired", StatusEvent{
+        Dbid:         dbid,
+        Status:       StatusRetired.String(),
+        SunsetHeight: d.SunsetHeights[dbid],
+    })
+}
+
+// checkAccepting panics unless a database accepts new queries, paused and
+// retired databases reject new queries, deprecated databases accept queries
+// that settle before sunset
+func (d *DB3) checkAccepting(dbid DBId, ttl int64) {
+    switch d.DatabaseStatus(dbid) {
+    case StatusActive:
+    case StatusDeprecated:
+        if ttl >= d.SunsetHeights[dbid] {
+            panic("Fee TTL exceeds database sunset")
+        }
+    default:
+        panic("Database is not accepting queries")
+    }
+}
+
+func (d *DB3) checkDatabaseOwner(dbid DBId) {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    if ctx.Caller != d.Owners[dbid] {
+        panic("Must be database owner to change status")
+    }
+}
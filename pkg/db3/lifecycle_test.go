@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+func TestPause(t *testing.T) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    setCtx(USER, PK, 1, 10)
+    db.EscrowFee(id, "qid-1", 100, 0)
+
+    setCtx(NO_CALLER, PK, 0, 10)
+    assert.Panics(t, func() { db.Pause(id) }, "not owner")
+    setCtx(CALLER, PK, 0, 10)
+    assert.Panics(t, func() { db.Resume(id) }, "not paused")
+    assert.NotPanics(t, func() { db.Pause(id) }, "successful pause")
+    assert.Equal(t, db.DatabaseStatus(id), StatusPaused, "paused status")
+    assert.Panics(t, func() { db.Pause(id) }, "already paused")
+
+    // pending queries still settle, new ones are rejected
+    setCtx(USER, PK, 1, 10)
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-2", 100, 0) }, "escrow rejected")
+    setCtx(CALLER, PK, 0, 11)
+    assert.NotPanics(t, func() { db.Settle(id, "qid-1", "rid-1") }, "pending query settles")
+    assert.Panics(t, func() { db.Settle(id, "qid-2", "rid-1") }, "new query rejected")
+
+    assert.NotPanics(t, func() { db.Resume(id) }, "successful resume")
+    assert.Equal(t, db.DatabaseStatus(id), StatusActive, "active status")
+    setCtx(USER, PK, 1, 10)
+    assert.NotPanics(t, func() { db.EscrowFee(id, "qid-2", 100, 0) }, "escrow accepted")
+
+    assert.Len(t, filterEvents(db, "db_paused"), 1, "pause event")
+    assert.Len(t, filterEvents(db, "db_resumed"), 1, "resume event")
+}
+
+func TestDeprecateAndRetire(t *testing.T) {
+    setCtx(CALLER, PK, 1000, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    assert.Equal(t, db.StorageDeposits[id], near.Money(1000), "storage deposit")
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+    db.Register(id, "api")
+
+    setCtx(CALLER, PK, 0, 10)
+    assert.Panics(t, func() { db.Deprecate(id, 10+MAX_BLOCKS_TO_SETTLE-1) }, "sunset too early")
+    assert.NotPanics(t, func() { db.Deprecate(id, 500) }, "successful deprecate")
+    assert.Equal(t, db.DatabaseStatus(id), StatusDeprecated, "deprecated status")
+    assert.Panics(t, func() { db.Deprecate(id, 600) }, "already deprecated")
+    assert.Panics(t, func() { db.Retire(id) }, "before sunset")
+
+    setCtx(USER, PK, 1, 10)
+    assert.NotPanics(t, func() { db.EscrowFee(id, "qid-1", 100, 0) }, "escrow before sunset")
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-2", 500, 0) }, "escrow past sunset")
+
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 500)
+    assert.Equal(t, db.DatabaseStatus(id), StatusRetired, "retired at sunset")
+    assert.Panics(t, func() { db.Deposit(id) }, "no deposits after retirement")
+    assert.Panics(t, func() { db.Register(id, "api2") }, "no registration after retirement")
+    assert.NotPanics(t, func() { db.Retire(id) }, "successful retire")
+    assert.Zero(t, db.StorageDeposits[id], "storage refunded")
+    assert.Empty(t, db.Discover(id), "registrations removed")
+    assert.Panics(t, func() { db.Retire(id) }, "already retired")
+    assert.NotPanics(t, func() { db.Withdraw(id) }, "deposit withdrawable")
+
+    assert.Equal(t, filterEvents(db, "db_deprecated")[0].Data, StatusEvent{Dbid: id, Status: "deprecated", SunsetHeight: 500}, "deprecate event")
+    assert.Len(t, filterEvents(db, "db_retired"), 1, "retire event")
+    assert.Equal(t, filterEvents(db, "storage_refunded")[0].Data, PayoutEvent{Dbid: id, Account: CALLER, Amount: 1000}, "refund event")
+}
+
+func TestRetireRefundsPayer(t *testing.T) {
+    setCtx(CALLER, PK, 1000, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    assert.Equal(t, db.StoragePayers[id], near.AccountID(CALLER), "payer recorded")
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+    db.ProposeOwner(id, USER)
+
+    // a host with an open claim cannot leave a retired database
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, QID_1, 100, 0)
+    setCtx(USER, PK, 0, 99)
+    db.FileClaim(id, QID_1, CALLER, "SELECT 1")
+
+    setCtx(USER, PK, 0, 100)
+    db.AcceptOwner(id)
+    db.Deprecate(id, 100+MAX_BLOCKS_TO_SETTLE)
+    setCtx(USER, PK, 0, 100+MAX_BLOCKS_TO_SETTLE)
+    db.Retire(id)
+    assert.Equal(t, filterEvents(db, "storage_refunded")[0].Data, PayoutEvent{Dbid: id, Account: CALLER, Amount: 1000}, "refund to payer")
+    assert.Empty(t, db.StoragePayers, "payer cleaned up")
+
+    setCtx(CALLER, PK, 0, 100+MAX_BLOCKS_TO_SETTLE)
+    assert.Panics(t, func() { db.Withdraw(id) }, "open claim blocks withdraw")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "sort"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Schema version of the contract state written by this contract version.
+// Version 1 is the layout written before the version was stored in the
+// contract object.
+const STATE_VERSION = 2
+
+// Migration upgrades a state snapshot from the schema version it is
+// registered for to the next version. Migrations edit storage entries in
+// place and must carry over all balances.
+type Migration func(s *State) error
+
+// registered migrations by the version they upgrade from
+var migrations = map[int]Migration{
+    1: migrateV1,
+}
+
+// RegisterMigration registers the migration from a schema version to the
+// next one, e.g. from a contract version that extends the state layout
+func RegisterMigration(from int, m Migration) {
+    if _, ok := migrations[from]; ok {
+        panic(fmt.Errorf("migration from state version %d already registered", from))
+    }
+    migrations[from] = m
+}
+
+// Version reads the schema version from the contract object of a snapshot
+func (s *State) Version() (int, error) {
+    buf, ok := s.Get(STATE_KEY)
+    if !ok {
+        return 0, fmt.Errorf("missing %s key", STATE_KEY)
+    }
+    var cs struct {
+        Version int `json:"version"`
+    }
+    if err := json.Unmarshal(buf, &cs); err != nil {
+        return 0, fmt.Errorf("decoding %s: %v", STATE_KEY, err)
+    }
+    if cs.Version == 0 {
+        return 1, nil
+    }
+    return cs.Version, nil
+}
+
+// Migrate upgrades a snapshot to a schema version by running all registered
+// migrations in order. Snapshots of a later version are not downgraded.
+func (s *State) Migrate(to int) error {
+    from, err := s.Version()
+    if err != nil {
+        return err
+    }
+    if from > to {
+        return fmt.Errorf("state version %d is newer than %d", from, to)
+    }
+    for v := from; v < to; v++ {
+        m, ok := migrations[v]
+        if !ok {
+            return fmt.Errorf("missing migration from state version %d", v)
+        }
+        if err := m(s); err != nil {
+            return fmt.Errorf("migrating state version %d: %v", v, err)
+        }
+        if next, err := s.Version(); err != nil || next != v+1 {
+            return fmt.Errorf("migration from state version %d did not reach version %d", v, v+1)
+        }
+    }
+    return nil
+}
+
+// Clone copies a snapshot so it can be migrated without changing the source
+func (s *State) Clone() *State {
+    c := &State{Items: make([]StateItem, len(s.Items))}
+    for i, v := range s.Items {
+        c.Items[i] = StateItem{
+            Key:   append([]byte{}, v.Key...),
+            Value: append([]byte{}, v.Value...),
+        }
+    }
+    return c
+}
+
+// Get returns the value of a storage entry
+func (s *State) Get(key string) ([]byte, bool) {
+    if i := s.index(key); i >= 0 {
+        return s.Items[i].Value, true
+    }
+    return nil, false
+}
+
+// Set writes a storage entry and keeps entries ordered by key
+func (s *State) Set(key string, value []byte) {
+    if i := s.index(key); i >= 0 {
+        s.Items[i].Value = value
+        return
+    }
+    s.Items = append(s.Items, StateItem{Key: []byte(key), Value: value})
+    sort.Slice(s.Items, func(i, j int) bool { return bytes.Compare(s.Items[i].Key, s.Items[j].Key) < 0 })
+}
+
+// Delete removes a storage entry
+func (s *State) Delete(key string) {
+    if i := s.index(key); i >= 0 {
+        s.Items = append(s.Items[:i], s.Items[i+1:]...)
+    }
+}
+
+// index finds the position of a key, snapshots assembled by hand may not be
+// ordered
+func (s *State) index(key string) int {
+    for i, v := range s.Items {
+        if string(v.Key) == key {
+            return i
+        }
+    }
+    return -1
+}
+
+// setVersion stamps the schema version into the contract object, other
+// fields are kept unchanged
+func (s *State) setVersion(version int) error {
+    buf, ok := s.Get(STATE_KEY)
+    if !ok {
+        return fmt.Errorf("missing %s key", STATE_KEY)
+    }
+    var cs map[string]json.RawMessage
+    if err := json.Unmarshal(buf, &cs); err != nil {
+        return fmt.Errorf("decoding %s: %v", STATE_KEY, err)
+    }
+    cs["version"] = json.RawMessage(fmt.Sprint(version))
+    buf, err := marshal(cs)
+    if err != nil {
+        return err
+    }
+    s.Set(STATE_KEY, buf)
+    return nil
+}
+
+// migrateV1 upgrades the unversioned layout of the first contract release,
+// which stored neither manifest versions, discovery indexes nor storage
+// deposits. Each database gets its stored manifest as version 0, indexes
+// are rebuilt from it and the storage deposit deploy required is recorded
+// as paid by the owner. Other entries were never charged for storage, so
+// refunds never unlock more than an account paid.
+func migrateV1(s *State) error {
+    buf, ok := s.Get(STATE_KEY)
+    if !ok {
+        return fmt.Errorf("missing %s key", STATE_KEY)
+    }
+    var cs struct {
+        NextId DBId `json:"next_id"`
+    }
+    if err := json.Unmarshal(buf, &cs); err != nil {
+        return fmt.Errorf("decoding %s: %v", STATE_KEY, err)
+    }
+    indexes := map[string]map[string][]string{
+        PREFIX_AUTHOR_INDEX:  make(map[string][]string),
+        PREFIX_LICENSE_INDEX: make(map[string][]string),
+        PREFIX_TAG_INDEX:     make(map[string][]string),
+    }
+    push := func(prefix, key, dbid string) {
+        for _, v := range indexes[prefix][key] {
+            if v == dbid {
+                return
+            }
+        }
+        indexes[prefix][key] = append(indexes[prefix][key], dbid)
+    }
+    deposit, err := marshal(near.Money(STORAGE_COST).Yocto())
+    if err != nil {
+        return err
+    }
+    for dbid := DBId(0); dbid < cs.NextId; dbid++ {
+        key := dbkey(dbid)
+        raw, err := unwrapEntry(s.entry(PREFIX_MANIFESTS + "m" + key))
+        if err != nil {
+            return fmt.Errorf("decoding manifest of db %d: %v", dbid, err)
+        }
+        var m tsManifest
+        if err := json.Unmarshal(raw, &m); err != nil {
+            return fmt.Errorf("decoding manifest of db %d: %v", dbid, err)
+        }
+        owner, err := unwrapEntry(s.entry(PREFIX_OWNERS + "m" + key))
+        if err != nil {
+            return fmt.Errorf("decoding owner of db %d: %v", dbid, err)
+        }
+
+        // keep the stored manifest encoding like the contract does
+        versions, err := marshal([]struct {
+            Version          int             `json:"version"`
+            Manifest         json.RawMessage `json:"manifest"`
+            ActivationHeight jsonInt         `json:"activation_height"`
+        }{{Version: 0, Manifest: raw}})
+        if err != nil {
+            return err
+        }
+        s.Set(PREFIX_VERSIONS+key, versions)
+        s.Set(PREFIX_STORAGE_DEPOSITS+key, deposit)
+        s.Set(PREFIX_STORAGE_PAYERS+key, owner)
+
+        push(PREFIX_AUTHOR_INDEX, string(m.Author), key)
+        if m.License != "" {
+            push(PREFIX_LICENSE_INDEX, m.License, key)
+        }
+        for _, tag := range m.Tags {
+            if tag = normalizeTag(tag); tag != "" {
+                push(PREFIX_TAG_INDEX, tag, key)
+            }
+        }
+    }
+    for prefix, index := range indexes {
+        for k, ids := range index {
+            buf, err := marshal(ids)
+            if err != nil {
+                return err
+            }
+            s.Set(prefix+k, buf)
+        }
+    }
+    return s.setVersion(2)
+}
+
+// entry returns the value of a storage entry or nil when it is missing
+func (s *State) entry(key string) []byte {
+    buf, _ := s.Get(key)
+    return buf
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "encoding/json"
+    "github.com/stretchr/testify/assert"
+    "os"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// loadV1 reads a snapshot in the layout of the first contract release, it
+// has no schema version, manifest versions, discovery indexes or storage
+// deposits
+func loadV1(t *testing.T) *State {
+    buf, err := os.ReadFile("testdata/state_v1.json")
+    assert.NoError(t, err, "read fixture")
+    s := &State{}
+    assert.NoError(t, json.Unmarshal(buf, s), "decode fixture")
+    return s
+}
+
+func TestMigrateV1(t *testing.T) {
+    v1 := loadV1(t)
+    v, err := v1.Version()
+    assert.NoError(t, err, "version")
+    assert.Equal(t, v, 1, "unversioned")
+    for _, key := range []string{PREFIX_VERSIONS + "0", PREFIX_AUTHOR_INDEX + "dev.near", PREFIX_STORAGE_DEPOSITS + "0"} {
+        _, ok := v1.Get(key)
+        assert.False(t, ok, "no %s", key)
+    }
+
+    // v1 snapshots survive the borsh export
+    buf, err := v1.MarshalBorsh()
+    assert.NoError(t, err, "borsh encode")
+    var exported State
+    assert.NoError(t, exported.UnmarshalBorsh(buf), "borsh decode")
+
+    // loading migrates a copy
+    db, err := LoadState(&exported)
+    assert.NoError(t, err, "load")
+    v, _ = exported.Version()
+    assert.Equal(t, v, 1, "source unchanged")
+
+    // the stored manifest becomes version 0
+    m0 := Manifest{Author: "dev.near", Name: "Hello", License: "MIT", CID: "cid-0", RoyaltyBips: 1000}
+    assert.Equal(t, db.Manifests[0], m0, "manifest")
+    assert.Equal(t, db.Versions(0), []ManifestVersion{{Version: 0, Manifest: m0}}, "versions")
+    assert.Len(t, db.Versions(1), 1, "versions of db 1")
+    assert.Equal(t, db.DatabaseStatus(0), StatusActive, "status")
+
+    // discovery indexes are rebuilt
+    assert.Len(t, db.SearchDatabases(DatabaseFilter{Author: "dev.near"}, 0, 10), 2, "author index")
+    assert.Len(t, db.SearchDatabases(DatabaseFilter{License: "MIT"}, 0, 10), 1, "license index")
+    assert.Equal(t, db.AuthorIndex, map[near.AccountID][]DBId{"dev.near": {0, 1}}, "author entries")
+    assert.Equal(t, db.LicenseIndex, map[string][]DBId{"MIT": {0}}, "license entries")
+
+    // the storage deploy required is refundable to the owner
+    assert.Equal(t, db.StorageDeposits, map[DBId]near.Money{0: STORAGE_COST, 1: STORAGE_COST}, "storage deposits")
+    assert.Equal(t, db.StoragePayers, map[DBId]near.AccountID{0: "dev.near", 1: "dev2.near"}, "storage payers")
+
+    // no funds are lost
+    assert.Equal(t, db.Deposits[0], map[near.AccountID]near.Money{"host1.near": 10000, "host2.near": 7500}, "deposits")
+    assert.Equal(t, db.PendingFees[0], map[QueryCID]near.Money{"q1": 1000}, "pending fees")
+    assert.Equal(t, db.ResultTTL[0], map[QueryCID]int64{"q1": 100}, "ttl")
+    assert.Equal(t, db.PendingResults[0]["q1"], map[near.AccountID]ResultCID{"host1.near": "rid-1"}, "votes")
+    assert.Equal(t, db.SettledFees, map[near.AccountID]near.Money{"host1.near": 900}, "settled fees")
+    assert.Equal(t, db.SettledRoyalties, map[near.AccountID]near.Money{"dev.near": 100}, "settled royalties")
+    assert.Equal(t, db.Slashed, near.Money(2500), "slashed")
+
+    // in place migration writes entries like the model, manifests keep
+    // their stored encoding
+    assert.NoError(t, exported.Migrate(STATE_VERSION), "migrate")
+    v, _ = exported.Version()
+    assert.Equal(t, v, STATE_VERSION, "migrated version")
+    db2, err := LoadState(&exported)
+    assert.NoError(t, err, "load migrated")
+    assert.Equal(t, db2, db, "model")
+    s, err := db.State()
+    assert.NoError(t, err, "encode")
+    for _, key := range []string{
+        PREFIX_AUTHOR_INDEX + "dev.near",
+        PREFIX_LICENSE_INDEX + "MIT",
+        PREFIX_STORAGE_DEPOSITS + "1",
+        PREFIX_STORAGE_PAYERS + "1",
+    } {
+        want, _ := s.Get(key)
+        have, ok := exported.Get(key)
+        assert.True(t, ok, "entry %s", key)
+        assert.Equal(t, string(have), string(want), "entry %s", key)
+    }
+    assert.Error(t, exported.Migrate(1), "no downgrade")
+
+    // entries written before storage accounting unlock no storage balance
+    setCtx("host1.near", PK, 1000, 50)
+    db.StorageDeposit("")
+    db.Withdraw(0)
+    assert.Equal(t, db.StorageBalanceOf("host1.near").Available, near.Money(1000-STORAGE_ENTRY_COST), "refunds capped")
+    assert.Panics(t, func() { db.StorageWithdraw(1000) }, "record stays paid")
+}
+
+func TestMigrateRegistered(t *testing.T) {
+    s := loadV1(t)
+    defer delete(migrations, STATE_VERSION)
+    RegisterMigration(STATE_VERSION, func(s *State) error {
+        s.Set("map-extension", []byte(`"1"`))
+        return s.setVersion(STATE_VERSION + 1)
+    })
+    assert.Panics(t, func() { RegisterMigration(STATE_VERSION, migrateV1) }, "duplicate")
+
+    // migrations run in order from v1
+    v1 := s.Clone()
+    assert.NoError(t, v1.Migrate(STATE_VERSION+1), "migrate")
+    v, _ := v1.Version()
+    assert.Equal(t, v, STATE_VERSION+1, "version")
+    buf, ok := v1.Get("map-extension")
+    assert.True(t, ok, "added entry")
+    assert.Equal(t, string(buf), `"1"`, "added value")
+    _, err := LoadState(v1)
+    assert.Error(t, err, "newer than the model")
+    assert.Error(t, v1.Migrate(STATE_VERSION+2), "missing migration")
+
+    // migrations must advance the version
+    delete(migrations, STATE_VERSION)
+    RegisterMigration(STATE_VERSION, func(s *State) error { return nil })
+    assert.Error(t, s.Clone().Migrate(STATE_VERSION+1), "version not bumped")
+
+    v1.Delete("map-extension")
+    _, ok = v1.Get("map-extension")
+    assert.False(t, ok, "deleted")
+}
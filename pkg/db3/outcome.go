@@ -0,0 +1,167 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "sort"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+type OutcomeStatus byte
+
+const (
+    OutcomeUnpaid        OutcomeStatus = iota // no fee was escrowed
+    OutcomeRefunded                           // too few votes, fees went back to payers
+    OutcomeUnanimous                          // all votes agree
+    OutcomeSuperMajority                      // a 2/3 supermajority agrees, the minority is slashed
+    OutcomeNoMajority                         // no supermajority, fees went to the treasury
+)
+
+func (s OutcomeStatus) String() string {
+    switch s {
+    case OutcomeUnpaid:
+        return "unpaid"
+    case OutcomeRefunded:
+        return "refunded"
+    case OutcomeUnanimous:
+        return "unanimous"
+    case OutcomeSuperMajority:
+        return "supermajority"
+    case OutcomeNoMajority:
+        return "no_majority"
+    default:
+        return "invalid"
+    }
+}
+
+// Votes counted for one result of a query
+type ResultTally struct {
+    Rid   ResultCID
+    Votes int
+}
+
+// Amount credited to or taken from an account
+type Payout struct {
+    Account near.AccountID
+    Amount  near.Money
+}
+
+// Audit record of a finalized query. It explains who voted for which
+// result, which hosts were paid or slashed and where the remainder went.
+// Votes of hosts outside the committee or without deposits on all joined
+// databases are not counted and listed as ignored.
+type ElectionOutcome struct {
+    Qid       QueryCID
+    Height    int64          // finalization height
+    Version   int            // code version results were judged against
+    Token     near.AccountID // fee token, empty for NEAR
+    Fee       near.Money     // escrowed fee
+    Royalty   near.Money     // developer royalty incl. fork and join shares
+    Quorum    int            // votes required to answer the query
+    Status    OutcomeStatus
+    Winner    ResultCID        // supermajority result, empty without supermajority
+    Tallies   []ResultTally    // counted votes per result, most votes first
+    Majority  []near.AccountID // hosts that voted for the winner
+    Minority  []near.AccountID // hosts that voted against a supermajority
+    Ignored   []near.AccountID // settled results that were not counted
+    FeeShares []Payout         // fees credited to majority hosts
+    Pooled    near.Money       // fee pooled into the payout epoch
+    Refunds   []Payout         // fees credited back to payers
+    Slashes   []Payout         // deposits slashed from minority hosts
+    Rewards   []Payout         // slash shares paid to majority hosts and the finalizer
+    Dust      near.Money       // remainders collected by the treasury
+}
+
+// Views the outcomes of recently finalized queries of a database, oldest
+// first. Only the last MAX_OUTCOMES outcomes are kept.
+// Called by: host
+func (d *DB3) Outcomes(dbid DBId) []ElectionOutcome {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    return append([]ElectionOutcome{}, d.History[dbid]...)
+}
+
+// Views the outcome of a finalized query, nil when it is no longer kept
+// Called by: host
+func (d *DB3) Outcome(dbid DBId, qid QueryCID) *ElectionOutcome {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    list := d.History[dbid]
+    for i := len(list) - 1; i >= 0; i-- {
+        if list[i].Qid == qid {
+            res := list[i]
+            return &res
+        }
+    }
+    return nil
+}
+
+// newOutcome starts the audit record of a query that is being finalized
+func (d *DB3) newOutcome(dbid DBId, qid QueryCID, version, quorum int, token near.AccountID, fee near.Money, votes map[near.AccountID]ResultCID) *ElectionOutcome {
+    out := &ElectionOutcome{
+        Qid:     qid,
+        Height:  ctx.Height,
+        Version: version,
+        Token:   token,
+        Fee:     fee,
+        Quorum:  quorum,
+    }
+    for acc := range d.PendingResults[dbid][qid] {
+        if _, ok := votes[acc]; !ok {
+            out.Ignored = append(out.Ignored, acc)
+        }
+    }
+    sortAccounts(out.Ignored)
+    return out
+}
+
+// decide records the election result, majority and minority are only set
+// when the election decided the payout
+func (out *ElectionOutcome) decide(status OutcomeStatus, e *Election) {
+    out.Status = status
+    if e.NumVoters() > 0 {
+        out.Tallies = e.Tallies()
+    }
+    if status != OutcomeUnanimous && status != OutcomeSuperMajority {
+        return
+    }
+    out.Winner, _ = e.Winner()
+    for _, v := range e.SuperMajority() {
+        out.Majority = append(out.Majority, v.AccountId)
+    }
+    for _, v := range e.Minority() {
+        out.Minority = append(out.Minority, v.AccountId)
+    }
+}
+
+// recordOutcome appends an outcome to the history of a database and drops
+// the oldest outcomes beyond MAX_OUTCOMES
+func (d *DB3) recordOutcome(dbid DBId, out *ElectionOutcome) {
+    list := append(d.History[dbid], *out)
+    if len(list) > MAX_OUTCOMES {
+        list = append([]ElectionOutcome{}, list[len(list)-MAX_OUTCOMES:]...)
+    }
+    d.History[dbid] = list
+}
+
+// reward adds a slash reward, rewards of the same account are summed
+func (out *ElectionOutcome) reward(account near.AccountID, amount near.Money) {
+    if amount == 0 {
+        return
+    }
+    for i := range out.Rewards {
+        if out.Rewards[i].Account == account {
+            out.Rewards[i].Amount += amount
+            return
+        }
+    }
+    out.Rewards = append(out.Rewards, Payout{account, amount})
+}
+
+func sortAccounts(list []near.AccountID) {
+    sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+}
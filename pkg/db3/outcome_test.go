@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "fmt"
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// newOutcomeDB3 deploys a database with three hosts holding deposits
+func newOutcomeDB3() (*DB3, DBId, []near.AccountID) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    hosts := []near.AccountID{"h1.near", "h2.near", "h3.near"}
+    for _, h := range hosts {
+        setCtx(CALLER, PK, 100, 10)
+        db.StorageDeposit(h)
+        setCtx(string(h), PK, SECURITY_DEPOSIT, 10)
+        db.Deposit(id)
+    }
+    return db, id, hosts
+}
+
+func TestOutcomeSuperMajority(t *testing.T) {
+    db, id, hosts := newOutcomeDB3()
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    for i, rid := range []ResultCID{"rid-1", "rid-2", "rid-1"} {
+        setCtx(string(hosts[i]), PK, 0, 11)
+        db.Settle(id, "qid-1", rid)
+    }
+    setCtx(USER, PK, 0, 20)
+    db.Finalize()
+
+    slash := near.Money(SECURITY_DEPOSIT * SLASHED_DEPOSIT_BIPS / 10000)
+    assert.Equal(t, db.Outcome(id, "qid-1"), &ElectionOutcome{
+        Qid:       "qid-1",
+        Height:    20,
+        Fee:       1000,
+        Royalty:   100,
+        Quorum:    1,
+        Status:    OutcomeSuperMajority,
+        Winner:    "rid-1",
+        Tallies:   []ResultTally{{"rid-1", 2}, {"rid-2", 1}},
+        Majority:  []near.AccountID{hosts[0], hosts[2]},
+        Minority:  []near.AccountID{hosts[1]},
+        FeeShares: []Payout{{hosts[0], 450}, {hosts[2], 450}},
+        Slashes:   []Payout{{hosts[1], slash}},
+        Rewards:   []Payout{{hosts[0], slash / 4}, {hosts[2], slash / 4}, {USER, slash / 10}},
+    }, "outcome")
+    assert.Equal(t, OutcomeSuperMajority.String(), "supermajority", "status name")
+    assert.Nil(t, db.Outcome(id, "qid-2"), "unknown query")
+    assert.Panics(t, func() { db.Outcomes(9) }, "unknown database")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestOutcomeStatus(t *testing.T) {
+    db, id, hosts := newOutcomeDB3()
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 2)
+    db.EscrowFee(id, "qid-2", 20, 0)
+    setCtx(string(hosts[0]), PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    db.Settle(id, "qid-2", "rid-1")
+    db.Settle(id, "qid-3", "rid-1")
+    setCtx(string(hosts[1]), PK, 0, 11)
+    db.Settle(id, "qid-2", "rid-2")
+    setCtx(USER, PK, 0, 11+MAX_BLOCKS_TO_SETTLE)
+    db.Finalize()
+
+    // too few votes refund the payer
+    out := db.Outcome(id, "qid-1")
+    assert.Equal(t, out.Status, OutcomeRefunded, "refunded")
+    assert.Equal(t, out.Quorum, 2, "quorum")
+    assert.Equal(t, out.Refunds, []Payout{{USER, 1000}}, "refunds")
+    assert.Empty(t, out.Majority, "no majority")
+    assert.Equal(t, out.Royalty, near.Money(0), "no royalty")
+
+    // a split vote sends the host fee to the treasury
+    out = db.Outcome(id, "qid-2")
+    assert.Equal(t, out.Status, OutcomeNoMajority, "no majority")
+    assert.Equal(t, out.Tallies, []ResultTally{{"rid-1", 1}, {"rid-2", 1}}, "tallies")
+    assert.Empty(t, out.Winner, "no winner")
+    assert.Empty(t, out.FeeShares, "nobody paid")
+    assert.Equal(t, out.Dust, near.Money(900), "dust")
+
+    // results without fee are recorded too
+    out = db.Outcome(id, "qid-3")
+    assert.Equal(t, out.Status, OutcomeUnpaid, "unpaid")
+    assert.Equal(t, out.Tallies, []ResultTally{{"rid-1", 1}}, "tallies")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestOutcomeEpoch(t *testing.T) {
+    db, id, hosts := newOutcomeDB3()
+    db.Params.EpochBlocks = 100
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    setCtx(string(hosts[0]), PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    setCtx(USER, PK, 0, 20)
+    db.Finalize()
+    out := db.Outcome(id, "qid-1")
+    assert.Equal(t, out.Status, OutcomeUnanimous, "unanimous")
+    assert.Equal(t, out.Pooled, near.Money(900), "pooled fee")
+    assert.Empty(t, out.FeeShares, "paid with the epoch")
+}
+
+func TestOutcomeHistory(t *testing.T) {
+    db, id, hosts := newOutcomeDB3()
+    setCtx(CALLER, PK, 1000, 10)
+    db.StorageDeposit(hosts[0])
+    setCtx(string(hosts[0]), PK, 0, 11)
+    for i := 0; i <= MAX_OUTCOMES; i++ {
+        db.Settle(id, QueryCID(fmt.Sprintf("qid-%d", i)), "rid-1")
+    }
+    setCtx(USER, PK, 0, 11+MAX_BLOCKS_TO_SETTLE)
+    db.Finalize()
+    assert.Len(t, db.Outcomes(id), MAX_OUTCOMES, "bounded")
+
+    // the oldest outcomes are dropped first
+    setCtx(string(hosts[0]), PK, 0, 200)
+    db.Settle(id, "qid-last", "rid-1")
+    setCtx(USER, PK, 0, 200+MAX_BLOCKS_TO_SETTLE)
+    db.Finalize()
+    list := db.Outcomes(id)
+    assert.Len(t, list, MAX_OUTCOMES, "still bounded")
+    assert.Equal(t, list[MAX_OUTCOMES-1].Qid, QueryCID("qid-last"), "newest last")
+    assert.Equal(t, list[0].Height, int64(11+MAX_BLOCKS_TO_SETTLE), "older outcomes kept")
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Proposes a new database owner who must accept the transfer. An empty
+// owner cancels a pending proposal.
+// Called by: developer
+func (d *DB3) ProposeOwner(dbid DBId, owner near.AccountID) {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    if ctx.Caller != d.Owners[dbid] {
+        panic("Must be database owner to transfer ownership")
+    }
+    if owner == "" {
+        if pending, ok := d.PendingOwners[dbid]; ok {
+            delete(d.PendingOwners, dbid)
+            d.emit("owner_cancelled", OwnerEvent{Dbid: dbid, Owner: pending})
+        }
+        return
+    }
+    if owner == ctx.Caller {
+        panic("Account already owns database")
+    }
+    d.PendingOwners[dbid] = owner
+    d.emit("owner_proposed", OwnerEvent{Dbid: dbid, Owner: owner})
+}
+
+// Accepts a proposed database ownership transfer. The royalty split of the
+// previous owner is reset, all royalties go to the new owner until it sets
+// its own split.
+// Called by: developer
+func (d *DB3) AcceptOwner(dbid DBId) {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    if owner, ok := d.PendingOwners[dbid]; !ok || owner != ctx.Caller {
+        panic("Caller is not the proposed owner")
+    }
+    delete(d.PendingOwners, dbid)
+    delete(d.RoyaltySplits, dbid)
+    d.Owners[dbid] = ctx.Caller
+    d.emit("owner_transferred", OwnerEvent{Dbid: dbid, Owner: ctx.Caller})
+}
+
+// Views the proposed owner of a database, empty when no transfer is pending
+// Called by: developer
+func (d *DB3) PendingOwner(dbid DBId) near.AccountID {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    return d.PendingOwners[dbid]
+}
+
+// Splits database royalties across beneficiaries by basis points. Shares
+// must add up to 10000 bips. An empty list pays all royalties to the owner.
+// Called by: developer
+func (d *DB3) SetRoyaltySplit(dbid DBId, shares []RoyaltyShare) {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    if ctx.Caller != d.Owners[dbid] {
+        panic("Must be database owner to split royalties")
+    }
+    if len(shares) == 0 {
+        delete(d.RoyaltySplits, dbid)
+        return
+    }
+    if len(shares) > MAX_ROYALTY_SPLITS {
+        panic("Too many royalty beneficiaries")
+    }
+    var sum int
+    seen := make(map[near.AccountID]bool)
+    for _, v := range shares {
+        if v.Account == "" {
+            panic("Empty royalty beneficiary")
+        }
+        if seen[v.Account] {
+            panic("Duplicate royalty beneficiary")
+        }
+        if v.Bips <= 0 || v.Bips > 10000 {
+            panic("Royalty share out of range")
+        }
+        seen[v.Account] = true
+        sum += v.Bips
+    }
+    if sum != 10000 {
+        panic("Royalty shares must add up to 10000 bips")
+    }
+    d.RoyaltySplits[dbid] = append([]RoyaltyShare{}, shares...)
+}
+
+// Views royalty beneficiaries of a database
+// Called by: developer
+func (d *DB3) RoyaltySplit(dbid DBId) []RoyaltyShare {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    if shares, ok := d.RoyaltySplits[dbid]; ok {
+        return shares
+    }
+    return []RoyaltyShare{{Account: d.Owners[dbid], Bips: 10000}}
+}
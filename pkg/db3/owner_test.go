@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+func TestOwnerTransfer(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+
+    setCtx(NO_CALLER, PK, 0, 10)
+    assert.Panics(t, func() { db.ProposeOwner(id, NO_CALLER) }, "not owner")
+    assert.Panics(t, func() { db.AcceptOwner(id) }, "nothing proposed")
+
+    setCtx(CALLER, PK, 0, 10)
+    assert.Panics(t, func() { db.ProposeOwner(id+1, USER) }, "no db")
+    assert.NotPanics(t, func() { db.ProposeOwner(id, USER) }, "successful propose")
+    assert.Equal(t, db.PendingOwner(id), near.AccountID(USER), "pending owner")
+    assert.Equal(t, db.Owners[id], near.AccountID(CALLER), "owner unchanged")
+
+    setCtx(NO_CALLER, PK, 0, 10)
+    assert.Panics(t, func() { db.AcceptOwner(id) }, "wrong acceptor")
+
+    setCtx(USER, PK, 0, 10)
+    assert.NotPanics(t, func() { db.AcceptOwner(id) }, "successful accept")
+    assert.Equal(t, db.Owners[id], near.AccountID(USER), "owner changed")
+    assert.Empty(t, db.PendingOwner(id), "no pending owner")
+
+    // cancel
+    db.ProposeOwner(id, CALLER)
+    db.ProposeOwner(id, "")
+    assert.Empty(t, db.PendingOwner(id), "proposal cancelled")
+    db.ProposeOwner(id, "")
+    assert.Len(t, filterEvents(db, "owner_cancelled"), 1, "cancel event")
+    assert.Equal(t, filterEvents(db, "owner_cancelled")[0].Data, OwnerEvent{Dbid: id, Owner: CALLER}, "cancelled owner")
+}
+
+func TestOwnerTransferResetsSplit(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.SetRoyaltySplit(id, []RoyaltyShare{{CALLER, 5000}, {"a.near", 5000}})
+    db.ProposeOwner(id, USER)
+    assert.Len(t, db.RoyaltySplit(id), 2, "split kept while pending")
+
+    setCtx(USER, PK, 0, 10)
+    db.AcceptOwner(id)
+    assert.Equal(t, db.RoyaltySplit(id), []RoyaltyShare{{USER, 10000}}, "new owner takes all royalties")
+
+    // royalties of queries finalized after the transfer go to the new owner
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    setCtx(CALLER, PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    setCtx(USER, PK, 0, 20)
+    db.Finalize()
+    assert.Equal(t, db.SettledRoyalties[USER], near.Money(100), "new owner royalty")
+    assert.Equal(t, db.SettledRoyalties["a.near"], near.Money(0), "old beneficiary")
+}
+
+func TestRoyaltySplit(t *testing.T) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    assert.Equal(t, db.RoyaltySplit(id), []RoyaltyShare{{CALLER, 10000}}, "default split")
+
+    shares := []RoyaltyShare{{CALLER, 5000}, {"a.near", 3333}, {"b.near", 1667}}
+    assert.Panics(t, func() { db.SetRoyaltySplit(id, shares[:2]) }, "bips do not add up")
+    assert.Panics(t, func() { db.SetRoyaltySplit(id, []RoyaltyShare{{"a.near", 5000}, {"a.near", 5000}}) }, "duplicate")
+    assert.Panics(t, func() { db.SetRoyaltySplit(id, []RoyaltyShare{{"a.near", 10001}, {"b.near", -1}}) }, "out of range")
+    setCtx(NO_CALLER, PK, 0, 10)
+    assert.Panics(t, func() { db.SetRoyaltySplit(id, shares) }, "not owner")
+    setCtx(CALLER, PK, 0, 10)
+    assert.NotPanics(t, func() { db.SetRoyaltySplit(id, shares) }, "successful split")
+    assert.Equal(t, db.RoyaltySplit(id), shares, "split is stored")
+
+    // royalty is 10% of 100000 = 10000 split 50/33.33/16.67
+    setCtx(USER, PK, 100000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    setCtx(CALLER, PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    setCtx(CALLER, PK, 0, 20)
+    db.finalizeResults()
+    assert.Equal(t, db.SettledRoyalties[CALLER], near.Money(5000), "owner share")
+    assert.Equal(t, db.SettledRoyalties["a.near"], near.Money(3333), "first share")
+    assert.Equal(t, db.SettledRoyalties["b.near"], near.Money(1667), "second share")
+
+    // reset
+    db.SetRoyaltySplit(id, nil)
+    assert.Equal(t, db.RoyaltySplit(id), []RoyaltyShare{{CALLER, 10000}}, "reset split")
+}
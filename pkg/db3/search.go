@@ -0,0 +1,233 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "sort"
+    "strings"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Database entry returned by discovery views
+type DatabaseInfo struct {
+    Id       DBId
+    Owner    near.AccountID
+    Manifest Manifest
+    Terms    LicenseTerms // license terms of the active code version
+    Parent   *ForkLink    // nil unless the database is a fork
+    Forks    []DBId       // direct forks in ascending order
+}
+
+// Search filter for database discovery, empty fields match all databases
+type DatabaseFilter struct {
+    Author  near.AccountID // exact author match
+    Name    string         // case-insensitive name substring
+    License string         // exact license match
+    Tags    []string       // databases must carry all tags
+
+    Commercial bool // only databases licensed for commercial use
+}
+
+// Views a page of registered databases ordered by id
+// Called by: user
+func (d *DB3) ListDatabases(fromIndex, limit int) []DatabaseInfo {
+    return d.SearchDatabases(DatabaseFilter{}, fromIndex, limit)
+}
+
+// Views a page of registered databases matching a search filter
+// Called by: user
+func (d *DB3) SearchDatabases(filter DatabaseFilter, fromIndex, limit int) []DatabaseInfo {
+    if fromIndex < 0 {
+        panic("Negative from index")
+    }
+    if limit <= 0 || limit > MAX_PAGE_LIMIT {
+        limit = MAX_PAGE_LIMIT
+    }
+
+    name := strings.ToLower(filter.Name)
+    res := make([]DatabaseInfo, 0)
+    skip := fromIndex
+    for _, dbid := range d.candidates(filter) {
+        // indexes also cover pending upgrades, match the active version
+        m := d.ActiveVersion(dbid, ctx.Height).Manifest
+        if !filter.matches(m) {
+            continue
+        }
+        if name != "" && !strings.Contains(strings.ToLower(m.Name), name) {
+            continue
+        }
+        terms := licenseTerms(m)
+        if filter.Commercial && !terms.Commercial {
+            continue
+        }
+        if skip > 0 {
+            skip--
+            continue
+        }
+        info := DatabaseInfo{
+            Id:       dbid,
+            Owner:    d.Owners[dbid],
+            Manifest: m,
+            Terms:    terms,
+            Forks:    append([]DBId{}, d.Forks[dbid]...),
+        }
+        if link, ok := d.Parents[dbid]; ok {
+            info.Parent = &link
+        }
+        res = append(res, info)
+        if len(res) == limit {
+            break
+        }
+    }
+    return res
+}
+
+// matches checks the indexed filter fields against a manifest
+func (f DatabaseFilter) matches(m Manifest) bool {
+    if f.Author != "" && m.Author != f.Author {
+        return false
+    }
+    if f.License != "" && m.License != f.License {
+        return false
+    }
+    for _, tag := range f.Tags {
+        found := false
+        for _, t := range m.Tags {
+            found = found || normalizeTag(t) == normalizeTag(tag)
+        }
+        if !found {
+            return false
+        }
+    }
+    return true
+}
+
+// candidates intersects all secondary indexes used by the filter and returns
+// matching database ids in ascending order; without an indexed filter field
+// all database ids are returned
+func (d *DB3) candidates(filter DatabaseFilter) []DBId {
+    lists := make([][]DBId, 0)
+    if filter.Author != "" {
+        lists = append(lists, d.AuthorIndex[filter.Author])
+    }
+    if filter.License != "" {
+        lists = append(lists, d.LicenseIndex[filter.License])
+    }
+    for _, tag := range filter.Tags {
+        lists = append(lists, d.TagIndex[normalizeTag(tag)])
+    }
+
+    if len(lists) == 0 {
+        ids := make([]DBId, 0, int(d.NextId))
+        for dbid := DBId(0); dbid < d.NextId; dbid++ {
+            if _, ok := d.Manifests[dbid]; ok {
+                ids = append(ids, dbid)
+            }
+        }
+        return ids
+    }
+
+    // start with the shortest list to keep intersections cheap
+    sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+    ids := lists[0]
+    for _, l := range lists[1:] {
+        ids = intersect(ids, l)
+    }
+    return ids
+}
+
+// indexDatabase adds a deployed database to all discovery indexes
+func (d *DB3) indexDatabase(dbid DBId, m Manifest) {
+    d.AuthorIndex[m.Author] = insert(d.AuthorIndex[m.Author], dbid)
+    if m.License != "" {
+        d.LicenseIndex[m.License] = insert(d.LicenseIndex[m.License], dbid)
+    }
+    seen := make(map[string]bool)
+    for _, tag := range m.Tags {
+        tag = normalizeTag(tag)
+        if tag == "" || seen[tag] {
+            continue
+        }
+        seen[tag] = true
+        d.TagIndex[tag] = insert(d.TagIndex[tag], dbid)
+    }
+}
+
+// indexVersions indexes the latest two versions of a database, which are
+// the active version and an upgrade that may still be pending
+func (d *DB3) indexVersions(dbid DBId, versions []ManifestVersion) {
+    for _, v := range latestVersions(versions) {
+        d.indexDatabase(dbid, v.Manifest)
+    }
+}
+
+// unindexVersions removes the versions added by indexVersions
+func (d *DB3) unindexVersions(dbid DBId, versions []ManifestVersion) {
+    for _, v := range latestVersions(versions) {
+        d.unindexDatabase(dbid, v.Manifest)
+    }
+}
+
+func latestVersions(versions []ManifestVersion) []ManifestVersion {
+    if len(versions) > 2 {
+        return versions[len(versions)-2:]
+    }
+    return versions
+}
+
+// unindexDatabase removes a database from all discovery indexes
+func (d *DB3) unindexDatabase(dbid DBId, m Manifest) {
+    d.AuthorIndex[m.Author] = remove(d.AuthorIndex[m.Author], dbid)
+    d.LicenseIndex[m.License] = remove(d.LicenseIndex[m.License], dbid)
+    for _, tag := range m.Tags {
+        tag = normalizeTag(tag)
+        d.TagIndex[tag] = remove(d.TagIndex[tag], dbid)
+    }
+}
+
+func normalizeTag(tag string) string {
+    return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// insert adds an id to an ascending id list
+func insert(list []DBId, dbid DBId) []DBId {
+    i := sort.Search(len(list), func(i int) bool { return list[i] >= dbid })
+    if i < len(list) && list[i] == dbid {
+        return list
+    }
+    list = append(list, 0)
+    copy(list[i+1:], list[i:])
+    list[i] = dbid
+    return list
+}
+
+// remove deletes an id from an ascending id list
+func remove(list []DBId, dbid DBId) []DBId {
+    res := make([]DBId, 0, len(list))
+    for _, v := range list {
+        if v != dbid {
+            res = append(res, v)
+        }
+    }
+    return res
+}
+
+// intersect merges two ascending id lists
+func intersect(a, b []DBId) []DBId {
+    res := make([]DBId, 0)
+    for i, j := 0, 0; i < len(a) && j < len(b); {
+        switch {
+        case a[i] < b[j]:
+            i++
+        case a[i] > b[j]:
+            j++
+        default:
+            res = append(res, a[i])
+            i++
+            j++
+        }
+    }
+    return res
+}
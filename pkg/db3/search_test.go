@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "fmt"
+    "github.com/stretchr/testify/assert"
+    "testing"
+)
+
+func deploySearchDbs(db *DB3) {
+    deployTestDb(db, Manifest{Author: "alice.near", Name: "NEAR Blocks", License: "MIT", CID: "cid-0", Tags: []string{"near", "blocks"}})
+    deployTestDb(db, Manifest{Author: "bob.near", Name: "Token Balances", License: "MIT", CID: "cid-1", Tags: []string{"NEAR", "tokens"}})
+    deployTestDb(db, Manifest{Author: "alice.near", Name: "DEX Trades", License: "NONE", CID: "cid-2", Tags: []string{"dex", "tokens"}})
+    deployTestDb(db, Manifest{Author: "alice.near", Name: "Token Transfers", License: "MIT", CID: "cid-3", Tags: []string{"near", "tokens"}})
+}
+
+func ids(infos []DatabaseInfo) []DBId {
+    res := make([]DBId, 0, len(infos))
+    for _, v := range infos {
+        res = append(res, v.Id)
+    }
+    return res
+}
+
+func TestListDatabases(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    for i := 0; i < 5; i++ {
+        deployTestDb(db, Manifest{Name: fmt.Sprintf("db-%d", i), CID: CodeCID(fmt.Sprintf("cid-%d", i))})
+    }
+    assert.Equal(t, ids(db.ListDatabases(0, 2)), []DBId{0, 1}, "first page")
+    assert.Equal(t, ids(db.ListDatabases(2, 2)), []DBId{2, 3}, "second page")
+    assert.Equal(t, ids(db.ListDatabases(4, 2)), []DBId{4}, "last page")
+    assert.Empty(t, db.ListDatabases(5, 2), "past end")
+    assert.Len(t, db.ListDatabases(0, 0), 5, "default limit")
+    assert.Equal(t, db.ListDatabases(1, 1)[0].Owner, ctx.Caller, "owner is returned")
+    assert.Panics(t, func() { db.ListDatabases(-1, 1) }, "negative index")
+}
+
+func TestSearchDatabases(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    deploySearchDbs(db)
+
+    assert.Equal(t, ids(db.SearchDatabases(DatabaseFilter{Author: "alice.near"}, 0, 0)), []DBId{0, 2, 3}, "by author")
+    assert.Equal(t, ids(db.SearchDatabases(DatabaseFilter{License: "MIT"}, 0, 0)), []DBId{0, 1, 3}, "by license")
+    assert.Equal(t, ids(db.SearchDatabases(DatabaseFilter{Name: "token"}, 0, 0)), []DBId{1, 3}, "by name")
+    assert.Equal(t, ids(db.SearchDatabases(DatabaseFilter{Tags: []string{"Near"}}, 0, 0)), []DBId{0, 1, 3}, "by tag")
+    assert.Equal(t, ids(db.SearchDatabases(DatabaseFilter{Tags: []string{"near", "tokens"}}, 0, 0)), []DBId{1, 3}, "by all tags")
+    assert.Equal(t, ids(db.SearchDatabases(DatabaseFilter{
+        Author:  "alice.near",
+        License: "MIT",
+        Name:    "transfer",
+        Tags:    []string{"tokens"},
+    }, 0, 0)), []DBId{3}, "combined")
+    assert.Equal(t, ids(db.SearchDatabases(DatabaseFilter{Author: "alice.near"}, 1, 1)), []DBId{2}, "paged")
+    assert.Empty(t, db.SearchDatabases(DatabaseFilter{Author: "carol.near"}, 0, 0), "no match")
+    assert.Empty(t, db.SearchDatabases(DatabaseFilter{Tags: []string{"unknown"}}, 0, 0), "unknown tag")
+}
+
+func TestSearchLicenseTerms(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    deploySearchDbs(db)
+    nc := deployTestDb(db, Manifest{Author: "bob.near", Name: "NFT Sales", License: "CC-BY-NC-4.0", CID: "cid-4", Attribution: "NFT Sales by bob.near", UsageCap: 100})
+
+    res := db.SearchDatabases(DatabaseFilter{Author: "bob.near"}, 0, 0)
+    assert.Equal(t, ids(res), []DBId{1, nc}, "all licenses")
+    assert.Equal(t, res[1].Terms, LicenseTerms{License: "CC-BY-NC-4.0", Attribution: "NFT Sales by bob.near", UsageCap: 100}, "terms")
+    assert.Equal(t, res[0].Terms.Commercial, true, "commercial terms")
+    assert.Equal(t, ids(db.SearchDatabases(DatabaseFilter{Author: "bob.near", Commercial: true}, 0, 0)), []DBId{1}, "commercial use")
+}
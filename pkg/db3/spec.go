@@ -4,13 +4,37 @@
 package db3
 
 import (
+    "time"
+
     "blockwatch.cc/db3-near/pkg/near"
 )
 
 const (
-    MAX_BLOCKS_TO_SETTLE = 120
-    SECURITY_DEPOSIT     = 10000
-    SLASHED_DEPOSIT_BIPS = 1000
+    MAX_BLOCKS_TO_SETTLE  = 120
+    SECURITY_DEPOSIT      = 10000
+    SLASHED_DEPOSIT_BIPS  = 2500
+    SLASH_MAJORITY_BIPS   = 5000 // slash share paid to majority hosts
+    SLASH_FINALIZER_BIPS  = 1000 // slash share paid to the finalizing account
+    MAX_PAGE_LIMIT        = 100
+    UPGRADE_DELAY_BLOCKS  = 1200
+    MAX_ROYALTY_SPLITS    = 16
+    MAX_QUORUM            = 16  // highest replication quorum a query may request
+    COMMITTEE_SIZE        = 3   // hosts assigned to answer each query
+    CLAIM_RESPONSE_BLOCKS = 600 // ~10 minutes for a host to answer a censorship claim
+    MAX_COUNCIL_SIZE      = 32
+    PROPOSAL_TTL_BLOCKS   = 604800     // ~7 days
+    STORAGE_ENTRY_COST    = 10         // storage staked per map entry
+    STORAGE_COST          = 1000       // storage deposit attached to deploy, refunded on retire
+    CONTRACT_ID           = "db3.near" // account of the modelled contract, receives token transfers
+    EPOCH_BLOCKS          = 0          // blocks per payout epoch, zero pays fees per query
+    VESTING_BLOCKS        = 86400      // ~1 day linear vesting of epoch royalties
+    MAX_FORK_DEPTH        = 8          // longest fork chain royalties are routed along
+    ACCESS_GRANT_BLOCKS   = 86400      // ~1 day access of token gate holders
+    MAX_JOIN_DATABASES    = 4          // most databases a cross-database query may join
+    CLOCK_WINDOW_BLOCKS   = 100        // blocks between block time samples
+    MAX_OUTCOMES          = 32         // finalized query outcomes kept per database
+    MAX_ATTRIBUTION_LEN   = 256        // longest credit line a license may require
+    MAX_AUTHOR_KEYS       = 8          // manifest signing keys an author may register
 )
 
 type AccountID near.AccountID
@@ -71,29 +95,133 @@ type Manifest struct {
     License     string
     CID         CodeCID
     RoyaltyBips int
+    Tags        []string
+    MinQuorum   int // votes required to answer a query (0 means 1)
+    MaxQuorum   int // highest quorum users may request (0 means MAX_QUORUM)
+
+    ForkRoyaltyBips int // share of fork royalties passed up to this database
+
+    // license terms, RoyaltyBips applies to commercial use
+    NonCommercialRoyaltyBips int    // royalty on non-commercial queries
+    Attribution              string // credit line results must carry
+    UsageCap                 int    // most queries an account may pay for (0 means unlimited)
+
+    // author signature over ManifestPayload, empty for unsigned bundles
+    AuthorKey near.Pubkey    // registered signing key of the author (hex)
+    Signature near.Signature // ed25519 signature (hex)
+}
+
+// Published code version of a database, hosts must migrate to a new version
+// before its activation height
+type ManifestVersion struct {
+    Version          int
+    Manifest         Manifest
+    ActivationHeight int64
+}
+
+// Share of database royalties paid to a beneficiary
+type RoyaltyShare struct {
+    Account near.AccountID
+    Bips    int
 }
 
 // Shared contract that manages all databases, deposits and payments
 type ContractState struct {
-    // contract owner (allowd to move slashed funds)
+    // contract owner (allowd to move slashed funds until a council is set up)
     Owner near.AccountID
 
+    // governance
+    Params         Params                   // protocol parameters
+    Council        []near.AccountID         // members allowed to propose and approve
+    Threshold      int                      // approvals required to pass a proposal
+    TimeLock       int64                    // blocks between approval and execution
+    NextProposalId ProposalId               // id of the next proposal (starts at 0)
+    Proposals      map[ProposalId]*Proposal // all proposals
+
     // registry
-    NextId      DBId                    // id of the next deployed database (starts at 0)
-    Owners      map[DBId]near.AccountID // royalty payments
-    Manifests   map[DBId]Manifest       // discoverability of dbs for hosts/users
-    ApiRegistry map[DBId]map[near.AccountID]ApiEndpoint
+    NextId           DBId                       // id of the next deployed database (starts at 0)
+    Owners           map[DBId]near.AccountID    // royalty payments
+    Manifests        map[DBId]Manifest          // manifest active at the last deploy or upgrade, views resolve ActiveVersion
+    ManifestVersions map[DBId][]ManifestVersion // code version history
+    ApiRegistry      map[DBId]map[near.AccountID]ApiEndpoint
+    SigningKeys      map[near.AccountID][]near.Pubkey // manifest signing keys registered by authors
+
+    // ownership
+    PendingOwners map[DBId]near.AccountID // proposed owners waiting to accept
+    RoyaltySplits map[DBId][]RoyaltyShare // royalty beneficiaries (empty means owner only)
+
+    // access control
+    Access     map[DBId]AccessPolicy                   // missing entries are public
+    Allowlists map[DBId]map[near.AccountID]AccessGrant // users allowed to query private dbs
+
+    // lineage
+    Parents map[DBId]ForkLink // parent of each forked database
+    Forks   map[DBId][]DBId   // direct forks of a database (ids in ascending order)
+
+    // lifecycle
+    Status          map[DBId]DBStatus       // missing entries are active
+    SunsetHeights   map[DBId]int64          // retirement height of deprecated dbs
+    StorageDeposits map[DBId]near.Money     // paid on deploy, refunded on retire
+    StoragePayers   map[DBId]near.AccountID // accounts that paid storage deposits
+
+    // discovery indexes (maintained on deploy, ids are kept in ascending order)
+    AuthorIndex  map[near.AccountID][]DBId
+    LicenseIndex map[string][]DBId
+    TagIndex     map[string][]DBId
 
     // deposits
     Deposits map[DBId]map[near.AccountID]near.Money
     Slashed  near.Money
 
+    // solvency accounting
+    TotalInflows  near.Money // all attached deposits accepted by the contract
+    TotalOutflows near.Money // all transfers sent by the contract
+
     // payment settlement
-    ResultTTL        map[DBId]map[QueryCID]int64                        // latest block height
-    PendingResults   map[DBId]map[QueryCID]map[near.AccountID]ResultCID // collected result hashes
-    PendingFees      map[DBId]map[QueryCID]near.Money                   // fee proposed / paid
+    ResultTTL        map[DBId]map[QueryCID]int64                         // latest block height
+    PendingResults   map[DBId]map[QueryCID]map[near.AccountID]ResultCID  // collected result hashes
+    PendingFees      map[DBId]map[QueryCID]near.Money                    // fee proposed / paid
+    QueryVersions    map[DBId]map[QueryCID]int                           // code version results are judged against
+    QueryQuorums     map[DBId]map[QueryCID]int                           // votes required to answer a query
+    QueryPayments    map[DBId]map[QueryCID]map[near.AccountID]near.Money // escrowed fees per payer, refunded when unanswered
+    Committees       map[DBId]map[QueryCID][]near.AccountID              // hosts assigned to answer a query
+    StorageCharges   map[DBId]map[QueryCID]map[near.AccountID]near.Money // storage locked by pending query entries
+    Joins            map[DBId]map[QueryCID][]JoinShare                   // databases and royalty shares of cross-database queries
+    QueryUses        map[DBId]map[QueryCID]Use                           // use a query is paid for (missing means commercial)
     SettledFees      map[near.AccountID]near.Money
     SettledRoyalties map[near.AccountID]near.Money
+
+    // license usage
+    UsageCounts map[DBId]map[near.AccountID]int // queries paid per account on databases with a usage cap
+
+    // audit history
+    History map[DBId][]ElectionOutcome // outcomes of recently finalized queries, oldest first
+
+    // epoch payouts
+    Epochs  map[DBId]*Epoch                   // open fee pool per database
+    Vesting map[near.AccountID][]VestingGrant // unvested royalty grants per beneficiary
+
+    // fungible token fees, pending fees and payments of a query are counted
+    // in base units of its fee token, settled balances are kept per token
+    FeeTokens             map[DBId]map[QueryCID]near.AccountID             // NEP-141 token a query fee is escrowed in (missing means NEAR)
+    SettledTokenFees      map[near.AccountID]map[near.AccountID]near.Money // by token and account
+    SettledTokenRoyalties map[near.AccountID]map[near.AccountID]near.Money // by token and account
+    SlashedTokens         map[near.AccountID]near.Money                    // token fee dust by token
+    TokenInflows          map[near.AccountID]near.Money                    // all token transfers accepted by the contract
+    TokenOutflows         map[near.AccountID]near.Money                    // all token transfers sent by the contract
+
+    // delivery guarantees
+    Receipts map[DBId]map[QueryCID]map[near.AccountID]Receipt         // delivery receipts by host, kept while the query is pending
+    Claims   map[DBId]map[QueryCID]map[near.AccountID]CensorshipClaim // open censorship claims by host
+
+    // storage staking
+    StorageBalances map[near.AccountID]StorageBalance
+
+    // block time estimate for TTL durations
+    Clock BlockClock
+
+    // emitted events (emulates near.log, not part of contract storage)
+    EventLog []Event `json:"-"`
 }
 
 type Contract interface {
@@ -101,6 +229,86 @@ type Contract interface {
     // Called by: developer
     Deploy(m Manifest) DBId
 
+    // Publishes a new code version that activates after a delay
+    // Called by: developer
+    Upgrade(dbid DBId, m Manifest) int
+
+    // Views all published code versions of a database
+    // Called by: host
+    Versions(dbid DBId) []ManifestVersion
+
+    // Registers the signing access key as manifest signing key of the caller
+    // Called by: developer
+    RegisterAuthorKey()
+
+    // Removes a manifest signing key of the caller
+    // Called by: developer
+    RemoveAuthorKey(key near.Pubkey)
+
+    // Views the manifest signing keys of an author
+    // Called by: host, user
+    AuthorKeys(author near.AccountID) []near.Pubkey
+
+    // Registers a fork of a database that pays upstream royalties
+    // Called by: developer
+    Fork(parent DBId, m Manifest) DBId
+
+    // Views the ancestors of a database, nearest first
+    // Called by: user
+    Lineage(dbid DBId) []ForkLink
+
+    // Proposes a new database owner who must accept the transfer
+    // Called by: developer
+    ProposeOwner(dbid DBId, owner near.AccountID)
+
+    // Accepts a proposed database ownership transfer
+    // Called by: developer
+    AcceptOwner(dbid DBId)
+
+    // Splits database royalties across beneficiaries by basis points
+    // Called by: developer
+    SetRoyaltySplit(dbid DBId, shares []RoyaltyShare)
+
+    // Views royalty beneficiaries of a database
+    // Called by: developer
+    RoyaltySplit(dbid DBId) []RoyaltyShare
+
+    // Views the lifecycle status of a database
+    // Called by: host
+    DatabaseStatus(dbid DBId) DBStatus
+
+    // Pauses a database, new escrows are rejected
+    // Called by: developer
+    Pause(dbid DBId)
+
+    // Resumes a paused database
+    // Called by: developer
+    Resume(dbid DBId)
+
+    // Deprecates a database which retires at the sunset height
+    // Called by: developer
+    Deprecate(dbid DBId, sunset int64)
+
+    // Retires a database after sunset and refunds its storage deposit
+    // Called by: developer
+    Retire(dbid DBId)
+
+    // Registers an account and adds funds to its storage balance
+    // Called by: anyone
+    StorageDeposit(account near.AccountID) StorageBalance
+
+    // Withdraws available storage balance
+    // Called by: anyone
+    StorageWithdraw(amount near.Money) StorageBalance
+
+    // Unregisters the caller and refunds its storage balance
+    // Called by: anyone
+    StorageUnregister() bool
+
+    // Views the storage balance of an account
+    // Called by: anyone
+    StorageBalanceOf(account near.AccountID) StorageBalance
+
     // Locks security deposit when joining a new database
     // Called by: host
     Deposit(dbid DBId)
@@ -117,17 +325,135 @@ type Contract interface {
     // Called by: user
     Databases() map[DBId]Manifest
 
+    // Views a page of registered databases ordered by id
+    // Called by: user
+    ListDatabases(fromIndex, limit int) []DatabaseInfo
+
+    // Views a page of registered databases matching a search filter
+    // Called by: user
+    SearchDatabases(filter DatabaseFilter, fromIndex, limit int) []DatabaseInfo
+
     // Views all registered API endpoints for a database
     // Called by: user
     Discover(dbid DBId) []ApiEndpoint
 
-    // Pays query fee
+    // Sets the access policy of a database
+    // Called by: developer
+    SetAccessPolicy(dbid DBId, p AccessPolicy)
+
+    // Views the access policy of a database
+    // Called by: user
+    AccessPolicy(dbid DBId) AccessPolicy
+
+    // Adds users to the allowlist of a database
+    // Called by: developer
+    AllowUsers(dbid DBId, accounts []near.AccountID)
+
+    // Removes users from the allowlist of a database
+    // Called by: developer
+    RevokeUsers(dbid DBId, accounts []near.AccountID)
+
+    // Grants the caller temporary access by holding the gate token
+    // Called by: user
+    RequestAccess(dbid DBId) bool
+
+    // Views the allowlist of a database
+    // Called by: developer
+    Allowlist(dbid DBId) []AccessGrant
+
+    // Views whether an account may escrow fees for a database
+    // Called by: host
+    HasAccess(dbid DBId, account near.AccountID) bool
+
+    // Pays query fee and requests a replication quorum (0 uses the database minimum)
     // Called by: user (maybe injected by host)
-    EscrowFee(dbid DBId, qid QueryCID, ttl int64)
+    EscrowFee(dbid DBId, qid QueryCID, ttl int64, quorum int)
+
+    // Pays query fee for commercial or non-commercial use
+    // Called by: user (maybe injected by host)
+    EscrowFeeFor(dbid DBId, qid QueryCID, ttl int64, quorum int, use Use)
+
+    // Pays query fee with a TTL given as duration from now
+    // Called by: user (maybe injected by host)
+    EscrowFeeWithin(dbid DBId, qid QueryCID, within time.Duration, quorum int)
+
+    // Views the estimated block time
+    // Called by: user
+    BlockTime() time.Duration
+
+    // Views the TTL height for a duration from now
+    // Called by: user
+    TTLWithin(within time.Duration) int64
+
+    // Pays a query fee in fungible tokens through ft_transfer_call, the msg
+    // carries the escrow arguments and unused tokens are returned
+    // Called by: NEP-141 token contract
+    FtOnTransfer(sender near.AccountID, amount near.Money, msg string) near.Money
+
+    // Pays the fee of a query that joins several databases, the query is
+    // kept under the first database and royalties are split by share
+    // Called by: user (maybe injected by host)
+    EscrowJoinFee(qid QueryCID, ttl int64, quorum int, shares []JoinShare)
+
+    // Views the databases joined by a pending query
+    // Called by: host
+    JoinShares(dbid DBId, qid QueryCID) []JoinShare
+
+    // Views the license terms of a database
+    // Called by: host, user
+    LicenseTerms(dbid DBId) LicenseTerms
+
+    // Views the queries an account has paid for on a database with a usage cap
+    // Called by: host, user
+    Usage(dbid DBId, account near.AccountID) int
+
+    // Views the use a pending query was paid for
+    // Called by: host
+    QueryUse(dbid DBId, qid QueryCID) Use
+
+    // Views the outcomes of recently finalized queries
+    // Called by: host
+    Outcomes(dbid DBId) []ElectionOutcome
+
+    // Views the outcome of a finalized query
+    // Called by: host
+    Outcome(dbid DBId, qid QueryCID) *ElectionOutcome
 
     // Forwards fee payment tx and query execution proof
     Settle(dbid DBId, qid QueryCID, rid ResultCID)
 
+    // Views the hosts assigned to answer a pending query
+    // Called by: user
+    Committee(dbid DBId, qid QueryCID) []near.AccountID
+
+    // Views pending queries a host is assigned to answer
+    // Called by: host
+    Assignments(dbid DBId, host near.AccountID) []QueryCID
+
+    // Countersigns delivery of a result by a host
+    // Called by: user
+    SignReceipt(dbid DBId, qid QueryCID, host near.AccountID, rid ResultCID)
+
+    // Files a no response claim against an assigned host
+    // Called by: user
+    FileClaim(dbid DBId, qid QueryCID, host near.AccountID, query string)
+
+    // Answers a censorship claim by posting the query result
+    // Called by: host
+    AnswerClaim(dbid DBId, qid QueryCID, rid ResultCID, result string)
+
+    // Views open censorship claims against a host
+    // Called by: host
+    OpenClaims(dbid DBId, host near.AccountID) []CensorshipClaim
+
+    // Views the open payout epoch of a database
+    // Called by: host
+    CurrentEpoch(dbid DBId) *Epoch
+
+    // Views royalty grants that did not fully vest yet
+    // Called by: developer
+    VestingGrants(account near.AccountID) []VestingGrant
+
     // Sends settled fees and royalties to claimer
     // Called by: host
     ClaimFees()
@@ -136,9 +462,33 @@ type Contract interface {
     // Called by: developer
     ClaimRoyalties()
 
+    // Sends settled fees and royalties in a fungible token to claimer
+    // Called by: host, developer
+    ClaimTokens(token near.AccountID)
+
+    // Finalizes all expired queries
+    // Called by: anyone
+    Finalize()
+
     // Recovers and transfers slashed funds
-    // Called by: contract owner (DAO)
+    // Called by: contract owner (before a council exists)
     Recover(amount near.Money, target near.AccountID)
+
+    // Installs the governance council once
+    // Called by: contract owner
+    SetupCouncil(members []near.AccountID, threshold int, timelock int64)
+
+    // Submits a governance proposal
+    // Called by: council member
+    Propose(p Proposal) ProposalId
+
+    // Approves a governance proposal
+    // Called by: council member
+    Approve(id ProposalId)
+
+    // Executes an approved proposal after its time-lock expired
+    // Called by: anyone
+    Execute(id ProposalId)
 }
 
 type Node interface {
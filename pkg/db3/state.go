@@ -0,0 +1,1763 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "blockwatch.cc/db3-near/pkg/near"
+    "github.com/near/borsh-go"
+)
+
+// Contract storage layout of the on-chain contract (near-sdk-js 0.5). The
+// contract object is stored as JSON under STATE_KEY, LookupMap entries live at
+// prefix+key and UnorderedMap entries at prefix+"m"+key as [value, index] with
+// a key vector at prefix+"u"+u32le(index). Composite keys are joined by '#'
+// like makekey in contract/src/utils.ts. Amounts are stored as yoctoNEAR
+// strings, fungible token amounts as strings in token base units.
+const (
+    STATE_KEY = "STATE"
+
+    PREFIX_OWNERS            = "map-dbid-owner"
+    PREFIX_MANIFESTS         = "map-dbid-manifest"
+    PREFIX_VERSIONS          = "map-dbid-versions"
+    PREFIX_QUERY_VERSIONS    = "map-dbid-query-versions"
+    PREFIX_PENDING_OWNERS    = "map-dbid-pending-owner"
+    PREFIX_ROYALTY_SPLITS    = "map-dbid-royalty-split"
+    PREFIX_PARENTS           = "map-dbid-parent"
+    PREFIX_STATUS            = "map-dbid-status"
+    PREFIX_STORAGE_DEPOSITS  = "map-dbid-storage-deposit"
+    PREFIX_STORAGE_PAYERS    = "map-dbid-storage-payer"
+    PREFIX_STORAGE_CHARGES   = "map-dbid-storage-charges"
+    PREFIX_API_REGISTRY      = "map-dbid-api"
+    PREFIX_ACCESS            = "map-dbid-access"
+    PREFIX_ALLOWLISTS        = "map-dbid-allowlist"
+    PREFIX_DEPOSITS          = "map-dbid-deposit"
+    PREFIX_TTLS              = "map-dbid-ttl"
+    PREFIX_PENDING_RESULTS   = "map-dbid-pending-results"
+    PREFIX_PENDING_FEES      = "map-dbid-pending-fees"
+    PREFIX_SETTLED_FEES      = "map-dbid-settled-fees"
+    PREFIX_SETTLED_ROYALTIES = "map-dbid-settled-royalties"
+    PREFIX_QUORUMS           = "map-dbid-quorum"
+    PREFIX_PAYMENTS          = "map-dbid-payments"
+    PREFIX_COMMITTEES        = "map-dbid-committee"
+    PREFIX_RECEIPTS          = "map-dbid-receipts"
+    PREFIX_CLAIMS            = "map-dbid-claims"
+    PREFIX_FEE_TOKENS        = "map-dbid-fee-token"
+    PREFIX_JOINS             = "map-dbid-joins"
+    PREFIX_OUTCOMES          = "map-dbid-outcomes"
+    PREFIX_QUERY_USES        = "map-dbid-query-use"
+    PREFIX_USAGE             = "map-dbid-usage"
+    PREFIX_SIGNING_KEYS      = "map-account-signing-keys"
+    PREFIX_STORAGE_BALANCES  = "map-account-storage"
+    PREFIX_TOKEN_FEES        = "map-token-settled-fees"
+    PREFIX_TOKEN_ROYALTIES   = "map-token-settled-royalties"
+    PREFIX_TOKEN_SLASHED     = "map-token-slashed"
+    PREFIX_AUTHOR_INDEX      = "idx-author-dbids"
+    PREFIX_LICENSE_INDEX     = "idx-license-dbids"
+    PREFIX_TAG_INDEX         = "idx-tag-dbids"
+    PREFIX_FORK_INDEX        = "idx-fork-dbids"
+
+    // Go model only, not present in on-chain state
+    PREFIX_PROPOSALS = "map-proposals"
+    PREFIX_EPOCHS    = "map-dbid-epoch"
+    PREFIX_VESTING   = "map-account-vesting"
+
+    KEY_SEPARATOR = "#"
+)
+
+// Raw contract storage entry, JSON encodes like the view_state RPC result
+type StateItem struct {
+    Key   []byte `json:"key"`
+    Value []byte `json:"value"`
+}
+
+// Contract storage snapshot ordered by key
+type State struct {
+    Items []StateItem `json:"values"`
+}
+
+// MarshalBorsh encodes the snapshot as borsh Vec<(Vec<u8>, Vec<u8>)>
+func (s *State) MarshalBorsh() ([]byte, error) {
+    return borsh.Serialize(*s)
+}
+
+// UnmarshalBorsh decodes a borsh encoded snapshot
+func (s *State) UnmarshalBorsh(buf []byte) error {
+    return borsh.Deserialize(s, buf)
+}
+
+// State encodes the contract in the storage layout of the on-chain contract
+func (d *DB3) State() (*State, error) {
+    w := &stateWriter{items: make(map[string][]byte)}
+
+    owners := make(map[string]interface{})
+    manifests := make(map[string]interface{})
+    for dbid, acc := range d.Owners {
+        owners[dbkey(dbid)] = acc
+    }
+    for dbid, m := range d.Manifests {
+        manifests[dbkey(dbid)] = toTsManifest(m)
+    }
+    versions := make(map[string]interface{})
+    for dbid, list := range d.ManifestVersions {
+        vs := make([]tsManifestVersion, 0, len(list))
+        for _, v := range list {
+            vs = append(vs, tsManifestVersion{
+                Version:          v.Version,
+                Manifest:         toTsManifest(v.Manifest),
+                ActivationHeight: jsonInt(v.ActivationHeight),
+            })
+        }
+        versions[dbkey(dbid)] = vs
+    }
+    pendingOwners := make(map[string]interface{})
+    for dbid, acc := range d.PendingOwners {
+        pendingOwners[dbkey(dbid)] = acc
+    }
+    splits := make(map[string]interface{})
+    for dbid, list := range d.RoyaltySplits {
+        shares := make([]tsRoyaltyShare, 0, len(list))
+        for _, v := range list {
+            shares = append(shares, tsRoyaltyShare{Account: v.Account, Bips: jsonInt(v.Bips)})
+        }
+        splits[dbkey(dbid)] = shares
+    }
+    parents := make(map[string]interface{})
+    for dbid, link := range d.Parents {
+        parents[dbkey(dbid)] = tsForkLink{Parent: dbkey(link.Parent), RoyaltyBips: jsonInt(link.RoyaltyBips)}
+    }
+    status := make(map[string]interface{})
+    for dbid, s := range d.Status {
+        status[dbkey(dbid)] = tsDatabaseStatus{Status: s.String(), SunsetHeight: jsonInt(d.SunsetHeights[dbid])}
+    }
+    storageDeposits := make(map[string]interface{})
+    for dbid, v := range d.StorageDeposits {
+        storageDeposits[dbkey(dbid)] = v.Yocto()
+    }
+    storagePayers := make(map[string]interface{})
+    for dbid, acc := range d.StoragePayers {
+        storagePayers[dbkey(dbid)] = acc
+    }
+
+    registry := make(map[string]interface{})
+    for dbid, m := range d.ApiRegistry {
+        for acc, uri := range m {
+            registry[makekey(dbkey(dbid), string(acc))] = uri
+        }
+    }
+    access := make(map[string]interface{})
+    for dbid, p := range d.Access {
+        access[dbkey(dbid)] = tsAccessPolicy{
+            Private:    p.Private,
+            Gate:       p.Gate,
+            Standard:   p.Standard,
+            MinBalance: tokenAmount(p.MinBalance),
+        }
+    }
+    allowlists := make(map[string]interface{})
+    for dbid, m := range d.Allowlists {
+        for acc, g := range m {
+            allowlists[makekey(dbkey(dbid), string(acc))] = tsAccessGrant{Expires: jsonInt(g.Expires), Payer: g.Payer}
+        }
+    }
+    deposits := make(map[string]interface{})
+    for dbid, m := range d.Deposits {
+        for acc, v := range m {
+            deposits[makekey(dbkey(dbid), string(acc))] = v.Yocto()
+        }
+    }
+
+    ttls := make(map[string]interface{})
+    for dbid, m := range d.ResultTTL {
+        for qid, ttl := range m {
+            ttls[makekey(dbkey(dbid), string(qid))] = jsonInt(ttl)
+        }
+    }
+    results := make(map[string]interface{})
+    for dbid, m := range d.PendingResults {
+        for qid, votes := range m {
+            for acc, rid := range votes {
+                results[makekey(dbkey(dbid), string(qid), string(acc))] = rid
+            }
+        }
+    }
+    fees := make(map[string]interface{})
+    for dbid, m := range d.PendingFees {
+        for qid, v := range m {
+            fees[makekey(dbkey(dbid), string(qid))] = d.queryAmount(dbid, qid, v)
+        }
+    }
+    feeTokens := make(map[string]interface{})
+    for dbid, m := range d.FeeTokens {
+        for qid, token := range m {
+            feeTokens[makekey(dbkey(dbid), string(qid))] = token
+        }
+    }
+    joins := make(map[string]interface{})
+    for dbid, m := range d.Joins {
+        for qid, list := range m {
+            shares := make([]tsJoinShare, 0, len(list))
+            for _, v := range list {
+                shares = append(shares, tsJoinShare{Dbid: jsonInt(v.Dbid), Bips: jsonInt(v.Bips)})
+            }
+            joins[makekey(dbkey(dbid), string(qid))] = shares
+        }
+    }
+    outcomes := make(map[string]interface{})
+    for dbid, list := range d.History {
+        vs := make([]tsOutcome, 0, len(list))
+        for _, v := range list {
+            vs = append(vs, toTsOutcome(v))
+        }
+        outcomes[dbkey(dbid)] = vs
+    }
+    queryVersions := make(map[string]interface{})
+    for dbid, m := range d.QueryVersions {
+        for qid, v := range m {
+            queryVersions[makekey(dbkey(dbid), string(qid))] = v
+        }
+    }
+    uses := make(map[string]interface{})
+    for dbid, m := range d.QueryUses {
+        for qid, v := range m {
+            uses[makekey(dbkey(dbid), string(qid))] = v.String()
+        }
+    }
+    usage := make(map[string]interface{})
+    for dbid, m := range d.UsageCounts {
+        for acc, v := range m {
+            usage[makekey(dbkey(dbid), string(acc))] = v
+        }
+    }
+    signingKeys := make(map[string]interface{})
+    for acc, keys := range d.SigningKeys {
+        signingKeys[string(acc)] = keys
+    }
+    quorums := make(map[string]interface{})
+    for dbid, m := range d.QueryQuorums {
+        for qid, v := range m {
+            quorums[makekey(dbkey(dbid), string(qid))] = v
+        }
+    }
+    payments := make(map[string]interface{})
+    for dbid, m := range d.QueryPayments {
+        for qid, accs := range m {
+            for acc, v := range accs {
+                payments[makekey(dbkey(dbid), string(qid), string(acc))] = d.queryAmount(dbid, qid, v)
+            }
+        }
+    }
+    committees := make(map[string]interface{})
+    for dbid, m := range d.Committees {
+        for qid, members := range m {
+            committees[makekey(dbkey(dbid), string(qid))] = members
+        }
+    }
+    receipts := make(map[string]interface{})
+    for dbid, m := range d.Receipts {
+        for qid, hosts := range m {
+            for host, r := range hosts {
+                receipts[makekey(dbkey(dbid), string(qid), string(host))] = tsReceipt{User: r.User, Rid: r.Rid}
+            }
+        }
+    }
+    claims := make(map[string]interface{})
+    for dbid, m := range d.Claims {
+        for qid, hosts := range m {
+            for host, c := range hosts {
+                claims[makekey(dbkey(dbid), string(qid), string(host))] = tsClaim{
+                    Claimant: c.Claimant,
+                    Query:    c.Query,
+                    Deadline: jsonInt(c.Deadline),
+                }
+            }
+        }
+    }
+    charges := make(map[string]interface{})
+    for dbid, m := range d.StorageCharges {
+        for qid, accs := range m {
+            for acc, v := range accs {
+                charges[makekey(dbkey(dbid), string(qid), string(acc))] = v.Yocto()
+            }
+        }
+    }
+    settledFees := make(map[string]interface{})
+    for acc, v := range d.SettledFees {
+        settledFees[string(acc)] = v.Yocto()
+    }
+    settledRoyalties := make(map[string]interface{})
+    for acc, v := range d.SettledRoyalties {
+        settledRoyalties[string(acc)] = v.Yocto()
+    }
+    tokenFees := make(map[string]interface{})
+    for token, m := range d.SettledTokenFees {
+        for acc, v := range m {
+            tokenFees[makekey(string(token), string(acc))] = tokenAmount(v)
+        }
+    }
+    tokenRoyalties := make(map[string]interface{})
+    for token, m := range d.SettledTokenRoyalties {
+        for acc, v := range m {
+            tokenRoyalties[makekey(string(token), string(acc))] = tokenAmount(v)
+        }
+    }
+    tokenSlashed := make(map[string]interface{})
+    for token, v := range d.SlashedTokens {
+        tokenSlashed[string(token)] = tokenAmount(v)
+    }
+    tokenInflows := make(map[near.AccountID]string)
+    for token, v := range d.TokenInflows {
+        tokenInflows[token] = tokenAmount(v)
+    }
+    tokenOutflows := make(map[near.AccountID]string)
+    for token, v := range d.TokenOutflows {
+        tokenOutflows[token] = tokenAmount(v)
+    }
+
+    authors := make(map[string]interface{})
+    for acc, ids := range d.AuthorIndex {
+        authors[string(acc)] = dbkeys(ids)
+    }
+    licenses := make(map[string]interface{})
+    for license, ids := range d.LicenseIndex {
+        licenses[license] = dbkeys(ids)
+    }
+    tags := make(map[string]interface{})
+    for tag, ids := range d.TagIndex {
+        tags[tag] = dbkeys(ids)
+    }
+    forks := make(map[string]interface{})
+    for dbid, ids := range d.Forks {
+        forks[dbkey(dbid)] = dbkeys(ids)
+    }
+
+    balances := make(map[string]interface{})
+    for acc, v := range d.StorageBalances {
+        balances[string(acc)] = tsStorageBalance{Total: v.Total.Yocto(), Available: v.Available.Yocto()}
+    }
+    proposals := make(map[string]interface{})
+    for id, p := range d.Proposals {
+        proposals[strconv.FormatUint(uint64(id), 10)] = p
+    }
+    epochs := make(map[string]interface{})
+    for dbid, e := range d.Epochs {
+        epochs[dbkey(dbid)] = e
+    }
+    vesting := make(map[string]interface{})
+    for acc, grants := range d.Vesting {
+        vesting[string(acc)] = grants
+    }
+
+    var clock *tsBlockClock
+    if d.Clock.Timestamp != 0 {
+        clock = &tsBlockClock{
+            Height:    jsonInt(d.Clock.Height),
+            Timestamp: jsonInt(d.Clock.Timestamp),
+            BlockTime: jsonInt(d.Clock.BlockTime),
+        }
+    }
+
+    params := d.Params
+    cs := tsContract{
+        Version:               STATE_VERSION,
+        Owner:                 d.Owner,
+        NextId:                d.NextId,
+        DbOwners:              w.unorderedMap(PREFIX_OWNERS, owners),
+        DbManifests:           w.unorderedMap(PREFIX_MANIFESTS, manifests),
+        DbVersions:            w.lookupMap(PREFIX_VERSIONS, versions),
+        DbQueryVersions:       w.lookupMap(PREFIX_QUERY_VERSIONS, queryVersions),
+        DbPendingOwners:       w.lookupMap(PREFIX_PENDING_OWNERS, pendingOwners),
+        DbRoyaltySplits:       w.lookupMap(PREFIX_ROYALTY_SPLITS, splits),
+        DbParents:             w.lookupMap(PREFIX_PARENTS, parents),
+        DbStatus:              w.lookupMap(PREFIX_STATUS, status),
+        DbStorageDeposits:     w.lookupMap(PREFIX_STORAGE_DEPOSITS, storageDeposits),
+        DbStoragePayers:       w.lookupMap(PREFIX_STORAGE_PAYERS, storagePayers),
+        DbStorageCharges:      w.unorderedMap(PREFIX_STORAGE_CHARGES, charges),
+        DbApiRegistry:         w.unorderedMap(PREFIX_API_REGISTRY, registry),
+        DbAccess:              w.lookupMap(PREFIX_ACCESS, access),
+        DbAllowlists:          w.unorderedMap(PREFIX_ALLOWLISTS, allowlists),
+        DbDeposits:            w.lookupMap(PREFIX_DEPOSITS, deposits),
+        DbTtls:                w.unorderedMap(PREFIX_TTLS, ttls),
+        DbPendingVotes:        w.unorderedMap(PREFIX_PENDING_RESULTS, results),
+        DbPendingFees:         w.lookupMap(PREFIX_PENDING_FEES, fees),
+        DbSettledFees:         w.lookupMap(PREFIX_SETTLED_FEES, settledFees),
+        DbSettledRoyalties:    w.lookupMap(PREFIX_SETTLED_ROYALTIES, settledRoyalties),
+        DbQuorums:             w.lookupMap(PREFIX_QUORUMS, quorums),
+        DbPayments:            w.unorderedMap(PREFIX_PAYMENTS, payments),
+        DbCommittees:          w.unorderedMap(PREFIX_COMMITTEES, committees),
+        DbReceipts:            w.unorderedMap(PREFIX_RECEIPTS, receipts),
+        DbClaims:              w.unorderedMap(PREFIX_CLAIMS, claims),
+        DbFeeTokens:           w.lookupMap(PREFIX_FEE_TOKENS, feeTokens),
+        DbJoins:               w.lookupMap(PREFIX_JOINS, joins),
+        DbOutcomes:            w.lookupMap(PREFIX_OUTCOMES, outcomes),
+        DbQueryUses:           w.lookupMap(PREFIX_QUERY_USES, uses),
+        DbUsage:               w.lookupMap(PREFIX_USAGE, usage),
+        SigningKeys:           w.lookupMap(PREFIX_SIGNING_KEYS, signingKeys),
+        StorageBalances:       w.lookupMap(PREFIX_STORAGE_BALANCES, balances),
+        TokenSettledFees:      w.lookupMap(PREFIX_TOKEN_FEES, tokenFees),
+        TokenSettledRoyalties: w.lookupMap(PREFIX_TOKEN_ROYALTIES, tokenRoyalties),
+        TokenSlashed:          w.lookupMap(PREFIX_TOKEN_SLASHED, tokenSlashed),
+        DbSlashed:             d.Slashed.Yocto(),
+        IdxAuthor:             w.lookupMap(PREFIX_AUTHOR_INDEX, authors),
+        IdxLicense:            w.lookupMap(PREFIX_LICENSE_INDEX, licenses),
+        IdxTag:                w.lookupMap(PREFIX_TAG_INDEX, tags),
+        IdxFork:               w.lookupMap(PREFIX_FORK_INDEX, forks),
+        Clock:                 clock,
+        Params:                &params,
+        Council:               d.Council,
+        Threshold:             d.Threshold,
+        TimeLock:              d.TimeLock,
+        NextProposalId:        d.NextProposalId,
+        TotalInflows:          d.TotalInflows.Yocto(),
+        TotalOutflows:         d.TotalOutflows.Yocto(),
+        TokenInflows:          tokenInflows,
+        TokenOutflows:         tokenOutflows,
+        Proposals:             w.lookupMap(PREFIX_PROPOSALS, proposals),
+        Epochs:                w.lookupMap(PREFIX_EPOCHS, epochs),
+        Vesting:               w.lookupMap(PREFIX_VESTING, vesting),
+    }
+    w.set(STATE_KEY, cs)
+    if w.err != nil {
+        return nil, w.err
+    }
+    return w.state(), nil
+}
+
+// LoadState decodes a contract storage snapshot, e.g. a view_state dump of
+// the deployed contract, into a new Go model. Snapshots of earlier schema
+// versions are migrated first, the source snapshot is not changed. Go model
+// only data that is missing from on-chain state is initialized with
+// defaults. Amounts below one milliNEAR are truncated.
+func LoadState(s *State) (*DB3, error) {
+    if v, err := s.Version(); err != nil {
+        return nil, err
+    } else if v != STATE_VERSION {
+        s = s.Clone()
+        if err := s.Migrate(STATE_VERSION); err != nil {
+            return nil, err
+        }
+    }
+    d := NewDB3()
+    items := make(map[string][]byte, len(s.Items))
+    for _, v := range s.Items {
+        items[string(v.Key)] = v.Value
+    }
+
+    // contract object
+    buf, ok := items[STATE_KEY]
+    if !ok {
+        return nil, fmt.Errorf("missing %s key", STATE_KEY)
+    }
+    // parameters added later keep their defaults in older snapshots
+    params := DefaultParams()
+    cs := tsContract{Params: &params}
+    if err := json.Unmarshal(buf, &cs); err != nil {
+        return nil, fmt.Errorf("decoding %s: %v", STATE_KEY, err)
+    }
+    d.Owner = cs.Owner
+    d.NextId = cs.NextId
+    d.Params = *cs.Params
+    if cs.Clock != nil {
+        d.Clock = BlockClock{
+            Height:    int64(cs.Clock.Height),
+            Timestamp: int64(cs.Clock.Timestamp),
+            BlockTime: int64(cs.Clock.BlockTime),
+        }
+    }
+    d.Council = cs.Council
+    d.Threshold = cs.Threshold
+    d.TimeLock = cs.TimeLock
+    d.NextProposalId = cs.NextProposalId
+    for _, v := range []struct {
+        s string
+        m *near.Money
+    }{
+        {cs.DbSlashed, &d.Slashed},
+        {cs.TotalInflows, &d.TotalInflows},
+        {cs.TotalOutflows, &d.TotalOutflows},
+    } {
+        if v.s == "" {
+            continue
+        }
+        amount, err := near.ParseYocto(v.s)
+        if err != nil {
+            return nil, err
+        }
+        *v.m = amount
+    }
+    for _, v := range []struct {
+        src map[near.AccountID]string
+        dst map[near.AccountID]near.Money
+    }{
+        {cs.TokenInflows, d.TokenInflows},
+        {cs.TokenOutflows, d.TokenOutflows},
+    } {
+        for token, s := range v.src {
+            amount, err := strconv.ParseUint(s, 10, 64)
+            if err != nil {
+                return nil, err
+            }
+            v.dst[token] = near.Money(amount)
+        }
+    }
+
+    // allocate per database maps like Deploy
+    for dbid := DBId(0); dbid < d.NextId; dbid++ {
+        d.ApiRegistry[dbid] = make(map[near.AccountID]ApiEndpoint)
+        d.Deposits[dbid] = make(map[near.AccountID]near.Money)
+        d.ResultTTL[dbid] = make(map[QueryCID]int64)
+        d.PendingResults[dbid] = make(map[QueryCID]map[near.AccountID]ResultCID)
+        d.PendingFees[dbid] = make(map[QueryCID]near.Money)
+        d.QueryVersions[dbid] = make(map[QueryCID]int)
+        d.QueryQuorums[dbid] = make(map[QueryCID]int)
+        d.QueryPayments[dbid] = make(map[QueryCID]map[near.AccountID]near.Money)
+        d.Committees[dbid] = make(map[QueryCID][]near.AccountID)
+        d.StorageCharges[dbid] = make(map[QueryCID]map[near.AccountID]near.Money)
+        d.Receipts[dbid] = make(map[QueryCID]map[near.AccountID]Receipt)
+        d.Claims[dbid] = make(map[QueryCID]map[near.AccountID]CensorshipClaim)
+        d.FeeTokens[dbid] = make(map[QueryCID]near.AccountID)
+        d.Joins[dbid] = make(map[QueryCID][]JoinShare)
+        d.QueryUses[dbid] = make(map[QueryCID]Use)
+        d.UsageCounts[dbid] = make(map[near.AccountID]int)
+    }
+
+    // decode collection entries, longest prefixes first
+    decoders := d.stateDecoders()
+    prefixes := make([]string, 0, len(decoders))
+    for p := range decoders {
+        prefixes = append(prefixes, p)
+    }
+    sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+    for key, value := range items {
+        if key == STATE_KEY {
+            continue
+        }
+        for _, p := range prefixes {
+            if !strings.HasPrefix(key, p) {
+                continue
+            }
+            if err := decoders[p](key[len(p):], value); err != nil {
+                return nil, fmt.Errorf("decoding %q: %v", key, err)
+            }
+            break
+        }
+    }
+
+    // fees of token queries are stored in token base units, decode them
+    // again once the fee token of each query is known
+    for dbid, m := range d.FeeTokens {
+        for qid := range m {
+            key := makekey(dbkey(dbid), string(qid))
+            if buf, ok := items[PREFIX_PENDING_FEES+key]; ok {
+                amount, err := parseTokenAmount(buf)
+                if err != nil {
+                    return nil, fmt.Errorf("decoding %q: %v", PREFIX_PENDING_FEES+key, err)
+                }
+                d.PendingFees[dbid][qid] = amount
+            }
+            for acc := range d.QueryPayments[dbid][qid] {
+                pkey := PREFIX_PAYMENTS + "m" + makekey(key, string(acc))
+                buf, err := unwrapEntry(items[pkey])
+                if err != nil {
+                    return nil, fmt.Errorf("decoding %q: %v", pkey, err)
+                }
+                amount, err := parseTokenAmount(buf)
+                if err != nil {
+                    return nil, fmt.Errorf("decoding %q: %v", pkey, err)
+                }
+                d.QueryPayments[dbid][qid][acc] = amount
+            }
+        }
+    }
+    return d, nil
+}
+
+// stateDecoders returns entry decoders by storage key prefix, UnorderedMap
+// values are unwrapped and their key vectors are skipped
+func (d *DB3) stateDecoders() map[string]func(key string, buf []byte) error {
+    dec := map[string]func(key string, buf []byte) error{
+        PREFIX_VERSIONS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var vs []tsManifestVersion
+            if err := json.Unmarshal(buf, &vs); err != nil {
+                return err
+            }
+            list := make([]ManifestVersion, 0, len(vs))
+            for _, v := range vs {
+                list = append(list, ManifestVersion{
+                    Version:          v.Version,
+                    Manifest:         v.Manifest.manifest(),
+                    ActivationHeight: int64(v.ActivationHeight),
+                })
+            }
+            d.ManifestVersions[dbid] = list
+            return nil
+        },
+        PREFIX_QUERY_VERSIONS: func(key string, buf []byte) error {
+            dbid, qid, err := parseQueryKey(key)
+            if err != nil {
+                return err
+            }
+            var v int
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            d.queryMap(dbid).versions[qid] = v
+            return nil
+        },
+        PREFIX_PENDING_OWNERS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var acc near.AccountID
+            if err := json.Unmarshal(buf, &acc); err != nil {
+                return err
+            }
+            d.PendingOwners[dbid] = acc
+            return nil
+        },
+        PREFIX_ROYALTY_SPLITS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var shares []tsRoyaltyShare
+            if err := json.Unmarshal(buf, &shares); err != nil {
+                return err
+            }
+            list := make([]RoyaltyShare, 0, len(shares))
+            for _, v := range shares {
+                list = append(list, RoyaltyShare{Account: v.Account, Bips: int(v.Bips)})
+            }
+            d.RoyaltySplits[dbid] = list
+            return nil
+        },
+        PREFIX_PARENTS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var v tsForkLink
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            parent, err := parseDbkey(v.Parent)
+            if err != nil {
+                return err
+            }
+            d.Parents[dbid] = ForkLink{Parent: parent, RoyaltyBips: int(v.RoyaltyBips)}
+            return nil
+        },
+        PREFIX_STATUS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var v tsDatabaseStatus
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            status, err := parseStatus(v.Status)
+            if err != nil {
+                return err
+            }
+            d.Status[dbid] = status
+            if v.SunsetHeight > 0 {
+                d.SunsetHeights[dbid] = int64(v.SunsetHeight)
+            }
+            return nil
+        },
+        PREFIX_STORAGE_DEPOSITS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            amount, err := parseAmount(buf)
+            d.StorageDeposits[dbid] = amount
+            return err
+        },
+        PREFIX_STORAGE_PAYERS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var acc near.AccountID
+            if err := json.Unmarshal(buf, &acc); err != nil {
+                return err
+            }
+            d.StoragePayers[dbid] = acc
+            return nil
+        },
+        PREFIX_ACCESS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var v tsAccessPolicy
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            p := AccessPolicy{Private: v.Private, Gate: v.Gate, Standard: v.Standard}
+            if v.MinBalance != "" {
+                amount, err := strconv.ParseUint(v.MinBalance, 10, 64)
+                if err != nil {
+                    return err
+                }
+                p.MinBalance = near.Money(amount)
+            }
+            d.Access[dbid] = p
+            return nil
+        },
+        PREFIX_DEPOSITS: func(key string, buf []byte) error {
+            dbid, acc, err := parseAccountKey(key)
+            if err != nil {
+                return err
+            }
+            amount, err := parseAmount(buf)
+            d.hostMap(dbid).deposits[acc] = amount
+            return err
+        },
+        PREFIX_PENDING_FEES: func(key string, buf []byte) error {
+            dbid, qid, err := parseQueryKey(key)
+            if err != nil {
+                return err
+            }
+            amount, err := parseAmount(buf)
+            d.queryMap(dbid).fees[qid] = amount
+            return err
+        },
+        PREFIX_QUERY_USES: func(key string, buf []byte) error {
+            dbid, qid, err := parseQueryKey(key)
+            if err != nil {
+                return err
+            }
+            var v string
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            use, err := parseUse(v)
+            d.queryMap(dbid).uses[qid] = use
+            return err
+        },
+        PREFIX_USAGE: func(key string, buf []byte) error {
+            dbid, acc, err := parseAccountKey(key)
+            if err != nil {
+                return err
+            }
+            var v int
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            if _, ok := d.UsageCounts[dbid]; !ok {
+                d.UsageCounts[dbid] = make(map[near.AccountID]int)
+            }
+            d.UsageCounts[dbid][acc] = v
+            return nil
+        },
+        PREFIX_SIGNING_KEYS: func(key string, buf []byte) error {
+            var keys []near.Pubkey
+            if err := json.Unmarshal(buf, &keys); err != nil {
+                return err
+            }
+            d.SigningKeys[near.AccountID(key)] = keys
+            return nil
+        },
+        PREFIX_QUORUMS: func(key string, buf []byte) error {
+            dbid, qid, err := parseQueryKey(key)
+            if err != nil {
+                return err
+            }
+            var v int
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            d.queryMap(dbid).quorums[qid] = v
+            return nil
+        },
+        PREFIX_SETTLED_FEES: func(key string, buf []byte) error {
+            amount, err := parseAmount(buf)
+            d.SettledFees[near.AccountID(key)] = amount
+            return err
+        },
+        PREFIX_SETTLED_ROYALTIES: func(key string, buf []byte) error {
+            amount, err := parseAmount(buf)
+            d.SettledRoyalties[near.AccountID(key)] = amount
+            return err
+        },
+        PREFIX_FEE_TOKENS: func(key string, buf []byte) error {
+            dbid, qid, err := parseQueryKey(key)
+            if err != nil {
+                return err
+            }
+            var token near.AccountID
+            if err := json.Unmarshal(buf, &token); err != nil {
+                return err
+            }
+            d.queryMap(dbid).feeTokens[qid] = token
+            return nil
+        },
+        PREFIX_JOINS: func(key string, buf []byte) error {
+            dbid, qid, err := parseQueryKey(key)
+            if err != nil {
+                return err
+            }
+            var v []tsJoinShare
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            shares := make([]JoinShare, 0, len(v))
+            for _, s := range v {
+                shares = append(shares, JoinShare{Dbid: DBId(s.Dbid), Bips: int(s.Bips)})
+            }
+            d.queryMap(dbid).joins[qid] = shares
+            return nil
+        },
+        PREFIX_OUTCOMES: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var vs []tsOutcome
+            if err := json.Unmarshal(buf, &vs); err != nil {
+                return err
+            }
+            list := make([]ElectionOutcome, 0, len(vs))
+            for _, v := range vs {
+                out, err := v.outcome()
+                if err != nil {
+                    return err
+                }
+                list = append(list, out)
+            }
+            d.History[dbid] = list
+            return nil
+        },
+        PREFIX_TOKEN_FEES: func(key string, buf []byte) error {
+            token, acc, err := parseTokenKey(key)
+            if err != nil {
+                return err
+            }
+            amount, err := parseTokenAmount(buf)
+            if _, ok := d.SettledTokenFees[token]; !ok {
+                d.SettledTokenFees[token] = make(map[near.AccountID]near.Money)
+            }
+            d.SettledTokenFees[token][acc] = amount
+            return err
+        },
+        PREFIX_TOKEN_ROYALTIES: func(key string, buf []byte) error {
+            token, acc, err := parseTokenKey(key)
+            if err != nil {
+                return err
+            }
+            amount, err := parseTokenAmount(buf)
+            if _, ok := d.SettledTokenRoyalties[token]; !ok {
+                d.SettledTokenRoyalties[token] = make(map[near.AccountID]near.Money)
+            }
+            d.SettledTokenRoyalties[token][acc] = amount
+            return err
+        },
+        PREFIX_TOKEN_SLASHED: func(key string, buf []byte) error {
+            amount, err := parseTokenAmount(buf)
+            d.SlashedTokens[near.AccountID(key)] = amount
+            return err
+        },
+        PREFIX_AUTHOR_INDEX: func(key string, buf []byte) error {
+            ids, err := parseDbkeys(buf)
+            d.AuthorIndex[near.AccountID(key)] = ids
+            return err
+        },
+        PREFIX_LICENSE_INDEX: func(key string, buf []byte) error {
+            ids, err := parseDbkeys(buf)
+            d.LicenseIndex[key] = ids
+            return err
+        },
+        PREFIX_TAG_INDEX: func(key string, buf []byte) error {
+            ids, err := parseDbkeys(buf)
+            d.TagIndex[key] = ids
+            return err
+        },
+        PREFIX_FORK_INDEX: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            ids, err := parseDbkeys(buf)
+            d.Forks[dbid] = ids
+            return err
+        },
+        PREFIX_STORAGE_BALANCES: func(key string, buf []byte) error {
+            var v tsStorageBalance
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            total, err := near.ParseYocto(v.Total)
+            if err != nil {
+                return err
+            }
+            available, err := near.ParseYocto(v.Available)
+            if err != nil {
+                return err
+            }
+            d.StorageBalances[near.AccountID(key)] = StorageBalance{Total: total, Available: available}
+            return nil
+        },
+        PREFIX_PROPOSALS: func(key string, buf []byte) error {
+            id, err := strconv.ParseUint(key, 10, 64)
+            if err != nil {
+                return err
+            }
+            p := &Proposal{}
+            if err := json.Unmarshal(buf, p); err != nil {
+                return err
+            }
+            // snapshots before the approved flag mark approval by height
+            p.Approved = p.Approved || p.ApprovedHeight > 0
+            d.Proposals[ProposalId(id)] = p
+            return nil
+        },
+        PREFIX_EPOCHS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            e := &Epoch{}
+            if err := json.Unmarshal(buf, e); err != nil {
+                return err
+            }
+            d.Epochs[dbid] = e
+            return nil
+        },
+        PREFIX_VESTING: func(key string, buf []byte) error {
+            var grants []VestingGrant
+            if err := json.Unmarshal(buf, &grants); err != nil {
+                return err
+            }
+            d.Vesting[near.AccountID(key)] = grants
+            return nil
+        },
+    }
+
+    unordered := map[string]func(key string, buf []byte) error{
+        PREFIX_OWNERS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var acc near.AccountID
+            if err := json.Unmarshal(buf, &acc); err != nil {
+                return err
+            }
+            d.Owners[dbid] = acc
+            return nil
+        },
+        PREFIX_MANIFESTS: func(key string, buf []byte) error {
+            dbid, err := parseDbkey(key)
+            if err != nil {
+                return err
+            }
+            var m tsManifest
+            if err := json.Unmarshal(buf, &m); err != nil {
+                return err
+            }
+            d.Manifests[dbid] = m.manifest()
+            return nil
+        },
+        PREFIX_STORAGE_CHARGES: func(key string, buf []byte) error {
+            dbid, qid, acc, err := parseVoteKey(key)
+            if err != nil {
+                return err
+            }
+            amount, err := parseAmount(buf)
+            charges := d.queryMap(dbid).charges
+            if _, ok := charges[qid]; !ok {
+                charges[qid] = make(map[near.AccountID]near.Money)
+            }
+            charges[qid][acc] = amount
+            return err
+        },
+        PREFIX_API_REGISTRY: func(key string, buf []byte) error {
+            dbid, acc, err := parseAccountKey(key)
+            if err != nil {
+                return err
+            }
+            var uri ApiEndpoint
+            if err := json.Unmarshal(buf, &uri); err != nil {
+                return err
+            }
+            d.hostMap(dbid).registry[acc] = uri
+            return nil
+        },
+        PREFIX_ALLOWLISTS: func(key string, buf []byte) error {
+            dbid, acc, err := parseAccountKey(key)
+            if err != nil {
+                return err
+            }
+            var v tsAccessGrant
+            if err := json.Unmarshal(buf, &v); err != nil {
+                return err
+            }
+            if _, ok := d.Allowlists[dbid]; !ok {
+                d.Allowlists[dbid] = make(map[near.AccountID]AccessGrant)
+            }
+            d.Allowlists[dbid][acc] = AccessGrant{Account: acc, Expires: int64(v.Expires), Payer: v.Payer}
+            return nil
+        },
+        PREFIX_TTLS: func(key string, buf []byte) error {
+            dbid, qid, err := parseQueryKey(key)
+            if err != nil {
+                return err
+            }
+            var ttl jsonInt
+            if err := json.Unmarshal(buf, &ttl); err != nil {
+                return err
+            }
+            d.queryMap(dbid).ttls[qid] = int64(ttl)
+            return nil
+        },
+        PREFIX_PENDING_RESULTS: func(key string, buf []byte) error {
+            dbid, qid, acc, err := parseVoteKey(key)
+            if err != nil {
+                return err
+            }
+            var rid ResultCID
+            if err := json.Unmarshal(buf, &rid); err != nil {
+                return err
+            }
+            results := d.queryMap(dbid).results
+            if _, ok := results[qid]; !ok {
+                results[qid] = make(map[near.AccountID]ResultCID)
+            }
+            results[qid][acc] = rid
+            return nil
+        },
+        PREFIX_PAYMENTS: func(key string, buf []byte) error {
+            dbid, qid, acc, err := parseVoteKey(key)
+            if err != nil {
+                return err
+            }
+            amount, err := parseAmount(buf)
+            payments := d.queryMap(dbid).payments
+            if _, ok := payments[qid]; !ok {
+                payments[qid] = make(map[near.AccountID]near.Money)
+            }
+            payments[qid][acc] = amount
+            return err
+        },
+        PREFIX_COMMITTEES: func(key string, buf []byte) error {
+            dbid, qid, err := parseQueryKey(key)
+            if err != nil {
+                return err
+            }
+            var members []near.AccountID
+            if err := json.Unmarshal(buf, &members); err != nil {
+                return err
+            }
+            d.queryMap(dbid).committees[qid] = members
+            return nil
+        },
+        PREFIX_RECEIPTS: func(key string, buf []byte) error {
+            dbid, qid, host, err := parseVoteKey(key)
+            if err != nil {
+                return err
+            }
+            var r tsReceipt
+            if err := json.Unmarshal(buf, &r); err != nil {
+                return err
+            }
+            receipts := d.queryMap(dbid).receipts
+            if _, ok := receipts[qid]; !ok {
+                receipts[qid] = make(map[near.AccountID]Receipt)
+            }
+            receipts[qid][host] = Receipt{User: r.User, Rid: r.Rid}
+            return nil
+        },
+        PREFIX_CLAIMS: func(key string, buf []byte) error {
+            dbid, qid, host, err := parseVoteKey(key)
+            if err != nil {
+                return err
+            }
+            var c tsClaim
+            if err := json.Unmarshal(buf, &c); err != nil {
+                return err
+            }
+            claims := d.queryMap(dbid).claims
+            if _, ok := claims[qid]; !ok {
+                claims[qid] = make(map[near.AccountID]CensorshipClaim)
+            }
+            claims[qid][host] = CensorshipClaim{
+                Qid:      qid,
+                Host:     host,
+                Claimant: c.Claimant,
+                Query:    c.Query,
+                Deadline: int64(c.Deadline),
+            }
+            return nil
+        },
+    }
+    for p, fn := range unordered {
+        fn := fn
+        dec[p+"m"] = func(key string, buf []byte) error {
+            value, err := unwrapEntry(buf)
+            if err != nil {
+                return err
+            }
+            return fn(key, value)
+        }
+        dec[p+"u"] = func(string, []byte) error { return nil }
+    }
+    return dec
+}
+
+// unwrapEntry returns the JSON value of an UnorderedMap entry
+func unwrapEntry(buf []byte) ([]byte, error) {
+    var entry [2]json.RawMessage
+    if err := json.Unmarshal(buf, &entry); err != nil {
+        return nil, err
+    }
+    var value string
+    if err := json.Unmarshal(entry[0], &value); err != nil {
+        return nil, err
+    }
+    return []byte(value), nil
+}
+
+// per database host maps, allocated for ids missing from the contract object
+type hostMaps struct {
+    registry map[near.AccountID]ApiEndpoint
+    deposits map[near.AccountID]near.Money
+}
+
+func (d *DB3) hostMap(dbid DBId) hostMaps {
+    if _, ok := d.Deposits[dbid]; !ok {
+        d.ApiRegistry[dbid] = make(map[near.AccountID]ApiEndpoint)
+        d.Deposits[dbid] = make(map[near.AccountID]near.Money)
+    }
+    return hostMaps{d.ApiRegistry[dbid], d.Deposits[dbid]}
+}
+
+// per database query maps, allocated for ids missing from the contract object
+type queryMaps struct {
+    ttls       map[QueryCID]int64
+    results    map[QueryCID]map[near.AccountID]ResultCID
+    fees       map[QueryCID]near.Money
+    versions   map[QueryCID]int
+    quorums    map[QueryCID]int
+    payments   map[QueryCID]map[near.AccountID]near.Money
+    committees map[QueryCID][]near.AccountID
+    charges    map[QueryCID]map[near.AccountID]near.Money
+    receipts   map[QueryCID]map[near.AccountID]Receipt
+    claims     map[QueryCID]map[near.AccountID]CensorshipClaim
+    feeTokens  map[QueryCID]near.AccountID
+    joins      map[QueryCID][]JoinShare
+    uses       map[QueryCID]Use
+}
+
+func (d *DB3) queryMap(dbid DBId) queryMaps {
+    if _, ok := d.ResultTTL[dbid]; !ok {
+        d.ResultTTL[dbid] = make(map[QueryCID]int64)
+        d.PendingResults[dbid] = make(map[QueryCID]map[near.AccountID]ResultCID)
+        d.PendingFees[dbid] = make(map[QueryCID]near.Money)
+        d.QueryVersions[dbid] = make(map[QueryCID]int)
+        d.QueryQuorums[dbid] = make(map[QueryCID]int)
+        d.QueryPayments[dbid] = make(map[QueryCID]map[near.AccountID]near.Money)
+        d.Committees[dbid] = make(map[QueryCID][]near.AccountID)
+        d.StorageCharges[dbid] = make(map[QueryCID]map[near.AccountID]near.Money)
+        d.Receipts[dbid] = make(map[QueryCID]map[near.AccountID]Receipt)
+        d.Claims[dbid] = make(map[QueryCID]map[near.AccountID]CensorshipClaim)
+        d.FeeTokens[dbid] = make(map[QueryCID]near.AccountID)
+        d.Joins[dbid] = make(map[QueryCID][]JoinShare)
+        d.QueryUses[dbid] = make(map[QueryCID]Use)
+    }
+    return queryMaps{
+        d.ResultTTL[dbid],
+        d.PendingResults[dbid],
+        d.PendingFees[dbid],
+        d.QueryVersions[dbid],
+        d.QueryQuorums[dbid],
+        d.QueryPayments[dbid],
+        d.Committees[dbid],
+        d.StorageCharges[dbid],
+        d.Receipts[dbid],
+        d.Claims[dbid],
+        d.FeeTokens[dbid],
+        d.Joins[dbid],
+        d.QueryUses[dbid],
+    }
+}
+
+// stateWriter collects storage entries in the contract layout
+type stateWriter struct {
+    items map[string][]byte
+    err   error
+}
+
+// collection descriptors as serialized inside the contract object
+type tsLookupMap struct {
+    KeyPrefix string `json:"keyPrefix"`
+}
+
+type tsVector struct {
+    Prefix string `json:"prefix"`
+    Length int    `json:"length"`
+}
+
+type tsUnorderedMap struct {
+    Prefix string      `json:"prefix"`
+    Keys   tsVector    `json:"keys"`
+    Values tsLookupMap `json:"values"`
+}
+
+func (w *stateWriter) set(key string, v interface{}) {
+    buf, err := marshal(v)
+    if err != nil && w.err == nil {
+        w.err = fmt.Errorf("encoding %q: %v", key, err)
+    }
+    w.items[key] = buf
+}
+
+func (w *stateWriter) lookupMap(prefix string, entries map[string]interface{}) tsLookupMap {
+    for k, v := range entries {
+        w.set(prefix+k, v)
+    }
+    return tsLookupMap{KeyPrefix: prefix}
+}
+
+func (w *stateWriter) unorderedMap(prefix string, entries map[string]interface{}) tsUnorderedMap {
+    keys := make([]string, 0, len(entries))
+    for k := range entries {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    var index [4]byte
+    for i, k := range keys {
+        value, err := marshal(entries[k])
+        if err != nil && w.err == nil {
+            w.err = fmt.Errorf("encoding %q: %v", prefix+k, err)
+        }
+        binary.LittleEndian.PutUint32(index[:], uint32(i))
+        w.set(prefix+"u"+string(index[:]), k)
+        w.set(prefix+"m"+k, []interface{}{string(value), i})
+    }
+    return tsUnorderedMap{
+        Prefix: prefix,
+        Keys:   tsVector{Prefix: prefix + "u", Length: len(keys)},
+        Values: tsLookupMap{KeyPrefix: prefix + "m"},
+    }
+}
+
+func (w *stateWriter) state() *State {
+    s := &State{Items: make([]StateItem, 0, len(w.items))}
+    for k, v := range w.items {
+        s.Items = append(s.Items, StateItem{Key: []byte(k), Value: v})
+    }
+    sort.Slice(s.Items, func(i, j int) bool { return bytes.Compare(s.Items[i].Key, s.Items[j].Key) < 0 })
+    return s
+}
+
+// contract object, field names match class Db3Contract
+type tsContract struct {
+    Version               int            `json:"version,omitempty"`
+    Owner                 near.AccountID `json:"owner"`
+    NextId                DBId           `json:"next_id"`
+    DbOwners              tsUnorderedMap `json:"db_owners"`
+    DbManifests           tsUnorderedMap `json:"db_manifests"`
+    DbVersions            tsLookupMap    `json:"db_versions"`
+    DbQueryVersions       tsLookupMap    `json:"db_query_versions"`
+    DbPendingOwners       tsLookupMap    `json:"db_pending_owners"`
+    DbRoyaltySplits       tsLookupMap    `json:"db_royalty_splits"`
+    DbParents             tsLookupMap    `json:"db_parents"`
+    DbStatus              tsLookupMap    `json:"db_status"`
+    DbStorageDeposits     tsLookupMap    `json:"db_storage_deposits"`
+    DbStoragePayers       tsLookupMap    `json:"db_storage_payers"`
+    DbStorageCharges      tsUnorderedMap `json:"db_storage_charges"`
+    DbApiRegistry         tsUnorderedMap `json:"db_api_registry"`
+    DbAccess              tsLookupMap    `json:"db_access"`
+    DbAllowlists          tsUnorderedMap `json:"db_allowlists"`
+    DbDeposits            tsLookupMap    `json:"db_deposits"`
+    DbTtls                tsUnorderedMap `json:"db_ttls"`
+    DbPendingVotes        tsUnorderedMap `json:"db_pending_votes"`
+    DbPendingFees         tsLookupMap    `json:"db_pending_fees"`
+    DbSettledFees         tsLookupMap    `json:"db_settled_fees"`
+    DbSettledRoyalties    tsLookupMap    `json:"db_settled_royalties"`
+    DbQuorums             tsLookupMap    `json:"db_quorums"`
+    DbPayments            tsUnorderedMap `json:"db_payments"`
+    DbCommittees          tsUnorderedMap `json:"db_committees"`
+    DbReceipts            tsUnorderedMap `json:"db_receipts"`
+    DbClaims              tsUnorderedMap `json:"db_claims"`
+    DbFeeTokens           tsLookupMap    `json:"db_fee_tokens"`
+    DbJoins               tsLookupMap    `json:"db_joins"`
+    DbOutcomes            tsLookupMap    `json:"db_outcomes"`
+    DbQueryUses           tsLookupMap    `json:"db_query_uses"`
+    DbUsage               tsLookupMap    `json:"db_usage"`
+    SigningKeys           tsLookupMap    `json:"signing_keys"`
+    StorageBalances       tsLookupMap    `json:"storage_balances"`
+    TokenSettledFees      tsLookupMap    `json:"token_settled_fees"`
+    TokenSettledRoyalties tsLookupMap    `json:"token_settled_royalties"`
+    TokenSlashed          tsLookupMap    `json:"token_slashed"`
+    DbSlashed             string         `json:"db_slashed"`
+    IdxAuthor             tsLookupMap    `json:"idx_author"`
+    IdxLicense            tsLookupMap    `json:"idx_license"`
+    IdxTag                tsLookupMap    `json:"idx_tag"`
+    IdxFork               tsLookupMap    `json:"idx_fork"`
+    Clock                 *tsBlockClock  `json:"clock,omitempty"`
+
+    // Go model only
+    Params         *Params                   `json:"params,omitempty"`
+    Council        []near.AccountID          `json:"council,omitempty"`
+    Threshold      int                       `json:"threshold,omitempty"`
+    TimeLock       int64                     `json:"time_lock,omitempty"`
+    NextProposalId ProposalId                `json:"next_proposal_id,omitempty"`
+    TotalInflows   string                    `json:"total_inflows,omitempty"`
+    TotalOutflows  string                    `json:"total_outflows,omitempty"`
+    TokenInflows   map[near.AccountID]string `json:"token_inflows,omitempty"`
+    TokenOutflows  map[near.AccountID]string `json:"token_outflows,omitempty"`
+    Proposals      tsLookupMap               `json:"proposals"`
+    Epochs         tsLookupMap               `json:"epochs"`
+    Vesting        tsLookupMap               `json:"vesting"`
+}
+
+type tsManifest struct {
+    Author      near.AccountID `json:"author_id"`
+    Name        string         `json:"name"`
+    License     string         `json:"license"`
+    CID         CodeCID        `json:"code_cid"`
+    RoyaltyBips jsonInt        `json:"royalty_bips"`
+    Tags        []string       `json:"tags"`
+    MinQuorum   jsonInt        `json:"min_quorum,omitempty"`
+    MaxQuorum   jsonInt        `json:"max_quorum,omitempty"`
+
+    ForkRoyaltyBips jsonInt `json:"fork_royalty_bips,omitempty"`
+
+    NonCommercialRoyaltyBips jsonInt `json:"non_commercial_royalty_bips,omitempty"`
+    Attribution              string  `json:"attribution,omitempty"`
+    UsageCap                 jsonInt `json:"usage_cap,omitempty"`
+
+    AuthorKey near.Pubkey    `json:"author_key,omitempty"`
+    Signature near.Signature `json:"signature,omitempty"`
+}
+
+func toTsManifest(m Manifest) tsManifest {
+    return tsManifest{
+        Author:      m.Author,
+        Name:        m.Name,
+        License:     m.License,
+        CID:         m.CID,
+        RoyaltyBips: jsonInt(m.RoyaltyBips),
+        Tags:        m.Tags,
+        MinQuorum:   jsonInt(m.MinQuorum),
+        MaxQuorum:   jsonInt(m.MaxQuorum),
+
+        ForkRoyaltyBips: jsonInt(m.ForkRoyaltyBips),
+
+        NonCommercialRoyaltyBips: jsonInt(m.NonCommercialRoyaltyBips),
+        Attribution:              m.Attribution,
+        UsageCap:                 jsonInt(m.UsageCap),
+
+        AuthorKey: m.AuthorKey,
+        Signature: m.Signature,
+    }
+}
+
+func (m tsManifest) manifest() Manifest {
+    res := Manifest{
+        Author:      m.Author,
+        Name:        m.Name,
+        License:     m.License,
+        CID:         m.CID,
+        RoyaltyBips: int(m.RoyaltyBips),
+        MinQuorum:   int(m.MinQuorum),
+        MaxQuorum:   int(m.MaxQuorum),
+
+        ForkRoyaltyBips: int(m.ForkRoyaltyBips),
+
+        NonCommercialRoyaltyBips: int(m.NonCommercialRoyaltyBips),
+        Attribution:              m.Attribution,
+        UsageCap:                 int(m.UsageCap),
+
+        AuthorKey: m.AuthorKey,
+        Signature: m.Signature,
+    }
+    if len(m.Tags) > 0 {
+        res.Tags = m.Tags
+    }
+    return res
+}
+
+type tsManifestVersion struct {
+    Version          int        `json:"version"`
+    Manifest         tsManifest `json:"manifest"`
+    ActivationHeight jsonInt    `json:"activation_height"`
+}
+
+type tsOutcome struct {
+    Qid       QueryCID         `json:"qid"`
+    Height    jsonInt          `json:"height"`
+    Version   int              `json:"version"`
+    Token     near.AccountID   `json:"token"`
+    Fee       string           `json:"fee"`
+    Royalty   string           `json:"royalty"`
+    Quorum    int              `json:"quorum"`
+    Status    string           `json:"status"`
+    Winner    ResultCID        `json:"winner"`
+    Tallies   []tsTally        `json:"tallies"`
+    Majority  []near.AccountID `json:"majority"`
+    Minority  []near.AccountID `json:"minority"`
+    Ignored   []near.AccountID `json:"ignored"`
+    FeeShares []tsPayout       `json:"fee_shares"`
+    Pooled    string           `json:"pooled"`
+    Refunds   []tsPayout       `json:"refunds"`
+    Slashes   []tsPayout       `json:"slashes"`
+    Rewards   []tsPayout       `json:"rewards"`
+    Dust      string           `json:"dust"`
+}
+
+type tsTally struct {
+    Rid   ResultCID `json:"rid"`
+    Votes int       `json:"votes"`
+}
+
+type tsPayout struct {
+    Account near.AccountID `json:"account_id"`
+    Amount  string         `json:"amount"`
+}
+
+// toTsOutcome encodes fee amounts in the fee token, slashes and slash
+// rewards are always paid from NEAR deposits
+func toTsOutcome(out ElectionOutcome) tsOutcome {
+    amount := func(v near.Money) string {
+        if out.Token != "" {
+            return tokenAmount(v)
+        }
+        return v.Yocto()
+    }
+    payouts := func(list []Payout, amount func(near.Money) string) []tsPayout {
+        if list == nil {
+            return nil
+        }
+        res := make([]tsPayout, 0, len(list))
+        for _, v := range list {
+            res = append(res, tsPayout{Account: v.Account, Amount: amount(v.Amount)})
+        }
+        return res
+    }
+    res := tsOutcome{
+        Qid:       out.Qid,
+        Height:    jsonInt(out.Height),
+        Version:   out.Version,
+        Token:     out.Token,
+        Fee:       amount(out.Fee),
+        Royalty:   amount(out.Royalty),
+        Quorum:    out.Quorum,
+        Status:    out.Status.String(),
+        Winner:    out.Winner,
+        Majority:  out.Majority,
+        Minority:  out.Minority,
+        Ignored:   out.Ignored,
+        FeeShares: payouts(out.FeeShares, amount),
+        Pooled:    amount(out.Pooled),
+        Refunds:   payouts(out.Refunds, amount),
+        Slashes:   payouts(out.Slashes, near.Money.Yocto),
+        Rewards:   payouts(out.Rewards, near.Money.Yocto),
+        Dust:      amount(out.Dust),
+    }
+    for _, v := range out.Tallies {
+        res.Tallies = append(res.Tallies, tsTally{Rid: v.Rid, Votes: v.Votes})
+    }
+    return res
+}
+
+func (v tsOutcome) outcome() (ElectionOutcome, error) {
+    var err error
+    parse := func(s string, token near.AccountID) near.Money {
+        var m near.Money
+        var e error
+        if token != "" {
+            var u uint64
+            u, e = strconv.ParseUint(s, 10, 64)
+            m = near.Money(u)
+        } else {
+            m, e = near.ParseYocto(s)
+        }
+        if e != nil && err == nil {
+            err = fmt.Errorf("outcome %s: %v", v.Qid, e)
+        }
+        return m
+    }
+    payouts := func(list []tsPayout, token near.AccountID) []Payout {
+        if len(list) == 0 {
+            return nil
+        }
+        res := make([]Payout, 0, len(list))
+        for _, p := range list {
+            res = append(res, Payout{Account: p.Account, Amount: parse(p.Amount, token)})
+        }
+        return res
+    }
+    status, serr := parseOutcomeStatus(v.Status)
+    if serr != nil {
+        return ElectionOutcome{}, serr
+    }
+    out := ElectionOutcome{
+        Qid:       v.Qid,
+        Height:    int64(v.Height),
+        Version:   v.Version,
+        Token:     v.Token,
+        Fee:       parse(v.Fee, v.Token),
+        Royalty:   parse(v.Royalty, v.Token),
+        Quorum:    v.Quorum,
+        Status:    status,
+        Winner:    v.Winner,
+        FeeShares: payouts(v.FeeShares, v.Token),
+        Pooled:    parse(v.Pooled, v.Token),
+        Refunds:   payouts(v.Refunds, v.Token),
+        Slashes:   payouts(v.Slashes, ""),
+        Rewards:   payouts(v.Rewards, ""),
+        Dust:      parse(v.Dust, v.Token),
+    }
+    if len(v.Majority) > 0 {
+        out.Majority = v.Majority
+    }
+    if len(v.Minority) > 0 {
+        out.Minority = v.Minority
+    }
+    if len(v.Ignored) > 0 {
+        out.Ignored = v.Ignored
+    }
+    for _, t := range v.Tallies {
+        out.Tallies = append(out.Tallies, ResultTally{Rid: t.Rid, Votes: t.Votes})
+    }
+    return out, err
+}
+
+type tsBlockClock struct {
+    Height    jsonInt `json:"height"`
+    Timestamp jsonInt `json:"timestamp"`
+    BlockTime jsonInt `json:"block_time"`
+}
+
+type tsJoinShare struct {
+    Dbid jsonInt `json:"dbid"`
+    Bips jsonInt `json:"bips"`
+}
+
+type tsRoyaltyShare struct {
+    Account near.AccountID `json:"account_id"`
+    Bips    jsonInt        `json:"bips"`
+}
+
+type tsForkLink struct {
+    Parent      string  `json:"parent"`
+    RoyaltyBips jsonInt `json:"royalty_bips"`
+}
+
+// access policy, the minimum balance is counted in base units of the gate
+type tsAccessPolicy struct {
+    Private    bool           `json:"private"`
+    Gate       near.AccountID `json:"gate"`
+    Standard   string         `json:"standard"`
+    MinBalance string         `json:"min_balance"`
+}
+
+type tsAccessGrant struct {
+    Expires jsonInt        `json:"expires"`
+    Payer   near.AccountID `json:"payer"`
+}
+
+type tsDatabaseStatus struct {
+    Status       string  `json:"status"`
+    SunsetHeight jsonInt `json:"sunset_height"`
+}
+
+type tsReceipt struct {
+    User near.AccountID `json:"user"`
+    Rid  ResultCID      `json:"rid"`
+}
+
+type tsClaim struct {
+    Claimant near.AccountID `json:"claimant"`
+    Query    string         `json:"query"`
+    Deadline jsonInt        `json:"deadline"`
+}
+
+type tsStorageBalance struct {
+    Total     string `json:"total"`
+    Available string `json:"available"`
+}
+
+// jsonInt is an integer the contract stores as string, numbers are accepted
+// when decoding because some values are stored as passed by the caller
+type jsonInt int64
+
+func (i jsonInt) MarshalJSON() ([]byte, error) {
+    return []byte(strconv.Quote(strconv.FormatInt(int64(i), 10))), nil
+}
+
+func (i *jsonInt) UnmarshalJSON(buf []byte) error {
+    v, err := strconv.ParseInt(strings.Trim(string(buf), `"`), 10, 64)
+    if err != nil {
+        return err
+    }
+    *i = jsonInt(v)
+    return nil
+}
+
+// marshal encodes like JSON.stringify without escaping HTML characters
+func marshal(v interface{}) ([]byte, error) {
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    enc.SetEscapeHTML(false)
+    if err := enc.Encode(v); err != nil {
+        return nil, err
+    }
+    return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func parseStatus(s string) (DBStatus, error) {
+    for _, v := range []DBStatus{StatusActive, StatusPaused, StatusDeprecated, StatusRetired} {
+        if v.String() == s {
+            return v, nil
+        }
+    }
+    return 0, fmt.Errorf("invalid database status %q", s)
+}
+
+func parseUse(s string) (Use, error) {
+    for _, v := range []Use{UseCommercial, UseNonCommercial} {
+        if v.String() == s {
+            return v, nil
+        }
+    }
+    return 0, fmt.Errorf("invalid query use %q", s)
+}
+
+func parseOutcomeStatus(s string) (OutcomeStatus, error) {
+    for _, v := range []OutcomeStatus{OutcomeUnpaid, OutcomeRefunded, OutcomeUnanimous, OutcomeSuperMajority, OutcomeNoMajority} {
+        if v.String() == s {
+            return v, nil
+        }
+    }
+    return 0, fmt.Errorf("invalid outcome status %q", s)
+}
+
+func parseAmount(buf []byte) (near.Money, error) {
+    var s string
+    if err := json.Unmarshal(buf, &s); err != nil {
+        return 0, err
+    }
+    return near.ParseYocto(s)
+}
+
+// parseTokenAmount decodes an amount in token base units
+func parseTokenAmount(buf []byte) (near.Money, error) {
+    var s string
+    if err := json.Unmarshal(buf, &s); err != nil {
+        return 0, err
+    }
+    v, err := strconv.ParseUint(s, 10, 64)
+    return near.Money(v), err
+}
+
+// tokenAmount formats an amount in token base units
+func tokenAmount(v near.Money) string {
+    return strconv.FormatUint(uint64(v), 10)
+}
+
+// queryAmount formats a pending fee or payment in the query's fee token
+func (d *DB3) queryAmount(dbid DBId, qid QueryCID, v near.Money) string {
+    if d.FeeTokens[dbid][qid] != "" {
+        return tokenAmount(v)
+    }
+    return v.Yocto()
+}
+
+func makekey(args ...string) string {
+    return strings.Join(args, KEY_SEPARATOR)
+}
+
+func dbkey(dbid DBId) string {
+    return strconv.FormatUint(uint64(dbid), 10)
+}
+
+func dbkeys(ids []DBId) []string {
+    res := make([]string, 0, len(ids))
+    for _, v := range ids {
+        res = append(res, dbkey(v))
+    }
+    return res
+}
+
+func parseDbkey(s string) (DBId, error) {
+    id, err := strconv.ParseUint(s, 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("invalid database id %q", s)
+    }
+    return DBId(id), nil
+}
+
+// parseDbkeys decodes an index list and keeps ids in ascending order
+func parseDbkeys(buf []byte) ([]DBId, error) {
+    var keys []string
+    if err := json.Unmarshal(buf, &keys); err != nil {
+        return nil, err
+    }
+    ids := make([]DBId, 0, len(keys))
+    for _, k := range keys {
+        id, err := parseDbkey(k)
+        if err != nil {
+            return nil, err
+        }
+        ids = insert(ids, id)
+    }
+    return ids, nil
+}
+
+// parseAccountKey splits a dbid#account key
+func parseAccountKey(key string) (DBId, near.AccountID, error) {
+    parts := strings.SplitN(key, KEY_SEPARATOR, 2)
+    if len(parts) != 2 {
+        return 0, "", fmt.Errorf("invalid account key %q", key)
+    }
+    dbid, err := parseDbkey(parts[0])
+    return dbid, near.AccountID(parts[1]), err
+}
+
+// parseTokenKey splits a token#account key
+func parseTokenKey(key string) (near.AccountID, near.AccountID, error) {
+    parts := strings.SplitN(key, KEY_SEPARATOR, 2)
+    if len(parts) != 2 {
+        return "", "", fmt.Errorf("invalid token key %q", key)
+    }
+    return near.AccountID(parts[0]), near.AccountID(parts[1]), nil
+}
+
+// parseQueryKey splits a dbid#qid key
+func parseQueryKey(key string) (DBId, QueryCID, error) {
+    parts := strings.SplitN(key, KEY_SEPARATOR, 2)
+    if len(parts) != 2 {
+        return 0, "", fmt.Errorf("invalid query key %q", key)
+    }
+    dbid, err := parseDbkey(parts[0])
+    return dbid, QueryCID(parts[1]), err
+}
+
+// parseVoteKey splits a dbid#qid#account key
+func parseVoteKey(key string) (DBId, QueryCID, near.AccountID, error) {
+    parts := strings.SplitN(key, KEY_SEPARATOR, 3)
+    if len(parts) != 3 {
+        return 0, "", "", fmt.Errorf("invalid vote key %q", key)
+    }
+    dbid, err := parseDbkey(parts[0])
+    return dbid, QueryCID(parts[1]), near.AccountID(parts[2]), err
+}
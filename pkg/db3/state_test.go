@@ -0,0 +1,163 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "encoding/json"
+    "github.com/stretchr/testify/assert"
+    "testing"
+    "time"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// newStateDB3 builds a contract touching every part of the state
+func newStateDB3() *DB3 {
+    setCtx(OWNER, PK, 0, 10)
+    db := newTestDB3()
+    db.Params.EpochBlocks = 2
+    db.Params.VestingBlocks = 10
+    db.SetupCouncil([]near.AccountID{MEMBER_A, MEMBER_B}, 2, 10)
+    setCtx(MEMBER_A, PK, 0, 10)
+    db.Propose(Proposal{Kind: ProposalRecover, Amount: 1, Target: MEMBER_A})
+
+    setCtx(CALLER, PK, 100, 10)
+    id := deployTestDb(db, Manifest{Name: "Hello <NEAR>", License: "MIT", CID: "cid-0", RoyaltyBips: 1000, Tags: []string{"near"}, ForkRoyaltyBips: 500,
+        NonCommercialRoyaltyBips: 200, Attribution: "Hello NEAR", UsageCap: 10})
+    db.Upgrade(id, m2)
+    db.SetRoyaltySplit(id, []RoyaltyShare{{CALLER, 6000}, {USER, 4000}})
+    db.ProposeOwner(id, USER)
+    setCtx(CALLER, AUTHOR_PK, 0, 10)
+    db.RegisterAuthorKey()
+    deployTestDb(db, signedM1)
+    setCtx(CALLER, PK, 100, 10)
+    paused := deployTestDb(db, m1)
+    db.Pause(paused)
+    deprecated := deployTestDb(db, m1)
+    db.Deprecate(deprecated, 1000)
+    fork := forkTestDb(db, id, m1)
+    db.SetAccessPolicy(deprecated, AccessPolicy{Private: true, Gate: TOKEN, Standard: GateFungibleToken, MinBalance: 5})
+    db.AllowUsers(deprecated, []near.AccountID{USER, NO_CALLER})
+
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+    db.Register(id, "http://localhost:8000")
+    setClock(USER, 1000, 10, time.Hour)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    db.EscrowFee(id, QID_2, 12, 0)
+    db.EscrowFee(id, "qid-4", 15, 0)
+    db.EscrowFeeFor(id, "qid-6", 20, 0, UseNonCommercial)
+    db.EscrowJoinFee("qid-5", 20, 0, []JoinShare{{id, 6000}, {fork, 4000}})
+    setCtx(TOKEN, PK, 0, 10)
+    db.FtOnTransfer(USER, 250000, `{"dbid":"0","qid":"qid-3","ttl":20}`)
+    setCtx(CALLER, PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    db.Settle(id, QID_2, "rid-2")
+    db.Settle(id, "qid-4", "rid-4")
+    setCtx(USER, PK, 0, 11)
+    db.SignReceipt(id, "qid-1", CALLER, "rid-1")
+    db.FileClaim(id, QID_2, CALLER, "SELECT 2")
+    setCtx(CALLER, PK, 0, 12)
+    db.Finalize()
+    setCtx(CALLER, PK, 0, 15)
+    db.ClaimRoyalties()
+    db.EventLog = nil
+    return db
+}
+
+func TestStateRoundTrip(t *testing.T) {
+    db := newStateDB3()
+    s, err := db.State()
+    assert.NoError(t, err, "encode")
+
+    buf, err := json.Marshal(s)
+    assert.NoError(t, err, "json encode")
+    var s2 State
+    assert.NoError(t, json.Unmarshal(buf, &s2), "json decode")
+    assert.Equal(t, s2, *s, "json round trip")
+
+    buf, err = s.MarshalBorsh()
+    assert.NoError(t, err, "borsh encode")
+    var s3 State
+    assert.NoError(t, s3.UnmarshalBorsh(buf), "borsh decode")
+    assert.Equal(t, s3, *s, "borsh round trip")
+
+    db2, err := LoadState(&s3)
+    assert.NoError(t, err, "load")
+    assert.Equal(t, db2, db, "model round trip")
+}
+
+func TestStateLayout(t *testing.T) {
+    setCtx(CALLER, PK, 100, 10)
+    db := newTestDB3()
+    deployTestDb(db, m1)
+    s, err := db.State()
+    assert.NoError(t, err, "encode")
+
+    items := make(map[string]string)
+    for _, v := range s.Items {
+        items[string(v.Key)] = string(v.Value)
+    }
+    assert.Equal(t, items["map-dbid-ownerm0"], `["\"sender.near\"",0]`, "unordered map value")
+    assert.Equal(t, items["map-dbid-owneru\x00\x00\x00\x00"], `"0"`, "unordered map key vector")
+    assert.Equal(t, items["map-dbid-storage-deposit0"], `"1000000000000000000000000"`, "lookup map value")
+    assert.Contains(t, items[STATE_KEY], `"db_owners":{"prefix":"map-dbid-owner","keys":{"prefix":"map-dbid-owneru","length":1},"values":{"keyPrefix":"map-dbid-ownerm"}}`, "collection descriptor")
+}
+
+// state as written by the on-chain contract
+var onchainState = map[string]string{
+    STATE_KEY: `{"owner":"echa.testnet","next_id":1,"db_slashed":"2500000000000000000000000",` +
+        `"db_owners":{"prefix":"map-dbid-owner","keys":{"prefix":"map-dbid-owneru","length":1},"values":{"keyPrefix":"map-dbid-ownerm"}}}`,
+    "map-dbid-ownerm0":                                 `["\"echa.testnet\"",0]`,
+    "map-dbid-owneru\x00\x00\x00\x00":                  `"0"`,
+    "map-dbid-manifestm0":                              `["{\"author_id\":\"echa.testnet\",\"name\":\"Hello NEAR\",\"license\":\"MIT\",\"code_cid\":\"cid-0\",\"royalty_bips\":\"1000\"}",0]`,
+    "map-dbid-versions0":                               `[{"version":0,"manifest":{"author_id":"echa.testnet","name":"Hello NEAR","license":"MIT","code_cid":"cid-0","royalty_bips":"1000"},"activation_height":"100"}]`,
+    "map-dbid-deposit0#node1.testnet":                  `"10000000000000000000000000"`,
+    "map-dbid-apim0#node1.testnet":                     `["\"http://localhost:8000\"",0]`,
+    "map-dbid-pending-fees0#query-1":                   `"1000000000000000000000000"`,
+    "map-dbid-ttlm0#query-1":                           `["100112999",0]`,
+    "map-dbid-pending-resultsm0#query-1#node1.testnet": `["\"result-1\"",0]`,
+    "map-dbid-query-versions0#query-1":                 `0`,
+    "idx-author-dbidsecha.testnet":                     `["0"]`,
+}
+
+func TestLoadOnchainState(t *testing.T) {
+    s := &State{}
+    for k, v := range onchainState {
+        s.Items = append(s.Items, StateItem{Key: []byte(k), Value: []byte(v)})
+    }
+    db, err := LoadState(s)
+    assert.NoError(t, err, "load")
+    assert.Equal(t, db.Owner, near.AccountID("echa.testnet"), "owner")
+    assert.Equal(t, db.NextId, DBId(1), "next id")
+    assert.Equal(t, db.Slashed, near.Money(2500), "slashed in model units")
+    assert.Equal(t, db.Params, DefaultParams(), "default params")
+    assert.Equal(t, db.Manifests[0].RoyaltyBips, 1000, "royalty")
+    assert.Equal(t, db.Deposits[0]["node1.testnet"], near.Money(SECURITY_DEPOSIT), "deposit")
+    assert.Equal(t, db.ApiRegistry[0]["node1.testnet"], ApiEndpoint("http://localhost:8000"), "registry")
+    assert.Equal(t, db.ResultTTL[0]["query-1"], int64(100112999), "numeric ttl")
+    assert.Equal(t, db.AuthorIndex["echa.testnet"], []DBId{0}, "index")
+
+    // what-if finalization
+    setCtx(CALLER, PK, 0, 100112999)
+    db.Finalize()
+    assert.Equal(t, db.SettledFees["node1.testnet"], near.Money(900), "host fee")
+    assert.Equal(t, db.SettledRoyalties["echa.testnet"], near.Money(100), "royalty")
+    assert.Empty(t, db.PendingFees[0], "query finalized")
+}
+
+func TestLoadStateFail(t *testing.T) {
+    _, err := LoadState(&State{})
+    assert.Error(t, err, "missing contract object")
+    _, err = LoadState(&State{Items: []StateItem{
+        {Key: []byte(STATE_KEY), Value: []byte(`{"next_id":1}`)},
+        {Key: []byte("map-dbid-deposit0"), Value: []byte(`"1"`)},
+    }})
+    assert.Error(t, err, "malformed key")
+    _, err = LoadState(&State{Items: []StateItem{
+        {Key: []byte(STATE_KEY), Value: []byte(`{"next_id":1}`)},
+        {Key: []byte("map-dbid-deposit0#a.near"), Value: []byte(`"-1"`)},
+    }})
+    assert.Error(t, err, "negative amount")
+}
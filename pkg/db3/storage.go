@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// NEP-145 storage balance of an account
+type StorageBalance struct {
+    Total     near.Money `json:"total,string"`
+    Available near.Money `json:"available,string"`
+}
+
+// NEP-145 storage balance bounds, a zero max means unbounded
+type StorageBalanceBounds struct {
+    Min near.Money `json:"min,string"`
+    Max near.Money `json:"max,string"`
+}
+
+// Registers an account and adds attached funds to its storage balance,
+// an empty account registers the caller
+// Called by: anyone
+func (d *DB3) StorageDeposit(account near.AccountID) StorageBalance {
+    if account == "" {
+        account = ctx.Caller
+    }
+    bal, ok := d.StorageBalances[account]
+    if !ok && ctx.Amount < STORAGE_ENTRY_COST {
+        panic("Storage deposit below minimum balance")
+    }
+    amount := d.receive()
+    if !ok {
+        // charge the balance record itself
+        bal.Total = amount
+        bal.Available = amount - STORAGE_ENTRY_COST
+    } else {
+        bal.Total += amount
+        bal.Available += amount
+    }
+    d.StorageBalances[account] = bal
+    return bal
+}
+
+// Withdraws available storage balance, a zero amount withdraws everything
+// Called by: anyone
+func (d *DB3) StorageWithdraw(amount near.Money) StorageBalance {
+    bal, ok := d.StorageBalances[ctx.Caller]
+    if !ok {
+        panic("Account is not registered")
+    }
+    if amount == 0 {
+        amount = bal.Available
+    }
+    if amount > bal.Available {
+        panic("Amount is larger than available storage balance")
+    }
+    bal.Total -= amount
+    bal.Available -= amount
+    d.StorageBalances[ctx.Caller] = bal
+    if amount > 0 {
+        d.transfer(ctx.Caller, amount)
+    }
+    return bal
+}
+
+// Unregisters the caller and refunds the full storage balance. Fails
+// while the account still occupies contract storage.
+// Called by: anyone
+func (d *DB3) StorageUnregister() bool {
+    bal, ok := d.StorageBalances[ctx.Caller]
+    if !ok {
+        return false
+    }
+    if bal.Total-bal.Available > STORAGE_ENTRY_COST {
+        panic("Account still uses contract storage")
+    }
+    delete(d.StorageBalances, ctx.Caller)
+    d.transfer(ctx.Caller, bal.Total)
+    return true
+}
+
+// Views the storage balance of an account
+// Called by: anyone
+func (d *DB3) StorageBalanceOf(account near.AccountID) StorageBalance {
+    return d.StorageBalances[account]
+}
+
+// Views storage balance bounds
+// Called by: anyone
+func (d *DB3) StorageBalanceBounds() StorageBalanceBounds {
+    return StorageBalanceBounds{Min: STORAGE_ENTRY_COST}
+}
+
+// chargeStorage locks storage balance for newly inserted map entries
+func (d *DB3) chargeStorage(account near.AccountID, entries int) near.Money {
+    cost := near.Money(STORAGE_ENTRY_COST).Mul(entries)
+    bal, ok := d.StorageBalances[account]
+    if !ok || bal.Available < cost {
+        panic("Insufficient storage balance")
+    }
+    bal.Available -= cost
+    d.StorageBalances[account] = bal
+    return cost
+}
+
+// refundStorage unlocks storage balance for deleted map entries, entries
+// migrated from state without storage accounting were never charged so
+// refunds stop at the cost of the balance record
+func (d *DB3) refundStorage(account near.AccountID, cost near.Money) {
+    bal, ok := d.StorageBalances[account]
+    if !ok {
+        return
+    }
+    bal.Available += cost
+    if max := bal.Total - STORAGE_ENTRY_COST; bal.Available > max {
+        bal.Available = max
+    }
+    d.StorageBalances[account] = bal
+}
+
+// chargeQueryStorage locks storage for pending query entries which are
+// refunded on finalization
+func (d *DB3) chargeQueryStorage(dbid DBId, qid QueryCID, entries int) {
+    d.chargeQueryStorageTo(dbid, qid, ctx.Caller, entries)
+}
+
+// chargeQueryStorageTo locks storage of an account other than the caller,
+// e.g. the sender of a token transfer
+func (d *DB3) chargeQueryStorageTo(dbid DBId, qid QueryCID, account near.AccountID, entries int) {
+    cost := d.chargeStorage(account, entries)
+    if _, ok := d.StorageCharges[dbid][qid]; !ok {
+        d.StorageCharges[dbid][qid] = make(map[near.AccountID]near.Money)
+    }
+    d.StorageCharges[dbid][qid][account] += cost
+}
+
+// refundQueryStorage unlocks all storage charged for a pending query
+func (d *DB3) refundQueryStorage(dbid DBId, qid QueryCID) {
+    for acc, cost := range d.StorageCharges[dbid][qid] {
+        d.refundStorage(acc, cost)
+    }
+    delete(d.StorageCharges[dbid], qid)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+func TestStorageDeposit(t *testing.T) {
+    setCtx(USER, PK, STORAGE_ENTRY_COST-1, 10)
+    db := NewDB3()
+    assert.Panics(t, func() { db.StorageDeposit("") }, "below minimum")
+    setCtx(USER, PK, 100, 10)
+    assert.Equal(t, db.StorageDeposit(""), StorageBalance{100, 100 - STORAGE_ENTRY_COST}, "registered")
+    assert.Equal(t, db.StorageDeposit(""), StorageBalance{200, 200 - STORAGE_ENTRY_COST}, "topped up")
+    setCtx(CALLER, PK, 50, 10)
+    db.StorageDeposit(USER)
+    assert.Equal(t, db.StorageBalanceOf(USER), StorageBalance{250, 250 - STORAGE_ENTRY_COST}, "deposit for other account")
+    assert.Equal(t, db.StorageBalanceBounds().Min, near.Money(STORAGE_ENTRY_COST), "bounds")
+
+    setCtx(USER, PK, 0, 10)
+    assert.Panics(t, func() { db.StorageWithdraw(1000) }, "too much")
+    assert.Equal(t, db.StorageWithdraw(40), StorageBalance{210, 210 - STORAGE_ENTRY_COST}, "partial withdraw")
+    assert.Equal(t, db.StorageWithdraw(0), StorageBalance{STORAGE_ENTRY_COST, 0}, "full withdraw")
+    assert.True(t, db.StorageUnregister(), "unregistered")
+    assert.False(t, db.StorageUnregister(), "not registered")
+    assert.Panics(t, func() { db.StorageWithdraw(0) }, "not registered")
+}
+
+func TestStorageCharges(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := NewDB3()
+    id := deployTestDb(db, m1)
+
+    // host needs storage to join
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    assert.Panics(t, func() { db.Deposit(id) }, "no storage balance")
+    setCtx(CALLER, PK, 100, 10)
+    db.StorageDeposit("")
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+    db.Register(id, "api")
+    db.Register(id, "api2")
+    assert.Equal(t, db.StorageBalanceOf(CALLER).Available, near.Money(100-3*STORAGE_ENTRY_COST), "deposit and registry charged once")
+
+    // user needs storage to escrow
+    setCtx(USER, PK, 1000, 10)
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-1", 20, 0) }, "no storage balance")
+    setCtx(USER, PK, 100, 10)
+    db.StorageDeposit("")
+    setCtx(USER, PK, 1000, 10)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    db.EscrowFee(id, "qid-1", 20, 0)
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, near.Money(100-5*STORAGE_ENTRY_COST), "fee, quorum, payment and committee charged once")
+    setCtx(USER, PK, 0, 10)
+    assert.Panics(t, func() { db.StorageUnregister() }, "storage in use")
+
+    setCtx(CALLER, PK, 0, 11)
+    db.Settle(id, "qid-1", "rid-1")
+    db.Settle(id, "qid-1", "rid-1")
+    assert.Equal(t, db.StorageBalanceOf(CALLER).Available, near.Money(100-4*STORAGE_ENTRY_COST), "vote charged once")
+
+    // finalization refunds query storage
+    setCtx(CALLER, PK, 0, 20)
+    db.finalizeResults()
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, near.Money(100-STORAGE_ENTRY_COST), "user refunded")
+    assert.Equal(t, db.StorageBalanceOf(CALLER).Available, near.Money(100-3*STORAGE_ENTRY_COST), "host refunded")
+    assert.Empty(t, db.StorageCharges[id], "charges cleaned up")
+
+    // unregister and withdraw refund host storage
+    db.Register(id, "")
+    db.Withdraw(id)
+    assert.Equal(t, db.StorageBalanceOf(CALLER).Available, near.Money(100-STORAGE_ENTRY_COST), "host fully refunded")
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "encoding/json"
+    "time"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+// Escrow arguments of a token fee payment, sent as ft_transfer_call msg
+type TokenEscrowMsg struct {
+    Dbid   jsonInt  `json:"dbid"`
+    Qid    QueryCID `json:"qid"`
+    TTL    jsonInt  `json:"ttl,omitempty"`
+    Quorum jsonInt  `json:"quorum,omitempty"`
+
+    // TTL as duration from now in milliseconds, used when ttl is missing
+    WithinMs jsonInt `json:"within_ms,omitempty"`
+
+    // databases joined by a cross-database query, the first must be dbid
+    Joins []tsJoinShare `json:"joins,omitempty"`
+
+    // pays the non-commercial royalty rate of the license
+    NonCommercial bool `json:"non_commercial,omitempty"`
+}
+
+// Pays a query fee in fungible tokens through ft_transfer_call. The caller
+// is the token contract, so any account can pretend to be a token and hosts
+// must check the fee token before serving a query. All fees of a query must
+// be paid in the same token. Failed escrows are refunded by the token.
+// Called by: NEP-141 token contract
+func (d *DB3) FtOnTransfer(sender near.AccountID, amount near.Money, msg string) near.Money {
+    var args TokenEscrowMsg
+    if err := json.Unmarshal([]byte(msg), &args); err != nil || args.Qid == "" {
+        panic("Invalid escrow message")
+    }
+    if args.Dbid < 0 {
+        panic("Database id does not exist")
+    }
+    token := ctx.Caller
+    var shares []JoinShare
+    for _, v := range args.Joins {
+        if v.Dbid < 0 {
+            panic("Database id does not exist")
+        }
+        shares = append(shares, JoinShare{Dbid: DBId(v.Dbid), Bips: int(v.Bips)})
+    }
+    ttl := int64(args.TTL)
+    if ttl == 0 && args.WithinMs > 0 {
+        d.observeClock()
+        ttl = d.TTLWithin(time.Duration(args.WithinMs) * time.Millisecond)
+    }
+    use := UseCommercial
+    if args.NonCommercial {
+        use = UseNonCommercial
+    }
+    d.escrow(DBId(args.Dbid), args.Qid, ttl, int(args.Quorum), sender, token, amount, shares, use)
+    d.TokenInflows[token] += amount
+    return 0
+}
+
+// Sends settled fees and royalties in a fungible token to claimer, the
+// balances are restored when the token transfer fails, e.g. because the
+// claimer is not registered with the token contract
+// Called by: host, developer
+func (d *DB3) ClaimTokens(token near.AccountID) {
+    // finalize all pending results
+    d.finalizeResults()
+
+    fees := d.SettledTokenFees[token][ctx.Caller]
+    royalties := d.SettledTokenRoyalties[token][ctx.Caller]
+    if fees+royalties == 0 {
+        return
+    }
+    if err := d.transferToken(token, ctx.Caller, fees+royalties); err != nil {
+        return
+    }
+    delete(d.SettledTokenFees[token], ctx.Caller)
+    delete(d.SettledTokenRoyalties[token], ctx.Caller)
+    if fees > 0 {
+        d.emit("fees_claimed", ClaimEvent{Account: ctx.Caller, Amount: fees, Token: token})
+    }
+    if royalties > 0 {
+        d.emit("royalties_claimed", ClaimEvent{Account: ctx.Caller, Amount: royalties, Token: token})
+    }
+}
+
+// creditFee credits a claimable fee in NEAR (empty token) or a fungible token
+func (d *DB3) creditFee(token, account near.AccountID, amount near.Money) {
+    if token == "" {
+        d.SettledFees[account] += amount
+        return
+    }
+    if _, ok := d.SettledTokenFees[token]; !ok {
+        d.SettledTokenFees[token] = make(map[near.AccountID]near.Money)
+    }
+    d.SettledTokenFees[token][account] += amount
+}
+
+// creditRoyalty credits a claimable royalty in NEAR (empty token) or a
+// fungible token
+func (d *DB3) creditRoyalty(token, account near.AccountID, amount near.Money) {
+    if token == "" {
+        d.SettledRoyalties[account] += amount
+        return
+    }
+    if _, ok := d.SettledTokenRoyalties[token]; !ok {
+        d.SettledTokenRoyalties[token] = make(map[near.AccountID]near.Money)
+    }
+    d.SettledTokenRoyalties[token][account] += amount
+}
+
+// transferToken sends fungible tokens out of the contract (ft_transfer)
+func (d *DB3) transferToken(token, target near.AccountID, amount near.Money) error {
+    if err := near.FtTransfer(token, CONTRACT_ID, target, amount, signer); err != nil {
+        return err
+    }
+    d.TokenOutflows[token] += amount
+    return nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+const TOKEN = "usdc.near"
+
+// ftEscrow pays a query fee through the token's ft_transfer_call
+func ftEscrow(db *DB3, ft *near.FungibleToken, sender near.AccountID, amount near.Money, msg string, height int64) (near.Money, error) {
+    setCtx(string(ft.Id), PK, 0, height)
+    return ft.TransferCall(sender, CONTRACT_ID, db, amount, msg)
+}
+
+func newTokenDB3() (*DB3, DBId, *near.FungibleToken) {
+    ft := near.NewFungibleToken(TOKEN)
+    ft.Mint(USER, 1000000)
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    setCtx(NO_CALLER, PK, SECURITY_DEPOSIT, 10)
+    db.Deposit(id)
+    return db, id, ft
+}
+
+func TestTokenEscrow(t *testing.T) {
+    db, id, ft := newTokenDB3()
+
+    // invalid escrows are refunded by the token contract
+    _, err := ftEscrow(db, ft, USER, 1000, `{"qid":`, 11)
+    assert.EqualError(t, err, "Invalid escrow message", "bad msg")
+    _, err = ftEscrow(db, ft, USER, 1000, `{"dbid":"7","qid":"qid-1","ttl":20}`, 11)
+    assert.EqualError(t, err, "Database id does not exist", "bad dbid")
+    assert.Equal(t, ft.BalanceOf(USER), near.Money(1000000), "refunded")
+
+    inflows := db.TotalInflows
+    used, err := ftEscrow(db, ft, USER, 300000, `{"dbid":"0","qid":"qid-1","ttl":20}`, 11)
+    assert.NoError(t, err, "escrow")
+    assert.Equal(t, used, near.Money(300000), "all tokens used")
+    assert.Equal(t, ft.BalanceOf(CONTRACT_ID), near.Money(300000), "contract balance")
+    assert.Equal(t, db.PendingFees[id]["qid-1"], near.Money(300000), "pending fee in token units")
+    assert.Equal(t, db.QueryPayments[id]["qid-1"][USER], near.Money(300000), "payment")
+    assert.Equal(t, db.FeeTokens[id]["qid-1"], near.AccountID(TOKEN), "fee token")
+    assert.Equal(t, filterEvents(db, "fee_escrowed")[0].Data, EscrowEvent{id, "qid-1", USER, 300000, TOKEN, 20, 1, false}, "escrow event")
+    assert.Equal(t, db.StorageBalanceOf(USER).Available, near.Money(1000-4*STORAGE_ENTRY_COST), "payer storage charged")
+    assert.Equal(t, db.TotalInflows, inflows, "no NEAR received")
+
+    // fees of a query are paid in a single token
+    setCtx(USER, PK, 100, 12)
+    assert.Panics(t, func() { db.EscrowFee(id, "qid-1", 20, 0) }, "NEAR after token")
+    setCtx(USER, PK, 100, 12)
+    db.EscrowFee(id, "qid-2", 20, 0)
+    _, err = ftEscrow(db, ft, USER, 1000, `{"dbid":"0","qid":"qid-2","ttl":20}`, 12)
+    assert.EqualError(t, err, "Fee token mismatch", "token after NEAR")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
+
+func TestTokenPayout(t *testing.T) {
+    db, id, ft := newTokenDB3()
+    ftEscrow(db, ft, USER, 300000, `{"dbid":"0","qid":"qid-1","ttl":20}`, 11)
+    ftEscrow(db, ft, USER, 50000, `{"dbid":0,"qid":"qid-2","ttl":20,"quorum":2}`, 11)
+    setCtx(USER, PK, 100, 11)
+    db.EscrowFee(id, "qid-3", 20, 0)
+    for _, h := range []string{CALLER, NO_CALLER} {
+        setCtx(h, PK, 0, 12)
+        db.Settle(id, "qid-1", "rid-1")
+        db.Settle(id, "qid-3", "rid-1")
+    }
+
+    // token fees are split like NEAR fees, unanswered queries are refunded
+    setCtx(CALLER, PK, 0, 20)
+    db.Finalize()
+    assert.Equal(t, db.SettledTokenRoyalties[TOKEN][CALLER], near.Money(30000), "token royalty")
+    assert.Equal(t, db.SettledTokenFees[TOKEN][CALLER], near.Money(135000), "token fee")
+    assert.Equal(t, db.SettledTokenFees[TOKEN][NO_CALLER], near.Money(135000), "token fee")
+    assert.Equal(t, db.SettledTokenFees[TOKEN][USER], near.Money(50000), "token refund")
+    assert.Equal(t, db.SettledFees[CALLER], near.Money(45), "NEAR fee")
+    assert.Empty(t, db.FeeTokens[id], "fee tokens cleaned up")
+    assert.Equal(t, filterEvents(db, "fee_refunded")[0].Data, PayoutEvent{id, "qid-2", USER, 50000, TOKEN}, "refund event")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+
+    // claims send one token at a time, NEAR balances stay
+    db.ClaimTokens(TOKEN)
+    assert.Equal(t, ft.BalanceOf(CALLER), near.Money(165000), "claimed tokens")
+    assert.Empty(t, db.SettledTokenFees[TOKEN][CALLER], "fees claimed")
+    assert.Empty(t, db.SettledTokenRoyalties[TOKEN][CALLER], "royalties claimed")
+    assert.Equal(t, db.SettledFees[CALLER], near.Money(45), "NEAR fee kept")
+    assert.Equal(t, filterEvents(db, "royalties_claimed")[0].Data, ClaimEvent{CALLER, 30000, TOKEN}, "claim event")
+    setCtx(USER, PK, 0, 21)
+    db.ClaimTokens(TOKEN)
+    assert.Equal(t, ft.BalanceOf(USER), near.Money(1000000-300000), "refund claimed")
+    assert.Equal(t, ft.BalanceOf(CONTRACT_ID), near.Money(135000), "contract balance")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+
+    // failed transfers keep the balance, here a fake token that cannot pay out
+    setCtx("fake.near", PK, 0, 22)
+    db.FtOnTransfer(USER, 1000, `{"dbid":"0","qid":"qid-4","ttl":30}`)
+    setCtx(USER, PK, 0, 30)
+    db.ClaimTokens("fake.near")
+    assert.Equal(t, db.SettledTokenFees["fake.near"][USER], near.Money(1000), "balance restored")
+    assert.NoError(t, db.CheckInvariants(), "books balance")
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+// Publishes a new code version that activates after a delay. Hosts must
+// migrate to the new code CID before the activation height. Queries are
+// bound to the version that is active when they are first seen, so results
+// settled around the activation height are judged against matching code.
+// Called by: developer
+func (d *DB3) Upgrade(dbid DBId, m Manifest) int {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    if ctx.Caller != d.Owners[dbid] {
+        panic("Must be database owner to upgrade")
+    }
+    validateManifest(m)
+    if m.Author == "" {
+        m.Author = d.ActiveVersion(dbid, ctx.Height).Manifest.Author
+    }
+    d.checkAuthor(m)
+
+    // discovery indexes the active and the pending version, drop both
+    // before the history changes
+    versions := d.ManifestVersions[dbid]
+    if len(versions) == 0 {
+        versions = []ManifestVersion{d.ActiveVersion(dbid, ctx.Height)}
+    }
+    d.unindexVersions(dbid, versions)
+
+    // replace an upgrade that has not activated yet
+    if last := versions[len(versions)-1]; last.ActivationHeight > ctx.Height {
+        versions = versions[:len(versions)-1]
+    }
+
+    v := ManifestVersion{
+        Version:          versions[len(versions)-1].Version + 1,
+        Manifest:         m,
+        ActivationHeight: ctx.Height + UPGRADE_DELAY_BLOCKS,
+    }
+    versions = append(versions, v)
+    d.ManifestVersions[dbid] = versions
+    d.indexVersions(dbid, versions)
+
+    // the published manifest follows the active version, the new version is
+    // only visible through Versions until it activates
+    d.Manifests[dbid] = d.ActiveVersion(dbid, ctx.Height).Manifest
+    d.emit("db_upgraded", UpgradeEvent{
+        Dbid:             dbid,
+        Version:          v.Version,
+        CodeCID:          m.CID,
+        ActivationHeight: v.ActivationHeight,
+    })
+
+    return v.Version
+}
+
+// Views all published code versions of a database
+// Called by: host
+func (d *DB3) Versions(dbid DBId) []ManifestVersion {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    return d.ManifestVersions[dbid]
+}
+
+// Views the code version that is active at the given block height
+// Called by: host
+func (d *DB3) ActiveVersion(dbid DBId, height int64) ManifestVersion {
+    if dbid >= d.NextId {
+        panic("Database id does not exist")
+    }
+    versions := d.ManifestVersions[dbid]
+    for i := len(versions) - 1; i > 0; i-- {
+        if versions[i].ActivationHeight <= height {
+            return versions[i]
+        }
+    }
+    if len(versions) == 0 {
+        // state without version history serves the stored manifest
+        return ManifestVersion{Manifest: d.Manifests[dbid]}
+    }
+    return versions[0]
+}
+
+// bindQueryVersion pins a query to the code version active at the current
+// height unless it was already bound by an earlier call
+func (d *DB3) bindQueryVersion(dbid DBId, qid QueryCID) {
+    if _, ok := d.QueryVersions[dbid][qid]; ok {
+        return
+    }
+    d.QueryVersions[dbid][qid] = d.ActiveVersion(dbid, ctx.Height).Version
+}
+
+// queryManifest returns the manifest version a query is judged against
+func (d *DB3) queryManifest(dbid DBId, qid QueryCID) Manifest {
+    v, ok := d.QueryVersions[dbid][qid]
+    if !ok {
+        return d.ActiveVersion(dbid, ctx.Height).Manifest
+    }
+    for _, mv := range d.ManifestVersions[dbid] {
+        if mv.Version == v {
+            return mv.Manifest
+        }
+    }
+    return d.Manifests[dbid]
+}
+
+func validateManifest(m Manifest) {
+    if m.RoyaltyBips < 0 || m.RoyaltyBips > 10000 {
+        panic("Royalty out of range")
+    }
+    if m.ForkRoyaltyBips < 0 || m.ForkRoyaltyBips > 10000 {
+        panic("Fork royalty out of range")
+    }
+    if m.CID == "" {
+        panic("Empty code CID")
+    }
+    if m.MinQuorum < 0 || m.MinQuorum > MAX_QUORUM || m.MaxQuorum < 0 || m.MaxQuorum > MAX_QUORUM {
+        panic("Quorum out of range")
+    }
+    if m.MaxQuorum > 0 && m.MaxQuorum < m.MinQuorum {
+        panic("Maximum quorum below minimum")
+    }
+    validateLicense(m)
+}
+
+// checkQuorum returns the votes a query requires, a zero request uses the
+// manifest minimum
+func checkQuorum(m Manifest, quorum int) int {
+    min, max := m.MinQuorum, m.MaxQuorum
+    if min == 0 {
+        min = 1
+    }
+    if max == 0 {
+        max = MAX_QUORUM
+    }
+    if quorum == 0 {
+        return min
+    }
+    if quorum < min || quorum > max {
+        panic("Quorum out of range")
+    }
+    return quorum
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package db3
+
+import (
+    "github.com/stretchr/testify/assert"
+    "testing"
+
+    "blockwatch.cc/db3-near/pkg/near"
+)
+
+var (
+    m2 = Manifest{
+        Name:        "Hello v2",
+        License:     "NOASSERTION",
+        CID:         "cid-2",
+        RoyaltyBips: 5000,
+    }
+)
+
+func TestUpgrade(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    assert.Len(t, db.Versions(id), 1, "initial version")
+
+    var v int
+    assert.NotPanics(t, func() { v = db.Upgrade(id, m2) }, "successful upgrade")
+    assert.Equal(t, v, 1, "version number")
+    assert.Len(t, db.Versions(id), 2, "version history")
+    assert.Equal(t, db.Versions(id)[1].ActivationHeight, int64(10+UPGRADE_DELAY_BLOCKS), "activation height")
+    assert.Equal(t, db.Versions(id)[1].Manifest.Author, m1.Author, "author is kept")
+    assert.Equal(t, db.ActiveVersion(id, 10).Version, 0, "old version active before activation")
+    assert.Equal(t, db.ActiveVersion(id, 10+UPGRADE_DELAY_BLOCKS).Version, 1, "new version active after activation")
+
+    // discovery shows the active version until the upgrade activates
+    assert.Equal(t, db.Manifests[id].CID, CodeCID("cid-1"), "pending manifest is not published")
+    assert.Equal(t, db.Databases()[id].CID, CodeCID("cid-1"), "databases show active code")
+    assert.Len(t, db.SearchDatabases(DatabaseFilter{Name: "v2"}, 0, 0), 0, "pending name not found")
+    assert.Len(t, db.SearchDatabases(DatabaseFilter{Author: m1.Author, Name: "Hello"}, 0, 0), 1, "active version found")
+    setCtx(CALLER, PK, 0, 10+UPGRADE_DELAY_BLOCKS)
+    assert.Equal(t, db.Databases()[id].CID, CodeCID("cid-2"), "activated code")
+    assert.Equal(t, ids(db.SearchDatabases(DatabaseFilter{Name: "v2"}, 0, 0)), []DBId{id}, "search finds new name")
+    setCtx(CALLER, PK, 0, 10)
+
+    // replace a pending upgrade
+    m3 := m2
+    m3.CID = "cid-3"
+    assert.Equal(t, db.Upgrade(id, m3), 1, "pending version is replaced")
+    assert.Len(t, db.Versions(id), 2, "no new history entry")
+    assert.Equal(t, db.Versions(id)[1].Manifest.CID, CodeCID("cid-3"), "replaced manifest")
+
+    // upgrade after activation appends
+    setCtx(CALLER, PK, 0, 10+UPGRADE_DELAY_BLOCKS)
+    assert.Equal(t, db.Upgrade(id, m1), 2, "next version")
+    assert.Len(t, db.Versions(id), 3, "version history grows")
+    assert.Equal(t, db.Manifests[id].CID, CodeCID("cid-3"), "manifest follows activation")
+
+    // indexes keep the active and the pending version only
+    assert.Equal(t, db.LicenseIndex["NOASSERTION"], []DBId{id}, "license indexed once")
+    assert.Len(t, db.SearchDatabases(DatabaseFilter{Name: "v2"}, 0, 0), 1, "active version still found")
+}
+
+func TestUpgradeNoHistory(t *testing.T) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    delete(db.ManifestVersions, id)
+
+    assert.Equal(t, db.ActiveVersion(id, 10).Manifest.CID, m1.CID, "stored manifest is active")
+    setCtx(USER, PK, 1000, 10)
+    assert.NotPanics(t, func() { db.EscrowFee(id, "qid-1", 20, 0) }, "escrow")
+    setCtx(CALLER, PK, 0, 10)
+    assert.Equal(t, db.Upgrade(id, m2), 1, "upgrade starts history")
+    assert.Len(t, db.Versions(id), 2, "history backfilled")
+}
+
+func TestUpgradeFail(t *testing.T) {
+    setCtx(CALLER, PK, 0, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    assert.Panics(t, func() { db.Upgrade(id+1, m2) }, "no db")
+    assert.Panics(t, func() { db.Upgrade(id, Manifest{Name: "no cid"}) }, "empty cid")
+    setCtx(NO_CALLER, PK, 0, 10)
+    assert.Panics(t, func() { db.Upgrade(id, m2) }, "not owner")
+    assert.Len(t, db.Versions(id), 1, "no version added")
+}
+
+func TestUpgradeQueryVersion(t *testing.T) {
+    setCtx(CALLER, PK, SECURITY_DEPOSIT, 10)
+    db := newTestDB3()
+    id := deployTestDb(db, m1)
+    db.Deposit(id)
+    db.Upgrade(id, m2)
+
+    // query escrowed before activation is judged against version 0
+    setCtx(USER, PK, 10000, 20)
+    db.EscrowFee(id, "qid-old", 10+UPGRADE_DELAY_BLOCKS+10, 0)
+    assert.Equal(t, db.QueryVersions[id]["qid-old"], 0, "bound to old version")
+
+    // query settled first after activation is judged against version 1
+    setCtx(CALLER, PK, 0, 10+UPGRADE_DELAY_BLOCKS)
+    db.Settle(id, "qid-new", "rid-1")
+    db.Settle(id, "qid-old", "rid-1")
+    assert.Equal(t, db.QueryVersions[id]["qid-new"], 1, "bound to new version")
+    setCtx(USER, PK, 10000, 10+UPGRADE_DELAY_BLOCKS)
+    db.EscrowFee(id, "qid-new", 10+UPGRADE_DELAY_BLOCKS+10, 0)
+    assert.Equal(t, db.QueryVersions[id]["qid-new"], 1, "binding is kept")
+
+    // finalize uses the matching royalty
+    setCtx(CALLER, PK, 0, 10+UPGRADE_DELAY_BLOCKS+10)
+    db.finalizeResults()
+    assert.Equal(t, db.SettledRoyalties[CALLER], near.Money(1000+5000), "royalties per version")
+    assert.Empty(t, db.QueryVersions[id], "bindings are cleaned up")
+}
@@ -4,6 +4,8 @@
 package db3
 
 import (
+    "sort"
+
     "blockwatch.cc/db3-near/pkg/near"
 )
 
@@ -78,3 +80,29 @@ func (e Election) SuperMajority() []Vote {
     }
     return majority
 }
+
+// Winner returns the result of the supermajority
+func (e Election) Winner() (ResultCID, bool) {
+    cutoff := 200 * len(e.votes) / 3
+    for rid, n := range e.results {
+        if n*100 >= cutoff {
+            return rid, true
+        }
+    }
+    return "", false
+}
+
+// Tallies returns the votes per result, most votes first
+func (e Election) Tallies() []ResultTally {
+    tallies := make([]ResultTally, 0, len(e.results))
+    for rid, n := range e.results {
+        tallies = append(tallies, ResultTally{Rid: rid, Votes: n})
+    }
+    sort.Slice(tallies, func(i, j int) bool {
+        if tallies[i].Votes != tallies[j].Votes {
+            return tallies[i].Votes > tallies[j].Votes
+        }
+        return tallies[i].Rid < tallies[j].Rid
+    })
+    return tallies
+}
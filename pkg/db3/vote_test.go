@@ -131,3 +131,18 @@ func TestFailedVote4(t *testing.T) {
         {"D", "cid-3"},
     }, "minority members match")
 }
+
+func TestTallies(t *testing.T) {
+    e := NewElection()
+    e.AddVote("A", "cid-2")
+    e.AddVote("B", "cid-1")
+    e.AddVote("C", "cid-1")
+    rid, ok := e.Winner()
+    assert.True(t, ok, "has winner")
+    assert.Equal(t, rid, ResultCID("cid-1"), "winner")
+    assert.Equal(t, e.Tallies(), []ResultTally{{"cid-1", 2}, {"cid-2", 1}}, "most votes first")
+    e.AddVote("D", "cid-2")
+    _, ok = e.Winner()
+    assert.False(t, ok, "tie")
+    assert.Equal(t, e.Tallies(), []ResultTally{{"cid-1", 2}, {"cid-2", 2}}, "ties by rid")
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package near
+
+import (
+    "fmt"
+    "runtime"
+)
+
+// Mock NEP-141 fungible token contract to drive contract models outside a
+// contract runtime. Token amounts are counted in token base units.
+type FungibleToken struct {
+    Id       AccountID
+    Balances map[AccountID]Money
+}
+
+// Contract that accepts tokens through ft_transfer_call, the call context of
+// the receiver must have the token contract as caller
+type FungibleTokenReceiver interface {
+    // Handles a token transfer and returns the unused amount
+    FtOnTransfer(sender AccountID, amount Money, msg string) Money
+}
+
+// mock token contracts by account id
+var tokens = make(map[AccountID]*FungibleToken)
+
+// NewFungibleToken deploys a mock token contract
+func NewFungibleToken(id AccountID) *FungibleToken {
+    t := &FungibleToken{
+        Id:       id,
+        Balances: make(map[AccountID]Money),
+    }
+    tokens[id] = t
+    return t
+}
+
+// Mint credits new tokens to an account
+func (t *FungibleToken) Mint(account AccountID, amount Money) {
+    t.Balances[account] += amount
+}
+
+// BalanceOf returns the token balance of an account (ft_balance_of)
+func (t *FungibleToken) BalanceOf(account AccountID) Money {
+    return t.Balances[account]
+}
+
+// Transfer moves tokens between accounts (ft_transfer)
+func (t *FungibleToken) Transfer(sender, receiver AccountID, amount Money) error {
+    if amount == 0 {
+        return fmt.Errorf("The amount should be a positive number")
+    }
+    if sender == receiver {
+        return fmt.Errorf("Sender and receiver should be different")
+    }
+    if t.Balances[sender] < amount {
+        return fmt.Errorf("The account doesn't have enough balance")
+    }
+    t.Balances[sender] -= amount
+    t.Balances[receiver] += amount
+    return nil
+}
+
+// TransferCall moves tokens to a receiver contract and calls its
+// ft_on_transfer handler (ft_transfer_call). Unused tokens are refunded to
+// the sender like ft_resolve_transfer does, a panicking receiver is refunded
+// in full. Runtime errors are bugs of the receiver model and are re-raised.
+// Returns the amount used by the receiver.
+func (t *FungibleToken) TransferCall(sender, receiverId AccountID, receiver FungibleTokenReceiver, amount Money, msg string) (used Money, err error) {
+    if err := t.Transfer(sender, receiverId, amount); err != nil {
+        return 0, err
+    }
+    unused := amount
+    func() {
+        defer func() {
+            if e := recover(); e != nil {
+                if re, ok := e.(runtime.Error); ok {
+                    panic(re)
+                }
+                err = fmt.Errorf("%v", e)
+            }
+        }()
+        unused = receiver.FtOnTransfer(sender, amount, msg)
+    }()
+    if unused > amount {
+        unused = amount
+    }
+    if unused > 0 {
+        if rerr := t.Transfer(receiverId, sender, unused); rerr != nil && err == nil {
+            err = rerr
+        }
+    }
+    return amount - unused, err
+}
+
+// FtTransfer sends tokens from a contract account through a mock token contract
+func FtTransfer(token, sender, receiver AccountID, amount Money, signer Signer) error {
+    t, ok := tokens[token]
+    if !ok {
+        return fmt.Errorf("token contract %s does not exist", token)
+    }
+    return t.Transfer(sender, receiver, amount)
+}
+
+// FtBalanceOf views a token balance through a mock token contract
+func FtBalanceOf(token, account AccountID) (Money, error) {
+    t, ok := tokens[token]
+    if !ok {
+        return 0, fmt.Errorf("token contract %s does not exist", token)
+    }
+    return t.BalanceOf(account), nil
+}
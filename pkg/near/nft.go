@@ -0,0 +1,67 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package near
+
+import (
+    "fmt"
+)
+
+// Mock NEP-171 non-fungible token contract with NEP-181 enumeration to
+// drive contract models outside a contract runtime
+type NonFungibleToken struct {
+    Id     AccountID
+    Owners map[string]AccountID // owner by token id
+}
+
+// mock NFT contracts by account id
+var nfts = make(map[AccountID]*NonFungibleToken)
+
+// NewNonFungibleToken deploys a mock NFT contract
+func NewNonFungibleToken(id AccountID) *NonFungibleToken {
+    t := &NonFungibleToken{
+        Id:     id,
+        Owners: make(map[string]AccountID),
+    }
+    nfts[id] = t
+    return t
+}
+
+// Mint creates a new token owned by an account
+func (t *NonFungibleToken) Mint(tokenId string, owner AccountID) error {
+    if _, ok := t.Owners[tokenId]; ok {
+        return fmt.Errorf("Token already exists")
+    }
+    t.Owners[tokenId] = owner
+    return nil
+}
+
+// Transfer moves a token to a new owner (nft_transfer)
+func (t *NonFungibleToken) Transfer(sender, receiver AccountID, tokenId string) error {
+    if t.Owners[tokenId] != sender {
+        return fmt.Errorf("Sender must be the token owner")
+    }
+    t.Owners[tokenId] = receiver
+    return nil
+}
+
+// SupplyForOwner counts the tokens of an account (nft_supply_for_owner)
+func (t *NonFungibleToken) SupplyForOwner(account AccountID) Money {
+    var n Money
+    for _, owner := range t.Owners {
+        if owner == account {
+            n++
+        }
+    }
+    return n
+}
+
+// NftSupplyForOwner views the token count of an account through a mock
+// NFT contract
+func NftSupplyForOwner(contract, account AccountID) (Money, error) {
+    t, ok := nfts[contract]
+    if !ok {
+        return 0, fmt.Errorf("NFT contract %s does not exist", contract)
+    }
+    return t.SupplyForOwner(account), nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package near
+
+import (
+    "time"
+)
+
+// Target block time of NEAR, actual blocks are often slightly slower
+const BLOCK_TIME = time.Second
+
+// BlocksWithin returns the number of blocks produced within a duration,
+// rounded up so a deadline is never undershot
+func BlocksWithin(d, blockTime time.Duration) int64 {
+    if d <= 0 {
+        return 0
+    }
+    if blockTime <= 0 {
+        blockTime = BLOCK_TIME
+    }
+    return int64((d + blockTime - 1) / blockTime)
+}
+
+// EstimateHeight estimates the height of the first block produced at or
+// after a wall-clock deadline, starting from a reference block and its
+// timestamp. Deadlines before the reference block return its height.
+func EstimateHeight(height int64, timestamp, deadline time.Time, blockTime time.Duration) int64 {
+    return height + BlocksWithin(deadline.Sub(timestamp), blockTime)
+}
+
+// EstimateTime estimates when a block height is reached, starting from a
+// reference block and its timestamp
+func EstimateTime(height int64, timestamp time.Time, target int64, blockTime time.Duration) time.Time {
+    if blockTime <= 0 {
+        blockTime = BLOCK_TIME
+    }
+    return timestamp.Add(time.Duration(target-height) * blockTime)
+}
+
+// Time returns the block timestamp of a call context, the zero time when
+// the timestamp is unknown
+func (c CallContext) Time() time.Time {
+    if c.Timestamp == 0 {
+        return time.Time{}
+    }
+    return time.Unix(0, c.Timestamp)
+}
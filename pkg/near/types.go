@@ -3,6 +3,11 @@
 
 package near
 
+import (
+    "fmt"
+    "math/big"
+)
+
 type AccountID string
 
 type Pubkey string
@@ -19,14 +24,40 @@ func (m Money) Div(n int) Money {
     return m / Money(n)
 }
 
+// Money is counted in milliNEAR, on-chain amounts are yoctoNEAR (10^24 per NEAR)
+const YOCTO_PER_MONEY = "1000000000000000000000"
+
+var yoctoPerMoney, _ = new(big.Int).SetString(YOCTO_PER_MONEY, 10)
+
+// ParseYocto converts a yoctoNEAR amount, fractions of a milliNEAR are truncated
+func ParseYocto(s string) (Money, error) {
+    n, ok := new(big.Int).SetString(s, 10)
+    if !ok || n.Sign() < 0 {
+        return 0, fmt.Errorf("invalid yocto amount %q", s)
+    }
+    n.Quo(n, yoctoPerMoney)
+    if !n.IsUint64() {
+        return 0, fmt.Errorf("yocto amount %s overflows", s)
+    }
+    return Money(n.Uint64()), nil
+}
+
+// Yocto formats the amount in yoctoNEAR
+func (m Money) Yocto() string {
+    n := new(big.Int).SetUint64(uint64(m))
+    return n.Mul(n, yoctoPerMoney).String()
+}
+
 type Signer interface {
     Sign([]byte) []byte
 }
 
 // Transaction context available during contract execution
 type CallContext struct {
-    Caller   AccountID // signer account id (near.predecessorAccountId)
-    SignedBy Pubkey    // signer's pubkey
-    Amount   Money     // sent amount (near.attachedDeposit)
-    Height   int64     // near.blockIndex
+    Caller     AccountID // signer account id (near.predecessorAccountId)
+    SignedBy   Pubkey    // signer's pubkey
+    Amount     Money     // sent amount (near.attachedDeposit)
+    Height     int64     // near.blockIndex
+    Timestamp  int64     // near.blockTimestamp in nanoseconds, zero when unknown
+    RandomSeed []byte    // near.randomSeed, derived from height when empty
 }